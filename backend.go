@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync"
 )
 
 // Backend acts as a server for the PostgreSQL wire protocol version 3.
@@ -34,7 +35,16 @@ type Backend struct {
 	bodyLen    int
 	msgType    byte
 	partialMsg bool
-	authType   uint32
+
+	// stateMu protects the state that is changed by Send and used by Receive.
+	stateMu  sync.Mutex
+	authType uint32
+	copyIn   bool
+	copyOut  bool
+
+	validator *backendValidator
+
+	readWatcher readWatcher
 }
 
 const (
@@ -42,26 +52,74 @@ const (
 	maxStartupPacketLen = 10000 // maxStartupPacketLen is MAX_STARTUP_PACKET_LENGTH from PG source.
 )
 
-// NewBackend creates a new Backend.
+// NewBackend creates a new Backend. ReceiveContext requires w to be the connection cr reads from and to have a
+// SetReadDeadline method, as net.Conn does, unless SetReadDeadliner is called.
 func NewBackend(cr ChunkReader, w io.Writer) *Backend {
 	return &Backend{cr: cr, w: w}
 }
 
 // Send sends a message to the frontend.
+//
+// When msg is an authentication request Send sets the authentication type used to decode the frontend's response.
+// See SetAuthType.
+//
+// Send also tracks the COPY state of the connection. Sending CopyInResponse starts copy-in mode in which Receive only
+// accepts CopyData, CopyDone, CopyFail, Flush and Sync. Sending CopyOutResponse starts copy-out mode in which CopyData
+// and CopyDone can be sent. CopyBothResponse starts both. Sending ErrorResponse or ReadyForQuery ends any copy. In
+// validation mode sending CopyData or CopyDone outside of copy-out mode is an error. See SetValidateProtocol.
+//
+// The authentication type and COPY state are only changed once msg has been written, so a write error leaves them as
+// they were.
 func (b *Backend) Send(msg BackendMessage) error {
 	buf, err := msg.Encode(nil)
 	if err != nil {
 		return err
 	}
 
+	err = b.checkCopySend(msg)
+	if err != nil {
+		return err
+	}
+
 	_, err = b.w.Write(buf)
-	return err
+	if err != nil {
+		return err
+	}
+
+	b.updateCopyStateOnSend(msg)
+
+	if authMsg, ok := msg.(AuthenticationResponseMessage); ok {
+		b.stateMu.Lock()
+		b.authType = authTypeOf(authMsg)
+		b.stateMu.Unlock()
+	}
+
+	if b.validator != nil {
+		b.validator.sent(msg)
+	}
+
+	return nil
 }
 
 // ReceiveStartupMessage receives the initial connection message. This method is used of the normal Receive method
 // because the initial connection message is "special" and does not include the message type as the first byte. This
 // will return either a StartupMessage, SSLRequest, GSSEncRequest, or CancelRequest.
 func (b *Backend) ReceiveStartupMessage() (FrontendMessage, error) {
+	msg, err := b.receiveStartupMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	if b.validator != nil {
+		if err := b.validator.receivedStartup(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+func (b *Backend) receiveStartupMessage() (FrontendMessage, error) {
 	buf, err := b.cr.Next(4)
 	if err != nil {
 		return nil, err
@@ -111,17 +169,28 @@ func (b *Backend) ReceiveStartupMessage() (FrontendMessage, error) {
 
 // Receive receives a message from the frontend. The returned message is only valid until the next call to Receive.
 func (b *Backend) Receive() (FrontendMessage, error) {
+	for {
+		msg, discard, err := b.receive()
+		if err != nil || !discard {
+			return msg, err
+		}
+	}
+}
+
+// receive receives a message from the frontend. It returns true if the message must be discarded because it is
+// ignored in the current phase of the session.
+func (b *Backend) receive() (FrontendMessage, bool, error) {
 	if !b.partialMsg {
 		header, err := b.cr.Next(5)
 		if err != nil {
-			return nil, translateEOFtoErrUnexpectedEOF(err)
+			return nil, false, translateEOFtoErrUnexpectedEOF(err)
 		}
 
 		b.msgType = header[0]
 		b.bodyLen = int(binary.BigEndian.Uint32(header[1:])) - 4
 		b.partialMsg = true
 		if b.bodyLen < 0 {
-			return nil, errors.New("invalid message with negative body length received")
+			return nil, false, errors.New("invalid message with negative body length received")
 		}
 	}
 
@@ -148,7 +217,11 @@ func (b *Backend) Receive() (FrontendMessage, error) {
 	case 'P':
 		msg = &b.parse
 	case 'p':
-		switch b.authType {
+		b.stateMu.Lock()
+		authType := b.authType
+		b.stateMu.Unlock()
+
+		switch authType {
 		case AuthTypeSASL:
 			msg = &SASLInitialResponse{}
 		case AuthTypeSASLContinue:
@@ -170,18 +243,42 @@ func (b *Backend) Receive() (FrontendMessage, error) {
 	case 'X':
 		msg = &b.terminate
 	default:
-		return nil, fmt.Errorf("unknown message type: %c", b.msgType)
+		return nil, false, fmt.Errorf("unknown message type: %c", b.msgType)
+	}
+
+	if err := b.checkCopyInMessage(msg); err != nil {
+		return nil, false, err
 	}
 
 	msgBody, err := b.cr.Next(b.bodyLen)
 	if err != nil {
-		return nil, translateEOFtoErrUnexpectedEOF(err)
+		return nil, false, translateEOFtoErrUnexpectedEOF(err)
 	}
 
 	b.partialMsg = false
 
 	err = msg.Decode(msgBody)
-	return msg, err
+	if err != nil {
+		return msg, false, err
+	}
+
+	b.stateMu.Lock()
+	copyIn := b.copyIn
+	switch msg.(type) {
+	case *CopyDone, *CopyFail:
+		b.copyIn = false
+	}
+	b.stateMu.Unlock()
+
+	if b.validator != nil {
+		discard, err := b.validator.received(msg, copyIn)
+		if err != nil {
+			return nil, false, err
+		}
+		return msg, discard, nil
+	}
+
+	return msg, false, nil
 }
 
 // SetAuthType sets the authentication type in the backend.
@@ -195,8 +292,8 @@ func (b *Backend) Receive() (FrontendMessage, error) {
 //			GSSAPI, SSPI and SASL response messages. The exact message type can be deduced from
 //			the context.
 //
-// Since the Frontend does not know about the state of a backend, it is important
-// to call SetAuthType() after an authentication request is received by the Frontend.
+// Send sets the authentication type automatically when it sends an authentication request, including one relayed from
+// a Frontend by a proxy. SetAuthType is only needed when the request reaches the frontend by other means.
 func (b *Backend) SetAuthType(authType uint32) error {
 	switch authType {
 	case AuthTypeOk,
@@ -209,10 +306,34 @@ func (b *Backend) SetAuthType(authType uint32) error {
 		AuthTypeSASL,
 		AuthTypeSASLContinue,
 		AuthTypeSASLFinal:
+		b.stateMu.Lock()
 		b.authType = authType
+		b.stateMu.Unlock()
 	default:
 		return fmt.Errorf("authType not recognized: %d", authType)
 	}
 
 	return nil
 }
+
+// authTypeOf returns the authentication type of an authentication request.
+func authTypeOf(msg AuthenticationResponseMessage) uint32 {
+	switch msg.(type) {
+	case *AuthenticationCleartextPassword:
+		return AuthTypeCleartextPassword
+	case *AuthenticationMD5Password:
+		return AuthTypeMD5Password
+	case *AuthenticationGSS:
+		return AuthTypeGSS
+	case *AuthenticationGSSContinue:
+		return AuthTypeGSSCont
+	case *AuthenticationSASL:
+		return AuthTypeSASL
+	case *AuthenticationSASLContinue:
+		return AuthTypeSASLContinue
+	case *AuthenticationSASLFinal:
+		return AuthTypeSASLFinal
+	default:
+		return AuthTypeOk
+	}
+}
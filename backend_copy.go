@@ -0,0 +1,204 @@
+package pgproto3
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CopyFailError is returned by CopyInReader when the frontend fails the copy with CopyFail.
+type CopyFailError struct {
+	Message string
+}
+
+func (e *CopyFailError) Error() string {
+	return "COPY from stdin failed: " + e.Message
+}
+
+// checkCopySend returns an error if msg can not be sent in the current COPY state. CopyData and CopyDone are only
+// checked in validation mode.
+func (b *Backend) checkCopySend(msg BackendMessage) error {
+	if b.validator == nil {
+		return nil
+	}
+
+	b.stateMu.Lock()
+	copyOut := b.copyOut
+	b.stateMu.Unlock()
+
+	switch msg.(type) {
+	case *CopyData:
+		if !copyOut {
+			return errors.New("cannot send CopyData when not in copy-out mode")
+		}
+	case *CopyDone:
+		if !copyOut {
+			return errors.New("cannot send CopyDone when not in copy-out mode")
+		}
+	}
+	return nil
+}
+
+// updateCopyStateOnSend updates the COPY state for msg which has been sent.
+func (b *Backend) updateCopyStateOnSend(msg BackendMessage) {
+	b.stateMu.Lock()
+	defer b.stateMu.Unlock()
+
+	switch msg.(type) {
+	case *CopyInResponse:
+		b.copyIn = true
+	case *CopyOutResponse:
+		b.copyOut = true
+	case *CopyBothResponse:
+		b.copyIn = true
+		b.copyOut = true
+	case *CopyDone:
+		b.copyOut = false
+	case *ErrorResponse, *ReadyForQuery:
+		b.copyIn = false
+		b.copyOut = false
+	}
+}
+
+// checkCopyInMessage returns a *ProtocolViolationError if msg, whose body has not been read yet, is not allowed in
+// copy-in mode. PostgreSQL accepts only CopyData, CopyDone, CopyFail, Flush and Sync from the frontend in copy-in mode.
+// The body of a rejected message is discarded and copy-in mode ends so the Backend remains usable.
+func (b *Backend) checkCopyInMessage(msg FrontendMessage) error {
+	b.stateMu.Lock()
+	copyIn := b.copyIn
+	b.stateMu.Unlock()
+
+	if !copyIn {
+		return nil
+	}
+
+	switch msg.(type) {
+	case *CopyData, *CopyDone, *CopyFail, *Flush, *Sync:
+		return nil
+	}
+
+	_, err := b.cr.Next(b.bodyLen)
+	if err != nil {
+		return translateEOFtoErrUnexpectedEOF(err)
+	}
+	b.partialMsg = false
+
+	b.stateMu.Lock()
+	b.copyIn = false
+	b.stateMu.Unlock()
+
+	return &ProtocolViolationError{
+		Received: strings.TrimPrefix(fmt.Sprintf("%T", msg), "*pgproto3."),
+		Reason:   "only CopyData, CopyDone, CopyFail, Flush and Sync are legal during COPY from stdin",
+	}
+}
+
+// CopyInReader reads the data the frontend sends for a COPY ... FROM STDIN. It is created by Backend.BeginCopyIn.
+// Read returns the payloads of the CopyData messages in order and returns io.EOF when the frontend sends CopyDone. If
+// the frontend sends CopyFail Read returns a *CopyFailError.
+//
+// When Read has returned an error the copy is over and the handler must send the response to the copy, such as
+// CommandComplete or ErrorResponse. To abort the copy early the handler sends ErrorResponse; any copy messages the
+// frontend sends afterwards are returned by Backend.Receive and should be discarded.
+type CopyInReader struct {
+	b        *Backend
+	response CopyInResponse
+
+	data []byte // unread part of the current CopyData
+	err  error
+}
+
+// BeginCopyIn sends response to start a copy from the frontend and returns a CopyInReader to read the data.
+func (b *Backend) BeginCopyIn(response *CopyInResponse) (*CopyInReader, error) {
+	err := b.Send(response)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &CopyInReader{
+		b: b,
+		response: CopyInResponse{
+			OverallFormat:     response.OverallFormat,
+			ColumnFormatCodes: append([]uint16(nil), response.ColumnFormatCodes...),
+		},
+	}
+	return r, nil
+}
+
+// Response returns the CopyInResponse the copy was started with.
+func (r *CopyInReader) Response() *CopyInResponse {
+	return &r.response
+}
+
+// Read reads the copy data sent by the frontend.
+func (r *CopyInReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		msg, err := r.b.Receive()
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+
+		switch msg := msg.(type) {
+		case *CopyData:
+			r.data = msg.Data
+		case *CopyDone:
+			r.err = io.EOF
+		case *CopyFail:
+			r.err = &CopyFailError{Message: msg.Message}
+		case *Flush, *Sync:
+			// PostgreSQL ignores Flush and Sync in copy-in mode.
+		}
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// CopyOutWriter sends data to the frontend for a COPY ... TO STDOUT. It is created by Backend.BeginCopyOut. Each
+// Write sends a CopyData message and Close sends CopyDone. The handler then sends CommandComplete.
+type CopyOutWriter struct {
+	b      *Backend
+	closed bool
+}
+
+// BeginCopyOut sends response to start a copy to the frontend and returns a CopyOutWriter to write the data.
+func (b *Backend) BeginCopyOut(response *CopyOutResponse) (*CopyOutWriter, error) {
+	err := b.Send(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CopyOutWriter{b: b}, nil
+}
+
+// Write sends p in a CopyData message.
+func (w *CopyOutWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed CopyOutWriter")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	err := w.b.Send(&CopyData{Data: p})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends CopyDone.
+func (w *CopyOutWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.b.Send(&CopyDone{})
+}
@@ -0,0 +1,263 @@
+package pgproto3_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPipe returns the ends of a net.Pipe that are closed when the test finishes.
+func newPipe(t *testing.T) (clientConn, serverConn net.Conn) {
+	clientConn, serverConn = net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	return clientConn, serverConn
+}
+
+func newBackendPipe(t *testing.T) (*pgproto3.Backend, net.Conn) {
+	clientConn, serverConn := newPipe(t)
+	return pgproto3.NewBackend(pgproto3.NewChunkReader(serverConn), serverConn), clientConn
+}
+
+// writeMessages writes msgs to conn in a single write in the background.
+func writeMessages(t *testing.T, conn net.Conn, msgs ...pgproto3.Message) {
+	var buf []byte
+	for _, msg := range msgs {
+		buf = append(buf, mustEncode(t, msg)...)
+	}
+	go conn.Write(buf)
+}
+
+func TestBackendCopyIn(t *testing.T) {
+	t.Parallel()
+
+	backend, clientConn := newBackendPipe(t)
+	go ioutil.ReadAll(clientConn)
+
+	r, err := backend.BeginCopyIn(&pgproto3.CopyInResponse{ColumnFormatCodes: []uint16{0}})
+	require.NoError(t, err)
+
+	writeMessages(t, clientConn,
+		&pgproto3.CopyData{Data: []byte("1\n")},
+		&pgproto3.Flush{},
+		&pgproto3.CopyData{Data: []byte("2\n")},
+		&pgproto3.Sync{},
+		&pgproto3.CopyDone{},
+		&pgproto3.Query{String: "select 1"},
+	)
+
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "1\n2\n", string(data))
+
+	// Copy-in mode is over.
+	msg, err := backend.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.Query{String: "select 1"}, msg)
+}
+
+func TestBackendCopyInFail(t *testing.T) {
+	t.Parallel()
+
+	backend, clientConn := newBackendPipe(t)
+	go ioutil.ReadAll(clientConn)
+
+	r, err := backend.BeginCopyIn(&pgproto3.CopyInResponse{})
+	require.NoError(t, err)
+
+	writeMessages(t, clientConn, &pgproto3.CopyData{Data: []byte("1\n")}, &pgproto3.CopyFail{Message: "oops"})
+
+	data, err := ioutil.ReadAll(r)
+	assert.Equal(t, "1\n", string(data))
+	var failErr *pgproto3.CopyFailError
+	require.True(t, errors.As(err, &failErr))
+	assert.Equal(t, "oops", failErr.Message)
+}
+
+func TestBackendCopyInRejectsOtherMessages(t *testing.T) {
+	t.Parallel()
+
+	backend, clientConn := newBackendPipe(t)
+	go ioutil.ReadAll(clientConn)
+
+	require.NoError(t, backend.Send(&pgproto3.CopyInResponse{}))
+	writeMessages(t, clientConn, &pgproto3.Query{String: "select 1"}, &pgproto3.Query{String: "select 2"})
+
+	_, err := backend.Receive()
+	var violation *pgproto3.ProtocolViolationError
+	require.True(t, errors.As(err, &violation))
+	assert.Equal(t, "Query", violation.Received)
+	assert.Contains(t, err.Error(), "during COPY from stdin")
+
+	// The rejected message was discarded and copy-in mode ended.
+	msg, err := backend.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.Query{String: "select 2"}, msg)
+}
+
+func TestBackendCopyOut(t *testing.T) {
+	t.Parallel()
+
+	backend, clientConn := newBackendPipe(t)
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)
+
+	// Sending copy data outside of copy-out mode is only an error in validation mode.
+	backend.SetValidateProtocol(true)
+	assert.Error(t, backend.Send(&pgproto3.CopyData{Data: []byte("x")}))
+	assert.Error(t, backend.Send(&pgproto3.CopyDone{}))
+
+	// The received messages are compared encoded because they are only valid until the next Receive.
+	received := make(chan []string, 1)
+	go func() {
+		var msgs []string
+		for i := 0; i < 4; i++ {
+			msg, err := frontend.Receive()
+			if err != nil {
+				break
+			}
+			buf, _ := msg.Encode(nil)
+			msgs = append(msgs, string(buf))
+		}
+		received <- msgs
+	}()
+
+	w, err := backend.BeginCopyOut(&pgproto3.CopyOutResponse{ColumnFormatCodes: []uint16{0}})
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "1\n")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "2\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	assert.Error(t, backend.Send(&pgproto3.CopyData{Data: []byte("x")}))
+
+	var expected []string
+	for _, msg := range []pgproto3.BackendMessage{
+		&pgproto3.CopyOutResponse{ColumnFormatCodes: []uint16{0}},
+		&pgproto3.CopyData{Data: []byte("1\n")},
+		&pgproto3.CopyData{Data: []byte("2\n")},
+		&pgproto3.CopyDone{},
+	} {
+		expected = append(expected, string(mustEncode(t, msg)))
+	}
+	assert.Equal(t, expected, <-received)
+}
+
+func TestBackendCopyOutStateIsNotCheckedByDefault(t *testing.T) {
+	t.Parallel()
+
+	backend, clientConn := newBackendPipe(t)
+	go ioutil.ReadAll(clientConn)
+
+	require.NoError(t, backend.Send(&pgproto3.CopyData{Data: []byte("1\n")}))
+	require.NoError(t, backend.Send(&pgproto3.CopyDone{}))
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestBackendSendFailureKeepsState(t *testing.T) {
+	t.Parallel()
+
+	server := &interruptReader{}
+	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(server), failingWriter{})
+
+	// Neither copy-in mode nor the SASL authentication type is started by a request the frontend never saw.
+	require.Error(t, backend.Send(&pgproto3.CopyInResponse{}))
+	require.Error(t, backend.Send(&pgproto3.AuthenticationSASL{AuthMechanisms: []string{"SCRAM-SHA-256"}}))
+
+	server.push(mustEncode(t, &pgproto3.Query{String: "select 1"}))
+	server.push(mustEncode(t, &pgproto3.PasswordMessage{Password: "secret"}))
+
+	msg, err := backend.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.Query{String: "select 1"}, msg)
+
+	msg, err = backend.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.PasswordMessage{Password: "secret"}, msg)
+}
+
+func TestBackendCopyWithFrontend(t *testing.T) {
+	t.Parallel()
+
+	backend, clientConn := newBackendPipe(t)
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- func() error {
+			// COPY FROM STDIN echoed back by COPY TO STDOUT.
+			var data []byte
+			for _, query := range []string{"copy t from stdin", "copy t to stdout"} {
+				msg, err := backend.Receive()
+				if err != nil {
+					return err
+				}
+				if q, ok := msg.(*pgproto3.Query); !ok || q.String != query {
+					return errors.New("unexpected message")
+				}
+
+				if query == "copy t from stdin" {
+					r, err := backend.BeginCopyIn(&pgproto3.CopyInResponse{ColumnFormatCodes: []uint16{0}})
+					if err != nil {
+						return err
+					}
+					data, err = ioutil.ReadAll(r)
+					if err != nil {
+						return err
+					}
+				} else {
+					w, err := backend.BeginCopyOut(&pgproto3.CopyOutResponse{ColumnFormatCodes: []uint16{0}})
+					if err != nil {
+						return err
+					}
+					if _, err := w.Write(data); err != nil {
+						return err
+					}
+					if err := w.Close(); err != nil {
+						return err
+					}
+				}
+
+				rows := strings.Count(string(data), "\n")
+				if err := backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("COPY " + strconv.Itoa(rows))}); err != nil {
+					return err
+				}
+				if err := backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}()
+	}()
+
+	n, err := frontend.CopyFrom(context.Background(), "copy t from stdin", strings.NewReader("1\n2\n3\n"))
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, n)
+
+	var data []byte
+	n, err = frontend.CopyTo(context.Background(), "copy t to stdout", func(p []byte) error {
+		data = append(data, p...)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, n)
+	assert.Equal(t, "1\n2\n3\n", string(data))
+	require.NoError(t, <-serverErr)
+}
@@ -2,6 +2,7 @@ package pgproto3_test
 
 import (
 	"io"
+	"io/ioutil"
 	"testing"
 
 	"github.com/jackc/pgio"
@@ -120,3 +121,27 @@ func TestStartupMessage(t *testing.T) {
 		}
 	})
 }
+
+func TestBackendSendSetsAuthType(t *testing.T) {
+	t.Parallel()
+
+	client := &interruptReader{}
+	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(client), ioutil.Discard)
+
+	tests := []struct {
+		request  pgproto3.BackendMessage
+		response pgproto3.FrontendMessage
+	}{
+		{&pgproto3.AuthenticationSASL{AuthMechanisms: []string{"SCRAM-SHA-256"}}, &pgproto3.SASLInitialResponse{AuthMechanism: "SCRAM-SHA-256", Data: []byte("first")}},
+		{&pgproto3.AuthenticationSASLContinue{Data: []byte("server-first")}, &pgproto3.SASLResponse{Data: []byte("final")}},
+		{&pgproto3.AuthenticationGSS{}, &pgproto3.GSSResponse{Data: []byte("token")}},
+		{&pgproto3.AuthenticationMD5Password{Salt: [4]byte{1, 2, 3, 4}}, &pgproto3.PasswordMessage{Password: "md5"}},
+	}
+	for _, tt := range tests {
+		require.NoError(t, backend.Send(tt.request))
+		client.push(mustEncode(t, tt.response))
+		msg, err := backend.Receive()
+		require.NoError(t, err)
+		assert.Equal(t, tt.response, msg)
+	}
+}
@@ -0,0 +1,132 @@
+package pgproto3
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// SetValidateProtocol enables or disables validation mode. In validation mode the Backend tracks the phase of the
+// session from the messages it sends and receives and Receive reports a message that is not legal in the current phase
+// as a *ProtocolViolationError:
+//
+//   - startup: only ReceiveStartupMessage may be used.
+//   - authenticating: a 'p' message is only legal in response to an authentication request.
+//   - ready and in an extended query: the normal query messages are legal.
+//   - error until Sync: after an ErrorResponse is sent during an extended query, Receive discards messages until Sync
+//     as PostgreSQL does.
+//   - copy-in and copy-both: only COPY messages, Flush and Sync are legal.
+//
+// Terminate is legal in every phase. CopyData, CopyDone and CopyFail received outside of a copy are discarded as
+// PostgreSQL does. Send returns an error for CopyData or CopyDone sent outside of copy-out mode. Validation must be
+// enabled before the startup message is received.
+func (b *Backend) SetValidateProtocol(validate bool) {
+	if validate {
+		b.validator = &backendValidator{phase: backendPhaseStartup}
+	} else {
+		b.validator = nil
+	}
+}
+
+const (
+	backendPhaseStartup        = iota // waiting for the startup message
+	backendPhaseAuthenticating        // startup message received and waiting for AuthenticationOk
+	backendPhaseReady                 // ready for queries
+	backendPhaseExtendedQuery         // extended query messages received and waiting for Sync
+	backendPhaseErrorUntilSync        // an error occurred in an extended query and messages are discarded until Sync
+)
+
+// backendValidator tracks the phase of the session for a Backend. Send and Receive may be called by different
+// goroutines so the state is protected by mu.
+type backendValidator struct {
+	mu sync.Mutex
+
+	phase int
+
+	awaitingAuthMsg bool // an authentication request that needs a response has been sent
+}
+
+// sent records a message sent by the backend.
+func (v *backendValidator) sent(msg BackendMessage) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	switch msg.(type) {
+	case *AuthenticationOk:
+		v.phase = backendPhaseReady
+		v.awaitingAuthMsg = false
+	case *AuthenticationSASLFinal:
+		v.awaitingAuthMsg = false
+	case AuthenticationResponseMessage:
+		v.awaitingAuthMsg = true
+	case *ErrorResponse:
+		if v.phase == backendPhaseExtendedQuery {
+			v.phase = backendPhaseErrorUntilSync
+		}
+	}
+}
+
+func (v *backendValidator) violation(msg FrontendMessage, reason string) error {
+	return &ProtocolViolationError{Received: strings.TrimPrefix(fmt.Sprintf("%T", msg), "*pgproto3."), Reason: reason}
+}
+
+// receivedStartup checks a message received by ReceiveStartupMessage.
+func (v *backendValidator) receivedStartup(msg FrontendMessage) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.phase != backendPhaseStartup {
+		return v.violation(msg, "startup is complete")
+	}
+	if _, ok := msg.(*StartupMessage); ok {
+		v.phase = backendPhaseAuthenticating
+	}
+	return nil
+}
+
+// received checks a message received by Receive. It returns true if the message must be discarded.
+func (v *backendValidator) received(msg FrontendMessage, copyIn bool) (discard bool, err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := msg.(*Terminate); ok {
+		return false, nil
+	}
+
+	switch v.phase {
+	case backendPhaseStartup:
+		return false, v.violation(msg, "expected a startup message")
+
+	case backendPhaseAuthenticating:
+		switch msg.(type) {
+		case *PasswordMessage, *SASLInitialResponse, *SASLResponse, *GSSResponse:
+			if !v.awaitingAuthMsg {
+				return false, v.violation(msg, "no authentication request is pending")
+			}
+			v.awaitingAuthMsg = false
+			return false, nil
+		default:
+			return false, v.violation(msg, "authentication is in progress")
+		}
+
+	case backendPhaseErrorUntilSync:
+		if _, ok := msg.(*Sync); ok {
+			v.phase = backendPhaseReady
+			return false, nil
+		}
+		return true, nil
+	}
+
+	switch msg.(type) {
+	case *PasswordMessage, *SASLInitialResponse, *SASLResponse, *GSSResponse:
+		return false, v.violation(msg, "authentication is complete")
+	case *CopyData, *CopyDone, *CopyFail:
+		// Copy-in mode is enforced by the Backend. Copy messages outside of it are left over from a failed copy.
+		return !copyIn, nil
+	case *Parse, *Bind, *Describe, *Execute, *Close:
+		v.phase = backendPhaseExtendedQuery
+	case *Sync:
+		v.phase = backendPhaseReady
+	}
+	return false, nil
+}
@@ -0,0 +1,144 @@
+package pgproto3_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newValidatingBackend returns a Backend in validation mode that has received a StartupMessage.
+func newValidatingBackend(t *testing.T) (*pgproto3.Backend, *interruptReader) {
+	client := &interruptReader{}
+	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(client), ioutil.Discard)
+	backend.SetValidateProtocol(true)
+
+	client.push(mustEncode(t, &pgproto3.StartupMessage{ProtocolVersion: pgproto3.ProtocolVersionNumber, Parameters: map[string]string{"user": "jack"}}))
+	_, err := backend.ReceiveStartupMessage()
+	require.NoError(t, err)
+
+	return backend, client
+}
+
+func requireViolation(t *testing.T, err error) {
+	t.Helper()
+	var violation *pgproto3.ProtocolViolationError
+	require.True(t, errors.As(err, &violation), "expected ProtocolViolationError, got %v", err)
+}
+
+func TestBackendValidateProtocolSASL(t *testing.T) {
+	t.Parallel()
+
+	backend, client := newValidatingBackend(t)
+
+	// The 'p' messages are decoded by the authentication request they respond to without SetAuthType.
+	require.NoError(t, backend.Send(&pgproto3.AuthenticationSASL{AuthMechanisms: []string{"SCRAM-SHA-256"}}))
+	client.push(mustEncode(t, &pgproto3.SASLInitialResponse{AuthMechanism: "SCRAM-SHA-256", Data: []byte("first")}))
+	msg, err := backend.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.SASLInitialResponse{AuthMechanism: "SCRAM-SHA-256", Data: []byte("first")}, msg)
+
+	require.NoError(t, backend.Send(&pgproto3.AuthenticationSASLContinue{Data: []byte("server-first")}))
+	client.push(mustEncode(t, &pgproto3.SASLResponse{Data: []byte("final")}))
+	msg, err = backend.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.SASLResponse{Data: []byte("final")}, msg)
+
+	require.NoError(t, backend.Send(&pgproto3.AuthenticationSASLFinal{Data: []byte("server-final")}))
+	require.NoError(t, backend.Send(&pgproto3.AuthenticationOk{}))
+	require.NoError(t, backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'}))
+
+	client.push(mustEncode(t, &pgproto3.Query{String: "select 1"}))
+	msg, err = backend.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.Query{String: "select 1"}, msg)
+
+	client.push(mustEncode(t, &pgproto3.PasswordMessage{Password: "late"}))
+	_, err = backend.Receive()
+	requireViolation(t, err)
+}
+
+func TestBackendValidateProtocolAuthenticating(t *testing.T) {
+	t.Parallel()
+
+	backend, client := newValidatingBackend(t)
+
+	// A password is only legal in response to a request.
+	client.push(mustEncode(t, &pgproto3.PasswordMessage{Password: "early"}))
+	_, err := backend.Receive()
+	requireViolation(t, err)
+
+	client.push(mustEncode(t, &pgproto3.Query{String: "select 1"}))
+	_, err = backend.Receive()
+	requireViolation(t, err)
+
+	require.NoError(t, backend.Send(&pgproto3.AuthenticationMD5Password{Salt: [4]byte{1, 2, 3, 4}}))
+	client.push(mustEncode(t, &pgproto3.PasswordMessage{Password: "md5"}))
+	msg, err := backend.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.PasswordMessage{Password: "md5"}, msg)
+
+	client.push(mustEncode(t, &pgproto3.Terminate{}))
+	msg, err = backend.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.Terminate{}, msg)
+}
+
+func TestBackendValidateProtocolStartup(t *testing.T) {
+	t.Parallel()
+
+	client := &interruptReader{}
+	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(client), ioutil.Discard)
+	backend.SetValidateProtocol(true)
+
+	client.push(mustEncode(t, &pgproto3.Query{String: "select 1"}))
+	_, err := backend.Receive()
+	requireViolation(t, err)
+
+	startup := mustEncode(t, &pgproto3.StartupMessage{ProtocolVersion: pgproto3.ProtocolVersionNumber, Parameters: map[string]string{"user": "jack"}})
+	client.push(startup)
+	_, err = backend.ReceiveStartupMessage()
+	require.NoError(t, err)
+
+	client.push(startup)
+	_, err = backend.ReceiveStartupMessage()
+	requireViolation(t, err)
+}
+
+func TestBackendValidateProtocolErrorUntilSync(t *testing.T) {
+	t.Parallel()
+
+	backend, client := newValidatingBackend(t)
+	require.NoError(t, backend.Send(&pgproto3.AuthenticationOk{}))
+
+	var buf []byte
+	for _, msg := range []pgproto3.FrontendMessage{
+		&pgproto3.Parse{Query: "select"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Describe{ObjectType: 'P'},
+		&pgproto3.Sync{},
+		&pgproto3.CopyData{Data: []byte("left over")},
+		&pgproto3.Query{String: "select 1"},
+	} {
+		buf = append(buf, mustEncode(t, msg)...)
+	}
+	client.push(buf)
+
+	msg, err := backend.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.Parse{Query: "select"}, msg)
+	require.NoError(t, backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601"}))
+
+	// The messages up to Sync are discarded, as is the CopyData outside of a copy.
+	msg, err = backend.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.Sync{}, msg)
+
+	msg, err = backend.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.Query{String: "select 1"}, msg)
+}
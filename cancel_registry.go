@@ -0,0 +1,142 @@
+package pgproto3
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// CancelRegistry issues the BackendKeyData for sessions served by a Backend and finds the session a CancelRequest is
+// for. A proxy can also record which server session is currently serving each session and forward CancelRequests to
+// it. The zero value is ready to use. A CancelRegistry is safe for concurrent use.
+type CancelRegistry struct {
+	mu       sync.Mutex
+	sessions map[BackendKeyData]*cancelSession
+}
+
+type cancelSession struct {
+	cancel func()
+	server *BackendKeyData // the server session currently serving the session
+}
+
+// Register issues a new random key for a session. cancel is called by Cancel when a CancelRequest with the key is
+// received. It may be nil. The key should be sent to the client and must be unregistered when the session ends.
+func (r *CancelRegistry) Register(cancel func()) (*BackendKeyData, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sessions == nil {
+		r.sessions = make(map[BackendKeyData]*cancelSession)
+	}
+
+	buf := make([]byte, 8)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		key := BackendKeyData{ProcessID: binary.BigEndian.Uint32(buf), SecretKey: binary.BigEndian.Uint32(buf[4:])}
+		if _, exists := r.sessions[key]; !exists {
+			r.sessions[key] = &cancelSession{cancel: cancel}
+			return &key, nil
+		}
+	}
+}
+
+// Unregister removes the session identified by key.
+func (r *CancelRegistry) Unregister(key *BackendKeyData) {
+	r.mu.Lock()
+	delete(r.sessions, *key)
+	r.mu.Unlock()
+}
+
+// Assign records that the session identified by key is currently served by the server session identified by
+// serverKey. A nil serverKey records that no server session is serving it.
+func (r *CancelRegistry) Assign(key, serverKey *BackendKeyData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s, ok := r.sessions[*key]; ok {
+		if serverKey != nil {
+			k := *serverKey
+			serverKey = &k
+		}
+		s.server = serverKey
+	}
+}
+
+// Cancel calls the cancel function registered for the session req is for. It reports whether the session was found.
+func (r *CancelRegistry) Cancel(req *CancelRequest) bool {
+	r.mu.Lock()
+	s, ok := r.sessions[BackendKeyData{ProcessID: req.ProcessID, SecretKey: req.SecretKey}]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+	return true
+}
+
+// Forward sends a CancelRequest for the server session assigned to the session req is for over a new connection
+// opened with dial. It does nothing if the session is not found or no server session is assigned to it.
+func (r *CancelRegistry) Forward(ctx context.Context, req *CancelRequest, dial func(ctx context.Context) (net.Conn, error)) error {
+	r.mu.Lock()
+	var serverKey *BackendKeyData
+	if s, ok := r.sessions[BackendKeyData{ProcessID: req.ProcessID, SecretKey: req.SecretKey}]; ok {
+		serverKey = s.server
+	}
+	r.mu.Unlock()
+
+	if serverKey == nil {
+		return nil
+	}
+	return SendCancelRequest(ctx, dial, serverKey)
+}
+
+// SendCancelRequest asks the server to cancel the query in progress in the session identified by key. The
+// BackendKeyData sent by the server during startup identifies the session. The CancelRequest is sent over a new
+// connection opened with dial. SendCancelRequest waits for the server to close the connection, which it does after
+// processing the request. The server never replies, so success does not mean a query was canceled.
+func SendCancelRequest(ctx context.Context, dial func(ctx context.Context) (net.Conn, error), key *BackendKeyData) error {
+	conn, err := dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.SetDeadline(time.Now())
+			case <-done:
+			}
+		}()
+	}
+
+	buf, err := (&CancelRequest{ProcessID: key.ProcessID, SecretKey: key.SecretKey}).Encode(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(ioutil.Discard, conn)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
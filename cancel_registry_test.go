@@ -0,0 +1,87 @@
+package pgproto3_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancelRegistryCancel(t *testing.T) {
+	t.Parallel()
+
+	var registry pgproto3.CancelRegistry
+
+	canceled := make(chan int, 2)
+	key1, err := registry.Register(func() { canceled <- 1 })
+	require.NoError(t, err)
+	key2, err := registry.Register(func() { canceled <- 2 })
+	require.NoError(t, err)
+	assert.NotEqual(t, *key1, *key2)
+
+	assert.True(t, registry.Cancel(&pgproto3.CancelRequest{ProcessID: key2.ProcessID, SecretKey: key2.SecretKey}))
+	assert.Equal(t, 2, <-canceled)
+
+	assert.False(t, registry.Cancel(&pgproto3.CancelRequest{ProcessID: key1.ProcessID, SecretKey: key1.SecretKey + 1}))
+
+	registry.Unregister(key1)
+	assert.False(t, registry.Cancel(&pgproto3.CancelRequest{ProcessID: key1.ProcessID, SecretKey: key1.SecretKey}))
+}
+
+// cancelListener returns a dial function for a server that reports each CancelRequest it receives on the returned
+// channel.
+func cancelListener() (func(ctx context.Context) (net.Conn, error), chan pgproto3.CancelRequest) {
+	requests := make(chan pgproto3.CancelRequest, 10)
+	dial := func(ctx context.Context) (net.Conn, error) {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			defer serverConn.Close()
+			backend := pgproto3.NewBackend(pgproto3.NewChunkReader(serverConn), serverConn)
+			msg, err := backend.ReceiveStartupMessage()
+			if err != nil {
+				return
+			}
+			if req, ok := msg.(*pgproto3.CancelRequest); ok {
+				requests <- *req
+			}
+		}()
+		return clientConn, nil
+	}
+	return dial, requests
+}
+
+func TestCancelRegistryForward(t *testing.T) {
+	t.Parallel()
+
+	dial, requests := cancelListener()
+	var registry pgproto3.CancelRegistry
+
+	key, err := registry.Register(nil)
+	require.NoError(t, err)
+	req := &pgproto3.CancelRequest{ProcessID: key.ProcessID, SecretKey: key.SecretKey}
+
+	// Nothing is forwarded while no server session is assigned.
+	require.NoError(t, registry.Forward(context.Background(), req, dial))
+	assert.Len(t, requests, 0)
+
+	registry.Assign(key, &pgproto3.BackendKeyData{ProcessID: 42, SecretKey: 7})
+	require.NoError(t, registry.Forward(context.Background(), req, dial))
+	assert.Equal(t, pgproto3.CancelRequest{ProcessID: 42, SecretKey: 7}, <-requests)
+
+	registry.Assign(key, nil)
+	require.NoError(t, registry.Forward(context.Background(), req, dial))
+	assert.Len(t, requests, 0)
+}
+
+func TestSendCancelRequest(t *testing.T) {
+	t.Parallel()
+
+	dial, requests := cancelListener()
+
+	err := pgproto3.SendCancelRequest(context.Background(), dial, &pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 2})
+	require.NoError(t, err)
+	assert.Equal(t, pgproto3.CancelRequest{ProcessID: 1, SecretKey: 2}, <-requests)
+}
@@ -0,0 +1,311 @@
+package pgproto3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/jackc/pgio"
+)
+
+// copyBinarySignature starts the header of the binary COPY format.
+var copyBinarySignature = []byte("PGCOPY\n\377\r\n\000")
+
+// copyBinaryFlagOIDs is the header flag that indicates each tuple includes an OID. Bits 16-31 of the flags are critical:
+// a reader must reject data with an unknown critical flag set.
+const (
+	copyBinaryFlagOIDs     = 1 << 16
+	copyBinaryCriticalMask = 0xFFFF0000
+)
+
+// checkCopyBinaryFormats returns an error if overallFormat and columnFormatCodes, as sent in a CopyInResponse or
+// CopyOutResponse, do not describe a binary copy.
+func checkCopyBinaryFormats(overallFormat byte, columnFormatCodes []uint16) error {
+	if overallFormat != BinaryFormat {
+		return fmt.Errorf("copy is not in binary format: overall format %d", overallFormat)
+	}
+	for i, fc := range columnFormatCodes {
+		if fc != BinaryFormat {
+			return fmt.Errorf("copy is not in binary format: column %d format %d", i, fc)
+		}
+	}
+	return nil
+}
+
+// CopyBinaryWriter writes rows in the binary COPY format. The encoded data is written to an underlying writer such as
+// a CopyFromWriter. Field values must already be in the binary format of their column's type. The header is written
+// with the first row and Close writes the trailer.
+type CopyBinaryWriter struct {
+	w          io.Writer
+	fieldCount int
+	buf        []byte
+
+	headerWritten bool
+	closed        bool
+}
+
+// NewCopyBinaryWriter returns a CopyBinaryWriter that writes to w. overallFormat and columnFormatCodes are the formats
+// of the copy as sent in the server's CopyInResponse or CopyOutResponse. An error is returned if they are not binary.
+// If columnFormatCodes is not empty every row must have exactly that many fields.
+func NewCopyBinaryWriter(w io.Writer, overallFormat byte, columnFormatCodes []uint16) (*CopyBinaryWriter, error) {
+	if err := checkCopyBinaryFormats(overallFormat, columnFormatCodes); err != nil {
+		return nil, err
+	}
+
+	return &CopyBinaryWriter{w: w, fieldCount: len(columnFormatCodes)}, nil
+}
+
+func (cw *CopyBinaryWriter) appendHeader(dst []byte) []byte {
+	dst = append(dst, copyBinarySignature...)
+	dst = pgio.AppendUint32(dst, 0) // flags
+	dst = pgio.AppendUint32(dst, 0) // header extension length
+	return dst
+}
+
+// WriteRow writes a row. A nil value is written as NULL.
+func (cw *CopyBinaryWriter) WriteRow(values [][]byte) error {
+	if cw.closed {
+		return errors.New("write to closed CopyBinaryWriter")
+	}
+	if cw.fieldCount != 0 && len(values) != cw.fieldCount {
+		return fmt.Errorf("row has %d fields, copy has %d columns", len(values), cw.fieldCount)
+	}
+	if len(values) > math.MaxInt16 {
+		return errors.New("too many fields")
+	}
+
+	buf := cw.buf[:0]
+	if !cw.headerWritten {
+		buf = cw.appendHeader(buf)
+	}
+
+	buf = pgio.AppendInt16(buf, int16(len(values)))
+	for _, v := range values {
+		if v == nil {
+			buf = pgio.AppendInt32(buf, -1)
+			continue
+		}
+		if len(v) > math.MaxInt32 {
+			return errors.New("field value too long")
+		}
+		buf = pgio.AppendInt32(buf, int32(len(v)))
+		buf = append(buf, v...)
+	}
+	cw.buf = buf
+
+	_, err := cw.w.Write(buf)
+	if err != nil {
+		return err
+	}
+	cw.headerWritten = true
+	return nil
+}
+
+// Close writes the trailer. If no rows were written the header is written first. Close does not close the underlying
+// writer.
+func (cw *CopyBinaryWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+
+	buf := cw.buf[:0]
+	if !cw.headerWritten {
+		buf = cw.appendHeader(buf)
+	}
+	buf = pgio.AppendInt16(buf, -1)
+
+	_, err := cw.w.Write(buf)
+	if err != nil {
+		return err
+	}
+	cw.headerWritten = true
+	cw.closed = true
+	return nil
+}
+
+// DefaultCopyBinaryMaxFieldLen is the default limit on the length of a field value read by a CopyBinaryReader. It is
+// the largest value PostgreSQL can store in a field.
+const DefaultCopyBinaryMaxFieldLen = 1 << 30
+
+// CopyBinaryReader reads rows in the binary COPY format from an underlying reader such as a CopyToReader.
+type CopyBinaryReader struct {
+	r           io.Reader
+	fieldCount  int
+	maxFieldLen int
+
+	headerRead bool
+	done       bool
+
+	scratch [4]byte
+	buf     []byte
+	values  [][]byte
+}
+
+// NewCopyBinaryReader returns a CopyBinaryReader that reads from r. overallFormat and columnFormatCodes are the
+// formats of the copy as sent in the server's CopyOutResponse or CopyInResponse. An error is returned if they are not
+// binary. If columnFormatCodes is not empty every row must have exactly that many fields.
+func NewCopyBinaryReader(r io.Reader, overallFormat byte, columnFormatCodes []uint16) (*CopyBinaryReader, error) {
+	if err := checkCopyBinaryFormats(overallFormat, columnFormatCodes); err != nil {
+		return nil, err
+	}
+
+	return &CopyBinaryReader{r: r, fieldCount: len(columnFormatCodes), maxFieldLen: DefaultCopyBinaryMaxFieldLen}, nil
+}
+
+// SetMaxFieldLen sets the maximum length of a field value. ReadRow returns an error for a longer value without
+// reading it. The default is DefaultCopyBinaryMaxFieldLen.
+func (cr *CopyBinaryReader) SetMaxFieldLen(n int) {
+	cr.maxFieldLen = n
+}
+
+// readFull reads exactly len(buf) bytes. An EOF in the middle of the data is reported as io.ErrUnexpectedEOF.
+func (cr *CopyBinaryReader) readFull(buf []byte) error {
+	_, err := io.ReadFull(cr.r, buf)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (cr *CopyBinaryReader) readHeader() error {
+	signature := make([]byte, len(copyBinarySignature))
+	if err := cr.readFull(signature); err != nil {
+		return err
+	}
+	if !bytes.Equal(signature, copyBinarySignature) {
+		return errors.New("invalid binary copy signature")
+	}
+
+	if err := cr.readFull(cr.scratch[:4]); err != nil {
+		return err
+	}
+	flags := binary.BigEndian.Uint32(cr.scratch[:4])
+	if flags&copyBinaryFlagOIDs != 0 {
+		return errors.New("binary copy with OIDs is not supported")
+	}
+	if flags&copyBinaryCriticalMask != 0 {
+		return fmt.Errorf("binary copy has unknown critical flags: %#x", flags&copyBinaryCriticalMask)
+	}
+
+	if err := cr.readFull(cr.scratch[:4]); err != nil {
+		return err
+	}
+	extensionLen := binary.BigEndian.Uint32(cr.scratch[:4])
+	if _, err := io.CopyN(ioutil.Discard, cr.r, int64(extensionLen)); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	cr.headerRead = true
+	return nil
+}
+
+// ReadRow reads the next row. A NULL is returned as a nil value. The returned values are only valid until the next
+// call to ReadRow. It returns io.EOF after the trailer has been read.
+func (cr *CopyBinaryReader) ReadRow() ([][]byte, error) {
+	if cr.done {
+		return nil, io.EOF
+	}
+	if !cr.headerRead {
+		if err := cr.readHeader(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cr.readFull(cr.scratch[:2]); err != nil {
+		return nil, err
+	}
+	fieldCount := int16(binary.BigEndian.Uint16(cr.scratch[:2]))
+	if fieldCount == -1 {
+		cr.done = true
+		return nil, io.EOF
+	}
+	if fieldCount < 0 {
+		return nil, fmt.Errorf("invalid binary copy field count: %d", fieldCount)
+	}
+	if cr.fieldCount != 0 && int(fieldCount) != cr.fieldCount {
+		return nil, fmt.Errorf("row has %d fields, copy has %d columns", fieldCount, cr.fieldCount)
+	}
+
+	// The values are read into a single buffer. Their slices are set after all values are read because the buffer may
+	// be reallocated while it grows.
+	type span struct{ start, end int }
+	spans := make([]span, fieldCount)
+	if cr.buf == nil {
+		// An empty value must not be confused with NULL so the buffer must not be nil.
+		cr.buf = make([]byte, 0, 256)
+	}
+	buf := cr.buf[:0]
+	for i := range spans {
+		if err := cr.readFull(cr.scratch[:4]); err != nil {
+			return nil, err
+		}
+		n := int32(binary.BigEndian.Uint32(cr.scratch[:4]))
+		if n == -1 {
+			spans[i] = span{-1, -1}
+			continue
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("invalid binary copy field length: %d", n)
+		}
+
+		if int64(n) > int64(cr.maxFieldLen) {
+			return nil, fmt.Errorf("binary copy field length %d exceeds limit of %d", n, cr.maxFieldLen)
+		}
+
+		start := len(buf)
+		var err error
+		buf, err = cr.readValue(buf, int(n))
+		if err != nil {
+			return nil, err
+		}
+		spans[i] = span{start, len(buf)}
+	}
+	cr.buf = buf
+
+	values := cr.values[:0]
+	for _, s := range spans {
+		if s.start == -1 {
+			values = append(values, nil)
+		} else {
+			values = append(values, buf[s.start:s.end:s.end])
+		}
+	}
+	cr.values = values
+
+	return values, nil
+}
+
+// readValue appends the next n bytes to buf. The length is only a claim of the sender so buf grows with the data
+// actually read instead of being allocated for n bytes up front.
+func (cr *CopyBinaryReader) readValue(buf []byte, n int) ([]byte, error) {
+	for n > 0 {
+		if len(buf) == cap(buf) {
+			grow := cap(buf)
+			if grow > n {
+				grow = n
+			}
+			newBuf := make([]byte, len(buf), len(buf)+grow)
+			copy(newBuf, buf)
+			buf = newBuf
+		}
+
+		start := len(buf)
+		chunk := cap(buf) - start
+		if chunk > n {
+			chunk = n
+		}
+		buf = buf[:start+chunk]
+		if err := cr.readFull(buf[start:]); err != nil {
+			return nil, err
+		}
+		n -= chunk
+	}
+	return buf, nil
+}
@@ -0,0 +1,189 @@
+package pgproto3_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyBinaryWriterEncoding(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	cw, err := pgproto3.NewCopyBinaryWriter(&buf, pgproto3.BinaryFormat, []uint16{1, 1})
+	require.NoError(t, err)
+
+	require.NoError(t, cw.WriteRow([][]byte{{0, 0, 0, 1}, nil}))
+	require.NoError(t, cw.Close())
+
+	expected := []byte("PGCOPY\n\377\r\n\000")
+	expected = append(expected, 0, 0, 0, 0) // flags
+	expected = append(expected, 0, 0, 0, 0) // header extension length
+	expected = append(expected, 0, 2)       // field count
+	expected = append(expected, 0, 0, 0, 4, 0, 0, 0, 1)
+	expected = append(expected, 0xff, 0xff, 0xff, 0xff) // NULL
+	expected = append(expected, 0xff, 0xff)             // trailer
+	assert.Equal(t, expected, buf.Bytes())
+}
+
+func TestCopyBinaryRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	rows := [][][]byte{
+		{[]byte("a"), {}, nil},
+		{bytes.Repeat([]byte("x"), 1000), []byte("b"), []byte("c")},
+		{nil, nil, nil},
+	}
+
+	var buf bytes.Buffer
+	cw, err := pgproto3.NewCopyBinaryWriter(&buf, pgproto3.BinaryFormat, nil)
+	require.NoError(t, err)
+	for _, row := range rows {
+		require.NoError(t, cw.WriteRow(row))
+	}
+	require.NoError(t, cw.Close())
+
+	cr, err := pgproto3.NewCopyBinaryReader(&buf, pgproto3.BinaryFormat, []uint16{1, 1, 1})
+	require.NoError(t, err)
+	for _, expected := range rows {
+		values, err := cr.ReadRow()
+		require.NoError(t, err)
+		assert.Equal(t, expected, values)
+	}
+	_, err = cr.ReadRow()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestCopyBinaryRequiresBinaryFormat(t *testing.T) {
+	t.Parallel()
+
+	_, err := pgproto3.NewCopyBinaryWriter(&bytes.Buffer{}, pgproto3.TextFormat, []uint16{0})
+	assert.Error(t, err)
+	_, err = pgproto3.NewCopyBinaryReader(&bytes.Buffer{}, pgproto3.BinaryFormat, []uint16{1, 0})
+	assert.Error(t, err)
+}
+
+func TestCopyBinaryFieldCount(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	cw, err := pgproto3.NewCopyBinaryWriter(&buf, pgproto3.BinaryFormat, []uint16{1, 1})
+	require.NoError(t, err)
+	assert.Error(t, cw.WriteRow([][]byte{[]byte("a")}))
+
+	cw, err = pgproto3.NewCopyBinaryWriter(&buf, pgproto3.BinaryFormat, nil)
+	require.NoError(t, err)
+	require.NoError(t, cw.WriteRow([][]byte{[]byte("a")}))
+
+	cr, err := pgproto3.NewCopyBinaryReader(&buf, pgproto3.BinaryFormat, []uint16{1, 1})
+	require.NoError(t, err)
+	_, err = cr.ReadRow()
+	assert.Error(t, err)
+}
+
+func TestCopyBinaryReaderInvalidHeader(t *testing.T) {
+	t.Parallel()
+
+	header := func(flags byte) []byte {
+		buf := []byte("PGCOPY\n\377\r\n\000")
+		buf = append(buf, 0, flags, 0, 0)
+		buf = append(buf, 0, 0, 0, 0)
+		return append(buf, 0xff, 0xff)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"signature", []byte("COPY\n\377\r\n\000\000\000")},
+		{"oids", header(1)},
+		{"critical flag", header(2)},
+		{"truncated", header(0)[:14]},
+	}
+	for _, tt := range tests {
+		cr, err := pgproto3.NewCopyBinaryReader(bytes.NewReader(tt.data), pgproto3.BinaryFormat, nil)
+		require.NoError(t, err)
+		_, err = cr.ReadRow()
+		assert.Error(t, err, tt.name)
+		assert.NotEqual(t, io.EOF, err, tt.name)
+	}
+
+	// Header extensions are skipped.
+	data := []byte("PGCOPY\n\377\r\n\000")
+	data = append(data, 0, 0, 0, 1) // a non-critical flag
+	data = append(data, 0, 0, 0, 3, 'e', 'x', 't')
+	data = append(data, 0xff, 0xff)
+	cr, err := pgproto3.NewCopyBinaryReader(bytes.NewReader(data), pgproto3.BinaryFormat, nil)
+	require.NoError(t, err)
+	_, err = cr.ReadRow()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestCopyBinaryReaderFieldLength(t *testing.T) {
+	t.Parallel()
+
+	row := func(n int32, value []byte) []byte {
+		buf := []byte("PGCOPY\n\377\r\n\000")
+		buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0)
+		buf = append(buf, 0, 1)
+		buf = append(buf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		return append(buf, value...)
+	}
+
+	// A length the data does not back is not allocated up front.
+	cr, err := pgproto3.NewCopyBinaryReader(bytes.NewReader(row(pgproto3.DefaultCopyBinaryMaxFieldLen, []byte("short"))), pgproto3.BinaryFormat, nil)
+	require.NoError(t, err)
+	_, err = cr.ReadRow()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	value := bytes.Repeat([]byte("x"), 100000)
+	cr, err = pgproto3.NewCopyBinaryReader(bytes.NewReader(row(int32(len(value)), value)), pgproto3.BinaryFormat, nil)
+	require.NoError(t, err)
+	values, err := cr.ReadRow()
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{value}, values)
+
+	cr, err = pgproto3.NewCopyBinaryReader(bytes.NewReader(row(int32(len(value)), value)), pgproto3.BinaryFormat, nil)
+	require.NoError(t, err)
+	cr.SetMaxFieldLen(len(value) - 1)
+	_, err = cr.ReadRow()
+	assert.EqualError(t, err, "binary copy field length 100000 exceeds limit of 99999")
+}
+
+func TestCopyBinaryWriterCopyFrom(t *testing.T) {
+	t.Parallel()
+
+	frontend, server := startCopyInServer(t, 0)
+
+	w, err := frontend.BeginCopyFrom(context.Background(), "copy t from stdin", 0)
+	require.NoError(t, err)
+
+	// The fake server starts the copy in text format.
+	_, err = pgproto3.NewCopyBinaryWriter(w, w.Response().OverallFormat, w.Response().ColumnFormatCodes)
+	assert.Error(t, err)
+
+	cw, err := pgproto3.NewCopyBinaryWriter(w, pgproto3.BinaryFormat, []uint16{1, 1})
+	require.NoError(t, err)
+	require.NoError(t, cw.WriteRow([][]byte{[]byte("a"), nil}))
+	require.NoError(t, cw.Close())
+	_, err = w.Finish()
+	require.NoError(t, err)
+	require.NoError(t, <-server.done)
+
+	var data []byte
+	for _, chunk := range server.chunks {
+		data = append(data, chunk...)
+	}
+	cr, err := pgproto3.NewCopyBinaryReader(bytes.NewReader(data), pgproto3.BinaryFormat, []uint16{1, 1})
+	require.NoError(t, err)
+	values, err := cr.ReadRow()
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), nil}, values)
+	_, err = cr.ReadRow()
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,330 @@
+package pgproto3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// DefaultCopyChunkSize is the size of the CopyData messages sent by a CopyFromWriter when no chunk size is given.
+const DefaultCopyChunkSize = 64 * 1024
+
+// CopyFromWriter streams data to the server for a COPY ... FROM STDIN statement. It is created by
+// Frontend.BeginCopyFrom. Data written to it is sent in CopyData messages and the copy is completed by Finish or
+// Abort.
+//
+// While the copy is in progress the server's responses are received by a goroutine so an error reported by the server
+// in the middle of the copy is returned by the next Write. Meanwhile the CopyFromWriter sends on the caller's
+// goroutine, which is safe because Send and Receive may be called concurrently by one goroutine each. The Frontend
+// must not be used for anything else until Finish or Abort returns.
+type CopyFromWriter struct {
+	f         *Frontend
+	ctx       context.Context
+	chunkSize int
+	response  CopyInResponse
+
+	buf      []byte
+	finished bool
+	err      error // first error returned by Write
+
+	mu        sync.Mutex
+	copyDone  chan struct{} // closed when the server has finished the copy and sent ReadyForQuery
+	serverErr *ErrorResponse
+	recvErr   error
+	tag       []byte
+}
+
+// BeginCopyFrom sends sql, which must be a COPY ... FROM STDIN statement, and waits for the server to start the copy.
+// chunkSize is the maximum size of each CopyData message; if it is 0 DefaultCopyChunkSize is used. ctx applies to
+// the whole copy: if it is done before the copy is finished a CopyFail is sent and the copy returns ctx.Err(). The
+// caller must then receive until ReadyForQuery before using the Frontend again.
+//
+// If the server reports an error instead of starting the copy it is returned as an *ErrorResponse and the Frontend is
+// ready for the next query.
+func (f *Frontend) BeginCopyFrom(ctx context.Context, sql string, chunkSize int) (*CopyFromWriter, error) {
+	if chunkSize < 0 {
+		return nil, errors.New("chunkSize must not be negative")
+	}
+	if chunkSize == 0 {
+		chunkSize = DefaultCopyChunkSize
+	}
+
+	err := f.Send(&Query{String: sql})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		msg, err := f.ReceiveContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg := msg.(type) {
+		case *CopyInResponse:
+			w := &CopyFromWriter{
+				f:         f,
+				ctx:       ctx,
+				chunkSize: chunkSize,
+				response: CopyInResponse{
+					OverallFormat:     msg.OverallFormat,
+					ColumnFormatCodes: append([]uint16(nil), msg.ColumnFormatCodes...),
+				},
+				copyDone: make(chan struct{}),
+			}
+			go w.receive()
+			return w, nil
+		case *ErrorResponse:
+			errResp := *msg
+			if err := f.receiveReadyForQuery(ctx); err != nil {
+				return nil, err
+			}
+			return nil, &errResp
+		case *NoticeResponse, *ParameterStatus, *NotificationResponse:
+		default:
+			if err := f.receiveReadyForQuery(ctx); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("query is not COPY FROM STDIN: received %T", msg)
+		}
+	}
+}
+
+// CopyFrom runs sql, which must be a COPY ... FROM STDIN statement, with the data read from r. It returns the number
+// of rows copied. If reading r fails the copy is aborted and the read error is returned.
+func (f *Frontend) CopyFrom(ctx context.Context, sql string, r io.Reader) (int64, error) {
+	w, err := f.BeginCopyFrom(ctx, sql, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, w.chunkSize)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				w.Abort(err.Error())
+				return 0, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			w.Abort(readErr.Error())
+			return 0, readErr
+		}
+	}
+
+	return w.Finish()
+}
+
+// receiveReadyForQuery receives and discards messages until ReadyForQuery.
+func (f *Frontend) receiveReadyForQuery(ctx context.Context) error {
+	for {
+		msg, err := f.ReceiveContext(ctx)
+		if err != nil {
+			return err
+		}
+		if _, ok := msg.(*ReadyForQuery); ok {
+			return nil
+		}
+	}
+}
+
+// Response returns the CopyInResponse the server started the copy with. It describes the format of the data the
+// server expects.
+func (w *CopyFromWriter) Response() *CopyInResponse {
+	return &w.response
+}
+
+// receive receives the server's messages until the copy is finished.
+func (w *CopyFromWriter) receive() {
+	defer close(w.copyDone)
+
+	for {
+		msg, err := w.f.ReceiveContext(w.ctx)
+		if err != nil {
+			w.mu.Lock()
+			w.recvErr = err
+			w.mu.Unlock()
+			return
+		}
+
+		switch msg := msg.(type) {
+		case *ErrorResponse:
+			errResp := *msg
+			w.mu.Lock()
+			if w.serverErr == nil {
+				w.serverErr = &errResp
+			}
+			w.mu.Unlock()
+		case *CommandComplete:
+			w.mu.Lock()
+			w.tag = append([]byte(nil), msg.CommandTag...)
+			w.mu.Unlock()
+		case *ReadyForQuery:
+			return
+		}
+	}
+}
+
+// asyncErr returns the error that ended the copy early or nil if the copy is still in progress.
+func (w *CopyFromWriter) asyncErr() error {
+	select {
+	case <-w.copyDone:
+	default:
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.recvErr != nil {
+		return w.recvErr
+	}
+	if w.serverErr != nil {
+		return w.serverErr
+	}
+	return errors.New("server finished the copy unexpectedly")
+}
+
+// Write sends p to the server in CopyData messages. Data is buffered until a full chunk is available. If the server
+// has reported an error the error is returned.
+func (w *CopyFromWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.finished {
+		return 0, errors.New("write to finished copy")
+	}
+	if err := w.check(); err != nil {
+		return 0, err
+	}
+
+	n := len(p)
+
+	if len(w.buf) > 0 {
+		fill := w.chunkSize - len(w.buf)
+		if fill > len(p) {
+			fill = len(p)
+		}
+		w.buf = append(w.buf, p[:fill]...)
+		p = p[fill:]
+		if len(w.buf) == w.chunkSize {
+			if err := w.send(w.buf); err != nil {
+				return 0, err
+			}
+			w.buf = w.buf[:0]
+		}
+	}
+
+	for len(p) >= w.chunkSize {
+		if err := w.send(p[:w.chunkSize]); err != nil {
+			return 0, err
+		}
+		p = p[w.chunkSize:]
+	}
+
+	w.buf = append(w.buf, p...)
+	return n, nil
+}
+
+// check returns an error if the copy can not continue. If ctx is done the copy is failed.
+func (w *CopyFromWriter) check() error {
+	if err := w.ctx.Err(); err != nil {
+		w.f.Send(&CopyFail{Message: err.Error()})
+		w.err = err
+		w.finished = true
+		return err
+	}
+
+	if err := w.asyncErr(); err != nil {
+		w.err = err
+		w.finished = true
+		return err
+	}
+
+	return nil
+}
+
+func (w *CopyFromWriter) send(data []byte) error {
+	if err := w.check(); err != nil {
+		return err
+	}
+
+	err := w.f.Send(&CopyData{Data: data})
+	if err != nil {
+		w.err = err
+		w.finished = true
+	}
+	return err
+}
+
+// Finish sends any buffered data and CopyDone and waits for the server to complete the copy. It returns the number
+// of rows copied.
+func (w *CopyFromWriter) Finish() (int64, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.finished {
+		return 0, errors.New("copy already finished")
+	}
+
+	if len(w.buf) > 0 {
+		if err := w.send(w.buf); err != nil {
+			return 0, err
+		}
+		w.buf = nil
+	}
+	if err := w.check(); err != nil {
+		return 0, err
+	}
+
+	w.finished = true
+	if err := w.f.Send(&CopyDone{}); err != nil {
+		return 0, err
+	}
+
+	<-w.copyDone
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.recvErr != nil {
+		return 0, w.recvErr
+	}
+	if w.serverErr != nil {
+		return 0, w.serverErr
+	}
+	return parseCommandTagRows(w.tag), nil
+}
+
+// Abort fails the copy with reason as the error message and waits for the server to acknowledge it. No data is
+// committed.
+func (w *CopyFromWriter) Abort(reason string) error {
+	if !w.finished {
+		w.finished = true
+		if err := w.f.Send(&CopyFail{Message: reason}); err != nil {
+			return err
+		}
+	}
+
+	<-w.copyDone
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.recvErr
+}
+
+// parseCommandTagRows returns the row count at the end of a command tag such as "COPY 42".
+func parseCommandTagRows(tag []byte) int64 {
+	idx := bytes.LastIndexByte(tag, ' ')
+	if idx < 0 {
+		return 0
+	}
+	n, _ := strconv.ParseInt(string(tag[idx+1:]), 10, 64)
+	return n
+}
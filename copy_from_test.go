@@ -0,0 +1,241 @@
+package pgproto3_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// copyInServer is a server for a single COPY FROM STDIN. It records the CopyData messages it receives.
+type copyInServer struct {
+	backend *pgproto3.Backend
+
+	chunks  []string
+	failMsg string
+	done    chan error
+
+	// failAfter causes the server to report an error after receiving that many CopyData messages if it is positive.
+	failAfter int
+}
+
+func startCopyInServer(t *testing.T, failAfter int) (*pgproto3.Frontend, *copyInServer) {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	s := &copyInServer{
+		backend:   pgproto3.NewBackend(pgproto3.NewChunkReader(serverConn), serverConn),
+		done:      make(chan error, 1),
+		failAfter: failAfter,
+	}
+	go func() { s.done <- s.serve() }()
+
+	return pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn), s
+}
+
+func (s *copyInServer) serve() error {
+	msg, err := s.backend.Receive()
+	if err != nil {
+		return err
+	}
+	query, ok := msg.(*pgproto3.Query)
+	if !ok {
+		return errors.New("expected Query")
+	}
+	if !strings.Contains(query.String, "from stdin") {
+		s.backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601", Message: "not a copy"})
+		return s.backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	}
+
+	s.backend.Send(&pgproto3.CopyInResponse{OverallFormat: 0, ColumnFormatCodes: []uint16{0, 0}})
+
+	failed := false
+	for {
+		msg, err := s.backend.Receive()
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			if failed {
+				continue
+			}
+			s.chunks = append(s.chunks, string(msg.Data))
+			if len(s.chunks) == s.failAfter {
+				failed = true
+				s.backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "22P02", Message: "invalid input syntax"})
+				s.backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+			}
+		case *pgproto3.CopyDone:
+			if failed {
+				continue
+			}
+			rows := strings.Count(strings.Join(s.chunks, ""), "\n")
+			s.backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("COPY " + strconv.Itoa(rows))})
+			return s.backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		case *pgproto3.CopyFail:
+			if failed {
+				continue
+			}
+			s.failMsg = msg.Message
+			s.backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "57014", Message: "COPY from stdin failed: " + msg.Message})
+			return s.backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		default:
+			return errors.New("unexpected message")
+		}
+	}
+}
+
+func TestFrontendBeginCopyFromChunks(t *testing.T) {
+	t.Parallel()
+
+	frontend, server := startCopyInServer(t, 0)
+
+	w, err := frontend.BeginCopyFrom(context.Background(), "copy t from stdin", 8)
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{0, 0}, w.Response().ColumnFormatCodes)
+
+	for _, s := range []string{"1\ta\n", "2\tb\n3\tc\n", "4\td\n5\teeeeeeeeee\n"} {
+		n, err := w.Write([]byte(s))
+		require.NoError(t, err)
+		assert.Equal(t, len(s), n)
+	}
+
+	rows, err := w.Finish()
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, rows)
+	require.NoError(t, <-server.done)
+
+	assert.Equal(t, []string{"1\ta\n2\tb\n", "3\tc\n4\td\n", "5\teeeeee", "eeee\n"}, server.chunks)
+}
+
+func TestFrontendCopyFrom(t *testing.T) {
+	t.Parallel()
+
+	frontend, server := startCopyInServer(t, 0)
+
+	data := strings.Repeat("1\thello\n", 20000)
+	rows, err := frontend.CopyFrom(context.Background(), "copy t from stdin", strings.NewReader(data))
+	require.NoError(t, err)
+	assert.EqualValues(t, 20000, rows)
+	require.NoError(t, <-server.done)
+	assert.Equal(t, data, strings.Join(server.chunks, ""))
+}
+
+func TestFrontendBeginCopyFromNotCopy(t *testing.T) {
+	t.Parallel()
+
+	frontend, server := startCopyInServer(t, 0)
+
+	_, err := frontend.BeginCopyFrom(context.Background(), "select 1", 0)
+	var errResp *pgproto3.ErrorResponse
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "42601", errResp.Code)
+	require.NoError(t, <-server.done)
+}
+
+func TestFrontendCopyFromAsyncError(t *testing.T) {
+	t.Parallel()
+
+	frontend, _ := startCopyInServer(t, 1)
+
+	w, err := frontend.BeginCopyFrom(context.Background(), "copy t from stdin", 4)
+	require.NoError(t, err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for err == nil && time.Now().Before(deadline) {
+		_, err = w.Write([]byte("bad\n"))
+	}
+	var errResp *pgproto3.ErrorResponse
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "22P02", errResp.Code)
+
+	_, err = w.Finish()
+	assert.Equal(t, errResp, err)
+}
+
+// The copy sends on the caller's goroutine while its responses are received by another. Run with -race.
+func TestFrontendCopyFromConcurrentSendAndReceive(t *testing.T) {
+	t.Parallel()
+
+	frontend, server := startCopyInServer(t, 0)
+	frontend.SetValidateProtocol(true)
+
+	data := strings.Repeat("1\thello\n", 20000)
+	rows, err := frontend.CopyFrom(context.Background(), "copy t from stdin", strings.NewReader(data))
+	require.NoError(t, err)
+	assert.EqualValues(t, 20000, rows)
+	assert.Equal(t, byte('I'), frontend.TxStatus())
+	require.NoError(t, <-server.done)
+
+	frontend, _ = startCopyInServer(t, 3)
+	frontend.SetValidateProtocol(true)
+
+	w, err := frontend.BeginCopyFrom(context.Background(), "copy t from stdin", 4)
+	require.NoError(t, err)
+	deadline := time.Now().Add(5 * time.Second)
+	for err == nil && time.Now().Before(deadline) {
+		_, err = w.Write([]byte("bad\n"))
+	}
+	var errResp *pgproto3.ErrorResponse
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "22P02", errResp.Code)
+	assert.Equal(t, byte('I'), frontend.TxStatus())
+}
+
+func TestFrontendCopyFromAbort(t *testing.T) {
+	t.Parallel()
+
+	frontend, server := startCopyInServer(t, 0)
+
+	w, err := frontend.BeginCopyFrom(context.Background(), "copy t from stdin", 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("1\ta\n"))
+	require.NoError(t, err)
+
+	require.NoError(t, w.Abort("changed my mind"))
+	require.NoError(t, <-server.done)
+	assert.Equal(t, "changed my mind", server.failMsg)
+	assert.Empty(t, server.chunks)
+}
+
+func TestFrontendCopyFromContextCanceled(t *testing.T) {
+	t.Parallel()
+
+	frontend, server := startCopyInServer(t, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := frontend.BeginCopyFrom(ctx, "copy t from stdin", 0)
+	require.NoError(t, err)
+
+	cancel()
+	_, err = w.Write([]byte("1\ta\n"))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, w.Abort("unused"))
+
+	// The caller receives the server's response to the CopyFail.
+	var received []string
+	for {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		received = append(received, fmt.Sprintf("%T", msg))
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+	assert.Equal(t, []string{"*pgproto3.ErrorResponse", "*pgproto3.ReadyForQuery"}, received)
+
+	require.NoError(t, <-server.done)
+	assert.Equal(t, context.Canceled.Error(), server.failMsg)
+}
@@ -0,0 +1,646 @@
+package pgproto3
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CopyTextOptions are the options of a COPY statement in text or CSV format. They must match the options the COPY
+// statement was run with. Use CopyTextDefaults or CopyCSVDefaults to get the defaults of each format.
+type CopyTextOptions struct {
+	// CSV selects the CSV format instead of the text format.
+	CSV bool
+
+	// Delimiter separates the columns of a row. It corresponds to the DELIMITER option.
+	Delimiter byte
+
+	// Null is the string that represents a NULL value. It corresponds to the NULL option.
+	Null string
+
+	// Header is true if the first line contains the column names. It corresponds to the HEADER option. When reading the
+	// header line is skipped. When writing Columns are written as the header.
+	Header bool
+
+	// Quote is the CSV quoting character. It corresponds to the QUOTE option.
+	Quote byte
+
+	// Escape is the CSV character that escapes Quote inside a quoted value. It corresponds to the ESCAPE option.
+	Escape byte
+
+	// Columns are the names of the columns. They are required for Header when writing and to resolve the names in the
+	// FORCE options.
+	Columns []string
+
+	// ForceQuote are the columns whose non-NULL values are always quoted when writing CSV. "*" selects all columns. It
+	// corresponds to the FORCE_QUOTE option.
+	ForceQuote []string
+
+	// ForceNotNull are the columns whose values are never read as NULL in CSV. It corresponds to the FORCE_NOT_NULL
+	// option.
+	ForceNotNull []string
+
+	// ForceNull are the columns whose values are read as NULL in CSV when they match Null even if they are quoted. It
+	// corresponds to the FORCE_NULL option.
+	ForceNull []string
+}
+
+// CopyTextDefaults returns the default options of the COPY text format.
+func CopyTextDefaults() *CopyTextOptions {
+	return &CopyTextOptions{Delimiter: '\t', Null: `\N`}
+}
+
+// CopyCSVDefaults returns the default options of the COPY CSV format.
+func CopyCSVDefaults() *CopyTextOptions {
+	return &CopyTextOptions{CSV: true, Delimiter: ',', Null: "", Quote: '"', Escape: '"'}
+}
+
+// validate returns an error if the options are invalid. It uses the same rules as PostgreSQL.
+func (o *CopyTextOptions) validate() error {
+	if o.Delimiter == 0 || o.Delimiter == '\n' || o.Delimiter == '\r' {
+		return errors.New("invalid COPY delimiter")
+	}
+	if strings.ContainsAny(o.Null, "\r\n") {
+		return errors.New("COPY null representation cannot use newline or carriage return")
+	}
+	if strings.IndexByte(o.Null, o.Delimiter) >= 0 {
+		return errors.New("COPY delimiter must not appear in the NULL specification")
+	}
+
+	if !o.CSV {
+		if strings.IndexByte(`\.abcdefghijklmnopqrstuvwxyz0123456789`, o.Delimiter) >= 0 {
+			return fmt.Errorf("COPY delimiter cannot be %q", o.Delimiter)
+		}
+		if o.Quote != 0 || o.Escape != 0 {
+			return errors.New("COPY quote and escape are only available in CSV mode")
+		}
+		if len(o.ForceQuote) > 0 || len(o.ForceNotNull) > 0 || len(o.ForceNull) > 0 {
+			return errors.New("COPY force options are only available in CSV mode")
+		}
+		return nil
+	}
+
+	if o.Quote == 0 || o.Escape == 0 {
+		return errors.New("COPY quote and escape must be set in CSV mode")
+	}
+	if o.Delimiter == o.Quote {
+		return errors.New("COPY delimiter and quote must be different")
+	}
+	if strings.IndexByte(o.Null, o.Quote) >= 0 {
+		return errors.New("CSV quote character must not appear in the NULL specification")
+	}
+	for _, names := range [][]string{o.ForceQuote, o.ForceNotNull, o.ForceNull} {
+		if _, err := o.columnFlags(names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// columnFlags returns a flag for each column that is true if the column is named in names. "*" names all columns.
+func (o *CopyTextOptions) columnFlags(names []string) ([]bool, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	flags := make([]bool, len(o.Columns))
+	for _, name := range names {
+		if name == "*" {
+			for i := range flags {
+				flags[i] = true
+			}
+			continue
+		}
+
+		found := false
+		for i, column := range o.Columns {
+			if column == name {
+				flags[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("column %q is not in Columns", name)
+		}
+	}
+	return flags, nil
+}
+
+// newCopyTextOptions validates opts and the formats of the copy. If opts is nil the text format defaults are used.
+// It returns a copy of the options and the number of columns if it is known.
+func newCopyTextOptions(opts *CopyTextOptions, overallFormat byte, columnFormatCodes []uint16) (CopyTextOptions, int, error) {
+	if opts == nil {
+		opts = CopyTextDefaults()
+	}
+
+	if overallFormat != TextFormat {
+		return CopyTextOptions{}, 0, fmt.Errorf("copy is not in text format: overall format %d", overallFormat)
+	}
+	for i, fc := range columnFormatCodes {
+		if fc != TextFormat {
+			return CopyTextOptions{}, 0, fmt.Errorf("copy is not in text format: column %d format %d", i, fc)
+		}
+	}
+	if err := opts.validate(); err != nil {
+		return CopyTextOptions{}, 0, err
+	}
+
+	fieldCount := len(columnFormatCodes)
+	if len(opts.Columns) > 0 {
+		if fieldCount != 0 && fieldCount != len(opts.Columns) {
+			return CopyTextOptions{}, 0, fmt.Errorf("copy has %d columns but %d Columns are named", fieldCount, len(opts.Columns))
+		}
+		fieldCount = len(opts.Columns)
+	}
+
+	return *opts, fieldCount, nil
+}
+
+// CopyTextWriter writes rows in the COPY text or CSV format. The encoded data is written to an underlying writer
+// such as a CopyFromWriter. Field values must already be in the text format of their column's type.
+type CopyTextWriter struct {
+	w          io.Writer
+	opts       CopyTextOptions
+	fieldCount int
+	forceQuote []bool
+	buf        []byte
+
+	headerWritten bool
+}
+
+// NewCopyTextWriter returns a CopyTextWriter that writes to w. overallFormat and columnFormatCodes are the formats of
+// the copy as sent in the server's CopyInResponse or CopyOutResponse. An error is returned if they are not text or if
+// opts is invalid. If opts is nil the text format defaults are used.
+func NewCopyTextWriter(w io.Writer, overallFormat byte, columnFormatCodes []uint16, opts *CopyTextOptions) (*CopyTextWriter, error) {
+	o, fieldCount, err := newCopyTextOptions(opts, overallFormat, columnFormatCodes)
+	if err != nil {
+		return nil, err
+	}
+	if o.Header && len(o.Columns) == 0 {
+		return nil, errors.New("writing a header requires Columns")
+	}
+
+	forceQuote, err := o.columnFlags(o.ForceQuote)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CopyTextWriter{w: w, opts: o, fieldCount: fieldCount, forceQuote: forceQuote, headerWritten: !o.Header}, nil
+}
+
+// WriteRow writes a row. A nil value is written as NULL.
+func (cw *CopyTextWriter) WriteRow(values [][]byte) error {
+	if cw.fieldCount != 0 && len(values) != cw.fieldCount {
+		return fmt.Errorf("row has %d fields, copy has %d columns", len(values), cw.fieldCount)
+	}
+
+	buf := cw.buf[:0]
+	if !cw.headerWritten {
+		buf = cw.appendHeader(buf)
+	}
+
+	for i, v := range values {
+		if i > 0 {
+			buf = append(buf, cw.opts.Delimiter)
+		}
+		if v == nil {
+			buf = append(buf, cw.opts.Null...)
+			continue
+		}
+		if cw.opts.CSV {
+			forceQuote := i < len(cw.forceQuote) && cw.forceQuote[i]
+			buf = cw.appendCSVValue(buf, v, forceQuote || (len(values) == 1 && string(v) == `\.`))
+		} else {
+			buf = cw.appendTextValue(buf, v)
+		}
+	}
+	buf = append(buf, '\n')
+	cw.buf = buf
+
+	_, err := cw.w.Write(buf)
+	if err != nil {
+		return err
+	}
+	cw.headerWritten = true
+	return nil
+}
+
+// Close writes the header if it has not been written yet because no rows were written. Close does not close the
+// underlying writer.
+func (cw *CopyTextWriter) Close() error {
+	if cw.headerWritten {
+		return nil
+	}
+
+	_, err := cw.w.Write(cw.appendHeader(cw.buf[:0]))
+	if err != nil {
+		return err
+	}
+	cw.headerWritten = true
+	return nil
+}
+
+func (cw *CopyTextWriter) appendHeader(dst []byte) []byte {
+	for i, name := range cw.opts.Columns {
+		if i > 0 {
+			dst = append(dst, cw.opts.Delimiter)
+		}
+		if cw.opts.CSV {
+			dst = cw.appendCSVValue(dst, []byte(name), false)
+		} else {
+			dst = cw.appendTextValue(dst, []byte(name))
+		}
+	}
+	return append(dst, '\n')
+}
+
+// appendTextValue appends v with the backslash escapes of the text format.
+func (cw *CopyTextWriter) appendTextValue(dst []byte, v []byte) []byte {
+	for _, c := range v {
+		switch c {
+		case '\\':
+			dst = append(dst, '\\', '\\')
+		case '\b':
+			dst = append(dst, '\\', 'b')
+		case '\f':
+			dst = append(dst, '\\', 'f')
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		case '\t':
+			dst = append(dst, '\\', 't')
+		case '\v':
+			dst = append(dst, '\\', 'v')
+		default:
+			if c == cw.opts.Delimiter {
+				dst = append(dst, '\\')
+			}
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+// appendCSVValue appends v. It is quoted if forceQuote is true or if it could otherwise be misread.
+func (cw *CopyTextWriter) appendCSVValue(dst []byte, v []byte, forceQuote bool) []byte {
+	o := &cw.opts
+
+	quote := forceQuote || string(v) == o.Null
+	if !quote {
+		for _, c := range v {
+			if c == o.Delimiter || c == o.Quote || c == '\n' || c == '\r' {
+				quote = true
+				break
+			}
+		}
+	}
+	if !quote {
+		return append(dst, v...)
+	}
+
+	dst = append(dst, o.Quote)
+	for _, c := range v {
+		if c == o.Quote || c == o.Escape {
+			dst = append(dst, o.Escape)
+		}
+		dst = append(dst, c)
+	}
+	return append(dst, o.Quote)
+}
+
+// CopyTextReader reads rows in the COPY text or CSV format from an underlying reader such as a CopyToReader.
+type CopyTextReader struct {
+	r            *bufio.Reader
+	opts         CopyTextOptions
+	fieldCount   int
+	forceNotNull []bool
+	forceNull    []bool
+
+	headerSkipped bool
+	done          bool
+
+	line   []byte
+	buf    []byte
+	values [][]byte
+}
+
+// NewCopyTextReader returns a CopyTextReader that reads from r. overallFormat and columnFormatCodes are the formats
+// of the copy as sent in the server's CopyOutResponse or CopyInResponse. An error is returned if they are not text or
+// if opts is invalid. If opts is nil the text format defaults are used.
+func NewCopyTextReader(r io.Reader, overallFormat byte, columnFormatCodes []uint16, opts *CopyTextOptions) (*CopyTextReader, error) {
+	o, fieldCount, err := newCopyTextOptions(opts, overallFormat, columnFormatCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	forceNotNull, err := o.columnFlags(o.ForceNotNull)
+	if err != nil {
+		return nil, err
+	}
+	forceNull, err := o.columnFlags(o.ForceNull)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CopyTextReader{
+		r:             bufio.NewReader(r),
+		opts:          o,
+		fieldCount:    fieldCount,
+		forceNotNull:  forceNotNull,
+		forceNull:     forceNull,
+		headerSkipped: !o.Header,
+	}, nil
+}
+
+// ReadRow reads the next row. A NULL is returned as a nil value. The returned values are only valid until the next
+// call to ReadRow. It returns io.EOF at the end of the data or at the end-of-data marker `\.`.
+func (cr *CopyTextReader) ReadRow() ([][]byte, error) {
+	for {
+		if cr.done {
+			return nil, io.EOF
+		}
+
+		record, err := cr.readRecord()
+		if err != nil {
+			if err == io.EOF {
+				cr.done = true
+			}
+			return nil, err
+		}
+
+		if string(record) == `\.` {
+			cr.done = true
+			return nil, io.EOF
+		}
+
+		if !cr.headerSkipped {
+			cr.headerSkipped = true
+			continue
+		}
+
+		var values [][]byte
+		if cr.opts.CSV {
+			values, err = cr.parseCSV(record)
+		} else {
+			values, err = cr.parseText(record)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cr.fieldCount != 0 && len(values) != cr.fieldCount {
+			return nil, fmt.Errorf("row has %d fields, copy has %d columns", len(values), cr.fieldCount)
+		}
+		return values, nil
+	}
+}
+
+// readRecord reads the next line without its line ending. In CSV a quoted value can contain line endings so a record
+// can span several lines.
+func (cr *CopyTextReader) readRecord() ([]byte, error) {
+	line := cr.line[:0]
+	inQuote := false
+	for {
+		start := len(line)
+		eof := false
+		for {
+			part, err := cr.r.ReadSlice('\n')
+			line = append(line, part...)
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				cr.line = line
+				return nil, err
+			}
+			break
+		}
+		if eof && len(line) == 0 {
+			return nil, io.EOF
+		}
+
+		if cr.opts.CSV {
+			inQuote = cr.scanCSVQuotes(line[start:], inQuote)
+			if inQuote {
+				if eof {
+					cr.line = line
+					return nil, io.ErrUnexpectedEOF
+				}
+				continue
+			}
+		}
+		break
+	}
+	cr.line = line
+
+	line = bytes.TrimSuffix(line, []byte{'\n'})
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	return line, nil
+}
+
+// scanCSVQuotes returns whether the end of part is inside a quoted value. inQuote is whether the start of part is.
+func (cr *CopyTextReader) scanCSVQuotes(part []byte, inQuote bool) bool {
+	o := &cr.opts
+	for i := 0; i < len(part); i++ {
+		c := part[i]
+		if !inQuote {
+			if c == o.Quote {
+				inQuote = true
+			}
+			continue
+		}
+
+		if c == o.Escape && i+1 < len(part) && (part[i+1] == o.Quote || part[i+1] == o.Escape) {
+			i++
+			continue
+		}
+		if c == o.Quote {
+			inQuote = false
+		}
+	}
+	return inQuote
+}
+
+// parseText splits record into values and removes backslash escapes.
+func (cr *CopyTextReader) parseText(record []byte) ([][]byte, error) {
+	// Values are never longer than the record so the buffer is not reallocated while values refer to it.
+	buf := cr.buf[:0]
+	if cap(buf) < len(record) {
+		buf = make([]byte, 0, len(record))
+	}
+	values := cr.values[:0]
+
+	fieldStart := 0
+	for i := 0; i <= len(record); i++ {
+		if i < len(record) && record[i] == '\\' {
+			// A trailing backslash is reported by appendUnescapedText.
+			if i+1 < len(record) {
+				i++
+			}
+			continue
+		}
+		if i < len(record) && record[i] != cr.opts.Delimiter {
+			continue
+		}
+
+		raw := record[fieldStart:i]
+		fieldStart = i + 1
+		if string(raw) == cr.opts.Null {
+			values = append(values, nil)
+			continue
+		}
+
+		start := len(buf)
+		var err error
+		buf, err = appendUnescapedText(buf, raw)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, buf[start:len(buf):len(buf)])
+	}
+
+	cr.buf = buf
+	cr.values = values
+	return values, nil
+}
+
+// appendUnescapedText appends raw with the backslash escapes of the text format removed.
+func appendUnescapedText(dst []byte, raw []byte) ([]byte, error) {
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if c != '\\' {
+			dst = append(dst, c)
+			continue
+		}
+
+		i++
+		if i == len(raw) {
+			return nil, errors.New("COPY text value ends with a backslash")
+		}
+		c = raw[i]
+		switch {
+		case c == 'b':
+			dst = append(dst, '\b')
+		case c == 'f':
+			dst = append(dst, '\f')
+		case c == 'n':
+			dst = append(dst, '\n')
+		case c == 'r':
+			dst = append(dst, '\r')
+		case c == 't':
+			dst = append(dst, '\t')
+		case c == 'v':
+			dst = append(dst, '\v')
+		case c >= '0' && c <= '7':
+			n := c - '0'
+			for j := 0; j < 2 && i+1 < len(raw) && raw[i+1] >= '0' && raw[i+1] <= '7'; j++ {
+				i++
+				n = n*8 + raw[i] - '0'
+			}
+			dst = append(dst, n)
+		case c == 'x' && i+1 < len(raw) && isHexDigit(raw[i+1]):
+			i++
+			n := hexValue(raw[i])
+			if i+1 < len(raw) && isHexDigit(raw[i+1]) {
+				i++
+				n = n*16 + hexValue(raw[i])
+			}
+			dst = append(dst, n)
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst, nil
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexValue(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	default:
+		return c - '0'
+	}
+}
+
+// parseCSV splits record into values and removes quoting.
+func (cr *CopyTextReader) parseCSV(record []byte) ([][]byte, error) {
+	o := &cr.opts
+
+	// Values are never longer than the record so the buffer is not reallocated while values refer to it.
+	buf := cr.buf[:0]
+	if cap(buf) < len(record) {
+		buf = make([]byte, 0, len(record))
+	}
+	values := cr.values[:0]
+
+	i := 0
+	for {
+		column := len(values)
+		start := len(buf)
+		sawQuote := false
+		inQuote := false
+
+		for ; i < len(record); i++ {
+			c := record[i]
+			if !inQuote {
+				if c == o.Delimiter {
+					break
+				}
+				if c == o.Quote {
+					inQuote = true
+					sawQuote = true
+					continue
+				}
+				buf = append(buf, c)
+				continue
+			}
+
+			if c == o.Escape && i+1 < len(record) && (record[i+1] == o.Quote || record[i+1] == o.Escape) {
+				i++
+				buf = append(buf, record[i])
+				continue
+			}
+			if c == o.Quote {
+				inQuote = false
+				continue
+			}
+			buf = append(buf, c)
+		}
+		if inQuote {
+			return nil, errors.New("unterminated CSV quoted field")
+		}
+
+		value := buf[start:len(buf):len(buf)]
+		isNull := string(value) == o.Null && (!sawQuote || (column < len(cr.forceNull) && cr.forceNull[column]))
+		if column < len(cr.forceNotNull) && cr.forceNotNull[column] {
+			isNull = false
+		}
+		if isNull {
+			values = append(values, nil)
+		} else {
+			values = append(values, value)
+		}
+
+		if i == len(record) {
+			break
+		}
+		i++ // delimiter
+	}
+
+	cr.buf = buf
+	cr.values = values
+	return values, nil
+}
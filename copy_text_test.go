@@ -0,0 +1,189 @@
+package pgproto3_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAllTextRows(t *testing.T, data string, columnFormatCodes []uint16, opts *pgproto3.CopyTextOptions) [][]*string {
+	cr, err := pgproto3.NewCopyTextReader(strings.NewReader(data), pgproto3.TextFormat, columnFormatCodes, opts)
+	require.NoError(t, err)
+
+	var rows [][]*string
+	for {
+		values, err := cr.ReadRow()
+		if err == io.EOF {
+			return rows
+		}
+		require.NoError(t, err)
+
+		row := make([]*string, len(values))
+		for i, v := range values {
+			if v != nil {
+				s := string(v)
+				row[i] = &s
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+func str(s string) *string { return &s }
+
+func TestCopyTextWriterText(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	cw, err := pgproto3.NewCopyTextWriter(&buf, pgproto3.TextFormat, []uint16{0, 0, 0}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, cw.WriteRow([][]byte{[]byte("a\tb"), nil, []byte("back\\slash\nnew line")}))
+	require.NoError(t, cw.WriteRow([][]byte{{}, []byte(`\N`), []byte("x")}))
+	require.NoError(t, cw.Close())
+
+	assert.Equal(t, "a\\tb\t\\N\tback\\\\slash\\nnew line\n\t\\\\N\tx\n", buf.String())
+	assert.Error(t, cw.WriteRow([][]byte{[]byte("a")}))
+}
+
+func TestCopyTextReaderText(t *testing.T) {
+	t.Parallel()
+
+	data := "a\\tb\t\\N\tback\\\\slash\\nnew line\n" +
+		"\t\\\\N\t\\101\\x42\\q\r\n" +
+		"\\.\n" +
+		"ignored\tafter\tend\n"
+	rows := readAllTextRows(t, data, []uint16{0, 0, 0}, nil)
+	assert.Equal(t, [][]*string{
+		{str("a\tb"), nil, str("back\\slash\nnew line")},
+		{str(""), str(`\N`), str("ABq")},
+	}, rows)
+}
+
+func TestCopyTextReaderErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, data := range []string{"a\tb\n", "a\\\n"} {
+		cr, err := pgproto3.NewCopyTextReader(strings.NewReader(data), pgproto3.TextFormat, []uint16{0}, nil)
+		require.NoError(t, err)
+		_, err = cr.ReadRow()
+		assert.Error(t, err, data)
+		assert.NotEqual(t, io.EOF, err, data)
+	}
+}
+
+func TestCopyTextOptions(t *testing.T) {
+	t.Parallel()
+
+	opts := pgproto3.CopyTextDefaults()
+	opts.Delimiter = '|'
+	opts.Null = "NULL"
+	opts.Header = true
+	opts.Columns = []string{"id", "na|me"}
+
+	var buf bytes.Buffer
+	cw, err := pgproto3.NewCopyTextWriter(&buf, pgproto3.TextFormat, nil, opts)
+	require.NoError(t, err)
+	require.NoError(t, cw.WriteRow([][]byte{[]byte("1"), nil}))
+	assert.Equal(t, "id|na\\|me\n1|NULL\n", buf.String())
+
+	rows := readAllTextRows(t, buf.String(), nil, opts)
+	assert.Equal(t, [][]*string{{str("1"), nil}}, rows)
+
+	invalid := []*pgproto3.CopyTextOptions{
+		{Delimiter: 'a', Null: `\N`},
+		{Delimiter: '\n'},
+		{Delimiter: ',', Null: "a,b"},
+		{Delimiter: '\t', Quote: '"'},
+		{Delimiter: '\t', ForceNull: []string{"a"}, Columns: []string{"a"}},
+		{CSV: true, Delimiter: ','},
+		{CSV: true, Delimiter: '"', Quote: '"', Escape: '"'},
+		{CSV: true, Delimiter: ',', Quote: '"', Escape: '"', ForceQuote: []string{"missing"}},
+	}
+	for _, opts := range invalid {
+		_, err := pgproto3.NewCopyTextReader(&buf, pgproto3.TextFormat, nil, opts)
+		assert.Error(t, err, "%+v", opts)
+	}
+
+	_, err = pgproto3.NewCopyTextWriter(&buf, pgproto3.BinaryFormat, nil, nil)
+	assert.Error(t, err)
+	_, err = pgproto3.NewCopyTextWriter(&buf, pgproto3.TextFormat, []uint16{0, 1}, nil)
+	assert.Error(t, err)
+	_, err = pgproto3.NewCopyTextWriter(&buf, pgproto3.TextFormat, nil, &pgproto3.CopyTextOptions{Delimiter: '\t', Header: true})
+	assert.Error(t, err)
+}
+
+func TestCopyTextWriterCSV(t *testing.T) {
+	t.Parallel()
+
+	opts := pgproto3.CopyCSVDefaults()
+	opts.Header = true
+	opts.Columns = []string{"a", "b", "c"}
+	opts.ForceQuote = []string{"c"}
+
+	var buf bytes.Buffer
+	cw, err := pgproto3.NewCopyTextWriter(&buf, pgproto3.TextFormat, []uint16{0, 0, 0}, opts)
+	require.NoError(t, err)
+	require.NoError(t, cw.WriteRow([][]byte{[]byte("plain"), []byte(`say "hi", bye`), []byte("x")}))
+	require.NoError(t, cw.WriteRow([][]byte{nil, {}, nil}))
+	require.NoError(t, cw.WriteRow([][]byte{[]byte("multi\nline"), []byte("b"), []byte("c")}))
+
+	assert.Equal(t, "a,b,c\n"+
+		`plain,"say ""hi"", bye","x"`+"\n"+
+		`,"",`+"\n"+
+		"\"multi\nline\",b,\"c\"\n", buf.String())
+}
+
+func TestCopyTextReaderCSV(t *testing.T) {
+	t.Parallel()
+
+	opts := pgproto3.CopyCSVDefaults()
+	opts.Header = true
+
+	data := "a,b,c\n" +
+		`plain,"say ""hi"", bye","x"` + "\n" +
+		`,"",` + "\r\n" +
+		"\"multi\nline\",b,c\n" +
+		`mi"xed, quo"ting,,` + "\n"
+	rows := readAllTextRows(t, data, []uint16{0, 0, 0}, opts)
+	assert.Equal(t, [][]*string{
+		{str("plain"), str(`say "hi", bye`), str("x")},
+		{nil, str(""), nil},
+		{str("multi\nline"), str("b"), str("c")},
+		{str("mixed, quoting"), nil, nil},
+	}, rows)
+
+	cr, err := pgproto3.NewCopyTextReader(strings.NewReader("\"unterminated\n"), pgproto3.TextFormat, nil, opts)
+	require.NoError(t, err)
+	_, err = cr.ReadRow()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestCopyTextCSVEscapeAndForceOptions(t *testing.T) {
+	t.Parallel()
+
+	opts := pgproto3.CopyCSVDefaults()
+	opts.Escape = '\\'
+	opts.Null = "NULL"
+	opts.Columns = []string{"a", "b", "c"}
+	opts.ForceNotNull = []string{"a"}
+	opts.ForceNull = []string{"b"}
+
+	var buf bytes.Buffer
+	cw, err := pgproto3.NewCopyTextWriter(&buf, pgproto3.TextFormat, nil, opts)
+	require.NoError(t, err)
+	require.NoError(t, cw.WriteRow([][]byte{[]byte(`q"b\s`), []byte("NULL"), nil}))
+	assert.Equal(t, `"q\"b\\s","NULL",NULL`+"\n", buf.String())
+
+	data := buf.String() + `NULL,"NULL","NULL"` + "\n"
+	rows := readAllTextRows(t, data, nil, opts)
+	assert.Equal(t, [][]*string{
+		{str(`q"b\s`), nil, nil},
+		{str("NULL"), nil, str("NULL")},
+	}, rows)
+}
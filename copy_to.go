@@ -0,0 +1,183 @@
+package pgproto3
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// CopyToReader streams the data of a COPY ... TO STDOUT statement from the server. It is created by
+// Frontend.BeginCopyTo. Read returns the payloads of the CopyData messages in order and returns io.EOF when the copy
+// has completed successfully. If the server reports an error the error is returned by Read as an *ErrorResponse.
+//
+// The Frontend must not be used for anything else until Read has returned an error or Close has returned.
+type CopyToReader struct {
+	f        *Frontend
+	ctx      context.Context
+	response CopyOutResponse
+
+	data []byte // unread part of the current CopyData
+	done bool   // ReadyForQuery has been received
+
+	serverErr *ErrorResponse
+	err       error // error that prevents receiving the rest of the copy
+	tag       []byte
+}
+
+// BeginCopyTo sends sql, which must be a COPY ... TO STDOUT statement, and waits for the server to start the copy.
+// ctx applies to the whole copy. The server can not be told to stop a copy out, so if ctx is done the Frontend is left
+// in the middle of the copy and the caller must continue receiving until ReadyForQuery before using it again.
+//
+// If the server reports an error instead of starting the copy it is returned as an *ErrorResponse and the Frontend is
+// ready for the next query.
+func (f *Frontend) BeginCopyTo(ctx context.Context, sql string) (*CopyToReader, error) {
+	err := f.Send(&Query{String: sql})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		msg, err := f.ReceiveContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg := msg.(type) {
+		case *CopyOutResponse:
+			r := &CopyToReader{
+				f:   f,
+				ctx: ctx,
+				response: CopyOutResponse{
+					OverallFormat:     msg.OverallFormat,
+					ColumnFormatCodes: append([]uint16(nil), msg.ColumnFormatCodes...),
+				},
+			}
+			return r, nil
+		case *ErrorResponse:
+			errResp := *msg
+			if err := f.receiveReadyForQuery(ctx); err != nil {
+				return nil, err
+			}
+			return nil, &errResp
+		case *NoticeResponse, *ParameterStatus, *NotificationResponse:
+		default:
+			if err := f.receiveReadyForQuery(ctx); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("query is not COPY TO STDOUT: received %T", msg)
+		}
+	}
+}
+
+// CopyTo runs sql, which must be a COPY ... TO STDOUT statement, and calls fn with the payload of each CopyData
+// message. The data passed to fn is only valid until fn returns. It returns the number of rows copied.
+//
+// If fn returns an error the rest of the copy is received and discarded and the error is returned.
+func (f *Frontend) CopyTo(ctx context.Context, sql string, fn func(data []byte) error) (int64, error) {
+	r, err := f.BeginCopyTo(ctx, sql)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		data, err := r.next()
+		if err == io.EOF {
+			return r.Rows(), nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if err := fn(data); err != nil {
+			if closeErr := r.Close(); closeErr != nil {
+				if _, ok := closeErr.(*ErrorResponse); !ok {
+					return 0, closeErr
+				}
+			}
+			return 0, err
+		}
+	}
+}
+
+// Response returns the CopyOutResponse the server started the copy with. It describes the format of the data the
+// server sends.
+func (r *CopyToReader) Response() *CopyOutResponse {
+	return &r.response
+}
+
+// Read reads the copy data sent by the server. It returns io.EOF when the copy has completed successfully.
+func (r *CopyToReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		data, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+		r.data = data
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// next returns the payload of the next CopyData message. It returns io.EOF when the copy has completed successfully
+// and the server is ready for the next query.
+func (r *CopyToReader) next() ([]byte, error) {
+	for {
+		if r.err != nil {
+			return nil, r.err
+		}
+		if r.done {
+			if r.serverErr != nil {
+				return nil, r.serverErr
+			}
+			return nil, io.EOF
+		}
+
+		msg, err := r.f.ReceiveContext(r.ctx)
+		if err != nil {
+			r.err = err
+			return nil, err
+		}
+
+		switch msg := msg.(type) {
+		case *CopyData:
+			if len(msg.Data) > 0 {
+				return msg.Data, nil
+			}
+		case *CopyDone:
+		case *CommandComplete:
+			r.tag = append([]byte(nil), msg.CommandTag...)
+		case *ErrorResponse:
+			if r.serverErr == nil {
+				errResp := *msg
+				r.serverErr = &errResp
+			}
+		case *ReadyForQuery:
+			r.done = true
+		case *NoticeResponse, *ParameterStatus, *NotificationResponse:
+		default:
+			r.err = fmt.Errorf("unexpected message during COPY TO STDOUT: %T", msg)
+		}
+	}
+}
+
+// Rows returns the number of rows copied. It is only valid after Read has returned io.EOF.
+func (r *CopyToReader) Rows() int64 {
+	return parseCommandTagRows(r.tag)
+}
+
+// Close discards the rest of the copy and waits for the server to be ready for the next query. It returns the error
+// that ended the copy, if any.
+func (r *CopyToReader) Close() error {
+	r.data = nil
+	for {
+		_, err := r.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package pgproto3_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startCopyOutServer starts a server for a single COPY TO STDOUT that sends rows. If failAfter is positive the server
+// reports an error after sending that many rows.
+func startCopyOutServer(t *testing.T, rows []string, failAfter int) (*pgproto3.Frontend, chan error) {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		backend := pgproto3.NewBackend(pgproto3.NewChunkReader(serverConn), serverConn)
+		done <- func() error {
+			msg, err := backend.Receive()
+			if err != nil {
+				return err
+			}
+			query, ok := msg.(*pgproto3.Query)
+			if !ok {
+				return errors.New("expected Query")
+			}
+
+			var buf []byte
+			if !strings.Contains(query.String, "to stdout") {
+				buf, _ = (&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601", Message: "not a copy"}).Encode(buf)
+				buf, _ = (&pgproto3.ReadyForQuery{TxStatus: 'I'}).Encode(buf)
+				_, err = serverConn.Write(buf)
+				return err
+			}
+
+			buf, _ = (&pgproto3.CopyOutResponse{OverallFormat: 0, ColumnFormatCodes: []uint16{0, 0}}).Encode(buf)
+			for i, row := range rows {
+				if i == failAfter && failAfter > 0 {
+					buf, _ = (&pgproto3.ErrorResponse{Severity: "ERROR", Code: "57014", Message: "canceling statement due to user request"}).Encode(buf)
+					buf, _ = (&pgproto3.ReadyForQuery{TxStatus: 'I'}).Encode(buf)
+					_, err = serverConn.Write(buf)
+					return err
+				}
+				buf, _ = (&pgproto3.CopyData{Data: []byte(row)}).Encode(buf)
+			}
+			buf, _ = (&pgproto3.CopyDone{}).Encode(buf)
+			buf, _ = (&pgproto3.CommandComplete{CommandTag: []byte("COPY " + strconv.Itoa(len(rows)))}).Encode(buf)
+			buf, _ = (&pgproto3.ReadyForQuery{TxStatus: 'I'}).Encode(buf)
+			_, err = serverConn.Write(buf)
+			return err
+		}()
+	}()
+
+	return pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn), done
+}
+
+func TestFrontendBeginCopyTo(t *testing.T) {
+	t.Parallel()
+
+	rows := []string{"1\ta\n", "2\tb\n", "3\tc\n"}
+	frontend, done := startCopyOutServer(t, rows, 0)
+
+	r, err := frontend.BeginCopyTo(context.Background(), "copy t to stdout")
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{0, 0}, r.Response().ColumnFormatCodes)
+
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Join(rows, ""), string(data))
+	assert.EqualValues(t, 3, r.Rows())
+	require.NoError(t, r.Close())
+	require.NoError(t, <-done)
+}
+
+func TestFrontendBeginCopyToServerError(t *testing.T) {
+	t.Parallel()
+
+	frontend, done := startCopyOutServer(t, []string{"1\n", "2\n", "3\n"}, 2)
+
+	r, err := frontend.BeginCopyTo(context.Background(), "copy t to stdout")
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadAll(r)
+	assert.Equal(t, "1\n2\n", string(data))
+	var errResp *pgproto3.ErrorResponse
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "57014", errResp.Code)
+	assert.Equal(t, errResp, r.Close())
+	require.NoError(t, <-done)
+}
+
+func TestFrontendBeginCopyToNotCopy(t *testing.T) {
+	t.Parallel()
+
+	frontend, done := startCopyOutServer(t, nil, 0)
+
+	_, err := frontend.BeginCopyTo(context.Background(), "select 1")
+	var errResp *pgproto3.ErrorResponse
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "42601", errResp.Code)
+	require.NoError(t, <-done)
+}
+
+func TestFrontendCopyTo(t *testing.T) {
+	t.Parallel()
+
+	rows := []string{"1\ta\n", "2\tb\n", "3\tc\n"}
+	frontend, done := startCopyOutServer(t, rows, 0)
+
+	var received []string
+	n, err := frontend.CopyTo(context.Background(), "copy t to stdout", func(data []byte) error {
+		received = append(received, string(data))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, n)
+	assert.Equal(t, rows, received)
+	require.NoError(t, <-done)
+}
+
+func TestFrontendCopyToCallbackError(t *testing.T) {
+	t.Parallel()
+
+	frontend, done := startCopyOutServer(t, []string{"1\n", "2\n", "3\n"}, 0)
+
+	errStop := errors.New("stop")
+	calls := 0
+	_, err := frontend.CopyTo(context.Background(), "copy t to stdout", func(data []byte) error {
+		calls++
+		return errStop
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, 1, calls)
+	// The server's write only completes when the rest of the copy has been received.
+	require.NoError(t, <-done)
+}
@@ -32,6 +32,11 @@ type ErrorResponse struct {
 // Backend identifies this message as sendable by the PostgreSQL backend.
 func (*ErrorResponse) Backend() {}
 
+// Error implements the error interface so an ErrorResponse received from the server can be returned as an error.
+func (e *ErrorResponse) Error() string {
+	return e.Severity + ": " + e.Message + " (SQLSTATE " + e.Code + ")"
+}
+
 // Decode decodes src into dst. src must contain the complete message with the exception of the initial 1 byte message
 // type identifier and 4 byte message length.
 func (dst *ErrorResponse) Decode(src []byte) error {
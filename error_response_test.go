@@ -0,0 +1,23 @@
+package pgproto3_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorResponseError(t *testing.T) {
+	t.Parallel()
+
+	var err error = &pgproto3.ErrorResponse{Severity: "ERROR", Code: "42P01", Message: `relation "users" does not exist`}
+	assert.Equal(t, `ERROR: relation "users" does not exist (SQLSTATE 42P01)`, err.Error())
+
+	wrapped := fmt.Errorf("query failed: %w", err)
+	var errResp *pgproto3.ErrorResponse
+	require.True(t, errors.As(wrapped, &errResp))
+	assert.Equal(t, "42P01", errResp.Code)
+}
@@ -0,0 +1,153 @@
+package pgproto3
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgio"
+)
+
+// LookupFunction returns the OID of the function name. name is either a function name, which must not be overloaded,
+// or a signature such as "lo_lseek64(integer, bigint, integer)". The name may be schema qualified.
+//
+// If the function does not exist the server's error is returned as an *ErrorResponse and the Frontend is ready for
+// the next query.
+func (f *Frontend) LookupFunction(ctx context.Context, name string) (uint32, error) {
+	query := "select $1::regproc::oid"
+	if strings.Contains(name, "(") {
+		query = "select $1::regprocedure::oid"
+	}
+
+	err := f.sendBatch(&Parse{Query: query}, &Bind{Parameters: [][]byte{[]byte(name)}}, &Execute{}, &Sync{})
+	if err != nil {
+		return 0, err
+	}
+
+	var oid uint32
+	var found bool
+	var errResp *ErrorResponse
+	for {
+		msg, err := f.ReceiveContext(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		switch msg := msg.(type) {
+		case *DataRow:
+			if len(msg.Values) == 1 && msg.Values[0] != nil {
+				n, err := strconv.ParseUint(string(msg.Values[0]), 10, 32)
+				if err == nil {
+					oid = uint32(n)
+					found = true
+				}
+			}
+		case *ErrorResponse:
+			if errResp == nil {
+				e := *msg
+				errResp = &e
+			}
+		case *ReadyForQuery:
+			switch {
+			case errResp != nil:
+				return 0, errResp
+			case !found:
+				return 0, fmt.Errorf("function %s: server did not return an OID", name)
+			}
+			return oid, nil
+		}
+	}
+}
+
+// CallFunction calls the function with the OID function with the function call sub-protocol, also known as the
+// fast-path interface, and returns its result in resultFormat (0 for text or 1 for binary). A NULL result is nil.
+//
+// The type of each argument selects how it is sent: nil is NULL; int16, int32, int64, uint32 (an OID), float32,
+// float64 and bool are sent in binary format as smallint, integer, bigint, oid, real, double precision and boolean;
+// []byte is sent in binary format, as a bytea; string is sent in text format. The arguments must match the types the
+// function expects as the server does not convert them.
+//
+// If the server reports an error it is returned as an *ErrorResponse and the Frontend is ready for the next query.
+func (f *Frontend) CallFunction(ctx context.Context, function uint32, resultFormat int16, args ...interface{}) ([]byte, error) {
+	msg := &FunctionCall{
+		Function:         function,
+		ArgFormatCodes:   make([]uint16, len(args)),
+		Arguments:        make([][]byte, len(args)),
+		ResultFormatCode: uint16(resultFormat),
+	}
+	for i, arg := range args {
+		var err error
+		msg.ArgFormatCodes[i], msg.Arguments[i], err = encodeFunctionArg(arg)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i+1, err)
+		}
+	}
+
+	err := f.Send(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []byte
+	var errResp *ErrorResponse
+	for {
+		msg, err := f.ReceiveContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg := msg.(type) {
+		case *FunctionCallResponse:
+			if msg.Result != nil {
+				result = append([]byte{}, msg.Result...)
+			}
+		case *ErrorResponse:
+			e := *msg
+			errResp = &e
+		case *ReadyForQuery:
+			if errResp != nil {
+				return nil, errResp
+			}
+			return result, nil
+		case *NoticeResponse, *ParameterStatus, *NotificationResponse:
+		default:
+			return nil, fmt.Errorf("unexpected message in function call: %T", msg)
+		}
+	}
+}
+
+// encodeFunctionArg returns the format code and encoding of arg.
+func encodeFunctionArg(arg interface{}) (uint16, []byte, error) {
+	switch arg := arg.(type) {
+	case nil:
+		return 0, nil, nil
+	case int16:
+		return 1, pgio.AppendInt16(nil, arg), nil
+	case int32:
+		return 1, pgio.AppendInt32(nil, arg), nil
+	case int64:
+		return 1, pgio.AppendInt64(nil, arg), nil
+	case uint32:
+		return 1, pgio.AppendUint32(nil, arg), nil
+	case float32:
+		return 1, pgio.AppendUint32(nil, math.Float32bits(arg)), nil
+	case float64:
+		return 1, pgio.AppendUint64(nil, math.Float64bits(arg)), nil
+	case bool:
+		if arg {
+			return 1, []byte{1}, nil
+		}
+		return 1, []byte{0}, nil
+	case []byte:
+		if arg == nil {
+			return 0, nil, nil
+		}
+		return 1, arg, nil
+	case string:
+		return 0, []byte(arg), nil
+	default:
+		return 0, nil, fmt.Errorf("unsupported type %T", arg)
+	}
+}
@@ -8,6 +8,9 @@ import (
 )
 
 // Frontend acts as a client for the PostgreSQL wire protocol version 3.
+//
+// A Frontend is not safe for concurrent use except that one goroutine may call Send while another calls Receive or
+// ReceiveContext. The protocol validator synchronizes its state and the transaction status is only set by Receive.
 type Frontend struct {
 	cr ChunkReader
 	w  io.Writer
@@ -48,9 +51,20 @@ type Frontend struct {
 	msgType    byte
 	partialMsg bool
 	authType   uint32
+	txStatus   byte
+
+	onNotice          func(*NoticeResponse)
+	onParameterStatus func(*ParameterStatus)
+	onNotification    func(*NotificationResponse)
+	consumeAsync      bool
+
+	validator *frontendValidator
+
+	readWatcher readWatcher
 }
 
-// NewFrontend creates a new Frontend.
+// NewFrontend creates a new Frontend. ReceiveContext requires w to be the connection cr reads from and to have a
+// SetReadDeadline method, as net.Conn does, unless SetReadDeadliner is called.
 func NewFrontend(cr ChunkReader, w io.Writer) *Frontend {
 	return &Frontend{cr: cr, w: w}
 }
@@ -61,10 +75,36 @@ func (f *Frontend) Send(msg FrontendMessage) error {
 	if err != nil {
 		return err
 	}
+
+	// The message is recorded before it is written because the response may be received as soon as it is written.
+	if f.validator != nil {
+		f.validator.sent(msg)
+	}
 	_, err = f.w.Write(buf)
 	return err
 }
 
+// sendBatch sends msgs in a single write. The backend may respond to the first messages before the rest are sent, so
+// sending them one at a time can deadlock on a connection without buffering.
+func (f *Frontend) sendBatch(msgs ...FrontendMessage) error {
+	var buf []byte
+	for _, msg := range msgs {
+		var err error
+		buf, err = msg.Encode(buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.validator != nil {
+		for _, msg := range msgs {
+			f.validator.sent(msg)
+		}
+	}
+	_, err := f.w.Write(buf)
+	return err
+}
+
 func translateEOFtoErrUnexpectedEOF(err error) error {
 	if err == io.EOF {
 		return io.ErrUnexpectedEOF
@@ -73,7 +113,29 @@ func translateEOFtoErrUnexpectedEOF(err error) error {
 }
 
 // Receive receives a message from the backend. The returned message is only valid until the next call to Receive.
+//
+// NoticeResponse, ParameterStatus and NotificationResponse are passed to the handlers set with SetOnNotice,
+// SetOnParameterStatus and SetOnNotification. If SetConsumeAsyncMessages is enabled they are not returned.
 func (f *Frontend) Receive() (BackendMessage, error) {
+	for {
+		msg, err := f.receive()
+		if err != nil {
+			return msg, err
+		}
+
+		if f.consumeAsync {
+			switch msg.(type) {
+			case *NoticeResponse, *ParameterStatus, *NotificationResponse:
+				continue
+			}
+		}
+		return msg, nil
+	}
+}
+
+// receive receives a message from the backend and calls the handler for an asynchronous message. It never consumes
+// the message.
+func (f *Frontend) receive() (BackendMessage, error) {
 	if !f.partialMsg {
 		header, err := f.cr.Next(5)
 		if err != nil {
@@ -152,7 +214,34 @@ func (f *Frontend) Receive() (BackendMessage, error) {
 	}
 
 	err = msg.Decode(msgBody)
-	return msg, err
+	if err != nil {
+		return msg, err
+	}
+
+	if f.validator != nil {
+		if err := f.validator.received(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	switch msg := msg.(type) {
+	case *NoticeResponse:
+		if f.onNotice != nil {
+			f.onNotice(msg)
+		}
+	case *ParameterStatus:
+		if f.onParameterStatus != nil {
+			f.onParameterStatus(msg)
+		}
+	case *NotificationResponse:
+		if f.onNotification != nil {
+			f.onNotification(msg)
+		}
+	case *ReadyForQuery:
+		f.txStatus = msg.TxStatus
+	}
+
+	return msg, nil
 }
 
 // Authentication message type constants.
@@ -208,3 +297,35 @@ func (f *Frontend) findAuthenticationMessageType(src []byte) (BackendMessage, er
 func (f *Frontend) GetAuthType() uint32 {
 	return f.authType
 }
+
+// TxStatus returns the transaction status of the last ReadyForQuery received: 'I' when idle, 'T' in a transaction
+// block or 'E' in a failed transaction block. It is 0 until the first ReadyForQuery has been received.
+func (f *Frontend) TxStatus() byte {
+	return f.txStatus
+}
+
+// SetOnNotice sets a function that is called with every NoticeResponse received. The message is only valid until the
+// function returns. A nil fn removes the handler.
+func (f *Frontend) SetOnNotice(fn func(*NoticeResponse)) {
+	f.onNotice = fn
+}
+
+// SetOnParameterStatus sets a function that is called with every ParameterStatus received. The message is only valid
+// until the function returns. A nil fn removes the handler.
+func (f *Frontend) SetOnParameterStatus(fn func(*ParameterStatus)) {
+	f.onParameterStatus = fn
+}
+
+// SetOnNotification sets a function that is called with every NotificationResponse received. The message is only
+// valid until the function returns. A nil fn removes the handler.
+func (f *Frontend) SetOnNotification(fn func(*NotificationResponse)) {
+	f.onNotification = fn
+}
+
+// SetConsumeAsyncMessages sets whether Receive consumes the asynchronous messages NoticeResponse, ParameterStatus and
+// NotificationResponse after passing them to their handlers instead of returning them. This leaves only the messages
+// that belong to the protocol flow. A NotificationDispatcher receives no notifications while it is enabled; use
+// SetOnNotification instead. Startup still records the ParameterStatus messages in its result.
+func (f *Frontend) SetConsumeAsyncMessages(consume bool) {
+	f.consumeAsync = consume
+}
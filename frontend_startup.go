@@ -0,0 +1,124 @@
+package pgproto3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// StartupConfig contains the parameters used by Frontend.Startup to establish a session.
+type StartupConfig struct {
+	// Parameters are sent in the StartupMessage. They must include "user" and usually include "database".
+	Parameters map[string]string
+
+	// Password is used to respond to cleartext, MD5 and SCRAM-SHA-256 authentication requests.
+	Password string
+
+	// NewGSSProvider returns the GSSProvider used to respond to a GSSAPI authentication request. It is called once for
+	// each request. If nil, GSSAPI authentication fails.
+	NewGSSProvider func() (GSSProvider, error)
+}
+
+// StartupResult contains the session state reported by the server during startup.
+type StartupResult struct {
+	ProcessID       uint32
+	SecretKey       uint32
+	ParameterStatus map[string]string
+	TxStatus        byte
+}
+
+// Startup sends a StartupMessage, performs authentication and reads messages until the server is ready for queries.
+// If the server rejects the connection the returned error is an *ErrorResponse.
+func (f *Frontend) Startup(config *StartupConfig) (*StartupResult, error) {
+	if _, ok := config.Parameters["user"]; !ok {
+		return nil, errors.New("startup parameters must include user")
+	}
+
+	err := f.Send(&StartupMessage{ProtocolVersion: ProtocolVersionNumber, Parameters: config.Parameters})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &StartupResult{ParameterStatus: make(map[string]string)}
+	var sc *scramClient
+	var gss *gssClient
+
+	for {
+		// The asynchronous messages are received even if they are consumed by Receive so ParameterStatus is recorded.
+		msg, err := f.receive()
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg := msg.(type) {
+		case *AuthenticationOk:
+			if gss != nil && !gss.provider.Done() {
+				return nil, errors.New("server completed authentication before the GSSAPI security context was established")
+			}
+		case *AuthenticationCleartextPassword:
+			err = f.Send(&PasswordMessage{Password: config.Password})
+		case *AuthenticationMD5Password:
+			err = f.Send(&PasswordMessage{Password: md5Password(config.Parameters["user"], config.Password, msg.Salt)})
+		case *AuthenticationSASL:
+			sc, err = newSCRAMClient(msg.AuthMechanisms, config.Password)
+			if err == nil {
+				err = f.Send(&SASLInitialResponse{AuthMechanism: scramSHA256Name, Data: sc.clientFirstMessage()})
+			}
+		case *AuthenticationSASLContinue:
+			if sc == nil {
+				return nil, errors.New("received AuthenticationSASLContinue before AuthenticationSASL")
+			}
+			err = sc.recvServerFirstMessage(msg.Data)
+			if err == nil {
+				err = f.Send(&SASLResponse{Data: sc.clientFinalMessage()})
+			}
+		case *AuthenticationSASLFinal:
+			if sc == nil {
+				return nil, errors.New("received AuthenticationSASLFinal before AuthenticationSASL")
+			}
+			err = sc.recvServerFinalMessage(msg.Data)
+		case *AuthenticationGSS:
+			var token []byte
+			gss, token, err = newGSSClient(config)
+			if err == nil {
+				err = f.Send(&GSSResponse{Data: token})
+			}
+		case *AuthenticationGSSContinue:
+			if gss == nil {
+				return nil, errors.New("received AuthenticationGSSContinue before AuthenticationGSS")
+			}
+			var token []byte
+			token, err = gss.continueAuth(msg.Data)
+			if err == nil && len(token) > 0 {
+				err = f.Send(&GSSResponse{Data: token})
+			}
+		case *BackendKeyData:
+			result.ProcessID = msg.ProcessID
+			result.SecretKey = msg.SecretKey
+		case *ParameterStatus:
+			result.ParameterStatus[msg.Name] = msg.Value
+		case *NoticeResponse:
+		case *ReadyForQuery:
+			result.TxStatus = msg.TxStatus
+			return result, nil
+		case *ErrorResponse:
+			errResp := *msg
+			return nil, &errResp
+		default:
+			return nil, fmt.Errorf("unexpected message during startup: %T", msg)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// md5Password computes the response to an AuthenticationMD5Password request.
+func md5Password(user, password string, salt [4]byte) string {
+	digest := md5.Sum([]byte(password + user))
+	inner := hex.EncodeToString(digest[:])
+	digest = md5.Sum(append([]byte(inner), salt[:]...))
+	return "md5" + hex.EncodeToString(digest[:])
+}
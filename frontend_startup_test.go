@@ -0,0 +1,169 @@
+package pgproto3_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrontendStartup(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	serverErrChan := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		backend := pgproto3.NewBackend(pgproto3.NewChunkReader(serverConn), serverConn)
+
+		msg, err := backend.ReceiveStartupMessage()
+		if err != nil {
+			serverErrChan <- err
+			return
+		}
+		if sm, ok := msg.(*pgproto3.StartupMessage); !ok || sm.Parameters["user"] != "jack" {
+			serverErrChan <- assert.AnError
+			return
+		}
+
+		backend.Send(&pgproto3.AuthenticationMD5Password{Salt: [4]byte{1, 2, 3, 4}})
+		backend.SetAuthType(pgproto3.AuthTypeMD5Password)
+		msg, err = backend.Receive()
+		if err != nil {
+			serverErrChan <- err
+			return
+		}
+		if pw, ok := msg.(*pgproto3.PasswordMessage); !ok || pw.Password != "md56478b3003505cc2b7c3cf5b2e47288ef" {
+			serverErrChan <- assert.AnError
+			return
+		}
+
+		backend.Send(&pgproto3.AuthenticationOk{})
+		backend.Send(&pgproto3.ParameterStatus{Name: "server_version", Value: "14.0"})
+		backend.Send(&pgproto3.BackendKeyData{ProcessID: 42, SecretKey: 7})
+		serverErrChan <- backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	}()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)
+	// ParameterStatus is recorded even when Receive consumes it.
+	frontend.SetConsumeAsyncMessages(true)
+	result, err := frontend.Startup(&pgproto3.StartupConfig{
+		Parameters: map[string]string{"user": "jack", "database": "test"},
+		Password:   "secret",
+	})
+	require.NoError(t, err)
+	require.NoError(t, <-serverErrChan)
+
+	assert.Equal(t, &pgproto3.StartupResult{
+		ProcessID:       42,
+		SecretKey:       7,
+		ParameterStatus: map[string]string{"server_version": "14.0"},
+		TxStatus:        'I',
+	}, result)
+}
+
+func TestFrontendStartupErrorResponse(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go func() {
+		defer serverConn.Close()
+		backend := pgproto3.NewBackend(pgproto3.NewChunkReader(serverConn), serverConn)
+		if _, err := backend.ReceiveStartupMessage(); err != nil {
+			return
+		}
+		backend.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "3D000", Message: `database "test" does not exist`})
+	}()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)
+	_, err := frontend.Startup(&pgproto3.StartupConfig{
+		Parameters: map[string]string{"user": "jack", "database": "test"},
+	})
+	require.Error(t, err)
+
+	errResp, ok := err.(*pgproto3.ErrorResponse)
+	require.True(t, ok)
+	assert.Equal(t, "3D000", errResp.Code)
+	assert.Equal(t, `FATAL: database "test" does not exist (SQLSTATE 3D000)`, err.Error())
+}
+
+func TestFrontendStartupCleartextPassword(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	serverErrChan := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		backend := pgproto3.NewBackend(pgproto3.NewChunkReader(serverConn), serverConn)
+
+		if _, err := backend.ReceiveStartupMessage(); err != nil {
+			serverErrChan <- err
+			return
+		}
+
+		backend.Send(&pgproto3.AuthenticationCleartextPassword{})
+		backend.SetAuthType(pgproto3.AuthTypeCleartextPassword)
+		msg, err := backend.Receive()
+		if err != nil {
+			serverErrChan <- err
+			return
+		}
+		if pw, ok := msg.(*pgproto3.PasswordMessage); !ok || pw.Password != "secret" {
+			serverErrChan <- assert.AnError
+			return
+		}
+
+		backend.Send(&pgproto3.AuthenticationOk{})
+		serverErrChan <- backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	}()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)
+	result, err := frontend.Startup(&pgproto3.StartupConfig{
+		Parameters: map[string]string{"user": "jack"},
+		Password:   "secret",
+	})
+	require.NoError(t, err)
+	require.NoError(t, <-serverErrChan)
+	assert.Equal(t, byte('I'), result.TxStatus)
+}
+
+func TestFrontendStartupRequiresUser(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)
+	_, err := frontend.Startup(&pgproto3.StartupConfig{Parameters: map[string]string{"database": "test"}})
+	require.Error(t, err)
+}
+
+func TestFrontendStartupUnexpectedMessage(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go func() {
+		defer serverConn.Close()
+		backend := pgproto3.NewBackend(pgproto3.NewChunkReader(serverConn), serverConn)
+		if _, err := backend.ReceiveStartupMessage(); err != nil {
+			return
+		}
+		backend.Send(&pgproto3.AuthenticationSASLFinal{Data: []byte("v=AAAA")})
+	}()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)
+	_, err := frontend.Startup(&pgproto3.StartupConfig{Parameters: map[string]string{"user": "jack"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "before AuthenticationSASL")
+}
@@ -115,3 +115,62 @@ func TestErrorResponse(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, want, got)
 }
+
+func TestFrontendAsyncMessageHandlers(t *testing.T) {
+	t.Parallel()
+
+	var buf []byte
+	for _, msg := range []pgproto3.BackendMessage{
+		&pgproto3.NoticeResponse{Severity: "NOTICE", Code: "00000", Message: "hello"},
+		&pgproto3.CommandComplete{CommandTag: []byte("SET")},
+		&pgproto3.ParameterStatus{Name: "TimeZone", Value: "UTC"},
+		&pgproto3.NotificationResponse{PID: 1, Channel: "jobs", Payload: "1"},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	} {
+		buf = append(buf, mustEncode(t, msg)...)
+	}
+
+	for _, consume := range []bool{false, true} {
+		server := &interruptReader{}
+		server.push(buf)
+		frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(server), nil)
+
+		var events []string
+		frontend.SetOnNotice(func(msg *pgproto3.NoticeResponse) { events = append(events, "notice:"+msg.Message) })
+		frontend.SetOnParameterStatus(func(msg *pgproto3.ParameterStatus) { events = append(events, "status:"+msg.Name) })
+		frontend.SetOnNotification(func(msg *pgproto3.NotificationResponse) { events = append(events, "notify:"+msg.Channel) })
+		frontend.SetConsumeAsyncMessages(consume)
+
+		var received int
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			received++
+			if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				break
+			}
+		}
+
+		assert.Equal(t, []string{"notice:hello", "status:TimeZone", "notify:jobs"}, events)
+		if consume {
+			assert.Equal(t, 2, received)
+		} else {
+			assert.Equal(t, 5, received)
+		}
+	}
+}
+
+func TestFrontendTxStatus(t *testing.T) {
+	t.Parallel()
+
+	server := &interruptReader{}
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(server), nil)
+	assert.Equal(t, byte(0), frontend.TxStatus())
+
+	for _, status := range []byte{'I', 'T', 'E', 'I'} {
+		server.push(mustEncode(t, &pgproto3.ReadyForQuery{TxStatus: status}))
+		_, err := frontend.Receive()
+		require.NoError(t, err)
+		assert.Equal(t, status, frontend.TxStatus())
+	}
+}
@@ -0,0 +1,410 @@
+package pgproto3
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ProtocolViolationError is returned by Frontend.Receive in validation mode when the backend sends a message that is
+// not legal at that point of the protocol. See Frontend.SetValidateProtocol.
+type ProtocolViolationError struct {
+	// Received is the type of the unexpected message, for example "DataRow".
+	Received string
+
+	// Reason describes what was expected.
+	Reason string
+}
+
+func (e *ProtocolViolationError) Error() string {
+	return fmt.Sprintf("protocol violation: unexpected %s: %s", e.Received, e.Reason)
+}
+
+// SetValidateProtocol enables or disables validation mode. In validation mode the Frontend tracks the messages it
+// sends and checks that every message received is a legal response: the authentication flow, simple and extended
+// queries, COPY in all directions including replication and function calls. A message that is not legal is reported
+// as a *ProtocolViolationError by Receive. The connection should not be used after a violation because the Frontend
+// and the backend no longer agree on its state.
+//
+// Validation starts in the authentication phase if a StartupMessage is sent after it is enabled and otherwise
+// assumes the connection is idle and ready for queries.
+func (f *Frontend) SetValidateProtocol(validate bool) {
+	if validate {
+		f.validator = &frontendValidator{phase: validatePhaseReady}
+	} else {
+		f.validator = nil
+	}
+}
+
+const (
+	validatePhaseAuth    = iota // waiting for authentication requests
+	validatePhaseStartup        // authenticated and waiting for ReadyForQuery
+	validatePhaseReady          // normal operation
+)
+
+// validatorRequest is a message sent by the frontend that has not been fully answered.
+type validatorRequest struct {
+	kind byte // the message type: 'Q', 'P', 'B', 'D', 'E', 'C', 'S' or 'F'
+
+	describeStatement bool // Describe of a prepared statement: ParameterDescription then RowDescription or NoData
+	responded         bool // ParameterDescription of a Describe or FunctionCallResponse has been received
+}
+
+// frontendValidator checks the messages received by a Frontend against the messages it sent. Send and Receive may be
+// called by different goroutines so the state is protected by mu.
+type frontendValidator struct {
+	mu sync.Mutex
+
+	phase    int
+	authType uint32
+
+	pending []validatorRequest
+
+	inRows    bool // a RowDescription of a simple query has been received and its CommandComplete has not
+	errorSkip bool // an ErrorResponse was received and nothing but ReadyForQuery is expected
+
+	copyActive    bool // a Copy*Response has been received and its CommandComplete has not
+	copyClientIn  bool // the frontend may send CopyData
+	copyServerOut bool // the backend may send CopyData
+	copyBoth      bool // the copy was started by CopyBothResponse
+}
+
+func (v *frontendValidator) reset(phase int) {
+	v.phase = phase
+	v.authType = 0
+	v.pending = nil
+	v.inRows = false
+	v.errorSkip = false
+	v.copyActive = false
+	v.copyClientIn = false
+	v.copyServerOut = false
+	v.copyBoth = false
+}
+
+// sent records a message sent by the frontend.
+func (v *frontendValidator) sent(msg FrontendMessage) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	switch msg := msg.(type) {
+	case *StartupMessage:
+		v.reset(validatePhaseAuth)
+	case *Query:
+		v.pending = append(v.pending, validatorRequest{kind: 'Q'})
+	case *Parse:
+		v.pending = append(v.pending, validatorRequest{kind: 'P'})
+	case *Bind:
+		v.pending = append(v.pending, validatorRequest{kind: 'B'})
+	case *Describe:
+		v.pending = append(v.pending, validatorRequest{kind: 'D', describeStatement: msg.ObjectType == 'S'})
+	case *Execute:
+		v.pending = append(v.pending, validatorRequest{kind: 'E'})
+	case *Close:
+		v.pending = append(v.pending, validatorRequest{kind: 'C'})
+	case *Sync:
+		// The backend ignores Sync in copy-in mode.
+		if !v.copyClientIn {
+			v.pending = append(v.pending, validatorRequest{kind: 'S'})
+		}
+	case *FunctionCall:
+		v.pending = append(v.pending, validatorRequest{kind: 'F'})
+	case *CopyDone, *CopyFail:
+		v.copyClientIn = false
+		v.endCopyBoth()
+	}
+}
+
+// received checks a message received from the backend. It returns a *ProtocolViolationError if msg is not legal.
+func (v *frontendValidator) received(msg BackendMessage) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	violation := func(reason string) error {
+		return &ProtocolViolationError{Received: strings.TrimPrefix(fmt.Sprintf("%T", msg), "*pgproto3."), Reason: reason}
+	}
+
+	// Messages that are legal at any time.
+	switch msg.(type) {
+	case *NoticeResponse:
+		return nil
+	case *ErrorResponse:
+		v.receivedError()
+		return nil
+	}
+
+	switch v.phase {
+	case validatePhaseAuth:
+		return v.receivedAuth(msg, violation)
+	case validatePhaseStartup:
+		switch msg.(type) {
+		case *ParameterStatus, *BackendKeyData:
+			return nil
+		case *ReadyForQuery:
+			v.phase = validatePhaseReady
+			v.pending = nil
+			return nil
+		default:
+			return violation("expected ParameterStatus, BackendKeyData or ReadyForQuery after authentication")
+		}
+	}
+
+	switch msg.(type) {
+	case *ParameterStatus, *NotificationResponse:
+		return nil
+	}
+
+	if _, ok := msg.(*ReadyForQuery); ok {
+		return v.receivedReadyForQuery(violation)
+	}
+
+	if v.errorSkip {
+		return violation("expected ReadyForQuery after ErrorResponse")
+	}
+
+	if v.copyActive && (v.copyServerOut || v.copyClientIn) {
+		return v.receivedCopy(msg, violation)
+	}
+
+	if len(v.pending) == 0 {
+		return violation("no request is pending")
+	}
+	req := &v.pending[0]
+
+	switch msg.(type) {
+	case *ParseComplete:
+		return v.popIf(req.kind == 'P', violation, "expected a pending Parse")
+	case *BindComplete:
+		return v.popIf(req.kind == 'B', violation, "expected a pending Bind")
+	case *CloseComplete:
+		return v.popIf(req.kind == 'C', violation, "expected a pending Close")
+	case *ParameterDescription:
+		if req.kind != 'D' || !req.describeStatement || req.responded {
+			return violation("expected a pending Describe of a prepared statement")
+		}
+		req.responded = true
+		return nil
+	case *NoData:
+		if req.kind != 'D' || (req.describeStatement && !req.responded) {
+			return violation("expected a pending Describe")
+		}
+		v.pop()
+		return nil
+	case *RowDescription:
+		switch {
+		case req.kind == 'Q' && !v.inRows && !v.copyActive:
+			v.inRows = true
+			return nil
+		case req.kind == 'D' && (!req.describeStatement || req.responded):
+			v.pop()
+			return nil
+		default:
+			return violation("expected a pending Query or Describe")
+		}
+	case *DataRow:
+		if (req.kind == 'Q' && v.inRows) || req.kind == 'E' {
+			return nil
+		}
+		return violation("expected RowDescription or a pending Execute before DataRow")
+	case *CommandComplete:
+		switch req.kind {
+		case 'Q':
+			v.inRows = false
+			v.copyActive = false
+			return nil
+		case 'E':
+			v.copyActive = false
+			v.pop()
+			return nil
+		default:
+			return violation("expected a pending Query or Execute")
+		}
+	case *EmptyQueryResponse:
+		switch {
+		case req.kind == 'Q' && !v.inRows && !v.copyActive:
+			return nil
+		case req.kind == 'E' && !v.copyActive:
+			v.pop()
+			return nil
+		default:
+			return violation("expected a pending Query or Execute")
+		}
+	case *PortalSuspended:
+		return v.popIf(req.kind == 'E' && !v.copyActive, violation, "expected a pending Execute")
+	case *CopyInResponse, *CopyOutResponse, *CopyBothResponse:
+		if v.copyActive || !((req.kind == 'Q' && !v.inRows) || req.kind == 'E') {
+			return violation("expected a pending Query or Execute")
+		}
+		v.copyActive = true
+		switch msg.(type) {
+		case *CopyInResponse:
+			v.copyClientIn = true
+		case *CopyOutResponse:
+			v.copyServerOut = true
+		case *CopyBothResponse:
+			v.copyClientIn = true
+			v.copyServerOut = true
+			v.copyBoth = true
+		}
+		return nil
+	case *CopyData, *CopyDone:
+		return violation("not in copy-out mode")
+	case *FunctionCallResponse:
+		if req.kind != 'F' || req.responded {
+			return violation("expected a pending FunctionCall")
+		}
+		req.responded = true
+		return nil
+	case *BackendKeyData:
+		return violation("BackendKeyData is only sent during startup")
+	default:
+		return violation("not legal after authentication")
+	}
+}
+
+func (v *frontendValidator) receivedAuth(msg BackendMessage, violation func(string) error) error {
+	switch msg.(type) {
+	case *AuthenticationOk:
+		v.phase = validatePhaseStartup
+		return nil
+	case *AuthenticationCleartextPassword:
+		if v.authType != 0 {
+			return violation("authentication method already chosen")
+		}
+		v.authType = AuthTypeCleartextPassword
+		return nil
+	case *AuthenticationMD5Password:
+		if v.authType != 0 {
+			return violation("authentication method already chosen")
+		}
+		v.authType = AuthTypeMD5Password
+		return nil
+	case *AuthenticationSASL:
+		if v.authType != 0 {
+			return violation("authentication method already chosen")
+		}
+		v.authType = AuthTypeSASL
+		return nil
+	case *AuthenticationSASLContinue:
+		if v.authType != AuthTypeSASL {
+			return violation("expected AuthenticationSASL first")
+		}
+		v.authType = AuthTypeSASLContinue
+		return nil
+	case *AuthenticationSASLFinal:
+		if v.authType != AuthTypeSASLContinue {
+			return violation("expected AuthenticationSASLContinue first")
+		}
+		v.authType = AuthTypeSASLFinal
+		return nil
+	case *AuthenticationGSS:
+		if v.authType != 0 {
+			return violation("authentication method already chosen")
+		}
+		v.authType = AuthTypeGSS
+		return nil
+	case *AuthenticationGSSContinue:
+		if v.authType != AuthTypeGSS {
+			return violation("expected AuthenticationGSS first")
+		}
+		return nil
+	default:
+		return violation("expected an authentication request")
+	}
+}
+
+// receivedError records an ErrorResponse. During a query the rest of the query, or of the extended query batch up to
+// Sync, is skipped and ReadyForQuery is expected next.
+func (v *frontendValidator) receivedError() {
+	v.inRows = false
+	v.copyActive = false
+	v.copyClientIn = false
+	v.copyServerOut = false
+	v.copyBoth = false
+
+	if v.phase == validatePhaseReady && len(v.pending) > 0 {
+		v.errorSkip = true
+	}
+}
+
+// receivedReadyForQuery completes the pending Query, FunctionCall or Sync.
+func (v *frontendValidator) receivedReadyForQuery(violation func(string) error) error {
+	if v.errorSkip {
+		// The rest of the failed query or extended query batch was skipped.
+		for i, req := range v.pending {
+			if req.kind == 'Q' || req.kind == 'F' || req.kind == 'S' {
+				v.pending = v.pending[i+1:]
+				v.errorSkip = false
+				return nil
+			}
+		}
+		return violation("no Query, FunctionCall or Sync is pending")
+	}
+
+	if v.copyActive {
+		return violation("COPY is in progress")
+	}
+	if v.inRows {
+		return violation("expected CommandComplete")
+	}
+	if len(v.pending) == 0 {
+		return violation("no Query, FunctionCall or Sync is pending")
+	}
+
+	req := v.pending[0]
+	switch {
+	case req.kind == 'Q', req.kind == 'S', req.kind == 'F' && req.responded:
+		v.pop()
+		return nil
+	case req.kind == 'F':
+		return violation("expected FunctionCallResponse")
+	default:
+		return violation(fmt.Sprintf("expected a response to the pending '%c' message", req.kind))
+	}
+}
+
+// receivedCopy checks a message received while COPY data is being transferred.
+func (v *frontendValidator) receivedCopy(msg BackendMessage, violation func(string) error) error {
+	switch msg.(type) {
+	case *CopyData:
+		if !v.copyServerOut {
+			return violation("not in copy-out mode")
+		}
+		return nil
+	case *CopyDone:
+		if !v.copyServerOut {
+			return violation("not in copy-out mode")
+		}
+		v.copyServerOut = false
+		v.endCopyBoth()
+		return nil
+	case *CommandComplete:
+		if v.copyServerOut {
+			return violation("expected CopyDone")
+		}
+		return violation("expected the frontend to end the copy with CopyDone or CopyFail")
+	default:
+		return violation("COPY is in progress")
+	}
+}
+
+// endCopyBoth ends a copy started by CopyBothResponse once both sides have sent CopyDone. Unlike other copies it is
+// not ended by a CommandComplete: when START_REPLICATION reaches the end of a timeline the backend sends a result set
+// with the next timeline before its CommandComplete.
+func (v *frontendValidator) endCopyBoth() {
+	if v.copyBoth && !v.copyClientIn && !v.copyServerOut {
+		v.copyActive = false
+		v.copyBoth = false
+	}
+}
+
+func (v *frontendValidator) pop() {
+	v.pending = v.pending[1:]
+}
+
+func (v *frontendValidator) popIf(ok bool, violation func(string) error, reason string) error {
+	if !ok {
+		return violation(reason)
+	}
+	v.pop()
+	return nil
+}
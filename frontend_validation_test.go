@@ -0,0 +1,272 @@
+package pgproto3_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fromServer marks a message that is both a FrontendMessage and a BackendMessage, such as CopyData, as received.
+type fromServer struct {
+	pgproto3.BackendMessage
+}
+
+func TestFrontendValidateProtocol(t *testing.T) {
+	t.Parallel()
+
+	startup := &pgproto3.StartupMessage{ProtocolVersion: pgproto3.ProtocolVersionNumber, Parameters: map[string]string{"user": "jack"}}
+	rowDescription := &pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("n")}}}
+	dataRow := &pgproto3.DataRow{Values: [][]byte{[]byte("1")}}
+	rfq := &pgproto3.ReadyForQuery{TxStatus: 'I'}
+	errResp := &pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601"}
+
+	// Each test is a sequence of messages sent (FrontendMessage) and received (BackendMessage or fromServer). If
+	// violation is true the last message received must be reported as a violation and all others must be accepted.
+	tests := []struct {
+		name      string
+		messages  []pgproto3.Message
+		violation bool
+	}{
+		{
+			name: "startup",
+			messages: []pgproto3.Message{
+				startup,
+				&pgproto3.AuthenticationMD5Password{Salt: [4]byte{1, 2, 3, 4}},
+				&pgproto3.PasswordMessage{Password: "md5"},
+				&pgproto3.AuthenticationOk{},
+				&pgproto3.ParameterStatus{Name: "server_version", Value: "14"},
+				&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 2},
+				rfq,
+			},
+		},
+		{
+			name: "SASLContinue before SASL",
+			messages: []pgproto3.Message{
+				startup,
+				&pgproto3.AuthenticationSASLContinue{Data: []byte("x")},
+			},
+			violation: true,
+		},
+		{
+			name: "simple query",
+			messages: []pgproto3.Message{
+				&pgproto3.Query{String: "select 1; set x = 1"},
+				rowDescription,
+				&pgproto3.NotificationResponse{Channel: "jobs"},
+				dataRow,
+				&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+				&pgproto3.NoticeResponse{Message: "hello"},
+				&pgproto3.CommandComplete{CommandTag: []byte("SET")},
+				&pgproto3.ParameterStatus{Name: "x", Value: "1"},
+				rfq,
+			},
+		},
+		{
+			name:      "DataRow without RowDescription",
+			messages:  []pgproto3.Message{&pgproto3.Query{String: "select 1"}, dataRow},
+			violation: true,
+		},
+		{
+			name:      "ReadyForQuery without request",
+			messages:  []pgproto3.Message{rfq},
+			violation: true,
+		},
+		{
+			name: "extended query",
+			messages: []pgproto3.Message{
+				&pgproto3.Parse{Query: "select $1"},
+				&pgproto3.Describe{ObjectType: 'S'},
+				&pgproto3.Bind{},
+				&pgproto3.Describe{ObjectType: 'P'},
+				&pgproto3.Execute{MaxRows: 1},
+				&pgproto3.Execute{},
+				&pgproto3.Close{ObjectType: 'P'},
+				&pgproto3.Sync{},
+				&pgproto3.ParseComplete{},
+				&pgproto3.ParameterDescription{ParameterOIDs: []uint32{23}},
+				rowDescription,
+				&pgproto3.BindComplete{},
+				rowDescription,
+				dataRow,
+				&pgproto3.PortalSuspended{},
+				dataRow,
+				&pgproto3.CommandComplete{CommandTag: []byte("SELECT 2")},
+				&pgproto3.CloseComplete{},
+				rfq,
+			},
+		},
+		{
+			name: "BindComplete without Bind",
+			messages: []pgproto3.Message{
+				&pgproto3.Parse{Query: "select 1"},
+				&pgproto3.Sync{},
+				&pgproto3.ParseComplete{},
+				&pgproto3.BindComplete{},
+			},
+			violation: true,
+		},
+		{
+			name: "extended query error",
+			messages: []pgproto3.Message{
+				&pgproto3.Parse{Query: "select"},
+				&pgproto3.Bind{},
+				&pgproto3.Execute{},
+				&pgproto3.Sync{},
+				errResp,
+				rfq,
+				&pgproto3.Query{String: "select 1"},
+				&pgproto3.EmptyQueryResponse{},
+				rfq,
+			},
+		},
+		{
+			name: "response after error",
+			messages: []pgproto3.Message{
+				&pgproto3.Parse{Query: "select"},
+				&pgproto3.Bind{},
+				&pgproto3.Sync{},
+				errResp,
+				&pgproto3.BindComplete{},
+			},
+			violation: true,
+		},
+		{
+			name: "copy in",
+			messages: []pgproto3.Message{
+				&pgproto3.Query{String: "copy t from stdin"},
+				&pgproto3.CopyInResponse{},
+				&pgproto3.CopyData{Data: []byte("1\n")},
+				&pgproto3.Sync{},
+				&pgproto3.CopyDone{},
+				&pgproto3.CommandComplete{CommandTag: []byte("COPY 1")},
+				rfq,
+			},
+		},
+		{
+			name: "copy in completed early",
+			messages: []pgproto3.Message{
+				&pgproto3.Query{String: "copy t from stdin"},
+				&pgproto3.CopyInResponse{},
+				&pgproto3.CommandComplete{CommandTag: []byte("COPY 1")},
+			},
+			violation: true,
+		},
+		{
+			name: "copy out",
+			messages: []pgproto3.Message{
+				&pgproto3.Query{String: "copy t to stdout"},
+				&pgproto3.CopyOutResponse{},
+				fromServer{&pgproto3.CopyData{Data: []byte("1\n")}},
+				fromServer{&pgproto3.CopyDone{}},
+				&pgproto3.CommandComplete{CommandTag: []byte("COPY 1")},
+				rfq,
+			},
+		},
+		{
+			name: "CopyData without copy",
+			messages: []pgproto3.Message{
+				&pgproto3.Query{String: "select 1"},
+				fromServer{&pgproto3.CopyData{Data: []byte("1\n")}},
+			},
+			violation: true,
+		},
+		{
+			name: "replication",
+			messages: []pgproto3.Message{
+				&pgproto3.Query{String: "START_REPLICATION 0/0"},
+				&pgproto3.CopyBothResponse{},
+				fromServer{&pgproto3.CopyData{Data: []byte("w")}},
+				&pgproto3.CopyData{Data: []byte("r")},
+				&pgproto3.CopyDone{},
+				fromServer{&pgproto3.CopyDone{}},
+				&pgproto3.CommandComplete{CommandTag: []byte("START_REPLICATION")},
+				rfq,
+			},
+		},
+		{
+			name: "replication end of timeline",
+			messages: []pgproto3.Message{
+				&pgproto3.Query{String: "START_REPLICATION 0/0 TIMELINE 1"},
+				&pgproto3.CopyBothResponse{},
+				fromServer{&pgproto3.CopyData{Data: []byte("w")}},
+				fromServer{&pgproto3.CopyDone{}},
+				&pgproto3.CopyDone{},
+				&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("next_tli")}, {Name: []byte("next_tli_startpos")}}},
+				&pgproto3.DataRow{Values: [][]byte{[]byte("2"), []byte("0/3000000")}},
+				&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+				&pgproto3.CommandComplete{CommandTag: []byte("START_STREAMING")},
+				rfq,
+			},
+		},
+		{
+			name: "RowDescription during replication",
+			messages: []pgproto3.Message{
+				&pgproto3.Query{String: "START_REPLICATION 0/0 TIMELINE 1"},
+				&pgproto3.CopyBothResponse{},
+				fromServer{&pgproto3.CopyDone{}},
+				rowDescription,
+			},
+			violation: true,
+		},
+		{
+			name: "function call",
+			messages: []pgproto3.Message{
+				&pgproto3.FunctionCall{Function: 1},
+				&pgproto3.FunctionCallResponse{Result: []byte("1")},
+				rfq,
+			},
+		},
+		{
+			name: "function call without response",
+			messages: []pgproto3.Message{
+				&pgproto3.FunctionCall{Function: 1},
+				rfq,
+			},
+			violation: true,
+		},
+	}
+
+	for _, tt := range tests {
+		server := &interruptReader{}
+		frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(server), ioutil.Discard)
+		frontend.SetValidateProtocol(true)
+
+		var err error
+		for i, msg := range tt.messages {
+			if msg, ok := msg.(pgproto3.FrontendMessage); ok {
+				require.NoError(t, frontend.Send(msg), tt.name)
+				continue
+			}
+
+			server.push(mustEncode(t, msg))
+			_, err = frontend.Receive()
+			if i < len(tt.messages)-1 || !tt.violation {
+				require.NoError(t, err, "%s: message %d", tt.name, i)
+			}
+		}
+
+		if tt.violation {
+			var violation *pgproto3.ProtocolViolationError
+			require.True(t, errors.As(err, &violation), "%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestProtocolViolationErrorMessage(t *testing.T) {
+	t.Parallel()
+
+	server := &interruptReader{}
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(server), ioutil.Discard)
+	frontend.SetValidateProtocol(true)
+
+	server.push(mustEncode(t, &pgproto3.BindComplete{}))
+	_, err := frontend.Receive()
+	var violation *pgproto3.ProtocolViolationError
+	require.True(t, errors.As(err, &violation))
+	assert.Equal(t, "BindComplete", violation.Received)
+	assert.Equal(t, "protocol violation: unexpected BindComplete: no request is pending", err.Error())
+}
@@ -1,6 +1,6 @@
 module github.com/jackc/pgproto3/v2
 
-go 1.12
+go 1.14
 
 require (
 	github.com/jackc/chunkreader/v2 v2.0.0
@@ -0,0 +1,107 @@
+package pgproto3
+
+import (
+	"errors"
+	"fmt"
+)
+
+// GSSProvider performs the client side of GSSAPI authentication, such as Kerberos, for Frontend.Startup. It wraps a
+// GSSAPI library; the Frontend only relays the tokens it produces and consumes. A GSSProvider is used for a single
+// authentication exchange.
+type GSSProvider interface {
+	// InitialToken establishes a security context with the server and returns the first token to send to it.
+	InitialToken() ([]byte, error)
+
+	// Continue processes a token received from the server and returns the token to send in response. The token is
+	// only valid until Continue returns. It returns nil if there is nothing to send.
+	Continue(token []byte) ([]byte, error)
+
+	// Done reports whether the security context has been established.
+	Done() bool
+}
+
+// GSSAcceptor performs the server side of GSSAPI authentication for Backend.AuthenticateGSS. A GSSAcceptor is used
+// for a single authentication exchange.
+type GSSAcceptor interface {
+	// Accept processes a token received from the client and returns the token to send in response. The token is only
+	// valid until Accept returns. It returns nil if there is nothing to send.
+	Accept(token []byte) ([]byte, error)
+
+	// Done reports whether the security context has been established.
+	Done() bool
+
+	// Principal returns the name of the authenticated client, such as "jack@EXAMPLE.COM", once Done returns true.
+	Principal() string
+}
+
+// AuthenticateGSS requests GSSAPI authentication from the client and exchanges tokens between the client and acceptor
+// until the security context is established. It returns the client's principal. The caller decides whether the
+// principal may connect as the requested user and then sends AuthenticationOk or an ErrorResponse. If the client's
+// tokens are rejected the error from acceptor is returned and nothing more is sent to the client.
+func (b *Backend) AuthenticateGSS(acceptor GSSAcceptor) (string, error) {
+	err := b.Send(&AuthenticationGSS{})
+	if err != nil {
+		return "", err
+	}
+
+	for !acceptor.Done() {
+		msg, err := b.Receive()
+		if err != nil {
+			return "", err
+		}
+		response, ok := msg.(*GSSResponse)
+		if !ok {
+			return "", fmt.Errorf("expected GSSResponse, received %T", msg)
+		}
+
+		token, err := acceptor.Accept(response.Data)
+		if err != nil {
+			return "", err
+		}
+		// Like PostgreSQL, a token is only sent if there is one. The final token lets the client authenticate the
+		// server.
+		if len(token) > 0 {
+			err = b.Send(&AuthenticationGSSContinue{Data: token})
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return acceptor.Principal(), nil
+}
+
+// gssClient drives a GSSProvider during Frontend.Startup.
+type gssClient struct {
+	provider GSSProvider
+}
+
+func newGSSClient(config *StartupConfig) (*gssClient, []byte, error) {
+	if config.NewGSSProvider == nil {
+		return nil, nil, errors.New("server requested GSSAPI authentication but StartupConfig.NewGSSProvider is nil")
+	}
+	provider, err := config.NewGSSProvider()
+	if err != nil {
+		return nil, nil, err
+	}
+	token, err := provider.InitialToken()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &gssClient{provider: provider}, token, nil
+}
+
+// continueAuth processes a token from the server and returns the token to send in response, if any.
+func (c *gssClient) continueAuth(token []byte) ([]byte, error) {
+	if c.provider.Done() {
+		return nil, errors.New("received AuthenticationGSSContinue after the GSSAPI security context was established")
+	}
+	response, err := c.provider.Continue(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) == 0 && !c.provider.Done() {
+		// The server waits for a response that will never be sent.
+		return nil, errors.New("GSSAPI provider returned no token before the security context was established")
+	}
+	return response, nil
+}
@@ -0,0 +1,266 @@
+package pgproto3
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// gssMaxPacketSize is the largest packet, including its 4 byte length, that PostgreSQL sends or accepts on a GSSAPI
+// encrypted connection.
+const gssMaxPacketSize = 16384
+
+// ErrGSSEncryptionDeclined is returned by RequestGSSEncryption when the server does not support GSSAPI encryption.
+// The connection can still be used without encryption.
+var ErrGSSEncryptionDeclined = errors.New("server declined GSSAPI encryption")
+
+// GSSWrapper protects the data of a GSSAPI encrypted connection with an established security context.
+type GSSWrapper interface {
+	// Wrap encrypts data and returns the token to send.
+	Wrap(data []byte) ([]byte, error)
+
+	// Unwrap decrypts a token received from the peer and returns the data. The token is only valid until Unwrap
+	// returns.
+	Unwrap(token []byte) ([]byte, error)
+
+	// WrapSizeLimit returns the most data that can be wrapped into a token of at most size bytes.
+	WrapSizeLimit(size int) int
+}
+
+// GSSEncProvider is a GSSProvider whose security context can encrypt the connection.
+type GSSEncProvider interface {
+	GSSProvider
+	GSSWrapper
+}
+
+// GSSEncAcceptor is a GSSAcceptor whose security context can encrypt the connection.
+type GSSEncAcceptor interface {
+	GSSAcceptor
+	GSSWrapper
+}
+
+// RequestGSSEncryption sends a GSSEncRequest on conn, establishes a security context with provider and returns a
+// connection that encrypts everything sent on conn from then on. The StartupMessage is then sent on the returned
+// connection. If the server does not support GSSAPI encryption ErrGSSEncryptionDeclined is returned.
+func RequestGSSEncryption(conn net.Conn, provider GSSEncProvider) (net.Conn, error) {
+	buf, err := (&GSSEncRequest{}).Encode(nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// The response is read byte by byte so nothing the server sends after it is consumed.
+	var response [1]byte
+	_, err = io.ReadFull(conn, response[:])
+	if err != nil {
+		return nil, err
+	}
+	switch response[0] {
+	case 'G':
+	case 'N':
+		return nil, ErrGSSEncryptionDeclined
+	default:
+		return nil, fmt.Errorf("unexpected response to GSSEncRequest: %q", response[0])
+	}
+
+	token, err := provider.InitialToken()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if len(token) > 0 {
+			err = writeGSSPacket(conn, token)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if provider.Done() {
+			return newGSSConn(conn, provider), nil
+		}
+
+		token, err = readGSSPacket(conn)
+		if err != nil {
+			return nil, err
+		}
+		token, err = provider.Continue(token)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// AcceptGSSEncryption accepts a GSSEncRequest received on conn, establishes a security context with acceptor and
+// returns a connection that encrypts everything sent on conn from then on. The client's StartupMessage is then
+// received from the returned connection with a new Backend. acceptor.Principal returns the client's principal, which
+// can be used to authenticate the client without requesting GSSAPI authentication.
+//
+// Like PostgreSQL, the client must not send anything after the GSSEncRequest until it has received the response. The
+// Backend the request was received with must not have buffered anything after it.
+func AcceptGSSEncryption(conn net.Conn, acceptor GSSEncAcceptor) (net.Conn, error) {
+	_, err := conn.Write([]byte{'G'})
+	if err != nil {
+		return nil, err
+	}
+
+	for !acceptor.Done() {
+		token, err := readGSSPacket(conn)
+		if err != nil {
+			return nil, err
+		}
+		token, err = acceptor.Accept(token)
+		if err != nil {
+			return nil, err
+		}
+		if len(token) > 0 {
+			err = writeGSSPacket(conn, token)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return newGSSConn(conn, acceptor), nil
+}
+
+// readGSSPacket reads a packet of the GSSAPI encryption protocol and returns its token.
+func readGSSPacket(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > gssMaxPacketSize-4 {
+		return nil, fmt.Errorf("oversize GSSAPI packet: %d bytes", size)
+	}
+	token := make([]byte, size)
+	_, err = io.ReadFull(r, token)
+	if err != nil {
+		return nil, translateEOFtoErrUnexpectedEOF(err)
+	}
+	return token, nil
+}
+
+// writeGSSPacket writes token as a packet of the GSSAPI encryption protocol.
+func writeGSSPacket(w io.Writer, token []byte) error {
+	if len(token) > gssMaxPacketSize-4 {
+		return fmt.Errorf("oversize GSSAPI packet: %d bytes", len(token))
+	}
+	buf := make([]byte, 4, 4+len(token))
+	binary.BigEndian.PutUint32(buf, uint32(len(token)))
+	_, err := w.Write(append(buf, token...))
+	return err
+}
+
+// gssConn is a net.Conn that sends and receives data in packets wrapped with a GSSWrapper.
+type gssConn struct {
+	net.Conn
+	wrapper GSSWrapper
+
+	readMu    sync.Mutex
+	unread    []byte  // the unwrapped data not read yet
+	header    [4]byte // the header of the packet being read
+	headerLen int     // the bytes of header read so far
+	token     []byte  // the token of the packet being read once its header is complete, filled up to its capacity
+
+	writeMu  sync.Mutex
+	maxChunk int // the most data wrapped into one packet
+}
+
+func newGSSConn(conn net.Conn, wrapper GSSWrapper) *gssConn {
+	return &gssConn{
+		Conn:     conn,
+		wrapper:  wrapper,
+		maxChunk: wrapper.WrapSizeLimit(gssMaxPacketSize - 4),
+	}
+}
+
+func (c *gssConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.unread) == 0 {
+		token, err := c.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		c.unread, err = c.wrapper.Unwrap(token)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+// readPacket reads a packet and returns its token. A packet that is partially read when a read fails, for example
+// because the read deadline has passed, is completed by the next call.
+func (c *gssConn) readPacket() ([]byte, error) {
+	for c.headerLen < len(c.header) {
+		n, err := c.Conn.Read(c.header[c.headerLen:])
+		c.headerLen += n
+		if err != nil {
+			if c.headerLen > 0 {
+				err = translateEOFtoErrUnexpectedEOF(err)
+			}
+			return nil, err
+		}
+	}
+
+	if c.token == nil {
+		size := binary.BigEndian.Uint32(c.header[:])
+		if size > gssMaxPacketSize-4 {
+			return nil, fmt.Errorf("oversize GSSAPI packet: %d bytes", size)
+		}
+		c.token = make([]byte, 0, size)
+	}
+	for len(c.token) < cap(c.token) {
+		n, err := c.Conn.Read(c.token[len(c.token):cap(c.token)])
+		c.token = c.token[:len(c.token)+n]
+		if err != nil {
+			return nil, translateEOFtoErrUnexpectedEOF(err)
+		}
+	}
+
+	token := c.token
+	c.token = nil
+	c.headerLen = 0
+	return token, nil
+}
+
+func (c *gssConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.maxChunk <= 0 {
+		return 0, errors.New("GSSAPI wrap size limit is too small")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > c.maxChunk {
+			chunk = chunk[:c.maxChunk]
+		}
+
+		token, err := c.wrapper.Wrap(chunk)
+		if err != nil {
+			return n, err
+		}
+		err = writeGSSPacket(c.Conn, token)
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
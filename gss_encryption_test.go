@@ -0,0 +1,210 @@
+package pgproto3_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgio"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/gsstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingConn records the data written to a net.Conn.
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written []byte
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.written = append(c.written, p...)
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *recordingConn) contains(s string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Contains(c.written, []byte(s))
+}
+
+// serveGSSEncryption accepts GSSAPI encryption on conn and answers a query with a row of value.
+func serveGSSEncryption(conn net.Conn, value []byte) error {
+	defer conn.Close()
+
+	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	msg, err := backend.ReceiveStartupMessage()
+	if err != nil {
+		return err
+	}
+	if _, ok := msg.(*pgproto3.GSSEncRequest); !ok {
+		return assert.AnError
+	}
+
+	acceptor := gsstest.NewServer("postgres/db")
+	encConn, err := pgproto3.AcceptGSSEncryption(conn, acceptor)
+	if err != nil {
+		return err
+	}
+	backend = pgproto3.NewBackend(pgproto3.NewChunkReader(encConn), encConn)
+	msg, err = backend.ReceiveStartupMessage()
+	if err != nil {
+		return err
+	}
+	if _, ok := msg.(*pgproto3.StartupMessage); !ok {
+		return assert.AnError
+	}
+
+	// The client was authenticated by the security context.
+	for _, msg := range []pgproto3.BackendMessage{
+		&pgproto3.AuthenticationOk{},
+		&pgproto3.ParameterStatus{Name: "principal", Value: acceptor.Principal()},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	} {
+		err = backend.Send(msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	msg, err = backend.Receive()
+	if err != nil {
+		return err
+	}
+	if _, ok := msg.(*pgproto3.Query); !ok {
+		return assert.AnError
+	}
+	for _, msg := range []pgproto3.BackendMessage{
+		&pgproto3.DataRow{Values: [][]byte{value}},
+		&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	} {
+		err = backend.Send(msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestGSSEncryption(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	recorder := &recordingConn{Conn: clientConn}
+
+	// The value is larger than a packet so it is split.
+	value := bytes.Repeat([]byte("secret value "), 5000)
+	serverErrChan := make(chan error, 1)
+	go func() {
+		serverErrChan <- serveGSSEncryption(serverConn, value)
+	}()
+
+	encConn, err := pgproto3.RequestGSSEncryption(recorder, gsstest.NewClient("jack@EXAMPLE.COM", "postgres/db"))
+	require.NoError(t, err)
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(encConn), encConn)
+	result, err := frontend.Startup(&pgproto3.StartupConfig{Parameters: map[string]string{"user": "jack", "database": "confidential"}})
+	require.NoError(t, err)
+	assert.Equal(t, "jack@EXAMPLE.COM", result.ParameterStatus["principal"])
+
+	require.NoError(t, frontend.Send(&pgproto3.Query{String: "select secret"}))
+	var row []byte
+	for {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		if msg, ok := msg.(*pgproto3.DataRow); ok {
+			row = append([]byte(nil), msg.Values[0]...)
+		}
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+	assert.Equal(t, value, row)
+	require.NoError(t, <-serverErrChan)
+
+	// Only the GSSEncRequest and the tokens of the exchange are sent in the clear.
+	assert.False(t, recorder.contains("confidential"))
+	assert.False(t, recorder.contains("select secret"))
+}
+
+func TestGSSEncryptionDeclined(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go func() {
+		defer serverConn.Close()
+		backend := pgproto3.NewBackend(pgproto3.NewChunkReader(serverConn), serverConn)
+		if _, err := backend.ReceiveStartupMessage(); err != nil {
+			return
+		}
+		serverConn.Write([]byte{'N'})
+	}()
+
+	_, err := pgproto3.RequestGSSEncryption(clientConn, gsstest.NewClient("jack@EXAMPLE.COM", "postgres/db"))
+	assert.Equal(t, pgproto3.ErrGSSEncryptionDeclined, err)
+}
+
+func TestGSSEncryptionResumesPartialPacket(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := newPipe(t)
+
+	buf := mustEncode(t, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+	resume := make(chan struct{})
+	serverErrChan := make(chan error, 1)
+	go func() {
+		serverErrChan <- func() error {
+			backend := pgproto3.NewBackend(pgproto3.NewChunkReader(serverConn), serverConn)
+			if _, err := backend.ReceiveStartupMessage(); err != nil {
+				return err
+			}
+			acceptor := gsstest.NewServer("postgres/db")
+			if _, err := pgproto3.AcceptGSSEncryption(serverConn, acceptor); err != nil {
+				return err
+			}
+
+			// The packet is written in pieces that end in its header and in its token.
+			token, err := acceptor.Wrap(buf)
+			if err != nil {
+				return err
+			}
+			packet := append(pgio.AppendUint32(nil, uint32(len(token))), token...)
+			for _, piece := range [][]byte{packet[:3], packet[3:6], packet[6:]} {
+				if _, err := serverConn.Write(piece); err != nil {
+					return err
+				}
+				<-resume
+			}
+			return nil
+		}()
+	}()
+
+	encConn, err := pgproto3.RequestGSSEncryption(clientConn, gsstest.NewClient("jack@EXAMPLE.COM", "postgres/db"))
+	require.NoError(t, err)
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(encConn), encConn)
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, err = frontend.ReceiveContext(ctx)
+		cancel()
+		assert.Equal(t, context.DeadlineExceeded, err)
+		resume <- struct{}{}
+	}
+
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'I'}, msg)
+	resume <- struct{}{}
+	require.NoError(t, <-serverErrChan)
+}
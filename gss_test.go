@@ -0,0 +1,103 @@
+package pgproto3_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/gsstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveGSSAuth authenticates a client with acceptor on conn and sends the principal in the ParameterStatus
+// "principal" if it is accepted.
+func serveGSSAuth(conn net.Conn, acceptor pgproto3.GSSAcceptor) error {
+	defer conn.Close()
+	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+
+	_, err := backend.ReceiveStartupMessage()
+	if err != nil {
+		return err
+	}
+
+	principal, err := backend.AuthenticateGSS(acceptor)
+	if err != nil {
+		backend.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "28000", Message: err.Error()})
+		return err
+	}
+
+	for _, msg := range []pgproto3.BackendMessage{
+		&pgproto3.AuthenticationOk{},
+		&pgproto3.ParameterStatus{Name: "principal", Value: principal},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	} {
+		err = backend.Send(msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestFrontendStartupGSS(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	serverErrChan := make(chan error, 1)
+	go func() {
+		serverErrChan <- serveGSSAuth(serverConn, gsstest.NewServer("postgres/db"))
+	}()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)
+	provider := gsstest.NewClient("jack@EXAMPLE.COM", "postgres/db")
+	result, err := frontend.Startup(&pgproto3.StartupConfig{
+		Parameters:     map[string]string{"user": "jack"},
+		NewGSSProvider: func() (pgproto3.GSSProvider, error) { return provider, nil },
+	})
+	require.NoError(t, err)
+	require.NoError(t, <-serverErrChan)
+
+	assert.True(t, provider.Done())
+	assert.Equal(t, "jack@EXAMPLE.COM", result.ParameterStatus["principal"])
+}
+
+func TestFrontendStartupGSSRejected(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	serverErrChan := make(chan error, 1)
+	go func() {
+		serverErrChan <- serveGSSAuth(serverConn, gsstest.NewServer("postgres/db"))
+	}()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)
+	_, err := frontend.Startup(&pgproto3.StartupConfig{
+		Parameters: map[string]string{"user": "jack"},
+		NewGSSProvider: func() (pgproto3.GSSProvider, error) {
+			return gsstest.NewClient("jack@EXAMPLE.COM", "postgres/other"), nil
+		},
+	})
+	var errResp *pgproto3.ErrorResponse
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "28000", errResp.Code)
+	assert.Error(t, <-serverErrChan)
+}
+
+func TestFrontendStartupGSSWithoutProvider(t *testing.T) {
+	t.Parallel()
+
+	server := &interruptReader{}
+	server.push(mustEncode(t, &pgproto3.AuthenticationGSS{}))
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(server), ioutil.Discard)
+
+	_, err := frontend.Startup(&pgproto3.StartupConfig{Parameters: map[string]string{"user": "jack"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "NewGSSProvider")
+}
@@ -0,0 +1,243 @@
+// Package gsstest implements a fake in-process GSSAPI mechanism for testing GSSAPI authentication without Kerberos.
+//
+// A Client is a pgproto3.GSSEncProvider and a Server is a pgproto3.GSSEncAcceptor. They exchange three tokens: the
+// client names its principal and the service it wants, the server sends a challenge, and the server's reply to the
+// client's answer authenticates the server to the client. Once the exchange is complete both can wrap data for GSSAPI
+// encryption. Wrapping obscures the data so tests can tell it is not sent in the clear, but neither the tokens nor the
+// wrapped data are protected in any way.
+package gsstest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const (
+	tokenInit      = "init"
+	tokenChallenge = "challenge"
+	tokenResponse  = "response"
+	tokenAccept    = "accept"
+)
+
+// wrapPrefix starts every wrapped token.
+const wrapPrefix = "wrap"
+
+// Client authenticates as Principal to the service Service.
+type Client struct {
+	Principal string
+	Service   string
+
+	sent bool // the initial token has been sent
+	done bool
+	key  []byte
+}
+
+var _ pgproto3.GSSEncProvider = (*Client)(nil)
+
+// NewClient returns a Client that authenticates as principal to service, such as "postgres/db.example.com".
+func NewClient(principal, service string) *Client {
+	return &Client{Principal: principal, Service: service}
+}
+
+// InitialToken implements pgproto3.GSSProvider.
+func (c *Client) InitialToken() ([]byte, error) {
+	if c.sent {
+		return nil, errors.New("gsstest: initial token already sent")
+	}
+	c.sent = true
+	return makeToken(tokenInit, c.Principal, c.Service), nil
+}
+
+// Continue implements pgproto3.GSSProvider.
+func (c *Client) Continue(token []byte) ([]byte, error) {
+	kind, fields, err := parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case !c.sent || c.done:
+		return nil, fmt.Errorf("gsstest: unexpected %s token", kind)
+	case kind == tokenChallenge && len(fields) == 1:
+		c.key = wrapKey(fields[0])
+		return makeToken(tokenResponse, fields[0]), nil
+	case kind == tokenAccept && len(fields) == 1:
+		if fields[0] != c.Service {
+			return nil, fmt.Errorf("gsstest: server authenticated as %q instead of %q", fields[0], c.Service)
+		}
+		c.done = true
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("gsstest: unexpected %s token", kind)
+	}
+}
+
+// Done implements pgproto3.GSSProvider.
+func (c *Client) Done() bool {
+	return c.done
+}
+
+// Wrap implements pgproto3.GSSWrapper.
+func (c *Client) Wrap(data []byte) ([]byte, error) {
+	if !c.done {
+		return nil, errNoContext
+	}
+	return wrap(c.key, data), nil
+}
+
+// Unwrap implements pgproto3.GSSWrapper.
+func (c *Client) Unwrap(token []byte) ([]byte, error) {
+	if !c.done {
+		return nil, errNoContext
+	}
+	return unwrap(c.key, token)
+}
+
+// WrapSizeLimit implements pgproto3.GSSWrapper.
+func (c *Client) WrapSizeLimit(size int) int {
+	return size - len(wrapPrefix)
+}
+
+// Server accepts any client principal that asks for the service Service.
+type Server struct {
+	Service string
+
+	principal string
+	challenge string
+	done      bool
+}
+
+var _ pgproto3.GSSEncAcceptor = (*Server)(nil)
+
+// NewServer returns a Server for service.
+func NewServer(service string) *Server {
+	return &Server{Service: service}
+}
+
+// Accept implements pgproto3.GSSAcceptor.
+func (s *Server) Accept(token []byte) ([]byte, error) {
+	kind, fields, err := parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case s.done:
+		return nil, fmt.Errorf("gsstest: unexpected %s token", kind)
+	case kind == tokenInit && len(fields) == 2 && s.challenge == "":
+		if fields[1] != s.Service {
+			return nil, fmt.Errorf("gsstest: client requested service %q instead of %q", fields[1], s.Service)
+		}
+		s.principal = fields[0]
+
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		s.challenge = hex.EncodeToString(b[:])
+		return makeToken(tokenChallenge, s.challenge), nil
+	case kind == tokenResponse && len(fields) == 1 && s.challenge != "":
+		if fields[0] != s.challenge {
+			return nil, errors.New("gsstest: wrong response to challenge")
+		}
+		s.done = true
+		return makeToken(tokenAccept, s.Service), nil
+	default:
+		return nil, fmt.Errorf("gsstest: unexpected %s token", kind)
+	}
+}
+
+// Done implements pgproto3.GSSAcceptor.
+func (s *Server) Done() bool {
+	return s.done
+}
+
+// Principal implements pgproto3.GSSAcceptor.
+func (s *Server) Principal() string {
+	if !s.done {
+		return ""
+	}
+	return s.principal
+}
+
+// Wrap implements pgproto3.GSSWrapper.
+func (s *Server) Wrap(data []byte) ([]byte, error) {
+	if !s.done {
+		return nil, errNoContext
+	}
+	return wrap(wrapKey(s.challenge), data), nil
+}
+
+// Unwrap implements pgproto3.GSSWrapper.
+func (s *Server) Unwrap(token []byte) ([]byte, error) {
+	if !s.done {
+		return nil, errNoContext
+	}
+	return unwrap(wrapKey(s.challenge), token)
+}
+
+// WrapSizeLimit implements pgproto3.GSSWrapper.
+func (s *Server) WrapSizeLimit(size int) int {
+	return size - len(wrapPrefix)
+}
+
+var errNoContext = errors.New("gsstest: security context is not established")
+
+// wrapKey returns the key derived from the challenge of an exchange.
+func wrapKey(challenge string) []byte {
+	key := sha256.Sum256([]byte(challenge))
+	return key[:]
+}
+
+func wrap(key, data []byte) []byte {
+	token := append([]byte(wrapPrefix), data...)
+	xor(key, token[len(wrapPrefix):])
+	return token
+}
+
+func unwrap(key, token []byte) ([]byte, error) {
+	if !bytes.HasPrefix(token, []byte(wrapPrefix)) {
+		return nil, errors.New("gsstest: invalid wrapped token")
+	}
+	data := append([]byte(nil), token[len(wrapPrefix):]...)
+	xor(key, data)
+	return data, nil
+}
+
+func xor(key, data []byte) {
+	for i := range data {
+		data[i] ^= key[i%len(key)]
+	}
+}
+
+// makeToken returns a token of kind with fields. The parts are separated by NUL bytes.
+func makeToken(kind string, fields ...string) []byte {
+	token := []byte(kind)
+	for _, f := range fields {
+		token = append(token, 0)
+		token = append(token, f...)
+	}
+	return token
+}
+
+func parseToken(token []byte) (string, []string, error) {
+	parts := bytes.Split(token, []byte{0})
+	kind := string(parts[0])
+	switch kind {
+	case tokenInit, tokenChallenge, tokenResponse, tokenAccept:
+	default:
+		return "", nil, errors.New("gsstest: invalid token")
+	}
+
+	fields := make([]string, len(parts)-1)
+	for i, p := range parts[1:] {
+		fields[i] = string(p)
+	}
+	return kind, fields, nil
+}
@@ -0,0 +1,82 @@
+package gsstest_test
+
+import (
+	"testing"
+
+	"github.com/jackc/pgproto3/v2/gsstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExchange(t *testing.T) {
+	t.Parallel()
+
+	client := gsstest.NewClient("jack@EXAMPLE.COM", "postgres/db")
+	server := gsstest.NewServer("postgres/db")
+
+	token, err := client.InitialToken()
+	require.NoError(t, err)
+	for !client.Done() {
+		require.NotEmpty(t, token)
+		token, err = server.Accept(token)
+		require.NoError(t, err)
+		token, err = client.Continue(token)
+		require.NoError(t, err)
+	}
+	assert.Nil(t, token)
+	assert.True(t, server.Done())
+	assert.Equal(t, "jack@EXAMPLE.COM", server.Principal())
+}
+
+func TestWrongService(t *testing.T) {
+	t.Parallel()
+
+	client := gsstest.NewClient("jack@EXAMPLE.COM", "postgres/other")
+	server := gsstest.NewServer("postgres/db")
+
+	token, err := client.InitialToken()
+	require.NoError(t, err)
+	_, err = server.Accept(token)
+	assert.Error(t, err)
+	assert.False(t, server.Done())
+	assert.Empty(t, server.Principal())
+
+	_, err = server.Accept([]byte("garbage"))
+	assert.Error(t, err)
+}
+
+func TestWrap(t *testing.T) {
+	t.Parallel()
+
+	client := gsstest.NewClient("jack@EXAMPLE.COM", "postgres/db")
+	server := gsstest.NewServer("postgres/db")
+
+	_, err := client.Wrap([]byte("hello"))
+	require.Error(t, err)
+
+	token, err := client.InitialToken()
+	require.NoError(t, err)
+	for !client.Done() {
+		token, err = server.Accept(token)
+		require.NoError(t, err)
+		token, err = client.Continue(token)
+		require.NoError(t, err)
+	}
+
+	token, err = client.Wrap([]byte("hello"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(token), "hello")
+	assert.Equal(t, 5, client.WrapSizeLimit(len(token)))
+	data, err := server.Unwrap(token)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	token, err = server.Wrap([]byte("world"))
+	require.NoError(t, err)
+	data, err = client.Unwrap(token)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(data))
+
+	_, err = client.Unwrap([]byte("garbage"))
+	assert.Error(t, err)
+}
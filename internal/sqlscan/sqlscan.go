@@ -0,0 +1,227 @@
+// Package sqlscan implements just enough of the PostgreSQL lexer to split query strings into statements and identify
+// statement types without being fooled by quoted strings, quoted identifiers or comments.
+package sqlscan
+
+import (
+	"strings"
+)
+
+// Split splits sql into statements at semicolons that are not inside quotes, dollar-quoted strings or comments.
+// Statements are trimmed of surrounding whitespace and empty statements are omitted.
+func Split(sql string) []string {
+	var statements []string
+	start := 0
+	for i := 0; i < len(sql); {
+		if sql[i] == ';' {
+			statements = appendStatement(statements, sql[start:i])
+			i++
+			start = i
+			continue
+		}
+		i = skipToken(sql, i)
+	}
+	return appendStatement(statements, sql[start:])
+}
+
+func appendStatement(statements []string, s string) []string {
+	s = strings.TrimSpace(s)
+	if isOnlyComments(s) {
+		return statements
+	}
+	return append(statements, s)
+}
+
+func isOnlyComments(s string) bool {
+	for i := 0; i < len(s); {
+		switch {
+		case isSpace(s[i]):
+			i++
+		case strings.HasPrefix(s[i:], "--"), strings.HasPrefix(s[i:], "/*"):
+			i = skipToken(s, i)
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Keywords returns up to n leading keywords of stmt in upper case. Whitespace and comments are skipped and scanning
+// stops at the first token that is not an unquoted identifier or keyword.
+func Keywords(stmt string, n int) []string {
+	var keywords []string
+	for i := 0; i < len(stmt) && len(keywords) < n; {
+		switch {
+		case isSpace(stmt[i]):
+			i++
+		case strings.HasPrefix(stmt[i:], "--"), strings.HasPrefix(stmt[i:], "/*"):
+			i = skipToken(stmt, i)
+		case isIdentStart(stmt[i]):
+			end := i + 1
+			for end < len(stmt) && isIdentChar(stmt[end]) {
+				end++
+			}
+			keywords = append(keywords, strings.ToUpper(stmt[i:end]))
+			i = end
+		default:
+			return keywords
+		}
+	}
+	return keywords
+}
+
+// Identifier returns the identifier that follows the first n keywords of stmt. An unquoted identifier is folded to
+// lower case as PostgreSQL does and a quoted identifier is unquoted. It returns false if stmt does not start with n
+// keywords followed by an identifier.
+func Identifier(stmt string, n int) (string, bool) {
+	name, _, ok := IdentifierRest(stmt, n)
+	return name, ok
+}
+
+// IdentifierRest is like Identifier but also returns the text of stmt that follows the identifier.
+func IdentifierRest(stmt string, n int) (string, string, bool) {
+	for i := 0; i < len(stmt); {
+		switch {
+		case isSpace(stmt[i]):
+			i++
+		case strings.HasPrefix(stmt[i:], "--"), strings.HasPrefix(stmt[i:], "/*"):
+			i = skipToken(stmt, i)
+		case isIdentStart(stmt[i]):
+			end := i + 1
+			for end < len(stmt) && isIdentChar(stmt[end]) {
+				end++
+			}
+			if n == 0 {
+				return strings.ToLower(stmt[i:end]), stmt[end:], true
+			}
+			n--
+			i = end
+		case stmt[i] == '"' && n == 0:
+			end := skipQuoted(stmt, i, '"', false)
+			if end-i < 2 || stmt[end-1] != '"' {
+				return "", "", false
+			}
+			return strings.ReplaceAll(stmt[i+1:end-1], `""`, `"`), stmt[end:], true
+		default:
+			return "", "", false
+		}
+	}
+	return "", "", false
+}
+
+// Words returns the unquoted identifiers and keywords of stmt in upper case. Quoted identifiers, strings and comments
+// are skipped.
+func Words(stmt string) []string {
+	var words []string
+	for i := 0; i < len(stmt); {
+		end := skipToken(stmt, i)
+		if isIdentStart(stmt[i]) && strings.IndexByte(stmt[i:end], '\'') < 0 {
+			words = append(words, strings.ToUpper(stmt[i:end]))
+		}
+		i = end
+	}
+	return words
+}
+
+// skipToken returns the index just past the token starting at sql[i]. Quoted strings, quoted identifiers, dollar-quoted
+// strings and comments are single tokens. Any other byte is a token by itself. An unterminated token extends to the
+// end of sql.
+func skipToken(sql string, i int) int {
+	switch c := sql[i]; {
+	case c == '\'':
+		return skipQuoted(sql, i, '\'', false)
+	case c == '"':
+		return skipQuoted(sql, i, '"', false)
+	case c == '$':
+		if tag, ok := dollarTag(sql, i); ok {
+			end := strings.Index(sql[i+len(tag):], tag)
+			if end < 0 {
+				return len(sql)
+			}
+			return i + len(tag) + end + len(tag)
+		}
+	case strings.HasPrefix(sql[i:], "--"):
+		end := strings.IndexByte(sql[i:], '\n')
+		if end < 0 {
+			return len(sql)
+		}
+		return i + end + 1
+	case strings.HasPrefix(sql[i:], "/*"):
+		// Block comments nest.
+		depth := 0
+		for j := i; j < len(sql)-1; j++ {
+			switch sql[j : j+2] {
+			case "/*":
+				depth++
+				j++
+			case "*/":
+				depth--
+				j++
+				if depth == 0 {
+					return j + 1
+				}
+			}
+		}
+		return len(sql)
+	case isIdentStart(c):
+		// Identifiers are skipped whole so a '$' inside one is not taken for the start of a dollar quote.
+		end := i + 1
+		if (c == 'E' || c == 'e') && end < len(sql) && sql[end] == '\'' {
+			// A string with C-style escapes.
+			return skipQuoted(sql, end, '\'', true)
+		}
+		for end < len(sql) && isIdentChar(sql[end]) {
+			end++
+		}
+		return end
+	}
+	return i + 1
+}
+
+// skipQuoted skips a string quoted with quote in which a doubled quote stands for itself. If escapes is true a
+// backslash escapes the following character.
+func skipQuoted(sql string, i int, quote byte, escapes bool) int {
+	for j := i + 1; j < len(sql); j++ {
+		switch sql[j] {
+		case '\\':
+			if escapes {
+				j++
+			}
+		case quote:
+			if j+1 < len(sql) && sql[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(sql)
+}
+
+// dollarTag returns the dollar quote tag, including both dollar signs, starting at sql[i].
+func dollarTag(sql string, i int) (string, bool) {
+	j := i + 1
+	if j < len(sql) && sql[j] != '$' {
+		if !isIdentStart(sql[j]) {
+			return "", false
+		}
+		for j < len(sql) && isIdentChar(sql[j]) && sql[j] != '$' {
+			j++
+		}
+	}
+	if j >= len(sql) || sql[j] != '$' {
+		return "", false
+	}
+	return sql[i : j+1], true
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9' || c == '$'
+}
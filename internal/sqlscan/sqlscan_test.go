@@ -0,0 +1,112 @@
+package sqlscan_test
+
+import (
+	"testing"
+
+	"github.com/jackc/pgproto3/v2/internal/sqlscan"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplit(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		sql      string
+		expected []string
+	}{
+		{"", nil},
+		{" ; ;", nil},
+		{"select 1", []string{"select 1"}},
+		{"select 1; select 2;", []string{"select 1", "select 2"}},
+		{"select ';'; select 2", []string{"select ';'", "select 2"}},
+		{"select 'it''s;'; select 2", []string{"select 'it''s;'", "select 2"}},
+		{`select E'\';'; select 2`, []string{`select E'\';'`, "select 2"}},
+		{`select '\'; select 2`, []string{`select '\'`, "select 2"}},
+		{`select ";"; select 2`, []string{`select ";"`, "select 2"}},
+		{"select $$;$$; select $tag$ $$; $tag$; select 2", []string{"select $$;$$", "select $tag$ $$; $tag$", "select 2"}},
+		{"select $1; select a$b; select 2", []string{"select $1", "select a$b", "select 2"}},
+		{"select 1 -- ;\n; select 2", []string{"select 1 -- ;", "select 2"}},
+		{"select /* /* ; */ ; */ 1; select 2", []string{"select /* /* ; */ ; */ 1", "select 2"}},
+		{"select 1; -- trailing comment", []string{"select 1"}},
+		{"select 'unterminated;", []string{"select 'unterminated;"}},
+	}
+
+	for i, tt := range tests {
+		assert.Equalf(t, tt.expected, sqlscan.Split(tt.sql), "%d. %q", i, tt.sql)
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		stmt     string
+		n        int
+		expected []string
+	}{
+		{"drop table users", 2, []string{"DROP", "TABLE"}},
+		{"drop table users", 5, []string{"DROP", "TABLE", "USERS"}},
+		{"/* comment */ -- comment\n Truncate\tusers", 1, []string{"TRUNCATE"}},
+		{"select * from users", 3, []string{"SELECT"}},
+		{`drop table "users"`, 3, []string{"DROP", "TABLE"}},
+		{"(select 1)", 1, nil},
+		{"", 1, nil},
+	}
+
+	for i, tt := range tests {
+		assert.Equalf(t, tt.expected, sqlscan.Keywords(tt.stmt, tt.n), "%d. %q", i, tt.stmt)
+	}
+}
+
+func TestIdentifier(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		stmt     string
+		n        int
+		expected string
+		ok       bool
+	}{
+		{"deallocate Stmt1", 1, "stmt1", true},
+		{"DEALLOCATE PREPARE /* comment */ stmt1", 2, "stmt1", true},
+		{`deallocate "Stmt ""1"""`, 1, `Stmt "1"`, true},
+		{"set search_path = app", 1, "search_path", true},
+		{"set search_path = app", 3, "", false},
+		{`deallocate "unterminated`, 1, "", false},
+		{"deallocate", 1, "", false},
+	}
+
+	for i, tt := range tests {
+		name, ok := sqlscan.Identifier(tt.stmt, tt.n)
+		assert.Equalf(t, tt.ok, ok, "%d. %q", i, tt.stmt)
+		assert.Equalf(t, tt.expected, name, "%d. %q", i, tt.stmt)
+	}
+}
+
+func TestIdentifierRest(t *testing.T) {
+	t.Parallel()
+
+	name, rest, ok := sqlscan.IdentifierRest("PREPARE Stmt1 (int) AS select $1", 1)
+	assert.True(t, ok)
+	assert.Equal(t, "stmt1", name)
+	assert.Equal(t, " (int) AS select $1", rest)
+
+	name, rest, ok = sqlscan.IdentifierRest(`execute "S;1"(2)`, 1)
+	assert.True(t, ok)
+	assert.Equal(t, "S;1", name)
+	assert.Equal(t, "(2)", rest)
+
+	_, _, ok = sqlscan.IdentifierRest("execute", 1)
+	assert.False(t, ok)
+}
+
+func TestWords(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t,
+		[]string{"SELECT", "A", "FROM", "T", "WHERE", "B", "FOR", "UPDATE"},
+		sqlscan.Words(`select a, "Insert" from t /* delete */ where b = 'update' -- into
+for update`),
+	)
+	assert.Equal(t, []string{"SELECT", "E"}, sqlscan.Words(`select e, E'\' insert'`))
+}
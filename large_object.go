@@ -0,0 +1,171 @@
+package pgproto3
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Modes of LargeObjects.Open. They can be combined.
+const (
+	LargeObjectModeWrite int32 = 0x20000
+	LargeObjectModeRead  int32 = 0x40000
+)
+
+// largeObjectFunctions are the server functions used by LargeObjects.
+var largeObjectFunctions = []string{"lo_creat", "lo_open", "lo_close", "loread", "lowrite", "lo_lseek64", "lo_truncate64", "lo_unlink"}
+
+// maxLargeObjectChunk is the most data read or written by a single function call.
+const maxLargeObjectChunk = 1 << 20
+
+// LargeObjects creates, opens and removes large objects with the function call sub-protocol. It is created by
+// Frontend.LargeObjects.
+//
+// Large objects can only be used in a transaction block. The Frontend's transaction status is checked before every
+// call and descriptors opened by the server are closed when the transaction ends.
+type LargeObjects struct {
+	f    *Frontend
+	oids map[string]uint32
+}
+
+// LargeObjects looks up the OIDs of the large object functions and returns a LargeObjects that calls them with f.
+func (f *Frontend) LargeObjects(ctx context.Context) (*LargeObjects, error) {
+	oids := make(map[string]uint32, len(largeObjectFunctions))
+	for _, name := range largeObjectFunctions {
+		oid, err := f.LookupFunction(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("look up %s: %w", name, err)
+		}
+		oids[name] = oid
+	}
+	return &LargeObjects{f: f, oids: oids}, nil
+}
+
+// call calls the function name and returns its result in binary format.
+func (lo *LargeObjects) call(ctx context.Context, name string, args ...interface{}) ([]byte, error) {
+	if status := lo.f.TxStatus(); status != 'T' {
+		return nil, fmt.Errorf("%s: large objects require an open transaction block: transaction status is %q", name, status)
+	}
+	return lo.f.CallFunction(ctx, lo.oids[name], 1, args...)
+}
+
+func (lo *LargeObjects) callInt32(ctx context.Context, name string, args ...interface{}) (int32, error) {
+	result, err := lo.call(ctx, name, args...)
+	if err != nil {
+		return 0, err
+	}
+	if len(result) != 4 {
+		return 0, fmt.Errorf("%s: invalid result length: %d", name, len(result))
+	}
+	return int32(binary.BigEndian.Uint32(result)), nil
+}
+
+// Create creates an empty large object and returns its OID.
+func (lo *LargeObjects) Create(ctx context.Context) (uint32, error) {
+	oid, err := lo.callInt32(ctx, "lo_creat", LargeObjectModeRead|LargeObjectModeWrite)
+	return uint32(oid), err
+}
+
+// Open opens the large object oid in mode. ctx applies to all the operations on the returned LargeObject.
+func (lo *LargeObjects) Open(ctx context.Context, oid uint32, mode int32) (*LargeObject, error) {
+	fd, err := lo.callInt32(ctx, "lo_open", oid, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &LargeObject{lo: lo, ctx: ctx, fd: fd}, nil
+}
+
+// Unlink removes the large object oid.
+func (lo *LargeObjects) Unlink(ctx context.Context, oid uint32) error {
+	_, err := lo.callInt32(ctx, "lo_unlink", oid)
+	return err
+}
+
+// LargeObject is an open large object. It implements io.ReadWriteSeeker and io.Closer. Reads and writes are sent to
+// the server in chunks of at most 1 MiB without buffering.
+//
+// The Frontend must not be used for anything else while a LargeObject method is running.
+type LargeObject struct {
+	lo  *LargeObjects
+	ctx context.Context
+	fd  int32
+}
+
+// Read reads up to len(p) bytes at the current position. It returns io.EOF at the end of the object.
+func (o *LargeObject) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(p) > maxLargeObjectChunk {
+		p = p[:maxLargeObjectChunk]
+	}
+
+	data, err := o.lo.call(o.ctx, "loread", o.fd, int32(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		return 0, io.EOF
+	}
+	if len(data) > len(p) {
+		return 0, fmt.Errorf("loread: returned %d bytes but %d were requested", len(data), len(p))
+	}
+	return copy(p, data), nil
+}
+
+// Write writes p at the current position.
+func (o *LargeObject) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxLargeObjectChunk {
+			chunk = chunk[:maxLargeObjectChunk]
+		}
+
+		written, err := o.lo.callInt32(o.ctx, "lowrite", o.fd, chunk)
+		if err != nil {
+			return n, err
+		}
+		if written < 0 || int(written) > len(chunk) {
+			return n, fmt.Errorf("lowrite: wrote %d bytes but %d were sent", written, len(chunk))
+		}
+		n += int(written)
+		if int(written) < len(chunk) {
+			return n, io.ErrShortWrite
+		}
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// Seek sets the position for the next Read or Write to offset, interpreted according to whence, and returns the new
+// position.
+func (o *LargeObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart, io.SeekCurrent, io.SeekEnd:
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+
+	result, err := o.lo.call(o.ctx, "lo_lseek64", o.fd, offset, int32(whence))
+	if err != nil {
+		return 0, err
+	}
+	if len(result) != 8 {
+		return 0, fmt.Errorf("lo_lseek64: invalid result length: %d", len(result))
+	}
+	return int64(binary.BigEndian.Uint64(result)), nil
+}
+
+// Truncate truncates or extends the object to size bytes. The position is not changed.
+func (o *LargeObject) Truncate(size int64) error {
+	_, err := o.lo.callInt32(o.ctx, "lo_truncate64", o.fd, size)
+	return err
+}
+
+// Close closes the descriptor of the object.
+func (o *LargeObject) Close() error {
+	_, err := o.lo.callInt32(o.ctx, "lo_close", o.fd)
+	return err
+}
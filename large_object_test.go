@@ -0,0 +1,417 @@
+package pgproto3_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/jackc/pgio"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// largeObjectOIDs are the PostgreSQL OIDs of the large object functions.
+var largeObjectOIDs = map[string]uint32{
+	"lo_creat":      957,
+	"lo_open":       952,
+	"lo_close":      953,
+	"loread":        954,
+	"lowrite":       955,
+	"lo_lseek64":    3170,
+	"lo_truncate64": 3172,
+	"lo_unlink":     964,
+}
+
+// largeObjectServer is a server that supports transaction control statements, function lookups and the large object
+// functions. Descriptors are closed when a transaction ends but changes to objects are not transactional.
+type largeObjectServer struct {
+	backend   *pgproto3.Backend
+	txStatus  byte
+	functions map[string]uint32
+
+	objects     map[uint32][]byte
+	descriptors map[int32]*largeObjectDescriptor
+	nextOID     uint32
+	nextFD      int32
+
+	calls      []string // the names of the functions called
+	shortWrite bool     // lowrite writes one byte less than it was sent
+}
+
+type largeObjectDescriptor struct {
+	oid uint32
+	pos int64
+}
+
+// connectLargeObjectServer returns a Frontend connected to a new largeObjectServer.
+func connectLargeObjectServer(t *testing.T) (*pgproto3.Frontend, *largeObjectServer) {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	s := &largeObjectServer{
+		backend:     pgproto3.NewBackend(pgproto3.NewChunkReader(serverConn), serverConn),
+		txStatus:    'I',
+		functions:   map[string]uint32{},
+		objects:     map[uint32][]byte{},
+		descriptors: map[int32]*largeObjectDescriptor{},
+		nextOID:     16384,
+	}
+	for name, oid := range largeObjectOIDs {
+		s.functions[name] = oid
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.serve()
+	}()
+	t.Cleanup(func() {
+		serverConn.Close()
+		<-done
+	})
+
+	return pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn), s
+}
+
+func (s *largeObjectServer) serve() {
+	var lookup string
+	var lookupErr bool
+	for {
+		msg, err := s.backend.Receive()
+		if err != nil {
+			return
+		}
+
+		var out []pgproto3.BackendMessage
+		switch msg := msg.(type) {
+		case *pgproto3.Query:
+			out = s.query(msg.String)
+		case *pgproto3.Parse:
+			out = append(out, &pgproto3.ParseComplete{})
+		case *pgproto3.Bind:
+			lookup = string(msg.Parameters[0])
+			out = append(out, &pgproto3.BindComplete{})
+		case *pgproto3.Execute:
+			if oid, ok := s.functions[lookup]; ok {
+				out = append(out,
+					&pgproto3.DataRow{Values: [][]byte{[]byte(strconv.FormatUint(uint64(oid), 10))}},
+					&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+				)
+			} else {
+				lookupErr = true
+				out = append(out, &pgproto3.ErrorResponse{Severity: "ERROR", Code: "42883", Message: fmt.Sprintf("function \"%s\" does not exist", lookup)})
+			}
+		case *pgproto3.Sync:
+			if lookupErr && s.txStatus == 'T' {
+				s.txStatus = 'E'
+			}
+			lookupErr = false
+			out = append(out, &pgproto3.ReadyForQuery{TxStatus: s.txStatus})
+		case *pgproto3.FunctionCall:
+			result, err := s.call(msg)
+			if err != nil {
+				if s.txStatus == 'T' {
+					s.txStatus = 'E'
+				}
+				out = append(out, err)
+			} else {
+				out = append(out, &pgproto3.FunctionCallResponse{Result: result})
+			}
+			out = append(out, &pgproto3.ReadyForQuery{TxStatus: s.txStatus})
+		}
+
+		for _, msg := range out {
+			if s.backend.Send(msg) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *largeObjectServer) query(sql string) []pgproto3.BackendMessage {
+	switch sql {
+	case "begin":
+		s.txStatus = 'T'
+	case "commit", "rollback":
+		s.txStatus = 'I'
+		s.descriptors = map[int32]*largeObjectDescriptor{}
+	}
+	return []pgproto3.BackendMessage{&pgproto3.CommandComplete{CommandTag: []byte(sql)}, &pgproto3.ReadyForQuery{TxStatus: s.txStatus}}
+}
+
+func (s *largeObjectServer) call(msg *pgproto3.FunctionCall) ([]byte, *pgproto3.ErrorResponse) {
+	var name string
+	for n, oid := range s.functions {
+		if oid == msg.Function {
+			name = n
+		}
+	}
+	s.calls = append(s.calls, name)
+
+	if s.txStatus == 'E' {
+		return nil, &pgproto3.ErrorResponse{Severity: "ERROR", Code: "25P02", Message: "current transaction is aborted"}
+	}
+	if msg.ResultFormatCode != 1 {
+		return nil, &pgproto3.ErrorResponse{Severity: "ERROR", Code: "0A000", Message: "expected binary result format"}
+	}
+	args := msg.Arguments
+	int32Arg := func(i int) int32 { return int32(binary.BigEndian.Uint32(args[i])) }
+	int32Result := func(n int32) []byte { return pgio.AppendInt32(nil, n) }
+
+	descriptor := func() (*largeObjectDescriptor, *pgproto3.ErrorResponse) {
+		d, ok := s.descriptors[int32Arg(0)]
+		if !ok {
+			return nil, &pgproto3.ErrorResponse{Severity: "ERROR", Code: "42704", Message: fmt.Sprintf("invalid large-object descriptor: %d", int32Arg(0))}
+		}
+		return d, nil
+	}
+
+	switch name {
+	case "lo_creat":
+		oid := s.nextOID
+		s.nextOID++
+		s.objects[oid] = nil
+		return int32Result(int32(oid)), nil
+	case "lo_open":
+		oid := binary.BigEndian.Uint32(args[0])
+		if _, ok := s.objects[oid]; !ok {
+			return nil, &pgproto3.ErrorResponse{Severity: "ERROR", Code: "42704", Message: fmt.Sprintf("large object %d does not exist", oid)}
+		}
+		fd := s.nextFD
+		s.nextFD++
+		s.descriptors[fd] = &largeObjectDescriptor{oid: oid}
+		return int32Result(fd), nil
+	case "lo_close":
+		if _, err := descriptor(); err != nil {
+			return nil, err
+		}
+		delete(s.descriptors, int32Arg(0))
+		return int32Result(0), nil
+	case "loread":
+		d, err := descriptor()
+		if err != nil {
+			return nil, err
+		}
+		data := s.objects[d.oid]
+		if d.pos >= int64(len(data)) {
+			return []byte{}, nil
+		}
+		data = data[d.pos:]
+		if n := int(int32Arg(1)); n < len(data) {
+			data = data[:n]
+		}
+		d.pos += int64(len(data))
+		return append([]byte{}, data...), nil
+	case "lowrite":
+		d, err := descriptor()
+		if err != nil {
+			return nil, err
+		}
+		data := args[1]
+		if s.shortWrite {
+			data = data[:len(data)-1]
+		}
+		obj := s.objects[d.oid]
+		for int64(len(obj)) < d.pos+int64(len(data)) {
+			obj = append(obj, 0)
+		}
+		copy(obj[d.pos:], data)
+		s.objects[d.oid] = obj
+		d.pos += int64(len(data))
+		return int32Result(int32(len(data))), nil
+	case "lo_lseek64":
+		d, err := descriptor()
+		if err != nil {
+			return nil, err
+		}
+		offset := int64(binary.BigEndian.Uint64(args[1]))
+		switch int32Arg(2) {
+		case io.SeekCurrent:
+			offset += d.pos
+		case io.SeekEnd:
+			offset += int64(len(s.objects[d.oid]))
+		}
+		d.pos = offset
+		return pgio.AppendInt64(nil, offset), nil
+	case "lo_truncate64":
+		d, err := descriptor()
+		if err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint64(args[1]))
+		obj := s.objects[d.oid]
+		for int64(len(obj)) < size {
+			obj = append(obj, 0)
+		}
+		s.objects[d.oid] = obj[:size]
+		return int32Result(0), nil
+	case "lo_unlink":
+		oid := binary.BigEndian.Uint32(args[0])
+		if _, ok := s.objects[oid]; !ok {
+			return nil, &pgproto3.ErrorResponse{Severity: "ERROR", Code: "42704", Message: fmt.Sprintf("large object %d does not exist", oid)}
+		}
+		delete(s.objects, oid)
+		return int32Result(1), nil
+	default:
+		return nil, &pgproto3.ErrorResponse{Severity: "ERROR", Code: "42883", Message: fmt.Sprintf("function %d does not exist", msg.Function)}
+	}
+}
+
+// mustExec runs sql with the simple query protocol and returns the transaction status.
+func mustExec(t *testing.T, frontend *pgproto3.Frontend, sql string) byte {
+	require.NoError(t, frontend.Send(&pgproto3.Query{String: sql}))
+	for {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		if rfq, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			return rfq.TxStatus
+		}
+	}
+}
+
+func TestLargeObjects(t *testing.T) {
+	t.Parallel()
+
+	frontend, server := connectLargeObjectServer(t)
+	ctx := context.Background()
+
+	los, err := frontend.LargeObjects(ctx)
+	require.NoError(t, err)
+
+	mustExec(t, frontend, "begin")
+	oid, err := los.Create(ctx)
+	require.NoError(t, err)
+
+	obj, err := los.Open(ctx, oid, pgproto3.LargeObjectModeRead|pgproto3.LargeObjectModeWrite)
+	require.NoError(t, err)
+
+	// Writes larger than a chunk are split.
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<17)
+	n, err := obj.Write(data)
+	require.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.Equal(t, []string{"lo_creat", "lo_open", "lowrite", "lowrite"}, server.calls)
+
+	pos, err := obj.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, pos)
+	read, err := ioutil.ReadAll(obj)
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+
+	pos, err = obj.Seek(-6, io.SeekEnd)
+	require.NoError(t, err)
+	assert.EqualValues(t, len(data)-6, pos)
+	_, err = obj.Write([]byte("ABCDEF"))
+	require.NoError(t, err)
+
+	require.NoError(t, obj.Truncate(20))
+	_, err = obj.Seek(10, io.SeekStart)
+	require.NoError(t, err)
+	buf := make([]byte, 100)
+	n, err = obj.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdef0123", string(buf[:n]))
+	_, err = obj.Read(buf)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = obj.Seek(0, 3)
+	require.Error(t, err)
+
+	require.NoError(t, obj.Close())
+
+	// The descriptor is gone once it is closed.
+	_, err = obj.Read(buf)
+	var errResp *pgproto3.ErrorResponse
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "42704", errResp.Code)
+	assert.Equal(t, byte('E'), frontend.TxStatus())
+	mustExec(t, frontend, "rollback")
+
+	mustExec(t, frontend, "begin")
+	require.NoError(t, los.Unlink(ctx, oid))
+	_, err = los.Open(ctx, oid, pgproto3.LargeObjectModeRead)
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "42704", errResp.Code)
+	mustExec(t, frontend, "rollback")
+}
+
+func TestLargeObjectsRequireTransaction(t *testing.T) {
+	t.Parallel()
+
+	frontend, server := connectLargeObjectServer(t)
+	ctx := context.Background()
+
+	los, err := frontend.LargeObjects(ctx)
+	require.NoError(t, err)
+
+	// The transaction status is unknown until the first ReadyForQuery.
+	_, err = los.Create(ctx)
+	require.Error(t, err)
+
+	mustExec(t, frontend, "begin")
+	oid, err := los.Create(ctx)
+	require.NoError(t, err)
+	obj, err := los.Open(ctx, oid, pgproto3.LargeObjectModeWrite)
+	require.NoError(t, err)
+	mustExec(t, frontend, "commit")
+
+	// Calls outside a transaction block fail without being sent to the server.
+	_, err = obj.Write([]byte("x"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "transaction block")
+	_, err = los.Open(ctx, oid, pgproto3.LargeObjectModeRead)
+	require.Error(t, err)
+	assert.Equal(t, []string{"lo_creat", "lo_open"}, server.calls)
+
+	// And in a failed transaction block.
+	mustExec(t, frontend, "begin")
+	_, err = los.Open(ctx, oid+1, pgproto3.LargeObjectModeRead)
+	require.Error(t, err)
+	_, err = los.Open(ctx, oid, pgproto3.LargeObjectModeRead)
+	require.Error(t, err)
+	assert.Equal(t, []string{"lo_creat", "lo_open", "lo_open"}, server.calls)
+}
+
+func TestLargeObjectShortWrite(t *testing.T) {
+	t.Parallel()
+
+	frontend, server := connectLargeObjectServer(t)
+	ctx := context.Background()
+
+	los, err := frontend.LargeObjects(ctx)
+	require.NoError(t, err)
+	mustExec(t, frontend, "begin")
+	oid, err := los.Create(ctx)
+	require.NoError(t, err)
+	obj, err := los.Open(ctx, oid, pgproto3.LargeObjectModeWrite)
+	require.NoError(t, err)
+
+	server.shortWrite = true
+	n, err := obj.Write([]byte("hello"))
+	assert.Equal(t, io.ErrShortWrite, err)
+	assert.Equal(t, 4, n)
+}
+
+func TestLargeObjectsMissingFunction(t *testing.T) {
+	t.Parallel()
+
+	frontend, server := connectLargeObjectServer(t)
+	delete(server.functions, "lo_truncate64")
+
+	_, err := frontend.LargeObjects(context.Background())
+	var errResp *pgproto3.ErrorResponse
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "42883", errResp.Code)
+	assert.Contains(t, err.Error(), "lo_truncate64")
+}
@@ -0,0 +1,185 @@
+package pgproto3
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// NotificationDispatcher receives messages from a Frontend and delivers the NotificationResponse messages among them
+// to subscribers. NotificationResponse can arrive at any time, including in the middle of the results of a query, so
+// all receiving must be done through the dispatcher: Receive and ReceiveContext return every message except
+// NotificationResponse.
+//
+// A notification is delivered to the subscribers of its channel and to the subscribers of all channels. A notification
+// without subscribers is queued for WaitForNotification; notifications with subscribers are never queued. The queue
+// holds at most DefaultMaxPendingNotifications notifications unless changed with SetMaxPending. When it is full the
+// oldest notification is dropped.
+//
+// Subscribe, SubscribeFunc and the returned unsubscribe functions can be called from any goroutine. Receive,
+// ReceiveContext and WaitForNotification must not be called concurrently.
+type NotificationDispatcher struct {
+	f *Frontend
+
+	mu          sync.Mutex
+	subscribers map[string][]*notificationSubscriber
+	pending     []*NotificationResponse
+	maxPending  int
+}
+
+// DefaultMaxPendingNotifications is the default number of notifications without subscribers that a
+// NotificationDispatcher queues for WaitForNotification.
+const DefaultMaxPendingNotifications = 1024
+
+type notificationSubscriber struct {
+	ch chan<- *NotificationResponse
+	fn func(*NotificationResponse)
+}
+
+// NewNotificationDispatcher returns a NotificationDispatcher that receives from f.
+func NewNotificationDispatcher(f *Frontend) *NotificationDispatcher {
+	return &NotificationDispatcher{
+		f:           f,
+		subscribers: make(map[string][]*notificationSubscriber),
+		maxPending:  DefaultMaxPendingNotifications,
+	}
+}
+
+// SetMaxPending sets the number of notifications without subscribers that are queued for WaitForNotification. If n
+// is zero or negative such notifications are dropped. Queued notifications beyond n are dropped oldest first.
+func (d *NotificationDispatcher) SetMaxPending(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if n < 0 {
+		n = 0
+	}
+	d.maxPending = n
+	d.trimPending()
+}
+
+// trimPending drops the oldest queued notifications until at most maxPending remain. d.mu must be held.
+func (d *NotificationDispatcher) trimPending() {
+	if excess := len(d.pending) - d.maxPending; excess > 0 {
+		for i := 0; i < excess; i++ {
+			d.pending[i] = nil
+		}
+		d.pending = d.pending[excess:]
+	}
+}
+
+// Receive receives the next message from the Frontend that is not a NotificationResponse. NotificationResponse
+// messages received before it are dispatched. The returned message is only valid until the next call to Receive.
+func (d *NotificationDispatcher) Receive() (BackendMessage, error) {
+	return d.ReceiveContext(context.Background())
+}
+
+// ReceiveContext is like Receive but it returns ctx.Err() if ctx is done before a message is received. See
+// Frontend.ReceiveContext.
+func (d *NotificationDispatcher) ReceiveContext(ctx context.Context) (BackendMessage, error) {
+	for {
+		msg, err := d.f.ReceiveContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if n, ok := msg.(*NotificationResponse); ok {
+			d.dispatch(n)
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// Subscribe delivers the notifications of channel to ch. If channel is empty the notifications of all channels are
+// delivered. Delivery blocks until ch accepts the notification so ch should be buffered and must be drained by a
+// goroutine other than the one receiving. The returned function stops delivery.
+func (d *NotificationDispatcher) Subscribe(channel string, ch chan<- *NotificationResponse) (unsubscribe func()) {
+	return d.subscribe(channel, &notificationSubscriber{ch: ch})
+}
+
+// SubscribeFunc calls fn with the notifications of channel. If channel is empty fn is called with the notifications
+// of all channels. fn is called by the goroutine that is receiving and must not use the Frontend. The returned
+// function stops delivery.
+func (d *NotificationDispatcher) SubscribeFunc(channel string, fn func(*NotificationResponse)) (unsubscribe func()) {
+	return d.subscribe(channel, &notificationSubscriber{fn: fn})
+}
+
+func (d *NotificationDispatcher) subscribe(channel string, s *notificationSubscriber) func() {
+	d.mu.Lock()
+	d.subscribers[channel] = append(d.subscribers[channel], s)
+	d.mu.Unlock()
+
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		subscribers := d.subscribers[channel]
+		for i, sub := range subscribers {
+			if sub == s {
+				subscribers = append(subscribers[:i:i], subscribers[i+1:]...)
+				break
+			}
+		}
+		if len(subscribers) == 0 {
+			delete(d.subscribers, channel)
+		} else {
+			d.subscribers[channel] = subscribers
+		}
+	}
+}
+
+// dispatch delivers n to its subscribers or queues it for WaitForNotification. n is copied because it is only valid
+// until the next receive.
+func (d *NotificationDispatcher) dispatch(n *NotificationResponse) {
+	d.mu.Lock()
+	var subscribers []*notificationSubscriber
+	subscribers = append(subscribers, d.subscribers[n.Channel]...)
+	if n.Channel != "" {
+		subscribers = append(subscribers, d.subscribers[""]...)
+	}
+	if len(subscribers) == 0 && d.maxPending > 0 {
+		d.pending = append(d.pending, &NotificationResponse{PID: n.PID, Channel: n.Channel, Payload: n.Payload})
+		d.trimPending()
+	}
+	d.mu.Unlock()
+
+	for _, s := range subscribers {
+		notification := &NotificationResponse{PID: n.PID, Channel: n.Channel, Payload: n.Payload}
+		if s.fn != nil {
+			s.fn(notification)
+		} else {
+			s.ch <- notification
+		}
+	}
+}
+
+// WaitForNotification returns the next notification that has no subscribers. Notifications of channels with
+// subscribers are only delivered to the subscribers and are never returned. If none is queued it receives from the
+// Frontend until one arrives or ctx is done. It must only be called when no query is in progress.
+func (d *NotificationDispatcher) WaitForNotification(ctx context.Context) (*NotificationResponse, error) {
+	for {
+		d.mu.Lock()
+		if len(d.pending) > 0 {
+			n := d.pending[0]
+			d.pending[0] = nil
+			d.pending = d.pending[1:]
+			d.mu.Unlock()
+			return n, nil
+		}
+		d.mu.Unlock()
+
+		msg, err := d.f.ReceiveContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg := msg.(type) {
+		case *NotificationResponse:
+			d.dispatch(msg)
+		case *ParameterStatus, *NoticeResponse:
+		default:
+			return nil, fmt.Errorf("unexpected message while waiting for notification: %T", msg)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package pgproto3_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDispatcherPipe(t *testing.T) (*pgproto3.NotificationDispatcher, net.Conn) {
+	clientConn, serverConn := newPipe(t)
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)
+	return pgproto3.NewNotificationDispatcher(frontend), serverConn
+}
+
+func TestNotificationDispatcherReceive(t *testing.T) {
+	t.Parallel()
+
+	d, serverConn := newDispatcherPipe(t)
+
+	jobs := make(chan *pgproto3.NotificationResponse, 10)
+	d.Subscribe("jobs", jobs)
+	var all []string
+	d.SubscribeFunc("", func(n *pgproto3.NotificationResponse) { all = append(all, n.Channel+":"+n.Payload) })
+
+	writeMessages(t, serverConn,
+		&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("n")}}},
+		&pgproto3.NotificationResponse{PID: 1, Channel: "jobs", Payload: "1"},
+		&pgproto3.DataRow{Values: [][]byte{[]byte("1")}},
+		&pgproto3.NotificationResponse{PID: 1, Channel: "other", Payload: "x"},
+		&pgproto3.NotificationResponse{PID: 1, Channel: "jobs", Payload: "2"},
+		&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	)
+
+	var types []string
+	for {
+		msg, err := d.Receive()
+		require.NoError(t, err)
+		_, isNotification := msg.(*pgproto3.NotificationResponse)
+		require.False(t, isNotification)
+		types = append(types, fmt.Sprintf("%T", msg))
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+	assert.Equal(t, []string{"*pgproto3.RowDescription", "*pgproto3.DataRow", "*pgproto3.CommandComplete", "*pgproto3.ReadyForQuery"}, types)
+
+	require.Len(t, jobs, 2)
+	assert.Equal(t, &pgproto3.NotificationResponse{PID: 1, Channel: "jobs", Payload: "1"}, <-jobs)
+	assert.Equal(t, &pgproto3.NotificationResponse{PID: 1, Channel: "jobs", Payload: "2"}, <-jobs)
+	assert.Equal(t, []string{"jobs:1", "other:x", "jobs:2"}, all)
+}
+
+func TestNotificationDispatcherWaitForNotification(t *testing.T) {
+	t.Parallel()
+
+	d, serverConn := newDispatcherPipe(t)
+
+	jobs := make(chan *pgproto3.NotificationResponse, 10)
+	unsubscribe := d.Subscribe("jobs", jobs)
+
+	writeMessages(t, serverConn,
+		&pgproto3.NotificationResponse{PID: 1, Channel: "jobs", Payload: "1"},
+		&pgproto3.ParameterStatus{Name: "TimeZone", Value: "UTC"},
+		&pgproto3.NotificationResponse{PID: 1, Channel: "other", Payload: "x"},
+	)
+
+	n, err := d.WaitForNotification(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.NotificationResponse{PID: 1, Channel: "other", Payload: "x"}, n)
+	assert.Equal(t, &pgproto3.NotificationResponse{PID: 1, Channel: "jobs", Payload: "1"}, <-jobs)
+
+	unsubscribe()
+	writeMessages(t, serverConn, &pgproto3.NotificationResponse{PID: 1, Channel: "jobs", Payload: "2"})
+	n, err = d.WaitForNotification(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "2", n.Payload)
+	assert.Len(t, jobs, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = d.WaitForNotification(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestNotificationDispatcherQueuesDuringQuery(t *testing.T) {
+	t.Parallel()
+
+	d, serverConn := newDispatcherPipe(t)
+
+	writeMessages(t, serverConn,
+		&pgproto3.NotificationResponse{PID: 1, Channel: "jobs", Payload: "1"},
+		&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	)
+	for i := 0; i < 2; i++ {
+		_, err := d.Receive()
+		require.NoError(t, err)
+	}
+
+	// The notification that arrived during the query is not lost.
+	n, err := d.WaitForNotification(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.NotificationResponse{PID: 1, Channel: "jobs", Payload: "1"}, n)
+}
+
+func TestNotificationDispatcherDropsOldestPending(t *testing.T) {
+	t.Parallel()
+
+	d, serverConn := newDispatcherPipe(t)
+	d.SetMaxPending(2)
+
+	writeMessages(t, serverConn,
+		&pgproto3.NotificationResponse{PID: 1, Channel: "jobs", Payload: "1"},
+		&pgproto3.NotificationResponse{PID: 1, Channel: "jobs", Payload: "2"},
+		&pgproto3.NotificationResponse{PID: 1, Channel: "jobs", Payload: "3"},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	)
+	_, err := d.Receive()
+	require.NoError(t, err)
+
+	var payloads []string
+	for i := 0; i < 2; i++ {
+		n, err := d.WaitForNotification(context.Background())
+		require.NoError(t, err)
+		payloads = append(payloads, n.Payload)
+	}
+	assert.Equal(t, []string{"2", "3"}, payloads)
+}
@@ -0,0 +1,391 @@
+package pgpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// clientConn is a client connected to the pool.
+type clientConn struct {
+	pool    *Pool
+	conn    net.Conn
+	backend *pgproto3.Backend
+	sendMu  sync.Mutex // guards backend.Send; acquired before mu when both are held
+
+	sp  *serverPool
+	key *pgproto3.BackendKeyData
+
+	mu         sync.Mutex
+	params     map[string]string // tracked parameter values keyed by lower case name
+	statements map[string]*clientStatement
+	unnamed    *pgproto3.Parse // the client's most recent unnamed Parse
+	unnamedGen uint64          // incremented for each unnamed Parse
+	server     *serverConn
+	responses  []pendingResponse
+	txStatus   byte // transaction status of the last ReadyForQuery from the server
+	aborted    bool // the server is discarding extended protocol messages until Sync
+	discarding bool // the pool is discarding extended protocol messages until Sync
+	unsynced   bool // extended protocol messages have been sent since the last Sync
+	closing    bool
+	pumpDone   chan struct{}
+}
+
+func newClientConn(p *Pool, conn net.Conn) *clientConn {
+	return &clientConn{
+		pool:       p,
+		conn:       conn,
+		backend:    pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn),
+		statements: make(map[string]*clientStatement),
+	}
+}
+
+func (c *clientConn) run() error {
+	defer c.conn.Close()
+
+	startup, err := c.receiveStartupMessage()
+	if err != nil {
+		return err
+	}
+	if startup == nil {
+		return nil
+	}
+
+	err = c.handleStartup(startup)
+	if err != nil {
+		return err
+	}
+	defer c.pool.cancels.Unregister(c.key)
+
+	err = c.serve()
+	c.disconnect()
+
+	c.mu.Lock()
+	c.forgetStatements()
+	c.mu.Unlock()
+
+	return err
+}
+
+// receiveStartupMessage returns the client's StartupMessage. It returns nil if the client only sent a CancelRequest.
+func (c *clientConn) receiveStartupMessage() (*pgproto3.StartupMessage, error) {
+	for {
+		msg, err := c.backend.ReceiveStartupMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.SSLRequest, *pgproto3.GSSEncRequest:
+			_, err = c.conn.Write([]byte("N"))
+			if err != nil {
+				return nil, err
+			}
+		case *pgproto3.CancelRequest:
+			return nil, c.pool.cancel(context.Background(), msg)
+		case *pgproto3.StartupMessage:
+			return msg, nil
+		default:
+			return nil, fmt.Errorf("unexpected startup message: %T", msg)
+		}
+	}
+}
+
+func (c *clientConn) handleStartup(startup *pgproto3.StartupMessage) error {
+	if _, ok := startup.Parameters["replication"]; ok {
+		return c.sendFatal("0A000", "replication connections are not supported by the pool")
+	}
+
+	user := startup.Parameters["user"]
+	if user == "" {
+		return c.sendFatal("28000", "no PostgreSQL user name specified in startup packet")
+	}
+	database := startup.Parameters["database"]
+	if database == "" {
+		database = user
+	}
+
+	if c.pool.config.Authenticate != nil {
+		err := c.pool.config.Authenticate(c.backend, startup)
+		if err != nil {
+			c.sendFatal("28P01", err.Error())
+			return err
+		}
+	}
+
+	var err error
+	c.sp, err = c.pool.getServerPool(user, database)
+	if err != nil {
+		c.sendFatal("08006", err.Error())
+		return err
+	}
+
+	ps, err := c.sp.initialParameterStatus(context.Background())
+	if err != nil {
+		c.sendServerError(err)
+		return err
+	}
+
+	c.params = make(map[string]string, len(c.pool.tracked))
+	for name, value := range ps {
+		if lowerName := strings.ToLower(name); c.isTracked(lowerName) {
+			c.params[lowerName] = value
+		}
+	}
+	for name, value := range startup.Parameters {
+		if lowerName := strings.ToLower(name); c.isTracked(lowerName) {
+			c.params[lowerName] = value
+		}
+	}
+
+	c.key, err = c.pool.cancels.Register(nil)
+	if err != nil {
+		return err
+	}
+
+	err = c.send(&pgproto3.AuthenticationOk{})
+	if err != nil {
+		return err
+	}
+	for name, value := range ps {
+		if clientValue, ok := c.params[strings.ToLower(name)]; ok {
+			value = clientValue
+		}
+		err = c.send(&pgproto3.ParameterStatus{Name: name, Value: value})
+		if err != nil {
+			return err
+		}
+	}
+	err = c.send(c.key)
+	if err != nil {
+		return err
+	}
+	return c.send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+}
+
+func (c *clientConn) isTracked(lowerName string) bool {
+	_, ok := c.pool.tracked[lowerName]
+	return ok
+}
+
+func (c *clientConn) serve() error {
+	for {
+		msg, err := c.backend.Receive()
+		if err != nil {
+			return err
+		}
+
+		if _, ok := msg.(*pgproto3.Terminate); ok {
+			return nil
+		}
+
+		err = c.forward(msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// forward sends msg to the server connection assigned to the client, assigning one first if necessary.
+func (c *clientConn) forward(msg pgproto3.FrontendMessage) error {
+	c.mu.Lock()
+	sc := c.server
+	if sc == nil {
+		c.mu.Unlock()
+		var err error
+		sc, err = c.assignServer()
+		if err != nil {
+			c.sendServerError(err)
+			return err
+		}
+		c.mu.Lock()
+	}
+	out := c.rewrite(sc, msg)
+	c.mu.Unlock()
+
+	c.deliverAnswered()
+
+	for _, msg := range out {
+		err := sc.frontend.Send(msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverAnswered sends responses the pool answered itself that are no longer waiting on the server.
+func (c *clientConn) deliverAnswered() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	c.mu.Lock()
+	out := c.takeAnswered(nil)
+	c.mu.Unlock()
+
+	for _, msg := range out {
+		c.backend.Send(msg)
+	}
+}
+
+// assignServer acquires a server connection, brings its session parameters in line with the client's and starts
+// relaying its messages to the client.
+func (c *clientConn) assignServer() (*serverConn, error) {
+	sc, err := c.sp.acquire(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	err = sc.setParameters(c.pool.tracked, c.params)
+	c.mu.Unlock()
+	if err != nil {
+		c.sp.discard(sc)
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	c.mu.Lock()
+	c.server = sc
+	c.pool.cancels.Assign(c.key, &pgproto3.BackendKeyData{ProcessID: sc.processID, SecretKey: sc.secretKey})
+	c.responses = nil
+	c.txStatus = 'I'
+	c.aborted = false
+	c.discarding = false
+	c.unsynced = false
+	c.pumpDone = done
+	c.mu.Unlock()
+
+	go c.pump(sc, done)
+
+	return sc, nil
+}
+
+// pump relays messages from sc to the client until the server reports it is idle with no outstanding requests.
+func (c *clientConn) pump(sc *serverConn, done chan struct{}) {
+	defer close(done)
+
+	for {
+		msg, err := sc.frontend.Receive()
+		if err != nil {
+			c.mu.Lock()
+			c.server = nil
+			c.pool.cancels.Assign(c.key, nil)
+			c.mu.Unlock()
+			c.sp.discard(sc)
+			// The client's transaction is gone with the server connection.
+			c.conn.Close()
+			return
+		}
+
+		if msg, ok := msg.(*pgproto3.ParameterStatus); ok {
+			sc.parameterStatus[msg.Name] = msg.Value
+			if lowerName := strings.ToLower(msg.Name); c.isTracked(lowerName) {
+				c.mu.Lock()
+				c.params[lowerName] = msg.Value
+				c.mu.Unlock()
+			}
+		}
+
+		// Responses are matched with requests and delivered under sendMu so responses the pool answers itself are
+		// interleaved in order and a server connection assigned for the client's next message cannot deliver its
+		// responses before the ReadyForQuery that released this one.
+		c.sendMu.Lock()
+		c.mu.Lock()
+		out := c.handleResponse(msg)
+		rfq, ok := msg.(*pgproto3.ReadyForQuery)
+		release := ok && len(c.responses) == 0 && !c.unsynced && rfq.TxStatus == 'I'
+		if release {
+			c.server = nil
+			c.pool.cancels.Assign(c.key, nil)
+		}
+		closing := c.closing
+		c.mu.Unlock()
+		// Errors writing to the client are detected by the client goroutine. The server conversation is still
+		// completed so the server connection can be reused.
+		for _, msg := range out {
+			c.backend.Send(msg)
+		}
+		c.sendMu.Unlock()
+
+		if release {
+			c.releaseServer(sc, closing)
+			return
+		}
+	}
+}
+
+func (c *clientConn) releaseServer(sc *serverConn, closing bool) {
+	if closing || c.pool.config.ResetQueryAlways {
+		err := sc.exec(c.pool.config.ResetQuery)
+		if err != nil {
+			c.sp.discard(sc)
+			return
+		}
+		sc.forgetStatements()
+	} else if err := sc.closeStatements(c.sp.unusedStatements(sc)); err != nil {
+		c.sp.discard(sc)
+		return
+	}
+
+	c.sp.release(sc)
+}
+
+// disconnect ends the client's use of its assigned server connection, if any. A server connection that is idle in a
+// transaction is rolled back and returned to the pool. A server connection that is busy is closed.
+func (c *clientConn) disconnect() {
+	c.conn.Close()
+
+	c.mu.Lock()
+	c.closing = true
+	sc := c.server
+	done := c.pumpDone
+	idle := len(c.responses) == 0 && !c.unsynced
+	if sc != nil && idle {
+		c.expect('Q', forwardResponse, nil)
+	}
+	c.mu.Unlock()
+
+	if sc != nil {
+		if !idle || sc.frontend.Send(&pgproto3.Query{String: "ROLLBACK"}) != nil {
+			sc.conn.Close()
+		}
+	}
+
+	if done != nil {
+		<-done
+	}
+}
+
+func (c *clientConn) send(msg pgproto3.BackendMessage) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.backend.Send(msg)
+}
+
+func (c *clientConn) sendFatal(code, message string) error {
+	err := c.send(&pgproto3.ErrorResponse{Severity: "FATAL", SeverityUnlocalized: "FATAL", Code: code, Message: message})
+	if err != nil {
+		return err
+	}
+	return errors.New(message)
+}
+
+// sendServerError reports a failure to obtain or prepare a server connection to the client. The client connection is
+// closed afterwards so the error is always sent as FATAL, even if the server reported it as an ERROR.
+func (c *clientConn) sendServerError(err error) {
+	var errResp *pgproto3.ErrorResponse
+	if errors.As(err, &errResp) {
+		fatal := *errResp
+		fatal.Severity = "FATAL"
+		fatal.SeverityUnlocalized = "FATAL"
+		c.send(&fatal)
+		return
+	}
+	c.sendFatal("08006", err.Error())
+}
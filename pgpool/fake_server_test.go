@@ -0,0 +1,366 @@
+package pgpool_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// fakeServer is a minimal PostgreSQL server that understands just enough SQL to exercise the pool.
+type fakeServer struct {
+	password string
+
+	mu         sync.Mutex
+	nextPID    uint32
+	queries    map[uint32][]string          // statements executed by each server connection
+	statements map[uint32]map[string]string // prepared statements of each server connection
+	cancels    chan pgproto3.CancelRequest
+	connects   int
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{
+		password:   "secret",
+		queries:    make(map[uint32][]string),
+		statements: make(map[uint32]map[string]string),
+		cancels:    make(chan pgproto3.CancelRequest, 10),
+	}
+}
+
+func (fs *fakeServer) dial(ctx context.Context) (net.Conn, error) {
+	clientConn, serverConn := net.Pipe()
+	go fs.serve(serverConn)
+	return clientConn, nil
+}
+
+func (fs *fakeServer) executed(pid uint32) []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]string(nil), fs.queries[pid]...)
+}
+
+// prepared returns the names of the statements prepared on the server connection pid.
+func (fs *fakeServer) prepared(pid uint32) []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	names := []string{}
+	for name := range fs.statements[pid] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (fs *fakeServer) connectCount() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.connects
+}
+
+type fakeSession struct {
+	fs       *fakeServer
+	backend  *pgproto3.Backend
+	pid      uint32
+	txStatus byte
+	params   map[string]string
+	portals  map[string]string
+	failed   bool // an error occurred in the extended protocol and messages are ignored until Sync
+}
+
+func (fs *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	msg, err := backend.ReceiveStartupMessage()
+	if err != nil {
+		return
+	}
+
+	switch msg := msg.(type) {
+	case *pgproto3.CancelRequest:
+		fs.cancels <- *msg
+		return
+	case *pgproto3.StartupMessage:
+	default:
+		return
+	}
+
+	backend.Send(&pgproto3.AuthenticationCleartextPassword{})
+	backend.SetAuthType(pgproto3.AuthTypeCleartextPassword)
+	msg, err = backend.Receive()
+	if err != nil {
+		return
+	}
+	if pw, ok := msg.(*pgproto3.PasswordMessage); !ok || pw.Password != fs.password {
+		backend.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "28P01", Message: "password authentication failed"})
+		return
+	}
+
+	fs.mu.Lock()
+	fs.nextPID++
+	fs.connects++
+	pid := fs.nextPID
+	fs.statements[pid] = make(map[string]string)
+	fs.mu.Unlock()
+
+	s := &fakeSession{
+		fs:       fs,
+		backend:  backend,
+		pid:      pid,
+		txStatus: 'I',
+		params: map[string]string{
+			"application_name": "",
+			"client_encoding":  "UTF8",
+			"TimeZone":         "UTC",
+			"server_version":   "14.0",
+		},
+		portals: make(map[string]string),
+	}
+
+	backend.Send(&pgproto3.AuthenticationOk{})
+	for name, value := range s.params {
+		backend.Send(&pgproto3.ParameterStatus{Name: name, Value: value})
+	}
+	backend.Send(&pgproto3.BackendKeyData{ProcessID: pid, SecretKey: pid * 7})
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.Query:
+			if strings.TrimSpace(msg.String) == "" {
+				backend.Send(&pgproto3.EmptyQueryResponse{})
+			}
+			for _, sql := range strings.Split(msg.String, ";") {
+				if sql = strings.TrimSpace(sql); sql == "" {
+					continue
+				}
+				if err := s.execute(sql, true); err != nil {
+					s.sendError(err)
+					break
+				}
+			}
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: s.txStatus})
+		case *pgproto3.Sync:
+			s.failed = false
+			delete(s.portals, "")
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: s.txStatus})
+		case *pgproto3.Terminate:
+			return
+		default:
+			if !s.failed {
+				if err := s.extended(msg); err != nil {
+					s.sendError(err)
+					s.failed = true
+				}
+			}
+		}
+	}
+}
+
+func (s *fakeSession) extended(msg pgproto3.FrontendMessage) error {
+	switch msg := msg.(type) {
+	case *pgproto3.Parse:
+		if _, exists := s.statement(msg.Name); exists && msg.Name != "" {
+			return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "42P05", Message: fmt.Sprintf("prepared statement %q already exists", msg.Name)}
+		}
+		s.setStatement(msg.Name, msg.Query)
+		return s.backend.Send(&pgproto3.ParseComplete{})
+	case *pgproto3.Bind:
+		sql, ok := s.statement(msg.PreparedStatement)
+		if !ok {
+			return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "26000", Message: fmt.Sprintf("prepared statement %q does not exist", msg.PreparedStatement)}
+		}
+		s.portals[msg.DestinationPortal] = sql
+		return s.backend.Send(&pgproto3.BindComplete{})
+	case *pgproto3.Describe:
+		var sql string
+		var ok bool
+		if msg.ObjectType == 'S' {
+			sql, ok = s.statement(msg.Name)
+		} else {
+			sql, ok = s.portals[msg.Name]
+		}
+		if !ok {
+			return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "26000", Message: fmt.Sprintf("%c %q does not exist", msg.ObjectType, msg.Name)}
+		}
+		if msg.ObjectType == 'S' {
+			s.backend.Send(&pgproto3.ParameterDescription{})
+		}
+		if fields := resultFields(sql); fields != nil {
+			return s.backend.Send(&pgproto3.RowDescription{Fields: fields})
+		}
+		return s.backend.Send(&pgproto3.NoData{})
+	case *pgproto3.Execute:
+		sql, ok := s.portals[msg.Portal]
+		if !ok {
+			return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "34000", Message: fmt.Sprintf("portal %q does not exist", msg.Portal)}
+		}
+		return s.execute(sql, false)
+	case *pgproto3.Close:
+		if msg.ObjectType == 'S' {
+			s.deleteStatement(msg.Name)
+		} else {
+			delete(s.portals, msg.Name)
+		}
+		return s.backend.Send(&pgproto3.CloseComplete{})
+	case *pgproto3.Flush:
+		return nil
+	default:
+		return fmt.Errorf("unexpected message %T", msg)
+	}
+}
+
+func resultFields(sql string) []pgproto3.FieldDescription {
+	switch {
+	case sql == "SELECT pg_backend_pid()":
+		return []pgproto3.FieldDescription{{Name: []byte("pg_backend_pid"), DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1}}
+	case strings.HasPrefix(sql, "SHOW "):
+		return []pgproto3.FieldDescription{{Name: []byte(strings.TrimPrefix(sql, "SHOW ")), DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1}}
+	default:
+		return nil
+	}
+}
+
+func (s *fakeSession) execute(sql string, sendRowDescription bool) error {
+	s.fs.mu.Lock()
+	s.fs.queries[s.pid] = append(s.fs.queries[s.pid], sql)
+	s.fs.mu.Unlock()
+
+	if s.txStatus == 'E' && sql != "ROLLBACK" && sql != "COMMIT" {
+		return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "25P02", Message: "current transaction is aborted"}
+	}
+
+	var tag string
+	var row []byte
+	switch {
+	case sql == "BEGIN":
+		s.txStatus = 'T'
+		tag = "BEGIN"
+	case sql == "COMMIT", sql == "ROLLBACK":
+		s.txStatus = 'I'
+		tag = sql
+	case sql == "DISCARD ALL" && s.txStatus == 'T':
+		return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "25001", Message: "DISCARD ALL cannot run inside a transaction block"}
+	case sql == "DISCARD ALL":
+		s.fs.mu.Lock()
+		s.fs.statements[s.pid] = make(map[string]string)
+		s.fs.mu.Unlock()
+		s.setParam("application_name", "")
+		tag = "DISCARD ALL"
+	case strings.HasPrefix(sql, "DEALLOCATE "):
+		name := strings.Trim(strings.TrimPrefix(sql, "DEALLOCATE "), `"`)
+		if _, ok := s.statement(name); !ok {
+			return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "26000", Message: fmt.Sprintf("prepared statement %q does not exist", name)}
+		}
+		s.deleteStatement(name)
+		tag = "DEALLOCATE"
+	case strings.HasPrefix(sql, "PREPARE "):
+		parts := strings.SplitN(strings.TrimPrefix(sql, "PREPARE "), " AS ", 2)
+		if len(parts) != 2 {
+			return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601", Message: "syntax error"}
+		}
+		name := strings.Trim(parts[0], `"`)
+		if _, ok := s.statement(name); ok {
+			return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "42P05", Message: fmt.Sprintf("prepared statement %q already exists", name)}
+		}
+		s.setStatement(name, parts[1])
+		tag = "PREPARE"
+	case strings.HasPrefix(sql, "EXECUTE "):
+		name := strings.Trim(strings.TrimPrefix(sql, "EXECUTE "), `"`)
+		stmt, ok := s.statement(name)
+		if !ok {
+			return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "26000", Message: fmt.Sprintf("prepared statement %q does not exist", name)}
+		}
+		return s.execute(stmt, sendRowDescription)
+	case strings.HasPrefix(sql, "DO "):
+		if strings.Contains(sql, "duplicate_prepared_statement") {
+			return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "42P05", Message: "prepared statement already exists"}
+		}
+		tag = "DO"
+	case strings.HasPrefix(sql, "SET "):
+		parts := strings.SplitN(strings.TrimPrefix(sql, "SET "), " TO ", 2)
+		if len(parts) != 2 {
+			return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601", Message: "syntax error"}
+		}
+		value := strings.Replace(strings.Trim(parts[1], "'"), "''", "'", -1)
+		if value == "invalid" {
+			return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "22023", Message: "invalid value for parameter"}
+		}
+		s.setParam(strings.Trim(parts[0], `"`), value)
+		tag = "SET"
+	case sql == "SELECT pg_backend_pid()":
+		row = []byte(strconv.FormatUint(uint64(s.pid), 10))
+		tag = "SELECT 1"
+	case strings.HasPrefix(sql, "SHOW "):
+		name := strings.TrimPrefix(sql, "SHOW ")
+		for k, v := range s.params {
+			if strings.EqualFold(k, name) {
+				row = []byte(v)
+			}
+		}
+		tag = "SHOW"
+	default:
+		return &pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601", Message: "syntax error"}
+	}
+
+	if row != nil {
+		if sendRowDescription {
+			s.backend.Send(&pgproto3.RowDescription{Fields: resultFields(sql)})
+		}
+		s.backend.Send(&pgproto3.DataRow{Values: [][]byte{row}})
+	}
+	return s.backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+}
+
+func (s *fakeSession) statement(name string) (string, bool) {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	sql, ok := s.fs.statements[s.pid][name]
+	return sql, ok
+}
+
+func (s *fakeSession) setStatement(name, sql string) {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	s.fs.statements[s.pid][name] = sql
+}
+
+func (s *fakeSession) deleteStatement(name string) {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	delete(s.fs.statements[s.pid], name)
+}
+
+func (s *fakeSession) setParam(name, value string) {
+	for k := range s.params {
+		if strings.EqualFold(k, name) {
+			name = k
+		}
+	}
+	if s.params[name] != value {
+		s.params[name] = value
+		s.backend.Send(&pgproto3.ParameterStatus{Name: name, Value: value})
+	}
+}
+
+func (s *fakeSession) sendError(err error) {
+	errResp, ok := err.(*pgproto3.ErrorResponse)
+	if !ok {
+		errResp = &pgproto3.ErrorResponse{Severity: "ERROR", Code: "XX000", Message: err.Error()}
+	}
+	if s.txStatus == 'T' {
+		s.txStatus = 'E'
+	}
+	s.backend.Send(errResp)
+}
@@ -0,0 +1,333 @@
+// Package pgpool implements a transaction pooling proxy for PostgreSQL built on pgproto3.
+//
+// Clients connect to a Pool as if it were a PostgreSQL server. Each client is assigned a server connection when it
+// starts a transaction and the server connection is returned to the pool when the server reports through
+// ReadyForQuery that the session is idle again. Session parameters that the server reports with ParameterStatus (such
+// as application_name and TimeZone) are tracked per client and replayed with SET whenever a client is assigned a
+// server connection.
+//
+// Named prepared statements created with the extended query protocol follow the client from server connection to
+// server connection. The pool renames them on each server connection and prepares them again wherever the client uses
+// them, so clients may keep prepared statements across transactions.
+package pgpool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// DefaultTrackedParameters are the parameters replayed on server connections when Config.TrackedParameters is nil.
+var DefaultTrackedParameters = []string{
+	"application_name",
+	"client_encoding",
+	"DateStyle",
+	"IntervalStyle",
+	"TimeZone",
+	"standard_conforming_strings",
+}
+
+const (
+	defaultMaxServerConns = 10
+	defaultResetQuery     = "DISCARD ALL"
+)
+
+// Config configures a Pool.
+type Config struct {
+	// Dial opens a new connection to the PostgreSQL server. It is required.
+	Dial func(ctx context.Context) (net.Conn, error)
+
+	// ServerPassword returns the password used to authenticate to the server as user on database. If nil, an empty
+	// password is used.
+	ServerPassword func(user, database string) (string, error)
+
+	// Authenticate is called after a client's StartupMessage is received. It may exchange authentication messages
+	// with the client through backend but must not send AuthenticationOk. If nil, all clients are accepted.
+	Authenticate func(backend *pgproto3.Backend, startup *pgproto3.StartupMessage) error
+
+	// MaxServerConns is the maximum number of server connections for each user and database pair. Defaults to 10.
+	MaxServerConns int
+
+	// TrackedParameters are the parameters whose client values are replayed with SET when a client is assigned a
+	// server connection. Defaults to DefaultTrackedParameters.
+	TrackedParameters []string
+
+	// ResetQuery is run on a server connection before it is returned to the pool when its client disconnected while
+	// the connection was assigned. Defaults to "DISCARD ALL".
+	ResetQuery string
+
+	// ResetQueryAlways causes ResetQuery to be run every time a server connection is returned to the pool.
+	ResetQueryAlways bool
+}
+
+// Pool is a transaction pooling proxy. It is safe for concurrent use.
+type Pool struct {
+	config  Config
+	tracked map[string]string // lower case name -> name
+
+	mu          sync.Mutex
+	serverPools map[serverPoolKey]*serverPool
+	closed      bool
+
+	cancels pgproto3.CancelRegistry
+}
+
+type serverPoolKey struct {
+	user     string
+	database string
+}
+
+// New creates a new Pool.
+func New(config Config) (*Pool, error) {
+	if config.Dial == nil {
+		return nil, errors.New("pgpool: Config.Dial is required")
+	}
+	if config.MaxServerConns == 0 {
+		config.MaxServerConns = defaultMaxServerConns
+	}
+	if config.MaxServerConns < 0 {
+		return nil, errors.New("pgpool: Config.MaxServerConns must be positive")
+	}
+	if config.TrackedParameters == nil {
+		config.TrackedParameters = DefaultTrackedParameters
+	}
+	if config.ResetQuery == "" {
+		config.ResetQuery = defaultResetQuery
+	}
+
+	p := &Pool{
+		config:      config,
+		tracked:     make(map[string]string, len(config.TrackedParameters)),
+		serverPools: make(map[serverPoolKey]*serverPool),
+	}
+	for _, name := range config.TrackedParameters {
+		p.tracked[strings.ToLower(name)] = name
+	}
+
+	return p, nil
+}
+
+// Serve accepts client connections on ln and serves each in its own goroutine. It returns when ln.Accept fails.
+func (p *Pool) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go p.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single client connection until the client disconnects. conn is closed when ServeConn returns.
+func (p *Pool) ServeConn(conn net.Conn) error {
+	c := newClientConn(p, conn)
+	return c.run()
+}
+
+// Close closes all idle server connections. Server connections currently assigned to clients are closed when they are
+// released.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	pools := make([]*serverPool, 0, len(p.serverPools))
+	for _, sp := range p.serverPools {
+		pools = append(pools, sp)
+	}
+	p.mu.Unlock()
+
+	for _, sp := range pools {
+		sp.close()
+	}
+
+	return nil
+}
+
+func (p *Pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+func (p *Pool) getServerPool(user, database string) (*serverPool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, errors.New("pgpool: pool is closed")
+	}
+
+	key := serverPoolKey{user: user, database: database}
+	sp, ok := p.serverPools[key]
+	if !ok {
+		sp = newServerPool(p, user, database)
+		p.serverPools[key] = sp
+	}
+
+	return sp, nil
+}
+
+// cancel forwards a CancelRequest from a client to the server connection currently assigned to that client.
+func (p *Pool) cancel(ctx context.Context, req *pgproto3.CancelRequest) error {
+	return p.cancels.Forward(ctx, req, p.config.Dial)
+}
+
+// serverPool holds the server connections for a single user and database.
+type serverPool struct {
+	pool     *Pool
+	user     string
+	database string
+
+	sem chan struct{}
+
+	mu              sync.Mutex
+	idle            []*serverConn
+	parameterStatus map[string]string
+
+	// refs counts the client statements with each statement key. A server statement whose key is not referenced is
+	// closed when its server connection is released.
+	refs map[string]int
+}
+
+func newServerPool(p *Pool, user, database string) *serverPool {
+	return &serverPool{
+		pool:     p,
+		user:     user,
+		database: database,
+		sem:      make(chan struct{}, p.config.MaxServerConns),
+		refs:     make(map[string]int),
+	}
+}
+
+// acquire returns an idle server connection or establishes a new one. It blocks while MaxServerConns connections are
+// in use.
+func (sp *serverPool) acquire(ctx context.Context) (*serverConn, error) {
+	select {
+	case sp.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	sp.mu.Lock()
+	if n := len(sp.idle); n > 0 {
+		sc := sp.idle[n-1]
+		sp.idle = sp.idle[:n-1]
+		sp.mu.Unlock()
+		return sc, nil
+	}
+	sp.mu.Unlock()
+
+	sc, err := connectServer(ctx, sp)
+	if err != nil {
+		<-sp.sem
+		return nil, err
+	}
+
+	sp.mu.Lock()
+	if sp.parameterStatus == nil {
+		sp.parameterStatus = make(map[string]string, len(sc.parameterStatus))
+		for k, v := range sc.parameterStatus {
+			sp.parameterStatus[k] = v
+		}
+	}
+	sp.mu.Unlock()
+
+	return sc, nil
+}
+
+// release returns sc to the pool.
+func (sp *serverPool) release(sc *serverConn) {
+	if sp.pool.isClosed() {
+		sp.discard(sc)
+		return
+	}
+
+	sp.mu.Lock()
+	sp.idle = append(sp.idle, sc)
+	sp.mu.Unlock()
+	<-sp.sem
+}
+
+// discard closes sc and frees its slot in the pool.
+func (sp *serverPool) discard(sc *serverConn) {
+	sc.close()
+	<-sp.sem
+}
+
+// initialParameterStatus returns the ParameterStatus values reported by the server at startup. It establishes a server
+// connection if none has been made yet.
+func (sp *serverPool) initialParameterStatus(ctx context.Context) (map[string]string, error) {
+	sp.mu.Lock()
+	ps := sp.parameterStatus
+	sp.mu.Unlock()
+	if ps != nil {
+		return ps, nil
+	}
+
+	sc, err := sp.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sp.release(sc)
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.parameterStatus, nil
+}
+
+// ref records a client statement with key.
+func (sp *serverPool) ref(key string) {
+	sp.mu.Lock()
+	sp.refs[key]++
+	sp.mu.Unlock()
+}
+
+// unref removes a client statement with key and reports whether no client statement uses key any longer.
+func (sp *serverPool) unref(key string) bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sp.refs[key]--
+	if sp.refs[key] > 0 {
+		return false
+	}
+	delete(sp.refs, key)
+	return true
+}
+
+// refCount returns the number of client statements that use key.
+func (sp *serverPool) refCount(key string) int {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.refs[key]
+}
+
+// unusedStatements removes the statements prepared on sc that no client statement uses from sc.prepared and returns
+// their server names.
+func (sp *serverPool) unusedStatements(sc *serverConn) []string {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	var names []string
+	for key, name := range sc.prepared {
+		if sp.refs[key] == 0 {
+			names = append(names, name)
+			delete(sc.prepared, key)
+		}
+	}
+	return names
+}
+
+func (sp *serverPool) close() {
+	sp.mu.Lock()
+	idle := sp.idle
+	sp.idle = nil
+	sp.mu.Unlock()
+
+	for _, sc := range idle {
+		sc.close()
+	}
+}
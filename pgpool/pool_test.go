@@ -0,0 +1,226 @@
+package pgpool_test
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/pgpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPool(t *testing.T, fs *fakeServer, maxServerConns int) *pgpool.Pool {
+	pool, err := pgpool.New(pgpool.Config{
+		Dial: fs.dial,
+		ServerPassword: func(user, database string) (string, error) {
+			return fs.password, nil
+		},
+		MaxServerConns: maxServerConns,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { pool.Close() })
+	return pool
+}
+
+type testClient struct {
+	conn     net.Conn
+	frontend *pgproto3.Frontend
+	startup  *pgproto3.StartupResult
+}
+
+func connectClient(t *testing.T, pool *pgpool.Pool, params map[string]string) *testClient {
+	clientConn, poolConn := net.Pipe()
+	go pool.ServeConn(poolConn)
+	t.Cleanup(func() { clientConn.Close() })
+
+	if params == nil {
+		params = map[string]string{}
+	}
+	params["user"] = "jack"
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)
+	result, err := frontend.Startup(&pgproto3.StartupConfig{Parameters: params})
+	require.NoError(t, err)
+
+	return &testClient{conn: clientConn, frontend: frontend, startup: result}
+}
+
+// query runs sql and returns the first value of each row and the transaction status.
+func (c *testClient) query(t *testing.T, sql string) ([]string, byte) {
+	err := c.frontend.Send(&pgproto3.Query{String: sql})
+	require.NoError(t, err)
+	return c.readResults(t)
+}
+
+func (c *testClient) readResults(t *testing.T) ([]string, byte) {
+	var values []string
+	for {
+		msg, err := c.frontend.Receive()
+		require.NoError(t, err)
+		switch msg := msg.(type) {
+		case *pgproto3.DataRow:
+			values = append(values, string(msg.Values[0]))
+		case *pgproto3.ErrorResponse:
+			t.Fatalf("unexpected error: %v", msg)
+		case *pgproto3.ReadyForQuery:
+			return values, msg.TxStatus
+		}
+	}
+}
+
+func (c *testClient) backendPID(t *testing.T) uint32 {
+	values, _ := c.query(t, "SELECT pg_backend_pid()")
+	require.Len(t, values, 1)
+	pid, err := strconv.ParseUint(values[0], 10, 32)
+	require.NoError(t, err)
+	return uint32(pid)
+}
+
+func TestPoolSharesServerConnBetweenTransactions(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	a := connectClient(t, pool, nil)
+	b := connectClient(t, pool, nil)
+
+	_, txStatus := a.query(t, "BEGIN")
+	require.Equal(t, byte('T'), txStatus)
+
+	bPID := make(chan uint32)
+	go func() {
+		bPID <- b.backendPID(t)
+	}()
+
+	aPID := a.backendPID(t)
+
+	select {
+	case <-bPID:
+		t.Fatal("client b was assigned a server connection while client a was in a transaction")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, txStatus = a.query(t, "COMMIT")
+	require.Equal(t, byte('I'), txStatus)
+
+	select {
+	case pid := <-bPID:
+		assert.Equal(t, aPID, pid)
+	case <-time.After(5 * time.Second):
+		t.Fatal("client b was never assigned a server connection")
+	}
+
+	assert.Equal(t, 1, fs.connectCount())
+}
+
+func TestPoolReportsServerParameterStatus(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	c := connectClient(t, pool, map[string]string{"application_name": "reporting"})
+	assert.Equal(t, "14.0", c.startup.ParameterStatus["server_version"])
+	assert.Equal(t, "reporting", c.startup.ParameterStatus["application_name"])
+	assert.Equal(t, byte('I'), c.startup.TxStatus)
+}
+
+func TestPoolReplaysTrackedParameters(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	a := connectClient(t, pool, map[string]string{"application_name": "a"})
+	b := connectClient(t, pool, map[string]string{"application_name": "b"})
+
+	values, _ := a.query(t, "SHOW application_name")
+	assert.Equal(t, []string{"a"}, values)
+
+	values, _ = b.query(t, "SHOW application_name")
+	assert.Equal(t, []string{"b"}, values)
+
+	values, _ = a.query(t, "SET application_name TO 'changed'")
+	assert.Empty(t, values)
+
+	values, _ = b.query(t, "SHOW application_name")
+	assert.Equal(t, []string{"b"}, values)
+
+	values, _ = a.query(t, "SHOW application_name")
+	assert.Equal(t, []string{"changed"}, values)
+
+	assert.Equal(t, 1, fs.connectCount())
+}
+
+func TestPoolReportsServerAssignmentFailureAsFatal(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	// The server rejects the tracked parameter when the pool sets it on the server connection.
+	c := connectClient(t, pool, map[string]string{"application_name": "invalid"})
+	require.NoError(t, c.frontend.Send(&pgproto3.Query{String: "SELECT pg_backend_pid()"}))
+
+	msg, err := c.frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+	errResp := msg.(*pgproto3.ErrorResponse)
+	assert.Equal(t, "FATAL", errResp.Severity)
+	assert.Equal(t, "22023", errResp.Code)
+
+	// The pool closes the client connection.
+	_, err = c.frontend.Receive()
+	assert.Error(t, err)
+}
+
+func TestPoolForwardsCancelRequest(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	c := connectClient(t, pool, nil)
+	c.query(t, "BEGIN")
+	pid := c.backendPID(t)
+
+	cancelConn, poolConn := net.Pipe()
+	go pool.ServeConn(poolConn)
+	buf, err := (&pgproto3.CancelRequest{ProcessID: c.startup.ProcessID, SecretKey: c.startup.SecretKey}).Encode(nil)
+	require.NoError(t, err)
+	_, err = cancelConn.Write(buf)
+	require.NoError(t, err)
+	cancelConn.Close()
+
+	select {
+	case req := <-fs.cancels:
+		assert.Equal(t, pid, req.ProcessID)
+		assert.Equal(t, pid*7, req.SecretKey)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancel request was not forwarded to server")
+	}
+}
+
+func TestPoolRollsBackAndResetsOnClientDisconnect(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	a := connectClient(t, pool, nil)
+	a.query(t, "BEGIN")
+	pid := a.backendPID(t)
+	require.NoError(t, a.frontend.Send(&pgproto3.Terminate{}))
+	a.conn.Close()
+
+	b := connectClient(t, pool, nil)
+	assert.Equal(t, pid, b.backendPID(t))
+
+	executed := fs.executed(pid)
+	require.True(t, len(executed) >= 4)
+	assert.Equal(t, []string{"ROLLBACK", "DISCARD ALL"}, executed[2:4])
+}
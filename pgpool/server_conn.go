@@ -0,0 +1,186 @@
+package pgpool
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+var noDeadline time.Time
+
+// serverConn is a connection from the pool to the PostgreSQL server.
+type serverConn struct {
+	conn     net.Conn
+	frontend *pgproto3.Frontend
+
+	processID uint32
+	secretKey uint32
+
+	// parameterStatus holds the latest value of each parameter reported by the server keyed by the name the server
+	// used. It is only accessed by the goroutine that currently owns the connection.
+	parameterStatus map[string]string
+
+	// prepared maps the key of each statement prepared on the server to its server name. It and the other statement
+	// fields are guarded by the mu of the client the connection is assigned to, or owned by the goroutine releasing
+	// the connection.
+	prepared        map[string]string
+	lastStatementID uint64
+	unnamedOwner    *clientConn // client whose unnamed statement the server holds
+	unnamedGen      uint64
+}
+
+func connectServer(ctx context.Context, sp *serverPool) (*serverConn, error) {
+	config := sp.pool.config
+
+	password := ""
+	if config.ServerPassword != nil {
+		var err error
+		password, err = config.ServerPassword(sp.user, sp.database)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := config.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
+	result, err := frontend.Startup(&pgproto3.StartupConfig{
+		Parameters: map[string]string{"user": sp.user, "database": sp.database},
+		Password:   password,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(noDeadline)
+
+	return &serverConn{
+		conn:            conn,
+		frontend:        frontend,
+		processID:       result.ProcessID,
+		secretKey:       result.SecretKey,
+		parameterStatus: result.ParameterStatus,
+		prepared:        make(map[string]string),
+	}, nil
+}
+
+// exec runs sql with the simple query protocol and waits for the server to become ready again.
+func (sc *serverConn) exec(sql string) error {
+	err := sc.frontend.Send(&pgproto3.Query{String: sql})
+	if err != nil {
+		return err
+	}
+	// A simple query destroys the unnamed prepared statement.
+	sc.unnamedOwner = nil
+
+	return sc.awaitReady()
+}
+
+// closeStatements closes the server statements names and waits for the server to become ready again.
+func (sc *serverConn) closeStatements(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	// The messages are sent in a single write as nothing reads the responses until all of them are sent.
+	msgs := make([]pgproto3.FrontendMessage, 0, len(names)+1)
+	for _, name := range names {
+		msgs = append(msgs, &pgproto3.Close{ObjectType: 'S', Name: name})
+	}
+	msgs = append(msgs, &pgproto3.Sync{})
+
+	var buf []byte
+	for _, msg := range msgs {
+		var err error
+		buf, err = msg.Encode(buf)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := sc.conn.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	return sc.awaitReady()
+}
+
+// awaitReady receives messages until ReadyForQuery. ParameterStatus messages are recorded and all other responses are
+// discarded. The first ErrorResponse is returned as the error.
+func (sc *serverConn) awaitReady() error {
+	var queryErr error
+	for {
+		msg, err := sc.frontend.Receive()
+		if err != nil {
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.ParameterStatus:
+			sc.parameterStatus[msg.Name] = msg.Value
+		case *pgproto3.ErrorResponse:
+			if queryErr == nil {
+				errResp := *msg
+				queryErr = &errResp
+			}
+		case *pgproto3.ReadyForQuery:
+			return queryErr
+		}
+	}
+}
+
+// setParameters runs SET for each parameter in params whose value differs from the one last reported by the server.
+// params is keyed by lower case parameter name.
+func (sc *serverConn) setParameters(tracked map[string]string, params map[string]string) error {
+	current := make(map[string]string, len(sc.parameterStatus))
+	for name, value := range sc.parameterStatus {
+		current[strings.ToLower(name)] = value
+	}
+
+	var sb strings.Builder
+	for lowerName, name := range tracked {
+		value, ok := params[lowerName]
+		if !ok {
+			continue
+		}
+		if serverValue, ok := current[lowerName]; ok && serverValue == value {
+			continue
+		}
+		fmt.Fprintf(&sb, "SET %s TO %s;", quoteIdentifier(name), quoteLiteral(value))
+	}
+
+	if sb.Len() == 0 {
+		return nil
+	}
+
+	return sc.exec(sb.String())
+}
+
+func (sc *serverConn) close() error {
+	sc.frontend.Send(&pgproto3.Terminate{})
+	return sc.conn.Close()
+}
+
+func quoteIdentifier(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+func quoteLiteral(s string) string {
+	s = strings.Replace(s, `'`, `''`, -1)
+	if strings.Contains(s, `\`) {
+		return `E'` + strings.Replace(s, `\`, `\\`, -1) + `'`
+	}
+	return `'` + s + `'`
+}
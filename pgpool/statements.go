@@ -0,0 +1,632 @@
+package pgpool
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgio"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/internal/sqlscan"
+)
+
+// Named prepared statements belong to a server session, but in transaction pooling a client may use a different server
+// connection for every transaction. The pool therefore keeps each client's Parse messages and prepares them on
+// whichever server connection the client is using under a name chosen by that server connection. Bind, Describe and
+// Close are rewritten to use the server's name, and a statement the server has not seen yet is parsed again
+// immediately before it is needed.
+//
+// Equivalent statements of different clients share a server statement. The server pool counts the client statements
+// that use each one, and a server statement no client uses any longer is closed when its server connection is
+// released.
+//
+// Statements created with SQL PREPARE are kept the same way. PREPARE, EXECUTE and DEALLOCATE statements in simple
+// queries are rewritten to use the server's names, and their effect on the client's statements is applied once the
+// server has completed them. EXECUTE nested in other statements, such as EXPLAIN EXECUTE, is not rewritten.
+
+// clientStatement is a named prepared statement created by a client.
+type clientStatement struct {
+	key    string // identifies equivalent statements across clients
+	parse  pgproto3.Parse
+	sql    string // the text following the name of a statement created with SQL PREPARE
+	failed bool   // the server rejected the Parse that created the statement
+}
+
+func statementKey(parse *pgproto3.Parse) string {
+	buf := make([]byte, 0, 1+len(parse.Query)+1+4*len(parse.ParameterOIDs))
+	buf = append(buf, 'P')
+	buf = append(buf, parse.Query...)
+	buf = append(buf, 0)
+	for _, oid := range parse.ParameterOIDs {
+		buf = pgio.AppendUint32(buf, oid)
+	}
+	return string(buf)
+}
+
+func sqlStatementKey(sql string) string {
+	return "Q" + sql
+}
+
+// responseKind determines what happens to the server's response to a request.
+type responseKind int
+
+const (
+	forwardResponse   responseKind = iota // the response is relayed to the client
+	dropResponse                          // the request was injected by the pool and the client does not expect a response
+	syntheticResponse                     // the request was not sent to the server and the pool answers in its place
+)
+
+// pendingResponse is a request that has been sent to the server, or answered by the pool, whose response has not yet
+// been delivered to the client.
+type pendingResponse struct {
+	request   byte // message type of the request
+	kind      responseKind
+	synthetic pgproto3.BackendMessage
+
+	// onFailure is called if the request fails or is skipped by the server because of an earlier error.
+	onFailure func()
+
+	// statements are the statements of a simple query in order. They are only recorded if the pool acts on the
+	// completion of one of them.
+	statements []queryStatement
+}
+
+// queryStatement is a statement of a simple query.
+type queryStatement struct {
+	tag        string // replaces the server's command tag if not empty
+	onComplete func() // called when the server completes the statement
+}
+
+// isFinal reports whether msg is the last message of the server's response to r.
+func (r *pendingResponse) isFinal(msg pgproto3.BackendMessage) bool {
+	switch r.request {
+	case 'P':
+		_, ok := msg.(*pgproto3.ParseComplete)
+		return ok
+	case 'B':
+		_, ok := msg.(*pgproto3.BindComplete)
+		return ok
+	case 'C':
+		_, ok := msg.(*pgproto3.CloseComplete)
+		return ok
+	case 'D':
+		switch msg.(type) {
+		case *pgproto3.RowDescription, *pgproto3.NoData:
+			return true
+		}
+	case 'E':
+		switch msg.(type) {
+		case *pgproto3.CommandComplete, *pgproto3.EmptyQueryResponse, *pgproto3.PortalSuspended:
+			return true
+		}
+	case 'S', 'Q', 'F':
+		_, ok := msg.(*pgproto3.ReadyForQuery)
+		return ok
+	}
+	return false
+}
+
+// endsOnError reports whether an ErrorResponse ends the response to r. Requests that are answered with ReadyForQuery
+// still receive it after an error.
+func (r *pendingResponse) endsOnError() bool {
+	switch r.request {
+	case 'S', 'Q', 'F':
+		return false
+	}
+	return true
+}
+
+// noopSQL replaces a statement the server must not run. Like the statement it replaces it fails in an aborted
+// transaction.
+const noopSQL = "DO 'BEGIN END'"
+
+// preparePortal is the portal the pool runs SQL PREPARE statements in when it prepares them with the extended
+// protocol.
+const preparePortal = "pgpool_prepare"
+
+// rewrite translates msg from the client into the messages to send to sc and records the responses the client
+// expects. c.mu must be held.
+func (c *clientConn) rewrite(sc *serverConn, msg pgproto3.FrontendMessage) []pgproto3.FrontendMessage {
+	var out []pgproto3.FrontendMessage
+
+	if c.discarding {
+		// The pool reported an error so, like the server, it ignores extended protocol messages until Sync.
+		if _, ok := msg.(*pgproto3.Sync); !ok {
+			return out
+		}
+		c.discarding = false
+	}
+
+	switch msg := msg.(type) {
+	case *pgproto3.Parse:
+		c.unsynced = true
+		if msg.Name == "" {
+			parse := *msg
+			c.unnamed = &parse
+			c.unnamedGen++
+			sc.unnamedOwner, sc.unnamedGen = c, c.unnamedGen
+			c.expect('P', forwardResponse, func() { sc.unnamedOwner = nil })
+			return append(out, msg)
+		}
+
+		if _, ok := c.statements[msg.Name]; ok {
+			// The server would report the error but the client's name is not the server's name. The server's
+			// transaction is not affected.
+			c.discarding = true
+			c.expectSynthetic('P', &pgproto3.ErrorResponse{
+				Severity:            "ERROR",
+				SeverityUnlocalized: "ERROR",
+				Code:                "42P05",
+				Message:             fmt.Sprintf(`prepared statement "%s" already exists`, msg.Name),
+			}, nil)
+			return out
+		}
+
+		stmt := &clientStatement{key: statementKey(msg), parse: *msg}
+		c.addStatement(msg.Name, stmt)
+		failed := func() {
+			stmt.failed = true
+			if c.statements[msg.Name] == stmt {
+				c.removeStatement(msg.Name)
+			}
+		}
+		if _, ok := sc.prepared[stmt.key]; ok {
+			c.expectSynthetic('P', &pgproto3.ParseComplete{}, failed)
+			return out
+		}
+		parse := c.prepareOnServer(sc, stmt)
+		c.expect('P', forwardResponse, func() {
+			delete(sc.prepared, stmt.key)
+			failed()
+		})
+		return append(out, parse)
+
+	case *pgproto3.Bind:
+		c.unsynced = true
+		var serverName string
+		out, serverName = c.ensurePrepared(sc, out, msg.PreparedStatement)
+		bind := *msg
+		bind.PreparedStatement = serverName
+		c.expect('B', forwardResponse, nil)
+		return append(out, &bind)
+
+	case *pgproto3.Describe:
+		c.unsynced = true
+		describe := *msg
+		if msg.ObjectType == 'S' {
+			out, describe.Name = c.ensurePrepared(sc, out, msg.Name)
+		}
+		c.expect('D', forwardResponse, nil)
+		return append(out, &describe)
+
+	case *pgproto3.Close:
+		c.unsynced = true
+		if msg.ObjectType == 'S' && msg.Name != "" {
+			stmt, ok := c.statements[msg.Name]
+			if !ok {
+				// Closing a statement that does not exist is not an error.
+				c.expectSynthetic('C', &pgproto3.CloseComplete{}, nil)
+				return out
+			}
+
+			unused := c.removeStatement(msg.Name)
+			restore := func() {
+				if !stmt.failed {
+					c.addStatement(msg.Name, stmt)
+				}
+			}
+			serverName, ok := sc.prepared[stmt.key]
+			if !unused || !ok {
+				// The server statement is still used by other clients or is not prepared on sc.
+				c.expectSynthetic('C', &pgproto3.CloseComplete{}, restore)
+				return out
+			}
+
+			delete(sc.prepared, stmt.key)
+			c.expect('C', forwardResponse, func() {
+				sc.prepared[stmt.key] = serverName
+				restore()
+			})
+			return append(out, &pgproto3.Close{ObjectType: 'S', Name: serverName})
+		}
+		c.expect('C', forwardResponse, nil)
+		return append(out, msg)
+
+	case *pgproto3.Execute:
+		c.unsynced = true
+		c.expect('E', forwardResponse, nil)
+		return append(out, msg)
+
+	case *pgproto3.Sync:
+		c.unsynced = false
+		c.expect('S', forwardResponse, nil)
+		return append(out, msg)
+
+	case *pgproto3.Query:
+		// A simple query destroys the unnamed prepared statement.
+		sc.unnamedOwner = nil
+		return c.rewriteQuery(sc, out, msg)
+
+	case *pgproto3.FunctionCall:
+		c.expect('F', forwardResponse, nil)
+		return append(out, msg)
+
+	default:
+		// Flush, CopyData, CopyDone and CopyFail do not have a response of their own.
+		return append(out, msg)
+	}
+}
+
+// rewriteQuery appends the messages to send to sc for msg to out and records the response the client expects.
+// c.mu must be held.
+func (c *clientConn) rewriteQuery(sc *serverConn, out []pgproto3.FrontendMessage, msg *pgproto3.Query) []pgproto3.FrontendMessage {
+	r := pendingResponse{request: 'Q', kind: forwardResponse}
+
+	// The statements of the query see the client's statements as changed by the statements before them.
+	names := make(map[string]*clientStatement) // statements prepared, or deallocated if nil, by earlier statements
+	serverNames := make(map[string]string)     // server statements prepared, or deallocated if "", by earlier statements
+	discarded := false                         // an earlier statement deallocated all statements
+	lookup := func(name string) *clientStatement {
+		if stmt, ok := names[name]; ok || discarded {
+			return stmt
+		}
+		return c.statements[name]
+	}
+	serverNameOf := func(key string) (string, bool) {
+		if name, ok := serverNames[key]; ok || discarded {
+			return name, name != ""
+		}
+		name, ok := sc.prepared[key]
+		return name, ok
+	}
+
+	statements := sqlscan.Split(msg.String)
+	changed := false
+	track := false
+	for i, stmt := range statements {
+		var qs queryStatement
+		keywords := sqlscan.Keywords(stmt, 3)
+		if len(keywords) == 0 {
+			r.statements = append(r.statements, qs)
+			continue
+		}
+
+		switch keywords[0] {
+		case "DEALLOCATE", "DISCARD":
+			n := 1
+			if keywords[0] == "DEALLOCATE" && len(keywords) > 1 && keywords[1] == "PREPARE" {
+				n = 2
+			}
+			if len(keywords) > n && keywords[n] == "ALL" {
+				names = make(map[string]*clientStatement)
+				serverNames = make(map[string]string)
+				discarded = true
+				qs.onComplete = func() {
+					c.forgetStatements()
+					sc.forgetStatements()
+				}
+				break
+			}
+			if keywords[0] != "DEALLOCATE" {
+				break
+			}
+			name, ok := sqlscan.Identifier(stmt, n)
+			if !ok {
+				break
+			}
+			clientStmt := lookup(name)
+			if clientStmt == nil {
+				// Let the server report that the statement does not exist.
+				break
+			}
+
+			names[name] = nil
+			qs.tag = "DEALLOCATE"
+			qs.onComplete = func() {
+				if c.statements[name] == clientStmt {
+					c.removeStatement(name)
+				}
+			}
+
+			serverName, ok := sc.prepared[clientStmt.key]
+			if _, inQuery := serverNames[clientStmt.key]; !ok || inQuery || discarded || !c.soleUser(name, clientStmt, names) {
+				// The server statement is not prepared on sc or may still be used. One no client uses any longer is
+				// closed when sc is released.
+				statements[i] = noopSQL
+				break
+			}
+			serverNames[clientStmt.key] = ""
+			statements[i] = "DEALLOCATE " + quoteIdentifier(serverName)
+			deallocated := qs.onComplete
+			qs.onComplete = func() {
+				if sc.prepared[clientStmt.key] == serverName {
+					delete(sc.prepared, clientStmt.key)
+				}
+				deallocated()
+			}
+
+		case "PREPARE":
+			if len(keywords) > 1 && keywords[1] == "TRANSACTION" {
+				break
+			}
+			name, rest, ok := sqlscan.IdentifierRest(stmt, 1)
+			if !ok {
+				break
+			}
+			if lookup(name) != nil {
+				// The server would not report the error as the client's name is not the server's name.
+				statements[i] = duplicateStatementSQL(name)
+				break
+			}
+
+			clientStmt := &clientStatement{key: sqlStatementKey(rest), sql: rest}
+			names[name] = clientStmt
+			serverName, prepared := serverNameOf(clientStmt.key)
+			if prepared {
+				statements[i] = noopSQL
+				qs.tag = "PREPARE"
+			} else {
+				sc.lastStatementID++
+				serverName = "pgpool_" + strconv.FormatUint(sc.lastStatementID, 10)
+				serverNames[clientStmt.key] = serverName
+				statements[i] = "PREPARE " + quoteIdentifier(serverName) + rest
+			}
+			qs.onComplete = func() {
+				if !prepared {
+					sc.prepared[clientStmt.key] = serverName
+				}
+				if _, ok := c.statements[name]; !ok {
+					c.addStatement(name, clientStmt)
+				}
+			}
+
+		case "EXECUTE":
+			name, rest, ok := sqlscan.IdentifierRest(stmt, 1)
+			if !ok {
+				break
+			}
+			clientStmt := lookup(name)
+			if clientStmt == nil {
+				break
+			}
+			serverName, ok := serverNameOf(clientStmt.key)
+			if !ok {
+				if c.txStatus == 'E' {
+					// The server rejects the statement anyway.
+					break
+				}
+				out, serverName = c.prepareStatement(sc, out, clientStmt)
+			}
+			statements[i] = "EXECUTE " + quoteIdentifier(serverName) + rest
+		}
+
+		if statements[i] != stmt {
+			changed = true
+		}
+		if qs.onComplete != nil || qs.tag != "" {
+			track = true
+		}
+		r.statements = append(r.statements, qs)
+	}
+
+	if len(out) > 0 && !c.unsynced {
+		// Statements prepared for the query are prepared with the extended protocol, which must be synced before the
+		// query is run.
+		c.expect('S', dropResponse, nil)
+		out = append(out, &pgproto3.Sync{})
+	}
+
+	if !track {
+		r.statements = nil
+	}
+	c.responses = append(c.responses, r)
+
+	if changed {
+		msg = &pgproto3.Query{String: strings.Join(statements, "; ")}
+	}
+	return append(out, msg)
+}
+
+// soleUser reports whether the client's statement name, stmt, is the only client statement that uses its server
+// statement. names are the statements prepared by earlier statements of a simple query, which are not counted by the
+// server pool yet. c.mu must be held.
+func (c *clientConn) soleUser(name string, stmt *clientStatement, names map[string]*clientStatement) bool {
+	for _, other := range names {
+		if other != nil && other != stmt && other.key == stmt.key {
+			return false
+		}
+	}
+	refs := 0
+	if c.statements[name] == stmt {
+		refs = 1
+	}
+	return c.sp.refCount(stmt.key) == refs
+}
+
+// duplicateStatementSQL returns a statement that fails as PREPARE fails for name when name is already in use.
+func duplicateStatementSQL(name string) string {
+	message := fmt.Sprintf(`prepared statement "%s" already exists`, name)
+	return "DO " + quoteLiteral("BEGIN RAISE EXCEPTION USING ERRCODE = 'duplicate_prepared_statement', MESSAGE = "+quoteLiteral(message)+"; END")
+}
+
+// ensurePrepared returns the name sc knows the client's statement name by, appending a Parse to out if sc has not
+// prepared it yet. c.mu must be held.
+func (c *clientConn) ensurePrepared(sc *serverConn, out []pgproto3.FrontendMessage, name string) ([]pgproto3.FrontendMessage, string) {
+	if name == "" {
+		if c.unnamed != nil && (sc.unnamedOwner != c || sc.unnamedGen != c.unnamedGen) {
+			sc.unnamedOwner, sc.unnamedGen = c, c.unnamedGen
+			c.expect('P', dropResponse, func() { sc.unnamedOwner = nil })
+			out = append(out, c.unnamed)
+		}
+		return out, ""
+	}
+
+	stmt, ok := c.statements[name]
+	if !ok {
+		// Let the server report that the statement does not exist.
+		return out, name
+	}
+
+	if serverName, ok := sc.prepared[stmt.key]; ok {
+		return out, serverName
+	}
+
+	return c.prepareStatement(sc, out, stmt)
+}
+
+// prepareStatement appends the messages that prepare stmt on sc to out and returns the name sc knows it by. Their
+// responses are not relayed to the client. c.mu must be held.
+func (c *clientConn) prepareStatement(sc *serverConn, out []pgproto3.FrontendMessage, stmt *clientStatement) ([]pgproto3.FrontendMessage, string) {
+	if stmt.sql == "" {
+		parse := c.prepareOnServer(sc, stmt)
+		c.expect('P', dropResponse, func() { delete(sc.prepared, stmt.key) })
+		return append(out, parse), parse.Name
+	}
+
+	// The PREPARE statement is run with the extended protocol so it can be sent in the middle of a batch. It replaces
+	// the unnamed statement.
+	sc.lastStatementID++
+	serverName := "pgpool_" + strconv.FormatUint(sc.lastStatementID, 10)
+	sc.prepared[stmt.key] = serverName
+	sc.unnamedOwner = nil
+	failed := func() { delete(sc.prepared, stmt.key) }
+	c.expect('P', dropResponse, failed)
+	c.expect('B', dropResponse, nil)
+	c.expect('E', dropResponse, failed)
+	c.expect('C', dropResponse, nil)
+	return append(out,
+		&pgproto3.Parse{Query: "PREPARE " + quoteIdentifier(serverName) + stmt.sql},
+		&pgproto3.Bind{DestinationPortal: preparePortal},
+		&pgproto3.Execute{Portal: preparePortal},
+		&pgproto3.Close{ObjectType: 'P', Name: preparePortal},
+	), serverName
+}
+
+// addStatement records stmt as the client's statement name. c.mu must be held.
+func (c *clientConn) addStatement(name string, stmt *clientStatement) {
+	c.statements[name] = stmt
+	c.sp.ref(stmt.key)
+}
+
+// removeStatement removes the client's statement name and reports whether no client uses its server statement any
+// longer. c.mu must be held.
+func (c *clientConn) removeStatement(name string) bool {
+	stmt := c.statements[name]
+	delete(c.statements, name)
+	return c.sp.unref(stmt.key)
+}
+
+// forgetStatements removes all of the client's statements. c.mu must be held.
+func (c *clientConn) forgetStatements() {
+	for name := range c.statements {
+		c.removeStatement(name)
+	}
+}
+
+// prepareOnServer returns a Parse that prepares stmt on sc and records it as prepared.
+func (c *clientConn) prepareOnServer(sc *serverConn, stmt *clientStatement) *pgproto3.Parse {
+	sc.lastStatementID++
+	parse := stmt.parse
+	parse.Name = "pgpool_" + strconv.FormatUint(sc.lastStatementID, 10)
+	sc.prepared[stmt.key] = parse.Name
+	return &parse
+}
+
+func (c *clientConn) expect(request byte, kind responseKind, onFailure func()) {
+	c.responses = append(c.responses, pendingResponse{request: request, kind: kind, onFailure: onFailure})
+}
+
+func (c *clientConn) expectSynthetic(request byte, msg pgproto3.BackendMessage, onFailure func()) {
+	c.responses = append(c.responses, pendingResponse{request: request, kind: syntheticResponse, synthetic: msg, onFailure: onFailure})
+}
+
+// takeAnswered removes responses from the front of the queue that will never receive a server message: synthetic
+// responses, which are appended to out, and requests the server skips after an error. c.mu must be held.
+func (c *clientConn) takeAnswered(out []pgproto3.BackendMessage) []pgproto3.BackendMessage {
+	for len(c.responses) > 0 {
+		r := &c.responses[0]
+		switch {
+		case c.aborted && r.request != 'S':
+			if r.onFailure != nil {
+				r.onFailure()
+			}
+		case r.kind == syntheticResponse:
+			out = append(out, r.synthetic)
+		default:
+			return out
+		}
+		c.responses = c.responses[1:]
+	}
+	return out
+}
+
+// handleResponse determines which messages to deliver to the client for msg received from the server. c.mu must be
+// held.
+func (c *clientConn) handleResponse(msg pgproto3.BackendMessage) []pgproto3.BackendMessage {
+	switch msg.(type) {
+	case *pgproto3.ParameterStatus, *pgproto3.NoticeResponse, *pgproto3.NotificationResponse:
+		return []pgproto3.BackendMessage{msg}
+	}
+	if rfq, ok := msg.(*pgproto3.ReadyForQuery); ok {
+		c.txStatus = rfq.TxStatus
+	}
+
+	out := c.takeAnswered(nil)
+	if len(c.responses) == 0 {
+		return append(out, msg)
+	}
+
+	r := &c.responses[0]
+	if _, ok := msg.(*pgproto3.ErrorResponse); ok && r.endsOnError() {
+		if r.onFailure != nil {
+			r.onFailure()
+		}
+		c.responses = c.responses[1:]
+		c.aborted = true
+		out = append(out, msg)
+		return c.takeAnswered(out)
+	}
+
+	if len(r.statements) > 0 {
+		msg = r.completeStatement(msg)
+	}
+
+	if r.kind != dropResponse {
+		out = append(out, msg)
+	}
+	if r.isFinal(msg) {
+		if r.request == 'S' {
+			c.aborted = false
+		}
+		c.responses = c.responses[1:]
+	}
+
+	return c.takeAnswered(out)
+}
+
+// completeStatement acts on the completion of the statement of a simple query that msg responds to and returns the
+// message to deliver in place of msg. c.mu must be held.
+func (r *pendingResponse) completeStatement(msg pgproto3.BackendMessage) pgproto3.BackendMessage {
+	switch msg.(type) {
+	case *pgproto3.CommandComplete:
+		qs := r.statements[0]
+		r.statements = r.statements[1:]
+		if qs.onComplete != nil {
+			qs.onComplete()
+		}
+		if qs.tag != "" {
+			return &pgproto3.CommandComplete{CommandTag: []byte(qs.tag)}
+		}
+	case *pgproto3.ErrorResponse:
+		// The rest of the query is not run.
+		r.statements = nil
+	}
+	return msg
+}
+
+// forgetStatements discards the record of statements prepared on sc. Statement names are never reused so a
+// statement that still exists on the server does not conflict with later ones.
+func (sc *serverConn) forgetStatements() {
+	sc.prepared = make(map[string]string)
+	sc.unnamedOwner = nil
+}
@@ -0,0 +1,420 @@
+package pgpool_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/pgpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// send writes msgs in a single write. net.Pipe is unbuffered so writing them one at a time could block on the pool
+// delivering responses to earlier messages.
+func (c *testClient) send(t *testing.T, msgs ...pgproto3.FrontendMessage) {
+	var buf []byte
+	for _, msg := range msgs {
+		var err error
+		buf, err = msg.Encode(buf)
+		require.NoError(t, err)
+	}
+	_, err := c.conn.Write(buf)
+	require.NoError(t, err)
+}
+
+// receiveUntilReady returns a description of each message received up to and including ReadyForQuery.
+func (c *testClient) receiveUntilReady(t *testing.T) []string {
+	var received []string
+	for {
+		msg, err := c.frontend.Receive()
+		require.NoError(t, err)
+		switch msg := msg.(type) {
+		case *pgproto3.DataRow:
+			received = append(received, fmt.Sprintf("DataRow %s", msg.Values[0]))
+		case *pgproto3.ErrorResponse:
+			received = append(received, fmt.Sprintf("ErrorResponse %s", msg.Code))
+		case *pgproto3.ReadyForQuery:
+			return append(received, fmt.Sprintf("ReadyForQuery %c", msg.TxStatus))
+		default:
+			received = append(received, fmt.Sprintf("%T", msg)[len("*pgproto3."):])
+		}
+	}
+}
+
+func TestPoolRepreparesStatementOnDifferentServerConn(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 2)
+
+	a := connectClient(t, pool, nil)
+	b := connectClient(t, pool, nil)
+
+	a.send(t, &pgproto3.Parse{Name: "s1", Query: "SELECT pg_backend_pid()"}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ParseComplete", "ReadyForQuery I"}, a.receiveUntilReady(t))
+
+	// b holds the server connection a prepared s1 on so a must use a new one.
+	b.query(t, "BEGIN")
+	bPID := b.backendPID(t)
+
+	a.send(t,
+		&pgproto3.Bind{PreparedStatement: "s1"},
+		&pgproto3.Describe{ObjectType: 'P'},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	received := a.receiveUntilReady(t)
+	require.Len(t, received, 5)
+	assert.Equal(t, []string{"BindComplete", "RowDescription"}, received[:2])
+	assert.NotEqual(t, fmt.Sprintf("DataRow %d", bPID), received[2])
+	assert.Equal(t, []string{"CommandComplete", "ReadyForQuery I"}, received[3:])
+
+	assert.Equal(t, 2, fs.connectCount())
+}
+
+func TestPoolSharesStatementsBetweenClients(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	a := connectClient(t, pool, nil)
+	b := connectClient(t, pool, nil)
+
+	a.send(t, &pgproto3.Parse{Name: "a_stmt", Query: "SHOW application_name"}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ParseComplete", "ReadyForQuery I"}, a.receiveUntilReady(t))
+
+	// b's statement is already prepared on the only server connection so the pool answers the Parse itself.
+	b.send(t,
+		&pgproto3.Parse{Name: "b_stmt", Query: "SHOW application_name"},
+		&pgproto3.Describe{ObjectType: 'S', Name: "b_stmt"},
+		&pgproto3.Bind{PreparedStatement: "b_stmt"},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t,
+		[]string{"ParseComplete", "ParameterDescription", "RowDescription", "BindComplete", "DataRow ", "CommandComplete", "ReadyForQuery I"},
+		b.receiveUntilReady(t),
+	)
+}
+
+func TestPoolSyntheticParseCompleteIsDeliveredOnFlush(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	c := connectClient(t, pool, nil)
+	c.send(t, &pgproto3.Parse{Name: "s1", Query: "SELECT pg_backend_pid()"}, &pgproto3.Sync{})
+	c.receiveUntilReady(t)
+
+	c.send(t, &pgproto3.Parse{Name: "s2", Query: "SELECT pg_backend_pid()"}, &pgproto3.Flush{})
+
+	received := make(chan pgproto3.BackendMessage)
+	go func() {
+		msg, _ := c.frontend.Receive()
+		received <- msg
+	}()
+
+	select {
+	case msg := <-received:
+		assert.IsType(t, &pgproto3.ParseComplete{}, msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ParseComplete was not delivered")
+	}
+
+	c.send(t, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ReadyForQuery I"}, c.receiveUntilReady(t))
+}
+
+func TestPoolCloseStatement(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	c := connectClient(t, pool, nil)
+	c.send(t,
+		&pgproto3.Parse{Name: "s1", Query: "SELECT pg_backend_pid()"},
+		&pgproto3.Close{ObjectType: 'S', Name: "s1"},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t, []string{"ParseComplete", "CloseComplete", "ReadyForQuery I"}, c.receiveUntilReady(t))
+
+	c.send(t,
+		&pgproto3.Bind{PreparedStatement: "s1"},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t, []string{"ErrorResponse 26000", "ReadyForQuery I"}, c.receiveUntilReady(t))
+}
+
+func TestPoolSkipsResponsesAfterError(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	a := connectClient(t, pool, nil)
+	a.send(t, &pgproto3.Parse{Name: "s1", Query: "SELECT pg_backend_pid()"}, &pgproto3.Sync{})
+	a.receiveUntilReady(t)
+
+	b := connectClient(t, pool, nil)
+	b.send(t,
+		&pgproto3.Bind{PreparedStatement: "missing"},
+		&pgproto3.Parse{Name: "s2", Query: "SELECT pg_backend_pid()"},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	// The server skipped everything after the failed Bind so the pool must not answer the Parse either.
+	assert.Equal(t, []string{"ErrorResponse 26000", "ReadyForQuery I"}, b.receiveUntilReady(t))
+
+	b.send(t,
+		&pgproto3.Parse{Name: "s2", Query: "SELECT pg_backend_pid()"},
+		&pgproto3.Bind{PreparedStatement: "s2"},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t, []string{"ParseComplete", "BindComplete", "DataRow 1", "CommandComplete", "ReadyForQuery I"}, b.receiveUntilReady(t))
+}
+
+func TestPoolRepreparesUnnamedStatement(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	a := connectClient(t, pool, nil)
+	b := connectClient(t, pool, nil)
+
+	a.send(t, &pgproto3.Parse{Query: "SELECT pg_backend_pid()"}, &pgproto3.Describe{ObjectType: 'S'}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ParseComplete", "ParameterDescription", "RowDescription", "ReadyForQuery I"}, a.receiveUntilReady(t))
+
+	// b replaces the unnamed statement on the shared server connection.
+	b.send(t, &pgproto3.Parse{Query: "SHOW application_name"}, &pgproto3.Sync{})
+	b.receiveUntilReady(t)
+
+	a.send(t, &pgproto3.Bind{}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"BindComplete", "DataRow 1", "CommandComplete", "ReadyForQuery I"}, a.receiveUntilReady(t))
+}
+
+func TestPoolDeallocate(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	c := connectClient(t, pool, nil)
+	c.send(t, &pgproto3.Parse{Name: "s1", Query: "SELECT pg_backend_pid()"}, &pgproto3.Sync{})
+	c.receiveUntilReady(t)
+
+	c.query(t, "DISCARD ALL")
+
+	c.send(t, &pgproto3.Bind{PreparedStatement: "s1"}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ErrorResponse 26000", "ReadyForQuery I"}, c.receiveUntilReady(t))
+
+	// A new statement after DISCARD ALL must be prepared on the server again.
+	c.send(t,
+		&pgproto3.Parse{Name: "s1", Query: "SELECT pg_backend_pid()"},
+		&pgproto3.Bind{PreparedStatement: "s1"},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t, []string{"ParseComplete", "BindComplete", "DataRow 1", "CommandComplete", "ReadyForQuery I"}, c.receiveUntilReady(t))
+}
+
+func TestPoolDeallocateInMultiStatementQuery(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	c := connectClient(t, pool, nil)
+	c.send(t, &pgproto3.Parse{Name: "s1", Query: "SELECT pg_backend_pid()"}, &pgproto3.Sync{})
+	c.receiveUntilReady(t)
+
+	c.send(t, &pgproto3.Query{String: "DEALLOCATE s1; SELECT pg_backend_pid()"})
+	assert.Equal(t, []string{"CommandComplete", "RowDescription", "DataRow 1", "CommandComplete", "ReadyForQuery I"}, c.receiveUntilReady(t))
+	assert.Equal(t, []string{}, fs.prepared(1))
+
+	c.send(t, &pgproto3.Bind{PreparedStatement: "s1"}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ErrorResponse 26000", "ReadyForQuery I"}, c.receiveUntilReady(t))
+}
+
+func TestPoolKeepsStatementsWhenDiscardAllFails(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	c := connectClient(t, pool, nil)
+	c.send(t, &pgproto3.Parse{Name: "s1", Query: "SELECT pg_backend_pid()"}, &pgproto3.Sync{})
+	c.receiveUntilReady(t)
+
+	c.query(t, "BEGIN")
+	c.send(t, &pgproto3.Query{String: "SELECT pg_backend_pid(); DISCARD ALL"})
+	assert.Equal(t, []string{"RowDescription", "DataRow 1", "CommandComplete", "ErrorResponse 25001", "ReadyForQuery E"}, c.receiveUntilReady(t))
+	c.query(t, "ROLLBACK")
+
+	c.send(t, &pgproto3.Bind{PreparedStatement: "s1"}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"BindComplete", "DataRow 1", "CommandComplete", "ReadyForQuery I"}, c.receiveUntilReady(t))
+}
+
+func TestPoolSQLPrepare(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	// The reset query deallocates the server's statements whenever the server connection is released.
+	pool, err := pgpool.New(pgpool.Config{
+		Dial: fs.dial,
+		ServerPassword: func(user, database string) (string, error) {
+			return fs.password, nil
+		},
+		MaxServerConns:   1,
+		ResetQueryAlways: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { pool.Close() })
+
+	c := connectClient(t, pool, nil)
+
+	c.send(t, &pgproto3.Query{String: "PREPARE q AS SELECT pg_backend_pid(); EXECUTE q"})
+	assert.Equal(t, []string{"CommandComplete", "RowDescription", "DataRow 1", "CommandComplete", "ReadyForQuery I"}, c.receiveUntilReady(t))
+
+	// The name is in use whichever way the statement was created.
+	c.send(t, &pgproto3.Parse{Name: "q", Query: "SHOW application_name"}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ErrorResponse 42P05", "ReadyForQuery I"}, c.receiveUntilReady(t))
+	c.send(t, &pgproto3.Query{String: "PREPARE q AS SHOW application_name"})
+	assert.Equal(t, []string{"ErrorResponse 42P05", "ReadyForQuery I"}, c.receiveUntilReady(t))
+
+	// q is prepared again for both SQL and the extended protocol.
+	c.send(t, &pgproto3.Query{String: "EXECUTE q"})
+	assert.Equal(t, []string{"RowDescription", "DataRow 1", "CommandComplete", "ReadyForQuery I"}, c.receiveUntilReady(t))
+	c.send(t, &pgproto3.Bind{PreparedStatement: "q"}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"BindComplete", "DataRow 1", "CommandComplete", "ReadyForQuery I"}, c.receiveUntilReady(t))
+
+	prepares := 0
+	for _, sql := range fs.executed(1) {
+		if strings.HasPrefix(sql, "PREPARE ") {
+			prepares++
+		}
+	}
+	assert.Equal(t, 3, prepares)
+
+	c.query(t, "BEGIN")
+	c.send(t, &pgproto3.Query{String: "EXECUTE q; DEALLOCATE q"})
+	assert.Equal(t, []string{"RowDescription", "DataRow 1", "CommandComplete", "CommandComplete", "ReadyForQuery T"}, c.receiveUntilReady(t))
+	// Only the unnamed statement the pool ran PREPARE with is left.
+	assert.Equal(t, []string{""}, fs.prepared(1))
+	c.query(t, "COMMIT")
+
+	c.send(t, &pgproto3.Query{String: "EXECUTE q"})
+	assert.Equal(t, []string{"ErrorResponse 26000", "ReadyForQuery I"}, c.receiveUntilReady(t))
+}
+
+func TestPoolRejectsDuplicateStatementName(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	c := connectClient(t, pool, nil)
+	c.send(t, &pgproto3.Parse{Name: "s1", Query: "SELECT pg_backend_pid()"}, &pgproto3.Sync{})
+	c.receiveUntilReady(t)
+
+	// The rest of the batch is discarded, so the portal is not bound to the new statement.
+	c.send(t,
+		&pgproto3.Parse{Name: "s1", Query: "SHOW application_name"},
+		&pgproto3.Bind{PreparedStatement: "s1"},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t, []string{"ErrorResponse 42P05", "ReadyForQuery I"}, c.receiveUntilReady(t))
+
+	c.send(t, &pgproto3.Bind{PreparedStatement: "s1"}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"BindComplete", "DataRow 1", "CommandComplete", "ReadyForQuery I"}, c.receiveUntilReady(t))
+
+	// A statement whose Parse failed can be created again.
+	c.send(t,
+		&pgproto3.Bind{PreparedStatement: "missing"},
+		&pgproto3.Parse{Name: "s2", Query: "SELECT pg_backend_pid()"},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t, []string{"ErrorResponse 26000", "ReadyForQuery I"}, c.receiveUntilReady(t))
+	c.send(t, &pgproto3.Parse{Name: "s2", Query: "SELECT pg_backend_pid()"}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ParseComplete", "ReadyForQuery I"}, c.receiveUntilReady(t))
+}
+
+func TestPoolClosesServerStatements(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 1)
+
+	a := connectClient(t, pool, nil)
+	b := connectClient(t, pool, nil)
+
+	a.send(t, &pgproto3.Parse{Name: "a_stmt", Query: "SELECT pg_backend_pid()"}, &pgproto3.Sync{})
+	a.receiveUntilReady(t)
+	b.send(t,
+		&pgproto3.Parse{Name: "b_stmt", Query: "SELECT pg_backend_pid()"},
+		&pgproto3.Parse{Name: "b_other", Query: "SHOW application_name"},
+		&pgproto3.Sync{},
+	)
+	b.receiveUntilReady(t)
+	assert.Equal(t, []string{"pgpool_1", "pgpool_2"}, fs.prepared(1))
+
+	// b's statement is still in use, so a's Close does not close the server statement.
+	a.send(t, &pgproto3.Close{ObjectType: 'S', Name: "a_stmt"}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"CloseComplete", "ReadyForQuery I"}, a.receiveUntilReady(t))
+	assert.Equal(t, []string{"pgpool_1", "pgpool_2"}, fs.prepared(1))
+
+	// DEALLOCATE only deallocates the server statement of the client's statement.
+	_, txStatus := b.query(t, "DEALLOCATE b_stmt")
+	assert.Equal(t, byte('I'), txStatus)
+	assert.Equal(t, []string{"pgpool_2"}, fs.prepared(1))
+
+	b.send(t, &pgproto3.Close{ObjectType: 'S', Name: "b_other"}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"CloseComplete", "ReadyForQuery I"}, b.receiveUntilReady(t))
+	assert.Equal(t, []string{}, fs.prepared(1))
+}
+
+func TestPoolClosesUnusedStatementsOnRelease(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeServer()
+	pool := newTestPool(t, fs, 2)
+
+	a := connectClient(t, pool, nil)
+	b := connectClient(t, pool, nil)
+
+	a.query(t, "BEGIN")
+	aPID := a.backendPID(t)
+	a.send(t, &pgproto3.Parse{Name: "s1", Query: "SELECT pg_backend_pid()"}, &pgproto3.Sync{})
+	a.receiveUntilReady(t)
+
+	b.query(t, "BEGIN")
+	bPID := b.backendPID(t)
+	b.send(t, &pgproto3.Parse{Name: "s1", Query: "SELECT pg_backend_pid()"}, &pgproto3.Sync{})
+	b.receiveUntilReady(t)
+	a.query(t, "COMMIT")
+
+	// b still uses the statement, so a's DEALLOCATE leaves the server statement in place.
+	a.send(t, &pgproto3.Query{String: "DEALLOCATE s1"})
+	assert.Equal(t, []string{"CommandComplete", "ReadyForQuery I"}, a.receiveUntilReady(t))
+	assert.Equal(t, []string{"pgpool_1"}, fs.prepared(aPID))
+
+	b.send(t, &pgproto3.Close{ObjectType: 'S', Name: "s1"}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"CloseComplete", "ReadyForQuery T"}, b.receiveUntilReady(t))
+	assert.Equal(t, []string{}, fs.prepared(bPID))
+
+	// The statement on a's server connection is no longer used and is closed when the connection is next released.
+	assert.Equal(t, aPID, a.backendPID(t))
+	require.Eventually(t, func() bool { return len(fs.prepared(aPID)) == 0 }, 5*time.Second, time.Millisecond)
+
+	a.send(t, &pgproto3.Bind{PreparedStatement: "s1"}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ErrorResponse 26000", "ReadyForQuery I"}, a.receiveUntilReady(t))
+}
@@ -1,3 +1,8 @@
 package pgproto3
 
 const MaxMessageBodyLen = maxMessageBodyLen
+
+// ReadWatcher identifies the goroutine that watches the reads of f.ReceiveContext.
+func ReadWatcher(f *Frontend) interface{} {
+	return f.readWatcher.watch
+}
@@ -0,0 +1,255 @@
+package pgproxy
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/internal/sqlscan"
+)
+
+// Policy determines which queries a Firewall blocks and how it rewrites the others. A Policy may be shared by many
+// Firewalls but must not be modified while in use.
+type Policy struct {
+	// BlockedStatements are the statement types to block, given by their leading keywords such as "DROP", "TRUNCATE"
+	// or "ALTER SYSTEM". Matching is case insensitive. Each statement of a multi-statement query is checked.
+	BlockedStatements []string
+
+	// BlockedPatterns block any query whose text matches one of them.
+	BlockedPatterns []*regexp.Regexp
+
+	// Rewriters are applied in order to every query that is not blocked.
+	Rewriters []Rewriter
+}
+
+// Rewriter rewrites the text of a query. extended is true if sql is the query of a Parse message rather than a simple
+// Query. txStatus is the transaction status the query runs in as reported by the server's last ReadyForQuery, or 0 if
+// the server has not yet answered earlier requests so the status is not known. It returns the statements to run
+// before the query and the query to run in its place. Responses to prepended statements are not relayed to the
+// client. A Parse message holds a single statement so prepend must be empty when extended is true.
+type Rewriter func(sql string, extended bool, txStatus byte) (prepend []string, rewritten string)
+
+// Check returns the reason sql is blocked by p or an empty string if it is allowed.
+func (p *Policy) Check(sql string) string {
+	for _, re := range p.BlockedPatterns {
+		if re.MatchString(sql) {
+			return "query matches blocked pattern " + strconv.Quote(re.String())
+		}
+	}
+
+	if len(p.BlockedStatements) == 0 {
+		return ""
+	}
+
+	for _, stmt := range sqlscan.Split(sql) {
+		for _, blocked := range p.BlockedStatements {
+			words := strings.Fields(strings.ToUpper(blocked))
+			keywords := sqlscan.Keywords(stmt, len(words))
+			if len(words) > 0 && len(keywords) == len(words) && strings.Join(keywords, " ") == strings.Join(words, " ") {
+				return strings.Join(words, " ") + " statements are not allowed"
+			}
+		}
+	}
+
+	return ""
+}
+
+// rewrite applies the rewriters of p to sql.
+func (p *Policy) rewrite(sql string, extended bool, txStatus byte) ([]string, string) {
+	var prepend []string
+	for _, rewriter := range p.Rewriters {
+		var more []string
+		more, sql = rewriter(sql, extended, txStatus)
+		prepend = append(prepend, more...)
+	}
+	return prepend, sql
+}
+
+// StatementTimeout returns a Rewriter that limits the run time of simple queries to d with SET LOCAL
+// statement_timeout. Only queries consisting solely of SELECT, INSERT, UPDATE, DELETE, MERGE, WITH, VALUES and TABLE
+// statements are rewritten, as prepending a statement runs the query in a transaction block which some other
+// statements do not allow. Queries in a transaction block, or whose transaction status is not known, are not
+// rewritten as the setting would last until the end of the client's transaction. Parse messages are not rewritten.
+func StatementTimeout(d time.Duration) Rewriter {
+	setTimeout := "SET LOCAL statement_timeout = " + strconv.FormatInt(int64(d/time.Millisecond), 10)
+
+	return func(sql string, extended bool, txStatus byte) ([]string, string) {
+		if extended || txStatus != 'I' {
+			return nil, sql
+		}
+
+		statements := sqlscan.Split(sql)
+		if len(statements) == 0 {
+			return nil, sql
+		}
+		for _, stmt := range statements {
+			keywords := sqlscan.Keywords(stmt, 1)
+			if len(keywords) == 0 {
+				return nil, sql
+			}
+			switch keywords[0] {
+			case "SELECT", "INSERT", "UPDATE", "DELETE", "MERGE", "WITH", "VALUES", "TABLE":
+			default:
+				return nil, sql
+			}
+		}
+
+		return []string{setTimeout}, sql
+	}
+}
+
+// blockedSQL replaces the text of a blocked query. It is a syntax error so the server fails the query as it would
+// fail a query that is not allowed: the transaction in progress is aborted and the rest of an extended protocol batch
+// is skipped until Sync.
+const blockedSQL = "BLOCKED BY POLICY"
+
+// Firewall is an Interceptor that blocks and rewrites queries according to a Policy. The client receives an
+// ErrorResponse with SQLSTATE 42501 (insufficient_privilege) in place of the response to a blocked query.
+//
+// A blocked Query or Parse is sent to the server with its text replaced by a syntax error, and the server's error is
+// replaced by the Firewall's. The blocked statement never runs but the server fails it like any other statement that
+// fails.
+//
+// FunctionCall messages are not checked as they identify the function by OID rather than by SQL text.
+//
+// A Firewall keeps per session state and must only be used by a single Proxy.
+type Firewall struct {
+	policy *Policy
+
+	mu        sync.Mutex
+	responses []firewallResponse // requests whose responses have not been sent to the client
+}
+
+// firewallResponse is a request forwarded to the server.
+type firewallResponse struct {
+	request              byte                    // message type of the request
+	blocked              *pgproto3.ErrorResponse // the error the server's error for a blocked request is replaced with
+	dropCommandCompletes int                     // responses to statements prepended to a Query
+}
+
+// NewFirewall creates a Firewall that enforces policy.
+func NewFirewall(policy *Policy) *Firewall {
+	return &Firewall{policy: policy}
+}
+
+func blockedError(reason string) *pgproto3.ErrorResponse {
+	return &pgproto3.ErrorResponse{
+		Severity:            "ERROR",
+		SeverityUnlocalized: "ERROR",
+		Code:                "42501",
+		Message:             "blocked by policy: " + reason,
+	}
+}
+
+// InterceptClientMessage implements Interceptor.
+func (fw *Firewall) InterceptClientMessage(p *Proxy, msg pgproto3.FrontendMessage) (pgproto3.FrontendMessage, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	// Until the server has answered the earlier requests the transaction status is not known.
+	var txStatus byte
+	if len(fw.responses) == 0 {
+		txStatus = p.TxStatus()
+	}
+
+	switch msg := msg.(type) {
+	case *pgproto3.Query:
+		if reason := fw.policy.Check(msg.String); reason != "" {
+			fw.responses = append(fw.responses, firewallResponse{request: 'Q', blocked: blockedError(reason)})
+			return &pgproto3.Query{String: blockedSQL}, nil
+		}
+
+		prepend, sql := fw.policy.rewrite(msg.String, false, txStatus)
+		fw.responses = append(fw.responses, firewallResponse{request: 'Q', dropCommandCompletes: len(prepend)})
+		if len(prepend) == 0 {
+			if sql == msg.String {
+				return msg, nil
+			}
+			return &pgproto3.Query{String: sql}, nil
+		}
+		return &pgproto3.Query{String: strings.Join(prepend, "; ") + "; " + sql}, nil
+
+	case *pgproto3.Parse:
+		if reason := fw.policy.Check(msg.Query); reason != "" {
+			fw.responses = append(fw.responses, firewallResponse{request: 'P', blocked: blockedError(reason)})
+			return &pgproto3.Parse{Name: msg.Name, Query: blockedSQL}, nil
+		}
+
+		prepend, sql := fw.policy.rewrite(msg.Query, true, txStatus)
+		if len(prepend) > 0 {
+			return nil, errors.New("pgproxy: Rewriter prepended statements to a Parse message")
+		}
+		fw.responses = append(fw.responses, firewallResponse{request: 'P'})
+		if sql == msg.Query {
+			return msg, nil
+		}
+		parse := *msg
+		parse.Query = sql
+		return &parse, nil
+
+	case *pgproto3.Bind:
+		fw.responses = append(fw.responses, firewallResponse{request: 'B'})
+	case *pgproto3.Describe:
+		fw.responses = append(fw.responses, firewallResponse{request: 'D'})
+	case *pgproto3.Execute:
+		fw.responses = append(fw.responses, firewallResponse{request: 'E'})
+	case *pgproto3.Close:
+		fw.responses = append(fw.responses, firewallResponse{request: 'C'})
+	case *pgproto3.Sync:
+		fw.responses = append(fw.responses, firewallResponse{request: 'S'})
+	case *pgproto3.FunctionCall:
+		fw.responses = append(fw.responses, firewallResponse{request: 'F'})
+	}
+
+	return msg, nil
+}
+
+// InterceptServerMessage implements Interceptor.
+func (fw *Firewall) InterceptServerMessage(p *Proxy, msg pgproto3.BackendMessage) (pgproto3.BackendMessage, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	switch msg.(type) {
+	case *pgproto3.ParameterStatus, *pgproto3.NoticeResponse, *pgproto3.NotificationResponse:
+		return msg, nil
+	}
+	if len(fw.responses) == 0 {
+		return msg, nil
+	}
+
+	r := &fw.responses[0]
+	switch msg.(type) {
+	case *pgproto3.CommandComplete:
+		if r.dropCommandCompletes > 0 {
+			r.dropCommandCompletes--
+			return nil, nil
+		}
+	case *pgproto3.ErrorResponse:
+		// The rest of the query is not run.
+		r.dropCommandCompletes = 0
+		if r.blocked != nil {
+			msg = r.blocked
+		}
+
+		switch r.request {
+		case 'S', 'Q', 'F':
+		default:
+			// The server skips the rest of the batch.
+			fw.responses = fw.responses[1:]
+			for len(fw.responses) > 0 && fw.responses[0].request != 'S' {
+				fw.responses = fw.responses[1:]
+			}
+			return msg, nil
+		}
+	}
+
+	if responseIsFinal(r.request, msg) {
+		fw.responses = fw.responses[1:]
+	}
+
+	return msg, nil
+}
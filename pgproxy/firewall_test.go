@@ -0,0 +1,199 @@
+package pgproxy_test
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/pgproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// send writes msgs in a single write. net.Pipe is unbuffered so writing them one at a time could block on the proxy
+// delivering responses to earlier messages.
+func (c *testClient) send(t *testing.T, msgs ...pgproto3.FrontendMessage) {
+	var buf []byte
+	for _, msg := range msgs {
+		var err error
+		buf, err = msg.Encode(buf)
+		require.NoError(t, err)
+	}
+	_, err := c.conn.Write(buf)
+	require.NoError(t, err)
+}
+
+// receiveUntilReady returns a description of each message received up to and including ReadyForQuery.
+func (c *testClient) receiveUntilReady(t *testing.T) []string {
+	var received []string
+	for {
+		msg, err := c.frontend.Receive()
+		require.NoError(t, err)
+		switch msg := msg.(type) {
+		case *pgproto3.DataRow:
+			received = append(received, fmt.Sprintf("DataRow %s", msg.Values[0]))
+		case *pgproto3.CommandComplete:
+			received = append(received, fmt.Sprintf("CommandComplete %s", msg.CommandTag))
+		case *pgproto3.ErrorResponse:
+			received = append(received, fmt.Sprintf("ErrorResponse %s", msg.Code))
+		case *pgproto3.ReadyForQuery:
+			return append(received, "ReadyForQuery")
+		default:
+			received = append(received, fmt.Sprintf("%T", msg)[len("*pgproto3."):])
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	t.Parallel()
+
+	policy := &pgproxy.Policy{
+		BlockedStatements: []string{"DROP", "truncate", "alter  system"},
+		BlockedPatterns:   []*regexp.Regexp{regexp.MustCompile(`(?i)\bpg_sleep\b`)},
+	}
+
+	tests := []struct {
+		sql     string
+		blocked bool
+	}{
+		{"select 1", false},
+		{"DROP TABLE users", true},
+		{"/* harmless */ drop table users", true},
+		{"select 1; Truncate users", true},
+		{"select 'drop table users; truncate users'", false},
+		{"alter table users add column x int", false},
+		{"ALTER SYSTEM SET work_mem = '1GB'", true},
+		{"select pg_sleep(10)", true},
+		{"select dropped from users", false},
+	}
+
+	for i, tt := range tests {
+		assert.Equalf(t, tt.blocked, policy.Check(tt.sql) != "", "%d. %q", i, tt.sql)
+	}
+}
+
+// recordQueries returns an Interceptor that records the text of the queries and Parse messages sent to the server.
+func recordQueries(queries *[]string) pgproxy.Interceptor {
+	return pgproxy.InterceptorFuncs{
+		ClientMessage: func(p *pgproxy.Proxy, msg pgproto3.FrontendMessage) (pgproto3.FrontendMessage, error) {
+			switch msg := msg.(type) {
+			case *pgproto3.Query:
+				*queries = append(*queries, msg.String)
+			case *pgproto3.Parse:
+				*queries = append(*queries, msg.Query)
+			}
+			return msg, nil
+		},
+	}
+}
+
+func TestFirewallBlocksQuery(t *testing.T) {
+	t.Parallel()
+
+	var serverQueries []string
+	c := connectClient(t, pgproxy.NewFirewall(&pgproxy.Policy{BlockedStatements: []string{"DROP"}}), recordQueries(&serverQueries))
+
+	c.send(t, &pgproto3.Query{String: "drop table users"})
+	assert.Equal(t, []string{"ErrorResponse 42501", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	c.send(t, &pgproto3.Query{String: "select 1"})
+	assert.Equal(t, []string{"RowDescription", "DataRow select 1", "CommandComplete SELECT 1", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	// The server receives a statement that fails in place of the blocked query.
+	require.Len(t, serverQueries, 2)
+	assert.NotContains(t, serverQueries[0], "drop")
+	assert.Equal(t, "select 1", serverQueries[1])
+}
+
+func TestFirewallBlocksPipelinedQuery(t *testing.T) {
+	t.Parallel()
+
+	c := connectClient(t, pgproxy.NewFirewall(&pgproxy.Policy{BlockedStatements: []string{"DROP"}}))
+
+	// The answer to the blocked query is delivered in order.
+	c.send(t,
+		&pgproto3.Query{String: "begin"},
+		&pgproto3.Query{String: "drop table users"},
+		&pgproto3.Query{String: "select 1"},
+	)
+	assert.Equal(t, []string{"CommandComplete BEGIN", "ReadyForQuery"}, c.receiveUntilReady(t))
+	assert.Equal(t, []string{"ErrorResponse 42501", "ReadyForQuery"}, c.receiveUntilReady(t))
+	assert.Equal(t, byte('E'), c.frontend.TxStatus())
+
+	// Like any failed statement the blocked query aborted the transaction.
+	assert.Equal(t, []string{"ErrorResponse 25P02", "ReadyForQuery"}, c.receiveUntilReady(t))
+	c.send(t, &pgproto3.Query{String: "commit"})
+	assert.Equal(t, []string{"CommandComplete ROLLBACK", "ReadyForQuery"}, c.receiveUntilReady(t))
+	assert.Equal(t, byte('I'), c.frontend.TxStatus())
+}
+
+func TestFirewallBlocksParse(t *testing.T) {
+	t.Parallel()
+
+	var serverQueries []string
+	c := connectClient(t, pgproxy.NewFirewall(&pgproxy.Policy{BlockedStatements: []string{"TRUNCATE"}}), recordQueries(&serverQueries))
+
+	c.send(t,
+		&pgproto3.Parse{Name: "s1", Query: "select 1"},
+		&pgproto3.Bind{PreparedStatement: "s1"},
+		&pgproto3.Execute{},
+		&pgproto3.Parse{Name: "s2", Query: "truncate users"},
+		&pgproto3.Bind{PreparedStatement: "s2"},
+		&pgproto3.Execute{},
+		&pgproto3.Parse{Name: "s3", Query: "select 3"},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t,
+		[]string{"ParseComplete", "BindComplete", "DataRow select 1", "CommandComplete SELECT 1", "ErrorResponse 42501", "ReadyForQuery"},
+		c.receiveUntilReady(t),
+	)
+
+	c.send(t, &pgproto3.Bind{PreparedStatement: "s1"}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"BindComplete", "DataRow select 1", "CommandComplete SELECT 1", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	// The server failed the blocked Parse so it skipped the rest of the batch.
+	c.send(t, &pgproto3.Bind{PreparedStatement: "s3"}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ErrorResponse 26000", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	require.Len(t, serverQueries, 3)
+	assert.Equal(t, "select 1", serverQueries[0])
+	assert.NotContains(t, serverQueries[1], "truncate")
+}
+
+func TestFirewallBlockedParseIsAnsweredOnFlush(t *testing.T) {
+	t.Parallel()
+
+	c := connectClient(t, pgproxy.NewFirewall(&pgproxy.Policy{BlockedStatements: []string{"TRUNCATE"}}))
+
+	c.send(t, &pgproto3.Parse{Query: "truncate users"}, &pgproto3.Describe{ObjectType: 'S'}, &pgproto3.Flush{})
+	msg, err := c.frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+	assert.Equal(t, "42501", msg.(*pgproto3.ErrorResponse).Code)
+
+	c.send(t, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ReadyForQuery"}, c.receiveUntilReady(t))
+}
+
+func TestFirewallStatementTimeout(t *testing.T) {
+	t.Parallel()
+
+	var serverQueries []string
+	c := connectClient(t, pgproxy.NewFirewall(&pgproxy.Policy{Rewriters: []pgproxy.Rewriter{pgproxy.StatementTimeout(5 * time.Second)}}), recordQueries(&serverQueries))
+
+	c.send(t, &pgproto3.Query{String: "select 1"})
+	assert.Equal(t, []string{"RowDescription", "DataRow select 1", "CommandComplete SELECT 1", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	c.send(t, &pgproto3.Query{String: "vacuum"})
+	assert.Equal(t, []string{"RowDescription", "DataRow vacuum", "CommandComplete SELECT 1", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	// In a transaction block the timeout would last until the end of the transaction.
+	c.send(t, &pgproto3.Query{String: "begin"})
+	c.receiveUntilReady(t)
+	c.send(t, &pgproto3.Query{String: "select 2"})
+	assert.Equal(t, []string{"RowDescription", "DataRow select 2", "CommandComplete SELECT 1", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	assert.Equal(t, []string{"SET LOCAL statement_timeout = 5000; select 1", "vacuum", "begin", "select 2"}, serverQueries)
+}
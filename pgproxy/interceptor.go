@@ -0,0 +1,41 @@
+package pgproxy
+
+import (
+	"github.com/jackc/pgproto3/v2"
+)
+
+// Interceptor inspects and rewrites messages relayed by a Proxy. An interceptor may return the message it was given,
+// a different message to send in its place, or nil to drop it. Additional messages may be injected with
+// Proxy.SendToClient and Proxy.SendToServer. Returning an error stops the Proxy.
+//
+// Received messages are only valid until the Proxy receives the next message from the same side. An interceptor that
+// needs to keep a message must copy it.
+//
+// InterceptClientMessage and InterceptServerMessage are called from different goroutines. An Interceptor instance
+// belongs to a single Proxy.
+type Interceptor interface {
+	InterceptClientMessage(p *Proxy, msg pgproto3.FrontendMessage) (pgproto3.FrontendMessage, error)
+	InterceptServerMessage(p *Proxy, msg pgproto3.BackendMessage) (pgproto3.BackendMessage, error)
+}
+
+// InterceptorFuncs adapts functions to the Interceptor interface. A nil function passes messages through unchanged.
+type InterceptorFuncs struct {
+	ClientMessage func(p *Proxy, msg pgproto3.FrontendMessage) (pgproto3.FrontendMessage, error)
+	ServerMessage func(p *Proxy, msg pgproto3.BackendMessage) (pgproto3.BackendMessage, error)
+}
+
+// InterceptClientMessage implements Interceptor.
+func (f InterceptorFuncs) InterceptClientMessage(p *Proxy, msg pgproto3.FrontendMessage) (pgproto3.FrontendMessage, error) {
+	if f.ClientMessage == nil {
+		return msg, nil
+	}
+	return f.ClientMessage(p, msg)
+}
+
+// InterceptServerMessage implements Interceptor.
+func (f InterceptorFuncs) InterceptServerMessage(p *Proxy, msg pgproto3.BackendMessage) (pgproto3.BackendMessage, error) {
+	if f.ServerMessage == nil {
+		return msg, nil
+	}
+	return f.ServerMessage(p, msg)
+}
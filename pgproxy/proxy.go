@@ -0,0 +1,258 @@
+// Package pgproxy implements a PostgreSQL protocol proxy with hooks for inspecting and rewriting messages.
+//
+// A Proxy relays a single client session to a server through a chain of Interceptors. Firewall is an Interceptor that
+// blocks and rewrites queries according to a Policy. Router splits a client session between a primary server and
+// read-only replicas.
+package pgproxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// Proxy relays messages between a client and a server. Messages received from the client are passed through the
+// interceptors in order before being sent to the server. Messages received from the server are passed through the
+// interceptors in reverse order before being sent to the client, so the first interceptor is the one closest to the
+// client.
+type Proxy struct {
+	clientConn net.Conn
+	serverConn net.Conn
+	backend    *pgproto3.Backend
+	frontend   *pgproto3.Frontend
+
+	interceptors []Interceptor
+
+	clientMu sync.Mutex // guards backend.Send
+	serverMu sync.Mutex // guards frontend.Send
+
+	txStatusMu sync.Mutex
+	txStatus   byte
+
+	terminated chan struct{} // closed when the client sends Terminate
+}
+
+// New creates a Proxy between clientConn and serverConn. serverConn must be a fresh connection on which no startup
+// message has been sent.
+func New(clientConn, serverConn net.Conn, interceptors ...Interceptor) *Proxy {
+	return &Proxy{
+		clientConn:   clientConn,
+		serverConn:   serverConn,
+		backend:      pgproto3.NewBackend(pgproto3.NewChunkReader(clientConn), clientConn),
+		frontend:     pgproto3.NewFrontend(pgproto3.NewChunkReader(serverConn), serverConn),
+		interceptors: interceptors,
+		terminated:   make(chan struct{}),
+	}
+}
+
+// Run relays the startup and authentication of the client and then relays messages in both directions until either
+// side disconnects or an interceptor returns an error. It returns nil if the client terminated the session normally.
+// Both connections are closed when Run returns.
+func (p *Proxy) Run() error {
+	defer p.Close()
+
+	ready, err := p.startup()
+	if err != nil || !ready {
+		return err
+	}
+
+	clientErrChan := make(chan error, 1)
+	serverErrChan := make(chan error, 1)
+	go func() { clientErrChan <- p.relayClientMessages() }()
+	go func() { serverErrChan <- p.relayServerMessages() }()
+
+	select {
+	case err = <-clientErrChan:
+		p.Close()
+		<-serverErrChan
+	case err = <-serverErrChan:
+		p.Close()
+		<-clientErrChan
+	}
+
+	// The server may close the connection in response to Terminate before the client relay returns.
+	select {
+	case <-p.terminated:
+		return nil
+	default:
+		return err
+	}
+}
+
+// Close closes the client and server connections.
+func (p *Proxy) Close() error {
+	clientErr := p.clientConn.Close()
+	serverErr := p.serverConn.Close()
+	if clientErr != nil {
+		return clientErr
+	}
+	return serverErr
+}
+
+// SendToClient sends msg to the client without passing it through the interceptors. It may be called by
+// interceptors to inject messages.
+func (p *Proxy) SendToClient(msg pgproto3.BackendMessage) error {
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+	return p.backend.Send(msg)
+}
+
+// SendToServer sends msg to the server without passing it through the interceptors. It may be called by
+// interceptors to inject messages.
+func (p *Proxy) SendToServer(msg pgproto3.FrontendMessage) error {
+	p.serverMu.Lock()
+	defer p.serverMu.Unlock()
+	return p.frontend.Send(msg)
+}
+
+// TxStatus returns the transaction status from the last ReadyForQuery sent by the server.
+func (p *Proxy) TxStatus() byte {
+	p.txStatusMu.Lock()
+	defer p.txStatusMu.Unlock()
+	return p.txStatus
+}
+
+// startup relays the startup message and authentication exchange. It returns true when the server is ready for
+// queries or when the rest of the exchange can be relayed by the message pumps.
+func (p *Proxy) startup() (bool, error) {
+	for {
+		msg, err := p.backend.ReceiveStartupMessage()
+		if err != nil {
+			return false, err
+		}
+
+		switch msg.(type) {
+		case *pgproto3.SSLRequest, *pgproto3.GSSEncRequest:
+			_, err = p.clientConn.Write([]byte("N"))
+			if err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		forwarded, err := p.forwardToServer(msg)
+		if err != nil {
+			return false, err
+		}
+		if _, ok := msg.(*pgproto3.CancelRequest); ok {
+			return false, nil
+		}
+		if forwarded != nil {
+			break
+		}
+	}
+
+	// Backend sets the authentication type used to decode the client's response when it forwards the request. The
+	// exchange is relayed in lockstep so the type is set before the client's response is received.
+	for {
+		msg, err := p.frontend.Receive()
+		if err != nil {
+			return false, err
+		}
+
+		// Whether the client responds depends on the message it was sent, which an interceptor may have rewritten or
+		// dropped.
+		forwarded, err := p.forwardToClient(msg)
+		if err != nil {
+			return false, err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			return false, fmt.Errorf("server rejected connection: %s", msg.Message)
+		case *pgproto3.ReadyForQuery:
+			return true, nil
+		}
+
+		switch forwarded.(type) {
+		case *pgproto3.AuthenticationCleartextPassword, *pgproto3.AuthenticationMD5Password,
+			*pgproto3.AuthenticationSASL, *pgproto3.AuthenticationSASLContinue:
+			clientMsg, err := p.backend.Receive()
+			if err != nil {
+				return false, err
+			}
+			if _, err := p.forwardToServer(clientMsg); err != nil {
+				return false, err
+			}
+		case *pgproto3.AuthenticationGSS:
+			// Only the client and server know how many GSSAPI tokens will be exchanged, but every client response
+			// from here on is a GSSResponse so the rest can be relayed by the message pumps.
+			return true, nil
+		}
+	}
+}
+
+func (p *Proxy) relayClientMessages() error {
+	for {
+		msg, err := p.backend.Receive()
+		if err != nil {
+			return err
+		}
+
+		forwarded, err := p.forwardToServer(msg)
+		// Only a Terminate the server was sent ends the session. Run waits for this goroutine before checking.
+		if _, ok := forwarded.(*pgproto3.Terminate); ok {
+			close(p.terminated)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (p *Proxy) relayServerMessages() error {
+	for {
+		msg, err := p.frontend.Receive()
+		if err != nil {
+			return err
+		}
+
+		_, err = p.forwardToClient(msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// forwardToServer passes msg through the interceptors and sends the result to the server. It returns the message
+// sent, or nil if an interceptor dropped the message.
+func (p *Proxy) forwardToServer(msg pgproto3.FrontendMessage) (pgproto3.FrontendMessage, error) {
+	for _, interceptor := range p.interceptors {
+		var err error
+		msg, err = interceptor.InterceptClientMessage(p, msg)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			return nil, nil
+		}
+	}
+
+	return msg, p.SendToServer(msg)
+}
+
+// forwardToClient passes msg through the interceptors in reverse order and sends the result to the client. It returns
+// the message sent, or nil if an interceptor dropped the message.
+func (p *Proxy) forwardToClient(msg pgproto3.BackendMessage) (pgproto3.BackendMessage, error) {
+	if rfq, ok := msg.(*pgproto3.ReadyForQuery); ok {
+		p.txStatusMu.Lock()
+		p.txStatus = rfq.TxStatus
+		p.txStatusMu.Unlock()
+	}
+
+	for i := len(p.interceptors) - 1; i >= 0; i-- {
+		var err error
+		msg, err = p.interceptors[i].InterceptServerMessage(p, msg)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			return nil, nil
+		}
+	}
+
+	return msg, p.SendToClient(msg)
+}
@@ -0,0 +1,402 @@
+package pgproxy_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/pgproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveFake serves a single session that authenticates with an MD5 password of "secret" and reports parameterStatus
+// at startup. Each statement of a query, separated by "; ", returns a row of the statement text and name. SET name =
+// value, SHOW name, BEGIN, COMMIT and ROLLBACK are understood. A statement starting with BLOCKED is a syntax error and
+// like any error aborts the transaction block.
+func serveFake(conn net.Conn, name string, parameterStatus map[string]string) {
+	defer conn.Close()
+
+	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	msg, err := backend.ReceiveStartupMessage()
+	if err != nil {
+		return
+	}
+	if _, ok := msg.(*pgproto3.StartupMessage); !ok {
+		return
+	}
+
+	backend.Send(&pgproto3.AuthenticationMD5Password{Salt: [4]byte{1, 2, 3, 4}})
+	backend.SetAuthType(pgproto3.AuthTypeMD5Password)
+	msg, err = backend.Receive()
+	if err != nil {
+		return
+	}
+	if pw, ok := msg.(*pgproto3.PasswordMessage); !ok || pw.Password != "md56478b3003505cc2b7c3cf5b2e47288ef" {
+		backend.Send(&pgproto3.ErrorResponse{Severity: "FATAL", Code: "28P01", Message: "password authentication failed"})
+		return
+	}
+
+	backend.Send(&pgproto3.AuthenticationOk{})
+	backend.Send(&pgproto3.ParameterStatus{Name: "server_version", Value: "14.0"})
+	for k, v := range parameterStatus {
+		backend.Send(&pgproto3.ParameterStatus{Name: k, Value: v})
+	}
+	backend.Send(&pgproto3.BackendKeyData{ProcessID: 42, SecretKey: 7})
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+
+	txStatus := byte('I')
+	params := make(map[string]string)
+	statements := make(map[string]string)
+
+	// execute runs stmt and reports whether it succeeded.
+	execute := func(stmt string, describe bool) bool {
+		row := func(value string) {
+			if describe {
+				backend.Send(&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{
+					{Name: []byte("value"), DataTypeOID: 25},
+					{Name: []byte("server"), DataTypeOID: 25},
+				}})
+			}
+			backend.Send(&pgproto3.DataRow{Values: [][]byte{[]byte(value), []byte(name)}})
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+		}
+
+		fail := func(code, message string) bool {
+			backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: code, Message: message})
+			if txStatus == 'T' {
+				txStatus = 'E'
+			}
+			return false
+		}
+
+		words := strings.Fields(stmt)
+		keyword := strings.ToUpper(words[0])
+		if keyword == "BLOCKED" {
+			return fail("42601", "syntax error at or near \"BLOCKED\"")
+		}
+		if txStatus == 'E' && keyword != "COMMIT" && keyword != "ROLLBACK" {
+			return fail("25P02", "current transaction is aborted")
+		}
+
+		switch keyword {
+		case "SET":
+			if len(words) == 4 {
+				params[words[1]] = strings.Trim(words[3], "'")
+			}
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("SET")})
+		case "RESET":
+			if strings.ToUpper(words[1]) == "ALL" {
+				params = make(map[string]string)
+			} else {
+				delete(params, words[1])
+			}
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("RESET")})
+		case "DEALLOCATE":
+			delete(statements, words[1])
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("DEALLOCATE")})
+		case "SHOW":
+			row(params[words[1]])
+		case "BEGIN":
+			txStatus = 'T'
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("BEGIN")})
+		case "COMMIT", "ROLLBACK":
+			// COMMIT of a failed transaction rolls it back.
+			tag := keyword
+			if txStatus == 'E' {
+				tag = "ROLLBACK"
+			}
+			txStatus = 'I'
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+		default:
+			row(stmt)
+		}
+		return true
+	}
+
+	var portal string
+	var failed bool
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.Query:
+			if failed {
+				continue
+			}
+			delete(statements, "")
+			for _, stmt := range strings.Split(msg.String, "; ") {
+				if !execute(stmt, true) {
+					break
+				}
+			}
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+		case *pgproto3.Parse:
+			if failed {
+				continue
+			}
+			if _, exists := statements[msg.Name]; exists && msg.Name != "" {
+				backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42P05", Message: "prepared statement already exists"})
+				failed = true
+				continue
+			}
+			if strings.HasPrefix(strings.ToUpper(msg.Query), "BLOCKED") {
+				backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601", Message: "syntax error at or near \"BLOCKED\""})
+				if txStatus == 'T' {
+					txStatus = 'E'
+				}
+				failed = true
+				continue
+			}
+			statements[msg.Name] = msg.Query
+			backend.Send(&pgproto3.ParseComplete{})
+		case *pgproto3.Bind:
+			if failed {
+				continue
+			}
+			var ok bool
+			portal, ok = statements[msg.PreparedStatement]
+			if !ok {
+				backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "26000", Message: "prepared statement does not exist"})
+				failed = true
+				continue
+			}
+			backend.Send(&pgproto3.BindComplete{})
+		case *pgproto3.Close:
+			if failed {
+				continue
+			}
+			if msg.ObjectType == 'S' {
+				delete(statements, msg.Name)
+			}
+			backend.Send(&pgproto3.CloseComplete{})
+		case *pgproto3.Execute:
+			if failed {
+				continue
+			}
+			failed = !execute(portal, false)
+		case *pgproto3.Sync:
+			failed = false
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+		case *pgproto3.Terminate:
+			return
+		}
+	}
+}
+
+type testClient struct {
+	conn      net.Conn
+	frontend  *pgproto3.Frontend
+	proxyDone chan error
+}
+
+func connectClient(t *testing.T, interceptors ...pgproxy.Interceptor) *testClient {
+	clientConn, proxyClientConn := net.Pipe()
+	proxyServerConn, serverConn := net.Pipe()
+	go serveFake(serverConn, "primary", nil)
+
+	proxy := pgproxy.New(proxyClientConn, proxyServerConn, interceptors...)
+	proxyDone := make(chan error, 1)
+	go func() { proxyDone <- proxy.Run() }()
+
+	c := &testClient{
+		conn:      clientConn,
+		frontend:  pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn),
+		proxyDone: proxyDone,
+	}
+	t.Cleanup(func() { clientConn.Close() })
+
+	result, err := c.frontend.Startup(&pgproto3.StartupConfig{
+		Parameters: map[string]string{"user": "jack", "database": "test"},
+		Password:   "secret",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(42), result.ProcessID)
+	assert.Equal(t, "14.0", result.ParameterStatus["server_version"])
+
+	return c
+}
+
+// query sends a simple query and returns the values of the first column and any error code.
+func (c *testClient) query(t *testing.T, sql string) ([]string, string) {
+	err := c.frontend.Send(&pgproto3.Query{String: sql})
+	require.NoError(t, err)
+
+	var values []string
+	var code string
+	for {
+		msg, err := c.frontend.Receive()
+		require.NoError(t, err)
+		switch msg := msg.(type) {
+		case *pgproto3.DataRow:
+			values = append(values, string(msg.Values[0]))
+		case *pgproto3.ErrorResponse:
+			code = msg.Code
+		case *pgproto3.ReadyForQuery:
+			return values, code
+		}
+	}
+}
+
+func TestProxyRelaysSession(t *testing.T) {
+	t.Parallel()
+
+	c := connectClient(t)
+
+	values, code := c.query(t, "select 1")
+	assert.Equal(t, []string{"select 1"}, values)
+	assert.Empty(t, code)
+
+	err := c.frontend.Send(&pgproto3.Terminate{})
+	require.NoError(t, err)
+	assert.NoError(t, <-c.proxyDone)
+}
+
+func TestProxyInterceptorModifiesMessages(t *testing.T) {
+	t.Parallel()
+
+	upper := pgproxy.InterceptorFuncs{
+		ClientMessage: func(p *pgproxy.Proxy, msg pgproto3.FrontendMessage) (pgproto3.FrontendMessage, error) {
+			if q, ok := msg.(*pgproto3.Query); ok {
+				return &pgproto3.Query{String: strings.ToUpper(q.String)}, nil
+			}
+			return msg, nil
+		},
+	}
+	suffix := pgproxy.InterceptorFuncs{
+		ServerMessage: func(p *pgproxy.Proxy, msg pgproto3.BackendMessage) (pgproto3.BackendMessage, error) {
+			if dr, ok := msg.(*pgproto3.DataRow); ok {
+				return &pgproto3.DataRow{Values: [][]byte{append(dr.Values[0], " -- seen"...)}}, nil
+			}
+			return msg, nil
+		},
+	}
+
+	c := connectClient(t, upper, suffix)
+
+	values, _ := c.query(t, "select 1")
+	assert.Equal(t, []string{"SELECT 1 -- seen"}, values)
+}
+
+func TestProxyInterceptorDropsAndInjectsMessages(t *testing.T) {
+	t.Parallel()
+
+	var sawRowDescription bool
+	block := pgproxy.InterceptorFuncs{
+		ClientMessage: func(p *pgproxy.Proxy, msg pgproto3.FrontendMessage) (pgproto3.FrontendMessage, error) {
+			if q, ok := msg.(*pgproto3.Query); ok && strings.HasPrefix(q.String, "drop") {
+				p.SendToClient(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42501", Message: "blocked"})
+				p.SendToClient(&pgproto3.ReadyForQuery{TxStatus: p.TxStatus()})
+				return nil, nil
+			}
+			return msg, nil
+		},
+		ServerMessage: func(p *pgproxy.Proxy, msg pgproto3.BackendMessage) (pgproto3.BackendMessage, error) {
+			if _, ok := msg.(*pgproto3.RowDescription); ok {
+				sawRowDescription = true
+				return nil, nil
+			}
+			return msg, nil
+		},
+	}
+
+	c := connectClient(t, block)
+
+	values, code := c.query(t, "drop table users")
+	assert.Empty(t, values)
+	assert.Equal(t, "42501", code)
+
+	values, code = c.query(t, "select 1")
+	assert.Equal(t, []string{"select 1"}, values)
+	assert.Empty(t, code)
+	assert.True(t, sawRowDescription)
+}
+
+func TestProxyInterceptorErrorStopsProxy(t *testing.T) {
+	t.Parallel()
+
+	c := connectClient(t, pgproxy.InterceptorFuncs{
+		ClientMessage: func(p *pgproxy.Proxy, msg pgproto3.FrontendMessage) (pgproto3.FrontendMessage, error) {
+			if _, ok := msg.(*pgproto3.Query); ok {
+				return nil, assert.AnError
+			}
+			return msg, nil
+		},
+	})
+
+	err := c.frontend.Send(&pgproto3.Query{String: "select 1"})
+	require.NoError(t, err)
+	assert.Equal(t, assert.AnError, <-c.proxyDone)
+
+	_, err = c.frontend.Receive()
+	assert.Error(t, err)
+}
+
+func TestProxyRejectsSSLRequest(t *testing.T) {
+	t.Parallel()
+
+	clientConn, proxyClientConn := net.Pipe()
+	defer clientConn.Close()
+	proxyServerConn, serverConn := net.Pipe()
+	go serveFake(serverConn, "primary", nil)
+	go pgproxy.New(proxyClientConn, proxyServerConn).Run()
+
+	buf, err := (&pgproto3.SSLRequest{}).Encode(nil)
+	require.NoError(t, err)
+	_, err = clientConn.Write(buf)
+	require.NoError(t, err)
+
+	response := make([]byte, 1)
+	_, err = clientConn.Read(response)
+	require.NoError(t, err)
+	assert.Equal(t, "N", string(response))
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)
+	_, err = frontend.Startup(&pgproto3.StartupConfig{
+		Parameters: map[string]string{"user": "jack", "database": "test"},
+		Password:   "secret",
+	})
+	require.NoError(t, err)
+}
+
+func TestProxyInterceptorAnswersAuthentication(t *testing.T) {
+	t.Parallel()
+
+	// The interceptor answers the server's password request itself so the client is never asked for a password.
+	c := connectClient(t, pgproxy.InterceptorFuncs{
+		ServerMessage: func(p *pgproxy.Proxy, msg pgproto3.BackendMessage) (pgproto3.BackendMessage, error) {
+			if _, ok := msg.(*pgproto3.AuthenticationMD5Password); ok {
+				return nil, p.SendToServer(&pgproto3.PasswordMessage{Password: "md56478b3003505cc2b7c3cf5b2e47288ef"})
+			}
+			return msg, nil
+		},
+	})
+
+	values, _ := c.query(t, "select 1")
+	assert.Equal(t, []string{"select 1"}, values)
+}
+
+func TestProxyInterceptorDropsTerminate(t *testing.T) {
+	t.Parallel()
+
+	c := connectClient(t, pgproxy.InterceptorFuncs{
+		ClientMessage: func(p *pgproxy.Proxy, msg pgproto3.FrontendMessage) (pgproto3.FrontendMessage, error) {
+			if _, ok := msg.(*pgproto3.Terminate); ok {
+				return nil, nil
+			}
+			return msg, nil
+		},
+	})
+
+	// The session continues after a Terminate that was not forwarded.
+	err := c.frontend.Send(&pgproto3.Terminate{})
+	require.NoError(t, err)
+	values, _ := c.query(t, "select 1")
+	assert.Equal(t, []string{"select 1"}, values)
+
+	c.conn.Close()
+	assert.Error(t, <-c.proxyDone)
+}
@@ -0,0 +1,769 @@
+package pgproxy
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"reflect"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/internal/sqlscan"
+)
+
+// Server is an established server connection used by a Router.
+type Server struct {
+	// Conn is the connection to the server. It is closed when the Router stops.
+	Conn net.Conn
+
+	// Frontend reads from and writes to Conn. Startup must already be complete, for example with Frontend.Startup.
+	Frontend *pgproto3.Frontend
+
+	// ParameterStatus holds the parameters the server reported during startup.
+	ParameterStatus map[string]string
+}
+
+// RouterConfig configures a Router.
+type RouterConfig struct {
+	// Primary receives every query that is not read-only. It is required.
+	Primary *Server
+
+	// Replicas receive read-only queries outside of explicit transactions. A replica is only used while it reports
+	// in_hot_standby as on (PostgreSQL 14 and later), so a server that is not a hot standby is never sent a query that
+	// could write.
+	Replicas []*Server
+
+	// IsReadOnly reports whether sql may be run on a replica. Defaults to IsReadOnly.
+	IsReadOnly func(sql string) bool
+}
+
+// IsReadOnly reports whether every statement in sql only reads data. It recognizes SELECT, VALUES, TABLE, SHOW, WITH
+// and EXPLAIN statements that do not lock rows, create tables with SELECT INTO, or modify data in a WITH clause.
+// Functions that modify data cannot be detected, except for nextval and setval.
+func IsReadOnly(sql string) bool {
+	statements := sqlscan.Split(sql)
+	if len(statements) == 0 {
+		return false
+	}
+
+	for _, stmt := range statements {
+		words := sqlscan.Words(stmt)
+		if len(words) == 0 {
+			return false
+		}
+
+		switch words[0] {
+		case "SELECT", "VALUES", "TABLE", "SHOW", "WITH", "EXPLAIN":
+		default:
+			return false
+		}
+
+		for i, word := range words {
+			switch word {
+			case "INSERT", "UPDATE", "DELETE", "MERGE", "INTO", "NEXTVAL", "SETVAL":
+				return false
+			case "FOR":
+				// FOR UPDATE is caught above. FOR SHARE, FOR NO KEY UPDATE and FOR KEY SHARE lock rows too.
+				if i+1 < len(words) && (words[i+1] == "SHARE" || words[i+1] == "NO" || words[i+1] == "KEY") {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// Router relays a client session to a primary server and any number of replicas. Read-only queries are sent to a
+// replica and all other queries to the primary. While the primary reports through ReadyForQuery that a transaction is
+// in progress every query is sent to the primary.
+//
+// Each batch of extended protocol messages up to a Sync is sent to a single server. If the client sends Flush before
+// Sync everything up to and including the Sync is sent to the same server, even simple queries. Named prepared
+// statements are prepared again on whichever server a batch uses them on, and are forgotten when the client closes them
+// or runs DEALLOCATE or DISCARD ALL. Session parameters changed with SET or RESET, in simple queries or in prepared
+// statements once an Execute of them completes, are set again on a replica before it is first used after the change.
+type Router struct {
+	clientConn net.Conn
+	backend    *pgproto3.Backend
+	primary    *routerServer
+	replicas   []*routerServer
+	servers    []*routerServer
+	isReadOnly func(string) bool
+
+	clientMu sync.Mutex // guards backend.Send; acquired before mu when both are held
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	closed     bool
+	txStatus   byte                        // from the last ReadyForQuery sent by the primary
+	replica    int                         // index of the preferred replica
+	statements map[string]*routerStatement // the client's prepared statements by name
+	session    []sessionStatement          // the statements to run on replicas, at most one per parameter
+
+	// Used only by the goroutine relaying client messages.
+	batch       []pgproto3.FrontendMessage
+	batchServer *routerServer // where the rest of the batch goes after a Flush
+	lastServer  *routerServer // where COPY data goes
+	discarding  bool          // a message of the batch could not be relayed so the rest is discarded until Sync
+
+	closeOnce  sync.Once
+	terminated chan struct{} // closed when the client sends Terminate
+}
+
+type routerServer struct {
+	conn     net.Conn
+	frontend *pgproto3.Frontend
+
+	// Guarded by Router.mu.
+	parameterStatus map[string]string
+	prepared        map[string]*routerStatement
+	responses       []routerResponse  // requests the server has not finished answering
+	aborted         bool              // the server is skipping messages until Sync
+	session         map[string]string // the Router.session statements run on the server by parameter
+
+	// portals are the statements the client's portals on the server were bound to.
+	portals map[string]*routerStatement
+}
+
+type routerStatement struct {
+	parse          pgproto3.Parse
+	readOnly       bool
+	changesSession bool // the statement is recorded by recordStatements when an Execute of it completes
+}
+
+// sessionStatement is a SET or RESET statement that changed the session parameter name. name is the statement itself
+// if the parameter could not be identified.
+type sessionStatement struct {
+	name string
+	sql  string
+}
+
+type routerResponse struct {
+	request   byte // message type of the request
+	drop      bool // the request was injected by the Router and the client does not expect a response
+	onFailure func()
+
+	// onComplete is called when the server answers the request with CommandComplete.
+	onComplete func()
+}
+
+// NewRouter creates a Router for the client connected by clientConn. backend must read from clientConn and the
+// client's startup must already be complete.
+func NewRouter(clientConn net.Conn, backend *pgproto3.Backend, config RouterConfig) (*Router, error) {
+	if config.Primary == nil {
+		return nil, errors.New("pgproxy: RouterConfig.Primary is required")
+	}
+	if config.IsReadOnly == nil {
+		config.IsReadOnly = IsReadOnly
+	}
+
+	r := &Router{
+		clientConn: clientConn,
+		backend:    backend,
+		isReadOnly: config.IsReadOnly,
+		txStatus:   'I',
+		statements: make(map[string]*routerStatement),
+		terminated: make(chan struct{}),
+	}
+	r.cond = sync.NewCond(&r.mu)
+
+	r.primary = newRouterServer(config.Primary)
+	r.servers = append(r.servers, r.primary)
+	for _, s := range config.Replicas {
+		rs := newRouterServer(s)
+		r.replicas = append(r.replicas, rs)
+		r.servers = append(r.servers, rs)
+	}
+	if len(r.replicas) > 0 {
+		r.replica = rand.Intn(len(r.replicas))
+	}
+
+	return r, nil
+}
+
+func newRouterServer(s *Server) *routerServer {
+	rs := &routerServer{
+		conn:            s.Conn,
+		frontend:        s.Frontend,
+		parameterStatus: make(map[string]string, len(s.ParameterStatus)),
+		prepared:        make(map[string]*routerStatement),
+		portals:         make(map[string]*routerStatement),
+		session:         make(map[string]string),
+	}
+	for k, v := range s.ParameterStatus {
+		rs.parameterStatus[k] = v
+	}
+	return rs
+}
+
+// Run relays messages until the client or any server disconnects. It returns nil if the client terminated the
+// session normally. All connections are closed when Run returns.
+func (r *Router) Run() error {
+	defer r.Close()
+
+	errChan := make(chan error, len(r.servers)+1)
+	for _, rs := range r.servers {
+		rs := rs
+		go func() { errChan <- r.relayServerMessages(rs) }()
+	}
+	go func() { errChan <- r.relayClientMessages() }()
+
+	err := <-errChan
+	r.Close()
+	for i := 0; i < len(r.servers); i++ {
+		<-errChan
+	}
+
+	select {
+	case <-r.terminated:
+		return nil
+	default:
+		return err
+	}
+}
+
+// Close closes the client and server connections.
+func (r *Router) Close() error {
+	r.closeOnce.Do(func() {
+		r.mu.Lock()
+		r.closed = true
+		r.cond.Broadcast()
+		r.mu.Unlock()
+
+		r.clientConn.Close()
+		for _, rs := range r.servers {
+			rs.conn.Close()
+		}
+	})
+	return nil
+}
+
+func (r *Router) relayClientMessages() error {
+	for {
+		msg, err := r.backend.Receive()
+		if err != nil {
+			return err
+		}
+
+		switch msg.(type) {
+		case *pgproto3.Terminate:
+			close(r.terminated)
+			for _, rs := range r.servers {
+				rs.frontend.Send(msg)
+			}
+			return nil
+		case *pgproto3.CopyData, *pgproto3.CopyDone, *pgproto3.CopyFail:
+			if r.lastServer != nil {
+				err = r.lastServer.frontend.Send(msg)
+			}
+		default:
+			if !r.discarding {
+				var clone pgproto3.FrontendMessage
+				clone, err = cloneFrontendMessage(msg)
+				if err != nil {
+					err = r.failBatch(err)
+				} else {
+					r.batch = append(r.batch, clone)
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+			switch msg.(type) {
+			case *pgproto3.Flush:
+				if !r.discarding {
+					err = r.route()
+				}
+			case *pgproto3.Sync, *pgproto3.Query, *pgproto3.FunctionCall:
+				if r.discarding {
+					// The client still expects ReadyForQuery and a server the batch was partly sent to needs Sync.
+					r.discarding = false
+					r.batch = []pgproto3.FrontendMessage{&pgproto3.Sync{}}
+				}
+				err = r.route()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// cloneFrontendMessage returns a copy of msg that remains valid after the next message is received.
+func cloneFrontendMessage(msg pgproto3.FrontendMessage) (pgproto3.FrontendMessage, error) {
+	buf, err := msg.Encode(nil)
+	if err != nil {
+		return nil, err
+	}
+	clone := reflect.New(reflect.TypeOf(msg).Elem()).Interface().(pgproto3.FrontendMessage)
+	if err := clone.Decode(buf[5:]); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// failBatch discards the batch and reports err to the client once the servers have answered everything sent before
+// it. The rest of the batch is discarded until Sync.
+func (r *Router) failBatch(err error) error {
+	r.batch = nil
+	r.discarding = true
+
+	r.mu.Lock()
+	for !r.closed && r.busyServer() != nil {
+		r.cond.Wait()
+	}
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return errRouterClosed
+	}
+
+	r.clientMu.Lock()
+	defer r.clientMu.Unlock()
+	return r.backend.Send(&pgproto3.ErrorResponse{
+		Severity:            "ERROR",
+		SeverityUnlocalized: "ERROR",
+		Code:                "08P01",
+		Message:             "pgproxy: " + err.Error(),
+	})
+}
+
+var errRouterClosed = errors.New("pgproxy: router closed")
+
+// route sends the buffered batch to the server chosen for it. A batch that ends with Flush pins the server until Sync.
+func (r *Router) route() error {
+	batch := r.batch
+	r.batch = nil
+
+	r.mu.Lock()
+	rs := r.batchServer
+	if rs == nil {
+		rs = r.chooseServer(batch)
+
+		// Responses must be delivered in order so a batch waits for any other server to finish answering.
+		for !r.closed && r.busyServer() != nil && r.busyServer() != rs {
+			r.cond.Wait()
+		}
+		if r.closed {
+			r.mu.Unlock()
+			return errRouterClosed
+		}
+	}
+	switch batch[len(batch)-1].(type) {
+	case *pgproto3.Flush:
+		r.batchServer = rs
+	case *pgproto3.Sync:
+		r.batchServer = nil
+	}
+	r.lastServer = rs
+	out := r.prepareBatch(rs, batch)
+	r.mu.Unlock()
+
+	for _, msg := range out {
+		if err := rs.frontend.Send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// busyServer returns the server that has not finished answering requests or nil if there is none. r.mu must be held.
+func (r *Router) busyServer() *routerServer {
+	for _, rs := range r.servers {
+		if len(rs.responses) > 0 {
+			return rs
+		}
+	}
+	return nil
+}
+
+// chooseServer returns the server to send batch to. r.mu must be held.
+func (r *Router) chooseServer(batch []pgproto3.FrontendMessage) *routerServer {
+	// Until the primary answers the transaction status is unknown.
+	if r.txStatus != 'I' || len(r.primary.responses) > 0 || !r.batchIsReadOnly(batch) {
+		return r.primary
+	}
+
+	for i := 0; i < len(r.replicas); i++ {
+		n := (r.replica + i) % len(r.replicas)
+		if r.replicas[n].parameterStatus["in_hot_standby"] == "on" {
+			r.replica = n
+			return r.replicas[n]
+		}
+	}
+
+	return r.primary
+}
+
+// batchIsReadOnly reports whether every query in batch is read-only. r.mu must be held.
+func (r *Router) batchIsReadOnly(batch []pgproto3.FrontendMessage) bool {
+	parsed := make(map[string]bool)
+	statementIsReadOnly := func(name string) bool {
+		if readOnly, ok := parsed[name]; ok {
+			return readOnly
+		}
+		stmt := r.statements[name]
+		return stmt != nil && stmt.readOnly
+	}
+
+	for _, msg := range batch {
+		switch msg := msg.(type) {
+		case *pgproto3.Query:
+			if !r.isReadOnly(msg.String) {
+				return false
+			}
+		case *pgproto3.Parse:
+			parsed[msg.Name] = r.isReadOnly(msg.Query)
+			if !parsed[msg.Name] {
+				return false
+			}
+		case *pgproto3.Bind:
+			if !statementIsReadOnly(msg.PreparedStatement) {
+				return false
+			}
+		case *pgproto3.Describe:
+			if msg.ObjectType == 'S' && !statementIsReadOnly(msg.Name) {
+				return false
+			}
+		case *pgproto3.FunctionCall:
+			return false
+		}
+	}
+
+	return true
+}
+
+// prepareBatch returns the messages to send to rs for batch and records the responses rs will send. r.mu must be
+// held.
+func (r *Router) prepareBatch(rs *routerServer, batch []pgproto3.FrontendMessage) []pgproto3.FrontendMessage {
+	var out []pgproto3.FrontendMessage
+
+	if rs != r.primary {
+		for _, sql := range r.sessionChanges(rs) {
+			out = append(out, &pgproto3.Query{String: sql})
+			rs.expect('Q', true, nil)
+			delete(rs.prepared, "")
+		}
+	}
+
+	for _, msg := range batch {
+		switch msg := msg.(type) {
+		case *pgproto3.Parse:
+			if msg.Name != "" && r.statements[msg.Name] == nil && rs.prepared[msg.Name] != nil {
+				// The client closed the statement while using another server.
+				out = append(out, &pgproto3.Close{ObjectType: 'S', Name: msg.Name})
+				rs.expect('C', true, nil)
+			}
+			stmt := &routerStatement{parse: *msg, readOnly: r.isReadOnly(msg.Query), changesSession: changesSession(msg.Query)}
+			r.statements[msg.Name] = stmt
+			rs.prepared[msg.Name] = stmt
+			rs.expect('P', false, r.forgetStatement(rs, msg.Name, stmt))
+
+		case *pgproto3.Bind:
+			out = r.ensurePrepared(rs, out, msg.PreparedStatement)
+			rs.portals[msg.DestinationPortal] = r.statements[msg.PreparedStatement]
+			rs.expect('B', false, nil)
+
+		case *pgproto3.Describe:
+			if msg.ObjectType == 'S' {
+				out = r.ensurePrepared(rs, out, msg.Name)
+			}
+			rs.expect('D', false, nil)
+
+		case *pgproto3.Close:
+			if msg.ObjectType == 'S' {
+				delete(r.statements, msg.Name)
+				delete(rs.prepared, msg.Name)
+			} else {
+				delete(rs.portals, msg.Name)
+			}
+			rs.expect('C', false, nil)
+
+		case *pgproto3.Execute:
+			rs.expect('E', false, nil)
+			if stmt := rs.portals[msg.Portal]; stmt != nil && stmt.changesSession {
+				sql := stmt.parse.Query
+				rs.responses[len(rs.responses)-1].onComplete = func() { r.recordStatements(rs, sql) }
+			}
+
+		case *pgproto3.Sync:
+			rs.expect('S', false, nil)
+
+		case *pgproto3.Query:
+			// A simple query destroys the unnamed prepared statement.
+			delete(r.statements, "")
+			delete(rs.prepared, "")
+			delete(rs.portals, "")
+			rs.expect('Q', false, nil)
+			r.recordStatements(rs, msg.String)
+
+		case *pgproto3.FunctionCall:
+			rs.expect('F', false, nil)
+		}
+
+		out = append(out, msg)
+	}
+
+	return out
+}
+
+// ensurePrepared appends a Parse to out if the client's statement name is not prepared on rs. r.mu must be held.
+func (r *Router) ensurePrepared(rs *routerServer, out []pgproto3.FrontendMessage, name string) []pgproto3.FrontendMessage {
+	stmt := r.statements[name]
+	if stmt == nil || rs.prepared[name] == stmt {
+		// Let the server report a statement that does not exist.
+		return out
+	}
+
+	if name != "" && rs.prepared[name] != nil {
+		out = append(out, &pgproto3.Close{ObjectType: 'S', Name: name})
+		rs.expect('C', true, nil)
+	}
+
+	parse := stmt.parse
+	rs.prepared[name] = stmt
+	rs.expect('P', true, r.forgetStatement(rs, name, stmt))
+	return append(out, &parse)
+}
+
+// forgetStatement returns a function that records that preparing stmt on rs failed.
+func (r *Router) forgetStatement(rs *routerServer, name string, stmt *routerStatement) func() {
+	return func() {
+		if rs.prepared[name] == stmt {
+			delete(rs.prepared, name)
+		}
+	}
+}
+
+// recordStatements records the statements of sql that deallocate prepared statements on rs or change session
+// parameters. r.mu must be held.
+func (r *Router) recordStatements(rs *routerServer, sql string) {
+	for _, stmt := range sqlscan.Split(sql) {
+		keywords := sqlscan.Keywords(stmt, 3)
+		if len(keywords) == 0 {
+			continue
+		}
+
+		switch keywords[0] {
+		case "DEALLOCATE":
+			n := 1
+			if len(keywords) > 1 && keywords[1] == "PREPARE" {
+				n = 2
+			}
+			if len(keywords) > n && keywords[n] == "ALL" {
+				r.forgetStatements(rs)
+			} else if name, ok := sqlscan.Identifier(stmt, n); ok {
+				delete(r.statements, name)
+				delete(rs.prepared, name)
+			}
+		case "DISCARD":
+			if len(keywords) > 1 && keywords[1] == "ALL" {
+				r.forgetStatements(rs)
+				rs.session = make(map[string]string)
+				if rs == r.primary {
+					r.session = nil
+				}
+			}
+		case "SET":
+			if rs != r.primary || len(keywords) > 1 && (keywords[1] == "LOCAL" || keywords[1] == "TRANSACTION") {
+				continue
+			}
+			n := 1
+			if len(keywords) > 1 && keywords[1] == "SESSION" {
+				n = 2
+			}
+			name, ok := sqlscan.Identifier(stmt, n)
+			switch {
+			case !ok:
+				name = stmt
+			case name == "time" && len(keywords) > n+1 && keywords[n+1] == "ZONE":
+				name = "timezone"
+			}
+			r.removeSessionStatement(name)
+			r.session = append(r.session, sessionStatement{name: name, sql: stmt})
+		case "RESET":
+			if rs != r.primary {
+				continue
+			}
+			if len(keywords) > 1 && keywords[1] == "ALL" {
+				r.session = nil
+			} else if name, ok := sqlscan.Identifier(stmt, 1); ok {
+				r.removeSessionStatement(name)
+			} else {
+				r.session = append(r.session, sessionStatement{name: stmt, sql: stmt})
+			}
+		}
+	}
+}
+
+// changesSession reports whether sql has a statement recordStatements records.
+func changesSession(sql string) bool {
+	for _, stmt := range sqlscan.Split(sql) {
+		if keywords := sqlscan.Keywords(stmt, 1); len(keywords) > 0 {
+			switch keywords[0] {
+			case "DEALLOCATE", "DISCARD", "SET", "RESET":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forgetStatements forgets the client's prepared statements, which have been deallocated on rs. r.mu must be held.
+func (r *Router) forgetStatements(rs *routerServer) {
+	r.statements = make(map[string]*routerStatement)
+	rs.prepared = make(map[string]*routerStatement)
+}
+
+// removeSessionStatement removes the statement that changed the session parameter name. r.mu must be held.
+func (r *Router) removeSessionStatement(name string) {
+	for i, ss := range r.session {
+		if ss.name == name {
+			r.session = append(r.session[:i], r.session[i+1:]...)
+			return
+		}
+	}
+}
+
+// sessionChanges returns the statements that bring the session parameters of rs in line with the client's and records
+// them as run. A parameter that is no longer changed is reset with RESET ALL. r.mu must be held.
+func (r *Router) sessionChanges(rs *routerServer) []string {
+	current := make(map[string]string, len(r.session))
+	for _, ss := range r.session {
+		current[ss.name] = ss.sql
+	}
+
+	var out []string
+	for name := range rs.session {
+		if _, ok := current[name]; !ok {
+			out = append(out, "RESET ALL")
+			rs.session = make(map[string]string)
+			break
+		}
+	}
+
+	for _, ss := range r.session {
+		if rs.session[ss.name] != ss.sql {
+			out = append(out, ss.sql)
+			rs.session[ss.name] = ss.sql
+		}
+	}
+	return out
+}
+
+func (rs *routerServer) expect(request byte, drop bool, onFailure func()) {
+	rs.responses = append(rs.responses, routerResponse{request: request, drop: drop, onFailure: onFailure})
+}
+
+func (r *Router) relayServerMessages(rs *routerServer) error {
+	for {
+		msg, err := rs.frontend.Receive()
+		if err != nil {
+			return err
+		}
+
+		// Holding clientMu while deciding keeps a batch sent to another server from being answered first.
+		r.clientMu.Lock()
+		r.mu.Lock()
+		forward := r.handleResponse(rs, msg)
+		r.mu.Unlock()
+		if forward {
+			err = r.backend.Send(msg)
+		}
+		r.clientMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleResponse records msg received from rs and reports whether it should be relayed to the client. r.mu must be
+// held.
+func (r *Router) handleResponse(rs *routerServer, msg pgproto3.BackendMessage) bool {
+	switch msg := msg.(type) {
+	case *pgproto3.ParameterStatus:
+		rs.parameterStatus[msg.Name] = msg.Value
+		return rs == r.primary
+	case *pgproto3.NoticeResponse, *pgproto3.NotificationResponse:
+		return true
+	}
+
+	// Requests sent after the server began skipping messages are skipped too.
+	rs.skipAborted(r.cond)
+	defer rs.skipAborted(r.cond)
+
+	if len(rs.responses) == 0 {
+		return true
+	}
+
+	resp := rs.responses[0]
+	if _, ok := msg.(*pgproto3.ErrorResponse); ok && resp.request != 'S' && resp.request != 'Q' && resp.request != 'F' {
+		if resp.onFailure != nil {
+			resp.onFailure()
+		}
+		rs.responses = rs.responses[1:]
+		rs.aborted = true
+		// The client is told when an injected Parse fails as its own messages will be skipped.
+		return true
+	}
+
+	if responseIsFinal(resp.request, msg) {
+		if _, ok := msg.(*pgproto3.CommandComplete); ok && resp.onComplete != nil {
+			resp.onComplete()
+		}
+		if rfq, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			rs.aborted = false
+			if rs == r.primary {
+				r.txStatus = rfq.TxStatus
+			}
+		}
+		rs.responses = rs.responses[1:]
+	}
+
+	return !resp.drop
+}
+
+// skipAborted removes the requests the server skips after an error and wakes waiters when every request has been
+// answered. Router.mu must be held.
+func (rs *routerServer) skipAborted(cond *sync.Cond) {
+	for rs.aborted && len(rs.responses) > 0 && rs.responses[0].request != 'S' {
+		if rs.responses[0].onFailure != nil {
+			rs.responses[0].onFailure()
+		}
+		rs.responses = rs.responses[1:]
+	}
+	if len(rs.responses) == 0 {
+		cond.Broadcast()
+	}
+}
+
+// responseIsFinal reports whether msg is the last message of the response to a request of type request.
+func responseIsFinal(request byte, msg pgproto3.BackendMessage) bool {
+	switch request {
+	case 'P':
+		_, ok := msg.(*pgproto3.ParseComplete)
+		return ok
+	case 'B':
+		_, ok := msg.(*pgproto3.BindComplete)
+		return ok
+	case 'C':
+		_, ok := msg.(*pgproto3.CloseComplete)
+		return ok
+	case 'D':
+		switch msg.(type) {
+		case *pgproto3.RowDescription, *pgproto3.NoData:
+			return true
+		}
+	case 'E':
+		switch msg.(type) {
+		case *pgproto3.CommandComplete, *pgproto3.EmptyQueryResponse, *pgproto3.PortalSuspended:
+			return true
+		}
+	case 'S', 'Q', 'F':
+		_, ok := msg.(*pgproto3.ReadyForQuery)
+		return ok
+	}
+	return false
+}
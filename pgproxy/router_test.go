@@ -0,0 +1,288 @@
+package pgproxy_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/pgproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func connectServer(t *testing.T, name string, parameterStatus map[string]string) *pgproxy.Server {
+	conn, serverConn := net.Pipe()
+	go serveFake(serverConn, name, parameterStatus)
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
+	result, err := frontend.Startup(&pgproto3.StartupConfig{
+		Parameters: map[string]string{"user": "jack", "database": "test"},
+		Password:   "secret",
+	})
+	require.NoError(t, err)
+
+	return &pgproxy.Server{Conn: conn, Frontend: frontend, ParameterStatus: result.ParameterStatus}
+}
+
+// connectRouter returns a client of a Router between a primary and a replica that reports replicaHotStandby as
+// in_hot_standby.
+func connectRouter(t *testing.T, replicaHotStandby string) *testClient {
+	clientConn, routerConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+
+	router, err := pgproxy.NewRouter(routerConn, pgproto3.NewBackend(pgproto3.NewChunkReader(routerConn), routerConn), pgproxy.RouterConfig{
+		Primary:  connectServer(t, "primary", map[string]string{"in_hot_standby": "off"}),
+		Replicas: []*pgproxy.Server{connectServer(t, "replica", map[string]string{"in_hot_standby": replicaHotStandby})},
+	})
+	require.NoError(t, err)
+
+	routerDone := make(chan error, 1)
+	go func() { routerDone <- router.Run() }()
+
+	return &testClient{
+		conn:      clientConn,
+		frontend:  pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn),
+		proxyDone: routerDone,
+	}
+}
+
+// queryServer runs a single statement query and returns the value and name of the server that ran it.
+func (c *testClient) queryServer(t *testing.T, sql string) (string, string) {
+	c.send(t, &pgproto3.Query{String: sql})
+	return c.receiveResult(t)
+}
+
+func (c *testClient) receiveResult(t *testing.T) (string, string) {
+	var value, server string
+	for {
+		msg, err := c.frontend.Receive()
+		require.NoError(t, err)
+		switch msg := msg.(type) {
+		case *pgproto3.DataRow:
+			value, server = string(msg.Values[0]), string(msg.Values[1])
+		case *pgproto3.ErrorResponse:
+			t.Fatalf("unexpected error: %v", msg)
+		case *pgproto3.ReadyForQuery:
+			return value, server
+		}
+	}
+}
+
+func TestIsReadOnly(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		sql      string
+		readOnly bool
+	}{
+		{"select * from users", true},
+		{"SELECT 1; show work_mem", true},
+		{"with t as (select 1) select * from t", true},
+		{"select * from users where name = 'delete'", true},
+		{"", false},
+		{"insert into users values (1)", false},
+		{"select 1; delete from users", false},
+		{"with t as (delete from users returning *) select * from t", false},
+		{"select * into new_users from users", false},
+		{"select * from users for update", false},
+		{"select * from users for share", false},
+		{"select * from users for no key update", false},
+		{"select nextval('users_id_seq')", false},
+		{"begin", false},
+		{"set work_mem = '1GB'", false},
+	}
+
+	for i, tt := range tests {
+		assert.Equalf(t, tt.readOnly, pgproxy.IsReadOnly(tt.sql), "%d. %q", i, tt.sql)
+	}
+}
+
+func TestRouterSplitsReadsAndWrites(t *testing.T) {
+	t.Parallel()
+
+	c := connectRouter(t, "on")
+
+	_, server := c.queryServer(t, "select 1")
+	assert.Equal(t, "replica", server)
+
+	_, server = c.queryServer(t, "insert into users values (1)")
+	assert.Equal(t, "primary", server)
+
+	c.send(t, &pgproto3.Terminate{})
+	assert.NoError(t, <-c.proxyDone)
+}
+
+func TestRouterPinsTransactionsToPrimary(t *testing.T) {
+	t.Parallel()
+
+	c := connectRouter(t, "on")
+
+	c.send(t, &pgproto3.Query{String: "begin"})
+	assert.Equal(t, []string{"CommandComplete BEGIN", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	_, server := c.queryServer(t, "select 1")
+	assert.Equal(t, "primary", server)
+
+	c.send(t, &pgproto3.Query{String: "commit"})
+	c.receiveUntilReady(t)
+
+	_, server = c.queryServer(t, "select 1")
+	assert.Equal(t, "replica", server)
+}
+
+func TestRouterRequiresHotStandby(t *testing.T) {
+	t.Parallel()
+
+	c := connectRouter(t, "off")
+
+	_, server := c.queryServer(t, "select 1")
+	assert.Equal(t, "primary", server)
+}
+
+func TestRouterReplaysSessionParametersOnReplica(t *testing.T) {
+	t.Parallel()
+
+	c := connectRouter(t, "on")
+
+	c.send(t, &pgproto3.Query{String: "set search_path = 'app'"})
+	assert.Equal(t, []string{"CommandComplete SET", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	value, server := c.queryServer(t, "show search_path")
+	assert.Equal(t, "replica", server)
+	assert.Equal(t, "app", value)
+}
+
+func TestRouterReplaysSessionParametersSetByPreparedStatement(t *testing.T) {
+	t.Parallel()
+
+	c := connectRouter(t, "on")
+
+	// A statement that is only prepared does not change the session.
+	c.send(t, &pgproto3.Parse{Name: "set_other", Query: "set search_path = 'other'"}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ParseComplete", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	c.send(t,
+		&pgproto3.Parse{Name: "set_app", Query: "set search_path = 'app'"},
+		&pgproto3.Bind{PreparedStatement: "set_app"},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t, []string{"ParseComplete", "BindComplete", "CommandComplete SET", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	value, server := c.queryServer(t, "show search_path")
+	assert.Equal(t, "replica", server)
+	assert.Equal(t, "app", value)
+}
+
+func TestRouterPreparesStatementsOnEachServer(t *testing.T) {
+	t.Parallel()
+
+	c := connectRouter(t, "on")
+
+	c.send(t, &pgproto3.Parse{Name: "s1", Query: "select 1"}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ParseComplete", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	c.send(t, &pgproto3.Bind{PreparedStatement: "s1"}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"BindComplete", "DataRow select 1", "CommandComplete SELECT 1", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	c.send(t, &pgproto3.Query{String: "begin"})
+	c.receiveUntilReady(t)
+
+	// s1 was prepared on the replica so the router prepares it on the primary and hides the ParseComplete.
+	c.send(t, &pgproto3.Bind{PreparedStatement: "s1"}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	msg, err := c.frontend.Receive()
+	require.NoError(t, err)
+	assert.IsType(t, &pgproto3.BindComplete{}, msg)
+	value, server := c.receiveResult(t)
+	assert.Equal(t, "select 1", value)
+	assert.Equal(t, "primary", server)
+
+	// Closing s1 on the primary leaves it on the replica, where the router must close it before it is parsed again.
+	c.send(t, &pgproto3.Close{ObjectType: 'S', Name: "s1"}, &pgproto3.Query{String: "commit"})
+	assert.Equal(t, []string{"CloseComplete", "CommandComplete COMMIT", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	c.send(t, &pgproto3.Parse{Name: "s1", Query: "select 2"}, &pgproto3.Bind{PreparedStatement: "s1"}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ParseComplete", "BindComplete", "DataRow select 2", "CommandComplete SELECT 1", "ReadyForQuery"}, c.receiveUntilReady(t))
+}
+
+func TestRouterResetsSessionParametersOnReplica(t *testing.T) {
+	t.Parallel()
+
+	c := connectRouter(t, "on")
+
+	c.send(t, &pgproto3.Query{String: "set search_path = 'app'"})
+	c.receiveUntilReady(t)
+	c.send(t, &pgproto3.Query{String: "set search_path = 'other'"})
+	c.receiveUntilReady(t)
+
+	value, server := c.queryServer(t, "show search_path")
+	assert.Equal(t, "replica", server)
+	assert.Equal(t, "other", value)
+
+	c.send(t, &pgproto3.Query{String: "reset search_path"})
+	assert.Equal(t, []string{"CommandComplete RESET", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	value, server = c.queryServer(t, "show search_path")
+	assert.Equal(t, "replica", server)
+	assert.Equal(t, "", value)
+}
+
+func TestRouterForgetsDeallocatedStatements(t *testing.T) {
+	t.Parallel()
+
+	c := connectRouter(t, "on")
+
+	c.send(t, &pgproto3.Parse{Name: "s1", Query: "select 1"}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ParseComplete", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	// DEALLOCATE runs on the primary so the router must close s1 on the replica before it is parsed again.
+	c.send(t, &pgproto3.Query{String: "deallocate s1"})
+	assert.Equal(t, []string{"CommandComplete DEALLOCATE", "ReadyForQuery"}, c.receiveUntilReady(t))
+
+	c.send(t, &pgproto3.Parse{Name: "s1", Query: "select 2"}, &pgproto3.Bind{PreparedStatement: "s1"}, &pgproto3.Execute{}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ParseComplete", "BindComplete", "DataRow select 2", "CommandComplete SELECT 1", "ReadyForQuery"}, c.receiveUntilReady(t))
+}
+
+func TestRouterPinsBatchUntilSync(t *testing.T) {
+	t.Parallel()
+
+	c := connectRouter(t, "on")
+
+	c.send(t, &pgproto3.Parse{Query: "select 1"}, &pgproto3.Bind{}, &pgproto3.Execute{}, &pgproto3.Flush{})
+	for _, expected := range []string{"ParseComplete", "BindComplete", "DataRow", "CommandComplete"} {
+		msg, err := c.frontend.Receive()
+		require.NoError(t, err)
+		assert.Equal(t, expected, fmt.Sprintf("%T", msg)[len("*pgproto3."):])
+	}
+
+	// A simple query in the middle of the batch goes to the same server even though it is not read-only.
+	c.send(t, &pgproto3.Query{String: "insert into users values (1)"})
+	_, server := c.receiveResult(t)
+	assert.Equal(t, "replica", server)
+	c.send(t, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ReadyForQuery"}, c.receiveUntilReady(t))
+
+	_, server = c.queryServer(t, "insert into users values (1)")
+	assert.Equal(t, "primary", server)
+}
+
+func TestRouterSkipsBatchAfterError(t *testing.T) {
+	t.Parallel()
+
+	c := connectRouter(t, "on")
+
+	c.send(t, &pgproto3.Bind{PreparedStatement: "missing"}, &pgproto3.Flush{})
+	msg, err := c.frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+
+	// The server skips everything up to Sync, including simple queries.
+	c.send(t, &pgproto3.Query{String: "select 2"}, &pgproto3.Sync{})
+	assert.Equal(t, []string{"ReadyForQuery"}, c.receiveUntilReady(t))
+
+	_, server := c.queryServer(t, "insert into users values (1)")
+	assert.Equal(t, "primary", server)
+	_, server = c.queryServer(t, "select 1")
+	assert.Equal(t, "replica", server)
+}
@@ -0,0 +1,839 @@
+// Package fakedb implements an in-memory database server for integration tests that speaks the PostgreSQL protocol.
+//
+// A DB keeps its tables in memory and serves clients through pgserver sessions over both the simple and extended
+// query protocols. It understands a small subset of SQL:
+//
+//	CREATE TABLE [IF NOT EXISTS] name (column type [PRIMARY KEY | UNIQUE | NOT NULL | NULL]..., ...)
+//	DROP TABLE [IF EXISTS] name
+//	INSERT INTO name [(column, ...)] VALUES (value, ...), ...
+//	SELECT * | column | value [AS alias], ... [FROM name [WHERE column = value [AND ...]]]
+//	UPDATE name SET column = value, ... [WHERE column = value [AND ...]]
+//	DELETE FROM name [WHERE column = value [AND ...]]
+//	BEGIN, START TRANSACTION, COMMIT, END, ROLLBACK, ABORT
+//	SET ... (ignored)
+//
+// A value is a literal, a $n parameter or NULL. The supported types are smallint, integer, bigint, serial, bigserial,
+// real, double precision, boolean, text and varchar. RowDescription reports the type OIDs, table OIDs and attribute
+// numbers that PostgreSQL would, and values are encoded in text or binary format as requested.
+//
+// Statements are atomic and transactions are isolated: changes made in a transaction are only visible to other
+// connections when it commits. Concurrent transactions that change the same table are not detected; the last to
+// commit wins.
+package fakedb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/pgserver"
+)
+
+// firstTableOID is the OID of the first table. PostgreSQL assigns OIDs starting at 16384 to user objects.
+const firstTableOID = 16384
+
+// DB is an in-memory database.
+type DB struct {
+	mu      sync.Mutex
+	tables  map[string]*table
+	nextOID uint32
+	nextPID uint32
+}
+
+// New returns an empty DB.
+func New() *DB {
+	return &DB{
+		tables:  make(map[string]*table),
+		nextOID: firstTableOID,
+	}
+}
+
+// Serve accepts connections on ln and serves each of them in its own goroutine until Accept fails, such as when ln is
+// closed. It returns the error from Accept.
+func (db *DB) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go db.ServeConn(context.Background(), conn)
+	}
+}
+
+// ServeConn serves a client on conn until it disconnects. Any user may connect without authentication and SSL and GSS
+// encryption are declined. conn is closed when ServeConn returns.
+func (db *DB) ServeConn(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+
+	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	var startup *pgproto3.StartupMessage
+	for startup == nil {
+		msg, err := backend.ReceiveStartupMessage()
+		if err != nil {
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.StartupMessage:
+			startup = msg
+		case *pgproto3.SSLRequest, *pgproto3.GSSEncRequest:
+			_, err = conn.Write([]byte("N"))
+			if err != nil {
+				return err
+			}
+		case *pgproto3.CancelRequest:
+			return nil
+		default:
+			return fmt.Errorf("fakedb: unexpected startup message %T", msg)
+		}
+	}
+
+	db.mu.Lock()
+	db.nextPID++
+	pid := db.nextPID
+	db.mu.Unlock()
+
+	messages := []pgproto3.BackendMessage{&pgproto3.AuthenticationOk{}}
+	for _, ps := range [][2]string{
+		{"application_name", startup.Parameters["application_name"]},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"integer_datetimes", "on"},
+		{"server_encoding", "UTF8"},
+		{"server_version", "14.0"},
+		{"standard_conforming_strings", "on"},
+		{"TimeZone", "UTC"},
+	} {
+		messages = append(messages, &pgproto3.ParameterStatus{Name: ps[0], Value: ps[1]})
+	}
+	messages = append(messages, &pgproto3.BackendKeyData{ProcessID: pid}, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+	for _, msg := range messages {
+		err := backend.Send(msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return pgserver.NewSession(backend, db.NewExecutor()).Serve(ctx)
+}
+
+// table is a table and its rows. A table is never changed once it is visible to other statements; statements change
+// a copy which replaces it when they succeed.
+type table struct {
+	name      string
+	oid       uint32
+	columns   []columnDef
+	rows      [][]interface{}
+	sequences []int64 // the last value of each serial column
+}
+
+func (t *table) clone() *table {
+	c := *t
+	c.rows = append([][]interface{}(nil), t.rows...)
+	c.sequences = append([]int64(nil), t.sequences...)
+	return &c
+}
+
+func (t *table) column(name string) (int, error) {
+	for i, col := range t.columns {
+		if col.name == name {
+			return i, nil
+		}
+	}
+	return 0, pgserver.Errorf("42703", "column \"%s\" of relation \"%s\" does not exist", name, t.name)
+}
+
+// check checks the NOT NULL, PRIMARY KEY and UNIQUE constraints of the rows of t.
+func (t *table) check() error {
+	for i, col := range t.columns {
+		var seen map[interface{}]bool
+		if col.unique {
+			seen = make(map[interface{}]bool, len(t.rows))
+		}
+
+		for _, row := range t.rows {
+			v := row[i]
+			if v == nil {
+				if col.notNull {
+					return pgserver.Errorf("23502", "null value in column \"%s\" of relation \"%s\" violates not-null constraint", col.name, t.name)
+				}
+				continue
+			}
+			if seen != nil {
+				if seen[v] {
+					return pgserver.Errorf("23505", "duplicate key value violates unique constraint \"%s\"", t.constraintName(col))
+				}
+				seen[v] = true
+			}
+		}
+	}
+	return nil
+}
+
+func (t *table) constraintName(col columnDef) string {
+	if col.primaryKey {
+		return t.name + "_pkey"
+	}
+	return t.name + "_" + col.name + "_key"
+}
+
+// transaction holds the tables created or changed by a transaction. A nil table has been dropped.
+type transaction struct {
+	tables map[string]*table
+}
+
+// Executor runs the statements of a single session. It implements pgserver.Executor and pgserver.ImplicitTransactor.
+type Executor struct {
+	db       *DB
+	tx       *transaction
+	implicit bool // tx is an implicit transaction
+}
+
+// NewExecutor returns an Executor for a new session on db.
+func (db *DB) NewExecutor() *Executor {
+	return &Executor{db: db}
+}
+
+// lookup returns the table name as seen by the session.
+func (e *Executor) lookup(name string) (*table, error) {
+	t, ok := e.db.tables[name]
+	if e.tx != nil {
+		if txTable, changed := e.tx.tables[name]; changed {
+			t, ok = txTable, txTable != nil
+		}
+	}
+	if !ok {
+		return nil, pgserver.Errorf("42P01", "relation \"%s\" does not exist", name)
+	}
+	return t, nil
+}
+
+// save makes t, which must be a new table or a clone, visible to the session. Outside of a transaction it is visible
+// to all sessions.
+func (e *Executor) save(t *table) {
+	if e.tx != nil {
+		e.tx.tables[t.name] = t
+	} else {
+		e.db.tables[t.name] = t
+	}
+}
+
+func (e *Executor) begin() {
+	e.tx = &transaction{tables: make(map[string]*table)}
+}
+
+// end ends the transaction and makes its changes visible to all sessions if commit is true.
+func (e *Executor) end(commit bool) {
+	if commit {
+		for name, t := range e.tx.tables {
+			if t == nil {
+				delete(e.db.tables, name)
+			} else {
+				e.db.tables[name] = t
+			}
+		}
+	}
+	e.tx = nil
+	e.implicit = false
+}
+
+// BeginImplicit implements pgserver.ImplicitTransactor.
+func (e *Executor) BeginImplicit(ctx context.Context) error {
+	e.db.mu.Lock()
+	defer e.db.mu.Unlock()
+
+	if e.tx == nil {
+		e.begin()
+		e.implicit = true
+	}
+	return nil
+}
+
+// EndImplicit implements pgserver.ImplicitTransactor.
+func (e *Executor) EndImplicit(ctx context.Context, commit bool) error {
+	e.db.mu.Lock()
+	defer e.db.mu.Unlock()
+
+	if e.implicit {
+		e.end(commit)
+	}
+	return nil
+}
+
+// Describe implements pgserver.Executor.
+func (e *Executor) Describe(ctx context.Context, sql string, paramOIDs []uint32) (*pgserver.StatementDescription, error) {
+	e.db.mu.Lock()
+	defer e.db.mu.Unlock()
+
+	stmt, err := parse(sql)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &describer{e: e, clientOIDs: paramOIDs}
+	fields, err := d.describe(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(paramOIDs)
+	if len(d.params) > n {
+		n = len(d.params)
+	}
+	desc := &pgserver.StatementDescription{ParamOIDs: make([]uint32, n), Fields: fields}
+	for i := range desc.ParamOIDs {
+		switch {
+		case i < len(paramOIDs) && paramOIDs[i] != 0:
+			desc.ParamOIDs[i] = paramOIDs[i]
+		case i < len(d.params) && d.params[i] != nil:
+			desc.ParamOIDs[i] = d.params[i].oid
+		default:
+			desc.ParamOIDs[i] = typeText.oid
+		}
+	}
+	return desc, nil
+}
+
+// describer infers the types of the parameters of a statement and describes its result.
+type describer struct {
+	e          *Executor
+	clientOIDs []uint32 // the parameter types specified by the client
+	params     []*dataType
+}
+
+// use records that e is used as a value of type t. The type specified by the client takes precedence.
+func (d *describer) use(e *expr, t *dataType) {
+	if e.kind != exprParam {
+		return
+	}
+	for len(d.params) <= e.param {
+		d.params = append(d.params, nil)
+	}
+	if d.params[e.param] != nil {
+		return
+	}
+	if e.param < len(d.clientOIDs) && d.clientOIDs[e.param] != 0 {
+		t = typesByOID[d.clientOIDs[e.param]]
+		if t == nil {
+			t = typeText
+		}
+	}
+	d.params[e.param] = t
+}
+
+func (d *describer) useConditions(t *table, conditions []condition) error {
+	for _, c := range conditions {
+		i, err := t.column(c.column)
+		if err != nil {
+			return err
+		}
+		d.use(c.value, t.columns[i].typ)
+	}
+	return nil
+}
+
+func (d *describer) describe(stmt statement) ([]pgproto3.FieldDescription, error) {
+	switch stmt := stmt.(type) {
+	case *insertStmt:
+		t, err := d.e.lookup(stmt.table)
+		if err != nil {
+			return nil, err
+		}
+		columns, err := insertColumns(t, stmt)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range stmt.rows {
+			for i, value := range row {
+				d.use(value, t.columns[columns[i]].typ)
+			}
+		}
+
+	case *selectStmt:
+		items, t, err := d.e.selectItems(stmt)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			err = d.useConditions(t, stmt.where)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		fields := make([]pgproto3.FieldDescription, len(items))
+		for i, item := range items {
+			typ := item.typ
+			if item.value != nil {
+				d.use(item.value, typeText)
+				if item.value.kind == exprParam {
+					typ = d.params[item.value.param]
+				}
+			}
+			fields[i] = pgproto3.FieldDescription{
+				Name:         []byte(item.name),
+				DataTypeOID:  typ.oid,
+				DataTypeSize: typ.size,
+				TypeModifier: -1,
+			}
+			if item.column >= 0 {
+				fields[i].TableOID = t.oid
+				fields[i].TableAttributeNumber = uint16(item.column + 1)
+			}
+		}
+		return fields, nil
+
+	case *updateStmt:
+		t, err := d.e.lookup(stmt.table)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range stmt.set {
+			i, err := t.column(a.column)
+			if err != nil {
+				return nil, err
+			}
+			d.use(a.value, t.columns[i].typ)
+		}
+		return nil, d.useConditions(t, stmt.where)
+
+	case *deleteStmt:
+		t, err := d.e.lookup(stmt.table)
+		if err != nil {
+			return nil, err
+		}
+		return nil, d.useConditions(t, stmt.where)
+	}
+
+	return nil, nil
+}
+
+// insertColumns returns the indexes of the columns stmt inserts into.
+func insertColumns(t *table, stmt *insertStmt) ([]int, error) {
+	var columns []int
+	if stmt.columns == nil {
+		for i := range t.columns {
+			columns = append(columns, i)
+		}
+	} else {
+		for _, name := range stmt.columns {
+			i, err := t.column(name)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range columns {
+				if c == i {
+					return nil, pgserver.Errorf("42701", "column \"%s\" specified more than once", name)
+				}
+			}
+			columns = append(columns, i)
+		}
+	}
+
+	for _, row := range stmt.rows {
+		if len(row) > len(columns) {
+			return nil, pgserver.Errorf("42601", "INSERT has more expressions than target columns")
+		}
+		if len(row) < len(columns) && stmt.columns != nil {
+			return nil, pgserver.Errorf("42601", "INSERT has more target columns than expressions")
+		}
+	}
+	return columns, nil
+}
+
+// resultItem is a column of the result of a SELECT.
+type resultItem struct {
+	name   string
+	typ    *dataType
+	column int   // the index of the table column or -1
+	value  *expr // the value if column is -1
+}
+
+// selectItems returns the columns of the result of stmt and the table it selects from, if any.
+func (e *Executor) selectItems(stmt *selectStmt) ([]resultItem, *table, error) {
+	var t *table
+	if stmt.table != "" {
+		var err error
+		t, err = e.lookup(stmt.table)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var items []resultItem
+	for _, item := range stmt.items {
+		switch {
+		case item.star:
+			if t == nil {
+				return nil, nil, pgserver.Errorf("42601", "SELECT * with no tables specified is not valid")
+			}
+			for i, col := range t.columns {
+				items = append(items, resultItem{name: col.name, typ: col.typ, column: i})
+			}
+		case item.column != "":
+			if t == nil {
+				return nil, nil, pgserver.Errorf("42703", "column \"%s\" does not exist", item.column)
+			}
+			i, err := t.column(item.column)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, resultItem{name: item.column, typ: t.columns[i].typ, column: i})
+		default:
+			typ := item.expr.typ
+			if typ == nil {
+				typ = typeText
+			}
+			items = append(items, resultItem{name: "?column?", typ: typ, column: -1, value: item.expr})
+		}
+
+		if item.alias != "" {
+			items[len(items)-1].name = item.alias
+		}
+	}
+	return items, t, nil
+}
+
+// Execute implements pgserver.Executor.
+func (e *Executor) Execute(ctx context.Context, portal *pgserver.Portal) (*pgserver.Result, error) {
+	e.db.mu.Lock()
+	defer e.db.mu.Unlock()
+
+	stmt, err := parse(portal.Statement.SQL)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := decodeParams(portal)
+	if err != nil {
+		return nil, err
+	}
+
+	switch stmt := stmt.(type) {
+	case *createTableStmt:
+		return e.createTable(stmt)
+	case *dropTableStmt:
+		return e.dropTable(stmt)
+	case *insertStmt:
+		return e.insert(stmt, params)
+	case *selectStmt:
+		return e.selectRows(stmt, params, portal.ResultFormats)
+	case *updateStmt:
+		return e.update(stmt, params)
+	case *deleteStmt:
+		return e.delete(stmt, params)
+	case *transactionStmt:
+		return e.transaction(stmt, portal.TxStatus), nil
+	default: // *setStmt
+		return &pgserver.Result{CommandTag: "SET"}, nil
+	}
+}
+
+// paramValue is the decoded value of a parameter and its type.
+type paramValue struct {
+	value interface{}
+	typ   *dataType
+}
+
+func decodeParams(portal *pgserver.Portal) ([]paramValue, error) {
+	params := make([]paramValue, len(portal.Params))
+	for i, src := range portal.Params {
+		t := typesByOID[portal.Statement.ParamOIDs[i]]
+		if t == nil {
+			if portal.ParamFormats[i] != 0 {
+				return nil, pgserver.Errorf("0A000", "binary format is not supported for parameter $%d of type %d", i+1, portal.Statement.ParamOIDs[i])
+			}
+			t = typeText
+		}
+
+		v, err := t.decode(src, portal.ParamFormats[i])
+		if err != nil {
+			return nil, err
+		}
+		params[i] = paramValue{value: v, typ: t}
+	}
+	return params, nil
+}
+
+// eval returns the value of e as type t.
+func eval(e *expr, t *dataType, params []paramValue) (interface{}, error) {
+	switch e.kind {
+	case exprNull:
+		return nil, nil
+	case exprParam:
+		if e.param >= len(params) {
+			return nil, pgserver.Errorf("08P01", "there is no parameter $%d", e.param+1)
+		}
+		return t.coerce(params[e.param].value)
+	default:
+		return t.parseText(e.text)
+	}
+}
+
+// filter returns a function that reports whether a row of t matches conditions.
+func filter(t *table, conditions []condition, params []paramValue) (func(row []interface{}) bool, error) {
+	columns := make([]int, len(conditions))
+	values := make([]interface{}, len(conditions))
+	for i, c := range conditions {
+		var err error
+		columns[i], err = t.column(c.column)
+		if err != nil {
+			return nil, err
+		}
+		values[i], err = eval(c.value, t.columns[columns[i]].typ, params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(row []interface{}) bool {
+		for i, col := range columns {
+			// NULL is not equal to anything.
+			if row[col] == nil || values[i] == nil || row[col] != values[i] {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func (e *Executor) createTable(stmt *createTableStmt) (*pgserver.Result, error) {
+	if _, err := e.lookup(stmt.table); err == nil {
+		if stmt.ifNotExists {
+			return &pgserver.Result{CommandTag: "CREATE TABLE"}, nil
+		}
+		return nil, pgserver.Errorf("42P07", "relation \"%s\" already exists", stmt.table)
+	}
+
+	t := &table{
+		name:      stmt.table,
+		oid:       e.db.nextOID,
+		columns:   stmt.columns,
+		sequences: make([]int64, len(stmt.columns)),
+	}
+	e.db.nextOID++
+	e.save(t)
+	return &pgserver.Result{CommandTag: "CREATE TABLE"}, nil
+}
+
+func (e *Executor) dropTable(stmt *dropTableStmt) (*pgserver.Result, error) {
+	if _, err := e.lookup(stmt.table); err != nil {
+		if stmt.ifExists {
+			return &pgserver.Result{CommandTag: "DROP TABLE"}, nil
+		}
+		return nil, pgserver.Errorf("42P01", "table \"%s\" does not exist", stmt.table)
+	}
+
+	if e.tx != nil {
+		e.tx.tables[stmt.table] = nil
+	} else {
+		delete(e.db.tables, stmt.table)
+	}
+	return &pgserver.Result{CommandTag: "DROP TABLE"}, nil
+}
+
+func (e *Executor) insert(stmt *insertStmt, params []paramValue) (*pgserver.Result, error) {
+	t, err := e.lookup(stmt.table)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := insertColumns(t, stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	t = t.clone()
+	for _, exprs := range stmt.rows {
+		row := make([]interface{}, len(t.columns))
+		set := make([]bool, len(t.columns))
+		for i, value := range exprs {
+			col := columns[i]
+			row[col], err = eval(value, t.columns[col].typ, params)
+			if err != nil {
+				return nil, err
+			}
+			set[col] = true
+		}
+		for i, col := range t.columns {
+			if col.serial && !set[i] {
+				t.sequences[i]++
+				row[i] = t.sequences[i]
+			}
+		}
+		t.rows = append(t.rows, row)
+	}
+
+	err = t.check()
+	if err != nil {
+		return nil, err
+	}
+	e.save(t)
+	return &pgserver.Result{CommandTag: fmt.Sprintf("INSERT 0 %d", len(stmt.rows))}, nil
+}
+
+func (e *Executor) selectRows(stmt *selectStmt, params []paramValue, formats []int16) (*pgserver.Result, error) {
+	items, t, err := e.selectItems(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	// The values that are not columns are the same in every row.
+	values := make([]interface{}, len(items))
+	for i, item := range items {
+		if item.value == nil {
+			continue
+		}
+		typ := item.typ
+		if item.value.kind == exprParam && item.value.param < len(params) {
+			typ = params[item.value.param].typ
+			items[i].typ = typ
+		}
+		values[i], err = eval(item.value, typ, params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	encode := func(row []interface{}) ([][]byte, error) {
+		encoded := make([][]byte, len(items))
+		for i, item := range items {
+			value := values[i]
+			if item.value == nil {
+				value = row[item.column]
+			}
+			var err error
+			encoded[i], err = item.typ.encode(value, formats[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return encoded, nil
+	}
+
+	result := &pgserver.Result{}
+	if t == nil {
+		row, err := encode(nil)
+		if err != nil {
+			return nil, err
+		}
+		result.Rows = append(result.Rows, row)
+		return result, nil
+	}
+
+	match, err := filter(t, stmt.where, params)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range t.rows {
+		if !match(row) {
+			continue
+		}
+		encoded, err := encode(row)
+		if err != nil {
+			return nil, err
+		}
+		result.Rows = append(result.Rows, encoded)
+	}
+	return result, nil
+}
+
+func (e *Executor) update(stmt *updateStmt, params []paramValue) (*pgserver.Result, error) {
+	t, err := e.lookup(stmt.table)
+	if err != nil {
+		return nil, err
+	}
+	match, err := filter(t, stmt.where, params)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]int, len(stmt.set))
+	values := make([]interface{}, len(stmt.set))
+	for i, a := range stmt.set {
+		columns[i], err = t.column(a.column)
+		if err != nil {
+			return nil, err
+		}
+		values[i], err = eval(a.value, t.columns[columns[i]].typ, params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t = t.clone()
+	n := 0
+	for i, row := range t.rows {
+		if !match(row) {
+			continue
+		}
+		row = append([]interface{}(nil), row...)
+		for j, col := range columns {
+			row[col] = values[j]
+		}
+		t.rows[i] = row
+		n++
+	}
+
+	err = t.check()
+	if err != nil {
+		return nil, err
+	}
+	e.save(t)
+	return &pgserver.Result{CommandTag: fmt.Sprintf("UPDATE %d", n)}, nil
+}
+
+func (e *Executor) delete(stmt *deleteStmt, params []paramValue) (*pgserver.Result, error) {
+	t, err := e.lookup(stmt.table)
+	if err != nil {
+		return nil, err
+	}
+	match, err := filter(t, stmt.where, params)
+	if err != nil {
+		return nil, err
+	}
+
+	t = t.clone()
+	rows := t.rows[:0]
+	for _, row := range t.rows {
+		if !match(row) {
+			rows = append(rows, row)
+		}
+	}
+	n := len(t.rows) - len(rows)
+	t.rows = rows
+
+	e.save(t)
+	return &pgserver.Result{CommandTag: fmt.Sprintf("DELETE %d", n)}, nil
+}
+
+func (e *Executor) transaction(stmt *transactionStmt, txStatus byte) *pgserver.Result {
+	switch stmt.kind {
+	case txBegin:
+		if e.tx == nil {
+			e.begin()
+		}
+		// An implicit transaction becomes part of the transaction block.
+		e.implicit = false
+		return &pgserver.Result{CommandTag: "BEGIN"}
+
+	case txCommit:
+		if e.tx == nil {
+			return &pgserver.Result{CommandTag: "COMMIT"}
+		}
+		// Committing a failed transaction rolls it back.
+		commit := txStatus != 'E'
+		e.end(commit)
+		if !commit {
+			return &pgserver.Result{CommandTag: "ROLLBACK"}
+		}
+		return &pgserver.Result{CommandTag: "COMMIT"}
+
+	default:
+		if e.tx != nil {
+			e.end(false)
+		}
+		return &pgserver.Result{CommandTag: "ROLLBACK"}
+	}
+}
@@ -0,0 +1,282 @@
+package fakedb_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/pgserver/fakedb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testClient struct {
+	t        *testing.T
+	conn     net.Conn
+	frontend *pgproto3.Frontend
+}
+
+// connect serves a connection to db and returns a client that has completed the startup.
+func connect(t *testing.T, db *fakedb.DB) *testClient {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	go db.ServeConn(context.Background(), serverConn)
+
+	c := &testClient{t: t, conn: clientConn, frontend: pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)}
+	c.send(&pgproto3.StartupMessage{ProtocolVersion: pgproto3.ProtocolVersionNumber, Parameters: map[string]string{"user": "test"}})
+	c.receiveUntilReady()
+	return c
+}
+
+// send writes msgs in a single write in the background.
+func (c *testClient) send(msgs ...pgproto3.FrontendMessage) {
+	var buf []byte
+	for _, msg := range msgs {
+		var err error
+		buf, err = msg.Encode(buf)
+		require.NoError(c.t, err)
+	}
+	go c.conn.Write(buf)
+}
+
+// result is what the client received up to and including ReadyForQuery.
+type result struct {
+	fields   []pgproto3.FieldDescription
+	rows     [][]string
+	tags     []string
+	err      *pgproto3.ErrorResponse
+	txStatus byte
+}
+
+func (c *testClient) receiveUntilReady() *result {
+	r := &result{}
+	for {
+		msg, err := c.frontend.Receive()
+		require.NoError(c.t, err)
+
+		switch msg := msg.(type) {
+		case *pgproto3.RowDescription:
+			r.fields = nil
+			for _, fd := range msg.Fields {
+				fd.Name = append([]byte(nil), fd.Name...)
+				r.fields = append(r.fields, fd)
+			}
+		case *pgproto3.DataRow:
+			row := make([]string, len(msg.Values))
+			for i, v := range msg.Values {
+				if v == nil {
+					row[i] = "NULL"
+				} else {
+					row[i] = string(v)
+				}
+			}
+			r.rows = append(r.rows, row)
+		case *pgproto3.CommandComplete:
+			r.tags = append(r.tags, string(msg.CommandTag))
+		case *pgproto3.ErrorResponse:
+			errResp := *msg
+			r.err = &errResp
+		case *pgproto3.ReadyForQuery:
+			r.txStatus = msg.TxStatus
+			return r
+		}
+	}
+}
+
+func (c *testClient) query(sql string) *result {
+	c.send(&pgproto3.Query{String: sql})
+	return c.receiveUntilReady()
+}
+
+// mustQuery runs sql and fails the test if the server reports an error.
+func (c *testClient) mustQuery(sql string) *result {
+	r := c.query(sql)
+	require.Nil(c.t, r.err, sql)
+	return r
+}
+
+func TestSimpleQuery(t *testing.T) {
+	t.Parallel()
+
+	client := connect(t, fakedb.New())
+	r := client.mustQuery(`create table users (id serial primary key, name text not null, age integer, score double precision, admin boolean)`)
+	assert.Equal(t, []string{"CREATE TABLE"}, r.tags)
+
+	r = client.mustQuery(`insert into users (name, age, score, admin) values ('alice', 30, 1.5, true), ('bob', 25, null, false)`)
+	assert.Equal(t, []string{"INSERT 0 2"}, r.tags)
+
+	r = client.mustQuery(`select * from users`)
+	assert.Equal(t, [][]string{{"1", "alice", "30", "1.5", "t"}, {"2", "bob", "25", "NULL", "f"}}, r.rows)
+	assert.Equal(t, []string{"SELECT 2"}, r.tags)
+
+	require.Len(t, r.fields, 5)
+	var oids []uint32
+	for i, fd := range r.fields {
+		oids = append(oids, fd.DataTypeOID)
+		assert.Equal(t, r.fields[0].TableOID, fd.TableOID)
+		assert.EqualValues(t, i+1, fd.TableAttributeNumber)
+		assert.EqualValues(t, 0, fd.Format)
+	}
+	assert.Equal(t, []uint32{23, 25, 23, 701, 16}, oids)
+	assert.EqualValues(t, 16384, r.fields[0].TableOID)
+	assert.Equal(t, "id", string(r.fields[0].Name))
+
+	r = client.mustQuery(`select name as n, 'x' from users where age = 25`)
+	assert.Equal(t, [][]string{{"bob", "x"}}, r.rows)
+	require.Len(t, r.fields, 2)
+	assert.Equal(t, "n", string(r.fields[0].Name))
+	assert.Equal(t, "?column?", string(r.fields[1].Name))
+	assert.EqualValues(t, 0, r.fields[1].TableOID)
+
+	r = client.mustQuery(`update users set age = 31, admin = false where name = 'alice'`)
+	assert.Equal(t, []string{"UPDATE 1"}, r.tags)
+	r = client.mustQuery(`delete from users where id = 2`)
+	assert.Equal(t, []string{"DELETE 1"}, r.tags)
+
+	r = client.mustQuery(`select id, age, admin from users`)
+	assert.Equal(t, [][]string{{"1", "31", "f"}}, r.rows)
+}
+
+func TestErrors(t *testing.T) {
+	t.Parallel()
+
+	client := connect(t, fakedb.New())
+	client.mustQuery(`create table t (id integer primary key, name varchar unique)`)
+	client.mustQuery(`insert into t values (1, 'a')`)
+
+	for _, tt := range []struct {
+		sql  string
+		code string
+	}{
+		{`insert into t values (1, 'b')`, "23505"},
+		{`insert into t (name) values ('b')`, "23502"},
+		{`insert into t values ('x', 'b')`, "22P02"},
+		{`insert into t values (100000000000, 'b')`, "22003"},
+		{`update t set name = 'a' where id = 2`, ""},
+		{`select missing from t`, "42703"},
+		{`select * from missing`, "42P01"},
+		{`create table t (id integer)`, "42P07"},
+		{`selec 1`, "42601"},
+	} {
+		r := client.query(tt.sql)
+		if tt.code == "" {
+			assert.Nil(t, r.err, tt.sql)
+			continue
+		}
+		if assert.NotNil(t, r.err, tt.sql) {
+			assert.Equal(t, tt.code, r.err.Code, tt.sql)
+		}
+		assert.Equal(t, byte('I'), r.txStatus)
+	}
+
+	r := client.query(`insert into t values (2, 'b'), (3, 'b')`)
+	require.NotNil(t, r.err)
+	assert.Equal(t, "duplicate key value violates unique constraint \"t_name_key\"", r.err.Message)
+
+	// Failed statements change nothing.
+	r = client.mustQuery(`select * from t`)
+	assert.Equal(t, [][]string{{"1", "a"}}, r.rows)
+}
+
+func TestExtendedQuery(t *testing.T) {
+	t.Parallel()
+
+	client := connect(t, fakedb.New())
+	client.mustQuery(`create table items (id bigint primary key, name text, price real)`)
+
+	param := make([]byte, 8)
+	for i, name := range []string{"one", "two", "three"} {
+		binary.BigEndian.PutUint64(param, uint64(i+1))
+		client.send(
+			&pgproto3.Parse{Query: `insert into items (id, name, price) values ($1, $2, $3)`},
+			&pgproto3.Bind{ParameterFormatCodes: []int16{1, 0, 0}, Parameters: [][]byte{param, []byte(name), []byte("2.5")}},
+			&pgproto3.Execute{},
+			&pgproto3.Sync{},
+		)
+		r := client.receiveUntilReady()
+		require.Nil(t, r.err)
+		assert.Equal(t, []string{"INSERT 0 1"}, r.tags)
+	}
+
+	// The parameter types are inferred from the columns they are compared with.
+	client.send(
+		&pgproto3.Parse{Name: "s", Query: `select id, name, price from items where id = $1`},
+		&pgproto3.Describe{ObjectType: 'S', Name: "s"},
+		&pgproto3.Sync{},
+	)
+	var paramOIDs []uint32
+	for {
+		msg, err := client.frontend.Receive()
+		require.NoError(t, err)
+		if msg, ok := msg.(*pgproto3.ParameterDescription); ok {
+			paramOIDs = append(paramOIDs, msg.ParameterOIDs...)
+		}
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+	assert.Equal(t, []uint32{20}, paramOIDs)
+
+	binary.BigEndian.PutUint64(param, 2)
+	client.send(
+		&pgproto3.Bind{PreparedStatement: "s", ParameterFormatCodes: []int16{1}, Parameters: [][]byte{param}, ResultFormatCodes: []int16{1}},
+		&pgproto3.Describe{ObjectType: 'P'},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	r := client.receiveUntilReady()
+	require.Nil(t, r.err)
+	require.Len(t, r.fields, 3)
+	assert.EqualValues(t, 1, r.fields[0].Format)
+	require.Len(t, r.rows, 1)
+	assert.EqualValues(t, 2, binary.BigEndian.Uint64([]byte(r.rows[0][0])))
+	assert.Equal(t, "two", r.rows[0][1])
+	assert.Equal(t, []byte{0x40, 0x20, 0, 0}, []byte(r.rows[0][2]))
+}
+
+func TestTransaction(t *testing.T) {
+	t.Parallel()
+
+	db := fakedb.New()
+	client := connect(t, db)
+	other := connect(t, db)
+	client.mustQuery(`create table t (id integer unique)`)
+
+	r := client.mustQuery(`begin`)
+	assert.Equal(t, byte('T'), r.txStatus)
+	client.mustQuery(`insert into t values (1)`)
+
+	// Changes are not visible to other sessions until the transaction commits.
+	r = other.mustQuery(`select * from t`)
+	assert.Empty(t, r.rows)
+
+	r = client.mustQuery(`rollback`)
+	assert.Equal(t, byte('I'), r.txStatus)
+	r = client.mustQuery(`select * from t`)
+	assert.Empty(t, r.rows)
+
+	client.mustQuery(`begin`)
+	client.mustQuery(`insert into t values (2)`)
+	r = client.query(`insert into t values (2)`)
+	require.NotNil(t, r.err)
+	assert.Equal(t, byte('E'), r.txStatus)
+	r = client.mustQuery(`commit`)
+	assert.Equal(t, []string{"ROLLBACK"}, r.tags)
+	assert.Equal(t, byte('I'), r.txStatus)
+
+	r = client.mustQuery(`begin; insert into t values (3); commit`)
+	assert.Equal(t, []string{"BEGIN", "INSERT 0 1", "COMMIT"}, r.tags)
+	r = other.mustQuery(`select * from t`)
+	assert.Equal(t, [][]string{{"3"}}, r.rows)
+
+	// A multi-statement query is atomic.
+	r = client.query(`insert into t values (4); insert into t values (3)`)
+	require.NotNil(t, r.err)
+	r = other.mustQuery(`select * from t`)
+	assert.Equal(t, [][]string{{"3"}}, r.rows)
+}
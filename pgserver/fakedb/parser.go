@@ -0,0 +1,717 @@
+package fakedb
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2/pgserver"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenQuotedIdent
+	tokenNumber
+	tokenString
+	tokenParam
+	tokenSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string // identifiers are lower case unless quoted; strings are unquoted
+}
+
+// lex splits sql into tokens. Comments and whitespace are skipped.
+func lex(sql string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			i += end
+
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				return nil, pgserver.Errorf("42601", "unterminated /* comment")
+			}
+			i += end + 4
+
+		case isIdentStart(c):
+			start := i
+			for i < len(sql) && (isIdentStart(sql[i]) || isDigit(sql[i]) || sql[i] == '$') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: strings.ToLower(sql[start:i])})
+
+		case c == '"' || c == '\'':
+			s, end, ok := unquote(sql, i)
+			if !ok {
+				if c == '"' {
+					return nil, pgserver.Errorf("42601", "unterminated quoted identifier")
+				}
+				return nil, pgserver.Errorf("42601", "unterminated quoted string")
+			}
+			kind := tokenString
+			if c == '"' {
+				kind = tokenQuotedIdent
+			}
+			tokens = append(tokens, token{kind: kind, text: s})
+			i = end
+
+		case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1])):
+			start := i
+			for i < len(sql) && (isDigit(sql[i]) || sql[i] == '.') {
+				i++
+			}
+			if i < len(sql) && (sql[i] == 'e' || sql[i] == 'E') {
+				i++
+				if i < len(sql) && (sql[i] == '+' || sql[i] == '-') {
+					i++
+				}
+				for i < len(sql) && isDigit(sql[i]) {
+					i++
+				}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: sql[start:i]})
+
+		case c == '$' && i+1 < len(sql) && isDigit(sql[i+1]):
+			start := i + 1
+			i++
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenParam, text: sql[start:i]})
+
+		case strings.IndexByte("(),;=*.-", c) >= 0:
+			tokens = append(tokens, token{kind: tokenSymbol, text: sql[i : i+1]})
+			i++
+
+		default:
+			return nil, pgserver.Errorf("42601", "syntax error at or near \"%c\"", c)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF}), nil
+}
+
+// unquote returns the contents of the quoted string or identifier starting at sql[i] and the index after it.
+func unquote(sql string, i int) (string, int, bool) {
+	quote := sql[i]
+	var sb strings.Builder
+	for i++; i < len(sql); i++ {
+		if sql[i] == quote {
+			if i+1 < len(sql) && sql[i+1] == quote {
+				sb.WriteByte(quote)
+				i++
+				continue
+			}
+			return sb.String(), i + 1, true
+		}
+		sb.WriteByte(sql[i])
+	}
+	return "", 0, false
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+type statement interface{}
+
+type columnDef struct {
+	name       string
+	typ        *dataType
+	notNull    bool
+	unique     bool
+	primaryKey bool
+	serial     bool
+}
+
+type createTableStmt struct {
+	table       string
+	ifNotExists bool
+	columns     []columnDef
+}
+
+type dropTableStmt struct {
+	table    string
+	ifExists bool
+}
+
+type insertStmt struct {
+	table   string
+	columns []string // nil means all columns
+	rows    [][]*expr
+}
+
+type selectItem struct {
+	star   bool
+	column string // a column of the table
+	expr   *expr  // a value if column is empty
+	alias  string
+}
+
+type selectStmt struct {
+	items []selectItem
+	table string // empty without FROM
+	where []condition
+}
+
+type updateStmt struct {
+	table string
+	set   []assignment
+	where []condition
+}
+
+type deleteStmt struct {
+	table string
+	where []condition
+}
+
+const (
+	txBegin = iota
+	txCommit
+	txRollback
+)
+
+type transactionStmt struct {
+	kind int
+}
+
+// setStmt is SET, which is accepted and ignored so drivers that configure the session can connect.
+type setStmt struct{}
+
+// condition is column = value.
+type condition struct {
+	column string
+	value  *expr
+}
+
+type assignment struct {
+	column string
+	value  *expr
+}
+
+const (
+	exprLiteral = iota
+	exprParam
+	exprNull
+)
+
+// expr is a literal, a parameter or NULL.
+type expr struct {
+	kind  int
+	text  string    // the text of a literal
+	typ   *dataType // the type of a literal
+	param int       // the index of a parameter
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse parses a single SQL statement.
+func parse(sql string) (statement, error) {
+	tokens, err := lex(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+
+	var stmt statement
+	switch {
+	case p.keyword("create"):
+		stmt, err = p.createTable()
+	case p.keyword("drop"):
+		stmt, err = p.dropTable()
+	case p.keyword("insert"):
+		stmt, err = p.insert()
+	case p.keyword("select"):
+		stmt, err = p.selectStmt()
+	case p.keyword("update"):
+		stmt, err = p.update()
+	case p.keyword("delete"):
+		stmt, err = p.delete()
+	case p.keyword("begin"):
+		p.keyword("transaction", "work")
+		stmt = &transactionStmt{kind: txBegin}
+	case p.keyword("start"):
+		err = p.expectKeyword("transaction")
+		stmt = &transactionStmt{kind: txBegin}
+	case p.keyword("commit", "end"):
+		p.keyword("transaction", "work")
+		stmt = &transactionStmt{kind: txCommit}
+	case p.keyword("rollback", "abort"):
+		p.keyword("transaction", "work")
+		stmt = &transactionStmt{kind: txRollback}
+	case p.keyword("set"):
+		for p.peek().kind != tokenEOF && !p.isSymbol(";") {
+			p.pos++
+		}
+		stmt = &setStmt{}
+	default:
+		return nil, p.syntaxError()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.symbol(";")
+	if p.peek().kind != tokenEOF {
+		return nil, p.syntaxError()
+	}
+	return stmt, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// keyword consumes the next token if it is one of keywords.
+func (p *parser) keyword(keywords ...string) bool {
+	t := p.peek()
+	if t.kind != tokenIdent {
+		return false
+	}
+	for _, k := range keywords {
+		if t.text == k {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	if !p.keyword(keyword) {
+		return p.syntaxError()
+	}
+	return nil
+}
+
+func (p *parser) isSymbol(s string) bool {
+	t := p.peek()
+	return t.kind == tokenSymbol && t.text == s
+}
+
+// symbol consumes the next token if it is the symbol s.
+func (p *parser) symbol(s string) bool {
+	if p.isSymbol(s) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectSymbol(s string) error {
+	if !p.symbol(s) {
+		return p.syntaxError()
+	}
+	return nil
+}
+
+func (p *parser) ident() (string, error) {
+	t := p.peek()
+	if t.kind != tokenIdent && t.kind != tokenQuotedIdent {
+		return "", p.syntaxError()
+	}
+	p.pos++
+	return t.text, nil
+}
+
+func (p *parser) syntaxError() error {
+	t := p.peek()
+	switch t.kind {
+	case tokenEOF:
+		return pgserver.Errorf("42601", "syntax error at end of input")
+	case tokenString:
+		return pgserver.Errorf("42601", "syntax error at or near \"'%s'\"", t.text)
+	case tokenParam:
+		return pgserver.Errorf("42601", "syntax error at or near \"$%s\"", t.text)
+	default:
+		return pgserver.Errorf("42601", "syntax error at or near \"%s\"", t.text)
+	}
+}
+
+// identList parses a parenthesized list of identifiers.
+func (p *parser) identList() ([]string, error) {
+	err := p.expectSymbol("(")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	return names, p.expectSymbol(")")
+}
+
+func (p *parser) createTable() (statement, error) {
+	err := p.expectKeyword("table")
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := &createTableStmt{}
+	if p.keyword("if") {
+		if err := p.expectKeyword("not"); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("exists"); err != nil {
+			return nil, err
+		}
+		stmt.ifNotExists = true
+	}
+	stmt.table, err = p.ident()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.expectSymbol("(")
+	if err != nil {
+		return nil, err
+	}
+	for {
+		col, err := p.columnDef()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range stmt.columns {
+			if c.name == col.name {
+				return nil, pgserver.Errorf("42701", "column \"%s\" specified more than once", col.name)
+			}
+		}
+		stmt.columns = append(stmt.columns, col)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	return stmt, p.expectSymbol(")")
+}
+
+func (p *parser) columnDef() (columnDef, error) {
+	var col columnDef
+	var err error
+	col.name, err = p.ident()
+	if err != nil {
+		return col, err
+	}
+
+	typeName, err := p.ident()
+	if err != nil {
+		return col, err
+	}
+	switch {
+	case typeName == "double" && p.keyword("precision"):
+		typeName = "double precision"
+	case typeName == "character" && p.keyword("varying"):
+		typeName = "character varying"
+	}
+	col.typ = typesByName[typeName]
+	if col.typ == nil {
+		return col, pgserver.Errorf("42704", "type \"%s\" does not exist", typeName)
+	}
+	col.serial = typeName == "serial" || typeName == "bigserial"
+	col.notNull = col.serial
+
+	// A length such as varchar(20) is ignored.
+	if p.symbol("(") {
+		if p.peek().kind != tokenNumber {
+			return col, p.syntaxError()
+		}
+		p.pos++
+		if err := p.expectSymbol(")"); err != nil {
+			return col, err
+		}
+	}
+
+	for {
+		switch {
+		case p.keyword("primary"):
+			if err := p.expectKeyword("key"); err != nil {
+				return col, err
+			}
+			col.primaryKey = true
+			col.unique = true
+			col.notNull = true
+		case p.keyword("unique"):
+			col.unique = true
+		case p.keyword("not"):
+			if err := p.expectKeyword("null"); err != nil {
+				return col, err
+			}
+			col.notNull = true
+		case p.keyword("null"):
+		default:
+			return col, nil
+		}
+	}
+}
+
+func (p *parser) dropTable() (statement, error) {
+	err := p.expectKeyword("table")
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := &dropTableStmt{}
+	if p.keyword("if") {
+		if err := p.expectKeyword("exists"); err != nil {
+			return nil, err
+		}
+		stmt.ifExists = true
+	}
+	stmt.table, err = p.ident()
+	return stmt, err
+}
+
+func (p *parser) insert() (statement, error) {
+	err := p.expectKeyword("into")
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := &insertStmt{}
+	stmt.table, err = p.ident()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isSymbol("(") {
+		stmt.columns, err = p.identList()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = p.expectKeyword("values")
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err := p.expectSymbol("(")
+		if err != nil {
+			return nil, err
+		}
+		var row []*expr
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, e)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		err = p.expectSymbol(")")
+		if err != nil {
+			return nil, err
+		}
+		stmt.rows = append(stmt.rows, row)
+
+		if !p.symbol(",") {
+			return stmt, nil
+		}
+	}
+}
+
+func (p *parser) selectStmt() (statement, error) {
+	stmt := &selectStmt{}
+	for {
+		var item selectItem
+		switch t := p.peek(); {
+		case p.symbol("*"):
+			item.star = true
+		case t.kind == tokenIdent && !isValueKeyword(t.text), t.kind == tokenQuotedIdent:
+			p.pos++
+			item.column = t.text
+		default:
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			item.expr = e
+		}
+
+		if !item.star && p.keyword("as") {
+			alias, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			item.alias = alias
+		}
+		stmt.items = append(stmt.items, item)
+
+		if !p.symbol(",") {
+			break
+		}
+	}
+
+	if p.keyword("from") {
+		var err error
+		stmt.table, err = p.ident()
+		if err != nil {
+			return nil, err
+		}
+		stmt.where, err = p.where()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+func (p *parser) update() (statement, error) {
+	stmt := &updateStmt{}
+	var err error
+	stmt.table, err = p.ident()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.expectKeyword("set")
+	if err != nil {
+		return nil, err
+	}
+	for {
+		column, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expectSymbol("=")
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.set = append(stmt.set, assignment{column: column, value: value})
+
+		if !p.symbol(",") {
+			break
+		}
+	}
+
+	stmt.where, err = p.where()
+	return stmt, err
+}
+
+func (p *parser) delete() (statement, error) {
+	err := p.expectKeyword("from")
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := &deleteStmt{}
+	stmt.table, err = p.ident()
+	if err != nil {
+		return nil, err
+	}
+	stmt.where, err = p.where()
+	return stmt, err
+}
+
+// where parses an optional WHERE clause of equality conditions joined by AND.
+func (p *parser) where() ([]condition, error) {
+	if !p.keyword("where") {
+		return nil, nil
+	}
+
+	var conditions []condition
+	for {
+		column, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expectSymbol("=")
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition{column: column, value: value})
+
+		if !p.keyword("and") {
+			return conditions, nil
+		}
+	}
+}
+
+func isValueKeyword(s string) bool {
+	return s == "null" || s == "true" || s == "false"
+}
+
+// expr parses a literal, a parameter or NULL.
+func (p *parser) expr() (*expr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokenString:
+		p.pos++
+		return &expr{kind: exprLiteral, text: t.text, typ: typeText}, nil
+	case t.kind == tokenNumber || p.isSymbol("-"):
+		text := ""
+		if p.symbol("-") {
+			text = "-"
+			t = p.peek()
+			if t.kind != tokenNumber {
+				return nil, p.syntaxError()
+			}
+		}
+		p.pos++
+		text += t.text
+		return &expr{kind: exprLiteral, text: text, typ: numberType(text)}, nil
+	case t.kind == tokenParam:
+		n, err := strconv.Atoi(t.text)
+		if err != nil || n < 1 {
+			return nil, pgserver.Errorf("42P02", "there is no parameter $%s", t.text)
+		}
+		p.pos++
+		return &expr{kind: exprParam, param: n - 1}, nil
+	case p.keyword("null"):
+		return &expr{kind: exprNull}, nil
+	case p.keyword("true", "false"):
+		return &expr{kind: exprLiteral, text: p.tokens[p.pos-1].text, typ: typeBool}, nil
+	default:
+		return nil, p.syntaxError()
+	}
+}
+
+// numberType returns the type of a numeric literal like PostgreSQL does.
+func numberType(text string) *dataType {
+	n, err := strconv.ParseInt(text, 10, 64)
+	switch {
+	case err != nil:
+		return typeNumeric
+	case int64(int32(n)) == n:
+		return typeInt4
+	default:
+		return typeInt8
+	}
+}
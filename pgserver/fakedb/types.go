@@ -0,0 +1,248 @@
+package fakedb
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2/pgserver"
+)
+
+// dataType is a column type. Values are stored as int64 for the integer types, float64 for the floating point types,
+// string for the text types and bool for boolean. NULL is nil.
+type dataType struct {
+	name string
+	oid  uint32
+	size int16
+}
+
+var (
+	typeInt2    = &dataType{name: "smallint", oid: 21, size: 2}
+	typeInt4    = &dataType{name: "integer", oid: 23, size: 4}
+	typeInt8    = &dataType{name: "bigint", oid: 20, size: 8}
+	typeFloat4  = &dataType{name: "real", oid: 700, size: 4}
+	typeFloat8  = &dataType{name: "double precision", oid: 701, size: 8}
+	typeBool    = &dataType{name: "boolean", oid: 16, size: 1}
+	typeText    = &dataType{name: "text", oid: 25, size: -1}
+	typeVarchar = &dataType{name: "character varying", oid: 1043, size: -1}
+	typeNumeric = &dataType{name: "numeric", oid: 1700, size: -1}
+)
+
+// typesByName maps the type names accepted by CREATE TABLE to types.
+var typesByName = map[string]*dataType{
+	"smallint":          typeInt2,
+	"int2":              typeInt2,
+	"integer":           typeInt4,
+	"int":               typeInt4,
+	"int4":              typeInt4,
+	"serial":            typeInt4,
+	"bigint":            typeInt8,
+	"int8":              typeInt8,
+	"bigserial":         typeInt8,
+	"real":              typeFloat4,
+	"float4":            typeFloat4,
+	"double precision":  typeFloat8,
+	"float8":            typeFloat8,
+	"boolean":           typeBool,
+	"bool":              typeBool,
+	"text":              typeText,
+	"varchar":           typeVarchar,
+	"character varying": typeVarchar,
+}
+
+// typesByOID maps the OIDs of the supported types to types.
+var typesByOID = map[uint32]*dataType{}
+
+func init() {
+	for _, t := range []*dataType{typeInt2, typeInt4, typeInt8, typeFloat4, typeFloat8, typeBool, typeText, typeVarchar, typeNumeric} {
+		typesByOID[t.oid] = t
+	}
+}
+
+func (t *dataType) isInteger() bool {
+	return t == typeInt2 || t == typeInt4 || t == typeInt8
+}
+
+// parseText parses the text representation of a value of type t.
+func (t *dataType) parseText(s string) (interface{}, error) {
+	switch t {
+	case typeInt2, typeInt4, typeInt8:
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			return nil, pgserver.Errorf("22P02", "invalid input syntax for type %s: \"%s\"", t.name, s)
+		}
+		return t.checkRange(n)
+	case typeFloat4, typeFloat8:
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return nil, pgserver.Errorf("22P02", "invalid input syntax for type %s: \"%s\"", t.name, s)
+		}
+		return f, nil
+	case typeBool:
+		switch strings.ToLower(strings.TrimSpace(s)) {
+		case "t", "true", "y", "yes", "on", "1":
+			return true, nil
+		case "f", "false", "n", "no", "off", "0":
+			return false, nil
+		}
+		return nil, pgserver.Errorf("22P02", "invalid input syntax for type boolean: \"%s\"", s)
+	default:
+		return s, nil
+	}
+}
+
+func (t *dataType) checkRange(n int64) (interface{}, error) {
+	if (t == typeInt2 && (n < math.MinInt16 || n > math.MaxInt16)) || (t == typeInt4 && (n < math.MinInt32 || n > math.MaxInt32)) {
+		return nil, pgserver.Errorf("22003", "%s out of range", t.name)
+	}
+	return n, nil
+}
+
+// decode decodes a parameter value of type t in format.
+func (t *dataType) decode(src []byte, format int16) (interface{}, error) {
+	if src == nil {
+		return nil, nil
+	}
+	if format == 0 || t == typeText || t == typeVarchar {
+		return t.parseText(string(src))
+	}
+
+	if t == typeNumeric || (t.size > 0 && len(src) != int(t.size)) {
+		return nil, pgserver.Errorf("22P03", "incorrect binary data format in bind parameter")
+	}
+	switch t {
+	case typeInt2:
+		return int64(int16(binary.BigEndian.Uint16(src))), nil
+	case typeInt4:
+		return int64(int32(binary.BigEndian.Uint32(src))), nil
+	case typeInt8:
+		return int64(binary.BigEndian.Uint64(src)), nil
+	case typeFloat4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(src))), nil
+	case typeFloat8:
+		return math.Float64frombits(binary.BigEndian.Uint64(src)), nil
+	default: // typeBool
+		return src[0] != 0, nil
+	}
+}
+
+// encode encodes value, which must be of type t, in format.
+func (t *dataType) encode(value interface{}, format int16) ([]byte, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	if format == 0 {
+		switch v := value.(type) {
+		case int64:
+			return []byte(strconv.FormatInt(v, 10)), nil
+		case float64:
+			bits := 64
+			if t == typeFloat4 {
+				bits = 32
+			}
+			return []byte(formatFloat(v, bits)), nil
+		case bool:
+			if v {
+				return []byte("t"), nil
+			}
+			return []byte("f"), nil
+		default:
+			return []byte(v.(string)), nil
+		}
+	}
+
+	buf := make([]byte, 8)
+	switch t {
+	case typeInt2:
+		binary.BigEndian.PutUint16(buf, uint16(value.(int64)))
+		return buf[:2], nil
+	case typeInt4:
+		binary.BigEndian.PutUint32(buf, uint32(value.(int64)))
+		return buf[:4], nil
+	case typeInt8:
+		binary.BigEndian.PutUint64(buf, uint64(value.(int64)))
+		return buf, nil
+	case typeFloat4:
+		binary.BigEndian.PutUint32(buf, math.Float32bits(float32(value.(float64))))
+		return buf[:4], nil
+	case typeFloat8:
+		binary.BigEndian.PutUint64(buf, math.Float64bits(value.(float64)))
+		return buf, nil
+	case typeBool:
+		if value.(bool) {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case typeText, typeVarchar:
+		return []byte(value.(string)), nil
+	default:
+		return nil, pgserver.Errorf("0A000", "binary format is not supported for type %s", t.name)
+	}
+}
+
+func formatFloat(f float64, bits int) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, bits)
+}
+
+// coerce converts value to type t.
+func (t *dataType) coerce(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case int64:
+		switch {
+		case t.isInteger():
+			return t.checkRange(v)
+		case t == typeFloat4 || t == typeFloat8:
+			return float64(v), nil
+		case t == typeText || t == typeVarchar || t == typeNumeric:
+			return strconv.FormatInt(v, 10), nil
+		}
+	case float64:
+		switch {
+		case t == typeFloat4 || t == typeFloat8:
+			return v, nil
+		case t.isInteger():
+			return t.checkRange(int64(math.RoundToEven(v)))
+		case t == typeText || t == typeVarchar || t == typeNumeric:
+			return formatFloat(v, 64), nil
+		}
+	case bool:
+		switch t {
+		case typeBool:
+			return v, nil
+		case typeText, typeVarchar:
+			if v {
+				return "true", nil
+			}
+			return "false", nil
+		}
+	case string:
+		return t.parseText(v)
+	}
+	return nil, pgserver.Errorf("42804", "value of type %s can not be converted to %s", valueTypeName(value), t.name)
+}
+
+// valueTypeName returns the name of the type of a stored value.
+func valueTypeName(value interface{}) string {
+	switch value.(type) {
+	case int64:
+		return typeInt8.name
+	case float64:
+		return typeFloat8.name
+	case bool:
+		return typeBool.name
+	default:
+		return typeText.name
+	}
+}
@@ -0,0 +1,122 @@
+package pgserver
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+)
+
+// FunctionCaller is implemented by Executors that support the function call sub-protocol, also known as the fast-path
+// interface. Session reports an error for function calls if the Executor does not implement it.
+type FunctionCaller interface {
+	// CallFunction calls a function and returns its result in call.ResultFormat. A nil result is NULL.
+	CallFunction(ctx context.Context, call *FunctionCall) ([]byte, error)
+}
+
+// FunctionCall is a call of a function by a client.
+type FunctionCall struct {
+	OID          uint32
+	Args         [][]byte // NULL arguments are nil
+	ArgFormats   []int16  // the format of each argument
+	ResultFormat int16
+
+	// TxStatus is the transaction status of the session when the function is called.
+	TxStatus byte
+}
+
+// Int32Arg returns argument i, which must be an integer in binary format.
+func (c *FunctionCall) Int32Arg(i int) (int32, error) {
+	n, err := c.intArg(i, 4)
+	return int32(n), err
+}
+
+// Int64Arg returns argument i, which must be a bigint in binary format.
+func (c *FunctionCall) Int64Arg(i int) (int64, error) {
+	return c.intArg(i, 8)
+}
+
+// OIDArg returns argument i, which must be an oid in binary format.
+func (c *FunctionCall) OIDArg(i int) (uint32, error) {
+	n, err := c.intArg(i, 4)
+	return uint32(n), err
+}
+
+func (c *FunctionCall) intArg(i, size int) (int64, error) {
+	if i >= len(c.Args) {
+		return 0, Errorf("42883", "function with OID %d called with %d arguments", c.OID, len(c.Args))
+	}
+	arg := c.Args[i]
+	if arg == nil {
+		return 0, Errorf("22004", "argument %d of function with OID %d is null", i+1, c.OID)
+	}
+	if c.ArgFormats[i] != 1 || len(arg) != size {
+		return 0, Errorf("22P03", "incorrect binary data format in function argument %d", i+1)
+	}
+	if size == 4 {
+		return int64(int32(binary.BigEndian.Uint32(arg))), nil
+	}
+	return int64(binary.BigEndian.Uint64(arg)), nil
+}
+
+// FunctionFunc is the implementation of a function registered with a FunctionDispatcher.
+type FunctionFunc func(ctx context.Context, call *FunctionCall) ([]byte, error)
+
+// FunctionDispatcher calls the functions registered with it by OID. It implements FunctionCaller so an Executor can
+// embed it to support function calls. It is safe for concurrent use.
+type FunctionDispatcher struct {
+	mu    sync.RWMutex
+	funcs map[uint32]registeredFunction
+	oids  map[string]uint32
+}
+
+type registeredFunction struct {
+	name string
+	fn   FunctionFunc
+}
+
+// NewFunctionDispatcher returns a FunctionDispatcher with no functions.
+func NewFunctionDispatcher() *FunctionDispatcher {
+	return &FunctionDispatcher{
+		funcs: make(map[uint32]registeredFunction),
+		oids:  make(map[string]uint32),
+	}
+}
+
+// Register registers fn as the function name with the OID oid. It replaces any function previously registered with
+// the OID or name.
+func (d *FunctionDispatcher) Register(oid uint32, name string, fn FunctionFunc) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if old, ok := d.oids[name]; ok {
+		delete(d.funcs, old)
+	}
+	if old, ok := d.funcs[oid]; ok {
+		delete(d.oids, old.name)
+	}
+	d.funcs[oid] = registeredFunction{name: name, fn: fn}
+	d.oids[name] = oid
+}
+
+// Lookup returns the OID of the function name. An Executor can use it to answer the queries clients use to look up
+// functions, such as Frontend.LookupFunction.
+func (d *FunctionDispatcher) Lookup(name string) (uint32, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	oid, ok := d.oids[name]
+	return oid, ok
+}
+
+// CallFunction implements FunctionCaller. It reports an undefined function error if no function is registered with
+// the OID.
+func (d *FunctionDispatcher) CallFunction(ctx context.Context, call *FunctionCall) ([]byte, error) {
+	d.mu.RLock()
+	f, ok := d.funcs[call.OID]
+	d.mu.RUnlock()
+
+	if !ok {
+		return nil, Errorf("42883", "function with OID %d does not exist", call.OID)
+	}
+	return f.fn(ctx, call)
+}
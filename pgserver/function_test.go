@@ -0,0 +1,172 @@
+package pgserver_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/pgserver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// functionExecutor supports function calls to the functions registered with its FunctionDispatcher and answers the
+// queries that look them up.
+type functionExecutor struct {
+	testExecutor
+	*pgserver.FunctionDispatcher
+}
+
+var oidField = pgproto3.FieldDescription{Name: []byte("oid"), DataTypeOID: 26, DataTypeSize: 4, TypeModifier: -1}
+
+func (e *functionExecutor) Describe(ctx context.Context, sql string, paramOIDs []uint32) (*pgserver.StatementDescription, error) {
+	if sql == "select $1::regproc::oid" {
+		return &pgserver.StatementDescription{ParamOIDs: []uint32{25}, Fields: []pgproto3.FieldDescription{oidField}}, nil
+	}
+	return e.testExecutor.Describe(ctx, sql, paramOIDs)
+}
+
+func (e *functionExecutor) Execute(ctx context.Context, portal *pgserver.Portal) (*pgserver.Result, error) {
+	if portal.Statement.SQL == "select $1::regproc::oid" {
+		oid, ok := e.Lookup(string(portal.Params[0]))
+		if !ok {
+			return nil, pgserver.Errorf("42883", "function \"%s\" does not exist", portal.Params[0])
+		}
+		return &pgserver.Result{Rows: [][][]byte{{[]byte(strconv.FormatUint(uint64(oid), 10))}}}, nil
+	}
+	return e.testExecutor.Execute(ctx, portal)
+}
+
+// newLargeObjectFunctions returns a FunctionDispatcher with simplified versions of lo_open, loread and lowrite that
+// use the PostgreSQL OIDs. Every object contains the data written to it and descriptors are object OIDs.
+func newLargeObjectFunctions() *pgserver.FunctionDispatcher {
+	objects := map[int32][]byte{}
+	d := pgserver.NewFunctionDispatcher()
+	d.Register(952, "lo_open", func(ctx context.Context, call *pgserver.FunctionCall) ([]byte, error) {
+		oid, err := call.OIDArg(0)
+		if err != nil {
+			return nil, err
+		}
+		if call.TxStatus != 'T' {
+			return nil, pgserver.Errorf("25P01", "lo_open can only be used in a transaction block")
+		}
+		objects[int32(oid)] = objects[int32(oid)]
+		return int32Result(int32(oid), call.ResultFormat), nil
+	})
+	d.Register(954, "loread", func(ctx context.Context, call *pgserver.FunctionCall) ([]byte, error) {
+		fd, err := call.Int32Arg(0)
+		if err != nil {
+			return nil, err
+		}
+		n, err := call.Int32Arg(1)
+		if err != nil {
+			return nil, err
+		}
+		data := objects[fd]
+		if int(n) < len(data) {
+			data = data[:n]
+		}
+		return append([]byte{}, data...), nil
+	})
+	d.Register(955, "lowrite", func(ctx context.Context, call *pgserver.FunctionCall) ([]byte, error) {
+		fd, err := call.Int32Arg(0)
+		if err != nil {
+			return nil, err
+		}
+		objects[fd] = append(objects[fd], call.Args[1]...)
+		return int32Result(int32(len(call.Args[1])), call.ResultFormat), nil
+	})
+	return d
+}
+
+func int32Result(n int32, format int16) []byte {
+	if format == 1 {
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, uint32(n))
+		return buf
+	}
+	return []byte(strconv.Itoa(int(n)))
+}
+
+func TestFunctionCall(t *testing.T) {
+	t.Parallel()
+
+	client := startSession(t, &functionExecutor{FunctionDispatcher: newLargeObjectFunctions()})
+	ctx := context.Background()
+
+	oids := map[string]uint32{}
+	for _, name := range []string{"lo_open", "loread", "lowrite"} {
+		oid, err := client.frontend.LookupFunction(ctx, name)
+		require.NoError(t, err)
+		oids[name] = oid
+	}
+	assert.Equal(t, map[string]uint32{"lo_open": 952, "loread": 954, "lowrite": 955}, oids)
+
+	client.send(&pgproto3.Query{String: "begin"})
+	_, txStatus := client.receiveUntilReady()
+	require.Equal(t, byte('T'), txStatus)
+
+	result, err := client.frontend.CallFunction(ctx, oids["lo_open"], 1, uint32(42), int32(0x20000))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 42}, result)
+
+	result, err = client.frontend.CallFunction(ctx, oids["lowrite"], 0, int32(42), []byte("hello, world"))
+	require.NoError(t, err)
+	assert.Equal(t, "12", string(result))
+
+	result, err = client.frontend.CallFunction(ctx, oids["loread"], 1, int32(42), int32(5))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(result))
+
+	// Functions are called with the arguments the client sent.
+	_, err = client.frontend.CallFunction(ctx, oids["loread"], 1, int64(42), int32(5))
+	var errResp *pgproto3.ErrorResponse
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "22P03", errResp.Code)
+
+	// A failed function call aborts the transaction.
+	_, err = client.frontend.CallFunction(ctx, oids["loread"], 1, int32(42), int32(5))
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "25P02", errResp.Code)
+
+	client.send(&pgproto3.Query{String: "rollback"})
+	_, txStatus = client.receiveUntilReady()
+	require.Equal(t, byte('I'), txStatus)
+
+	_, err = client.frontend.CallFunction(ctx, oids["lo_open"], 1, uint32(42), int32(0x20000))
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "25P01", errResp.Code)
+}
+
+func TestFunctionCallErrors(t *testing.T) {
+	t.Parallel()
+
+	client := startSession(t, &functionExecutor{FunctionDispatcher: newLargeObjectFunctions()})
+	ctx := context.Background()
+
+	_, err := client.frontend.LookupFunction(ctx, "lo_missing")
+	var errResp *pgproto3.ErrorResponse
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "42883", errResp.Code)
+
+	_, err = client.frontend.CallFunction(ctx, 1, 0)
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "42883", errResp.Code)
+
+	_, err = client.frontend.CallFunction(ctx, 952, 0, struct{}{})
+	require.Error(t, err)
+
+	// The Frontend is ready for the next query.
+	client.send(&pgproto3.Query{String: "generate 1"})
+	msgs, _ := client.receiveUntilReady()
+	assert.Equal(t, []string{"RowDescription", "DataRow 1", "CommandComplete SELECT 1", "ReadyForQuery"}, msgs)
+
+	// Executors that do not implement FunctionCaller do not support function calls.
+	client = startSession(t, &testExecutor{})
+	_, err = client.frontend.CallFunction(ctx, 952, 0)
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "0A000", errResp.Code)
+}
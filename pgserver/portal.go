@@ -0,0 +1,53 @@
+package pgserver
+
+import (
+	"context"
+	"io"
+)
+
+// RowIterator produces the rows of a Result as the client fetches them, which lets a portal be resumed across
+// Execute messages without materializing its rows.
+type RowIterator interface {
+	// Next returns the next row. It returns io.EOF when there are no more rows. Any other error is reported to the
+	// client and ends the portal. The row is not used after the next call to Next or Close.
+	Next(ctx context.Context) ([][]byte, error)
+
+	// Close releases the resources of the iterator. It is called once, either after Next returned an error or when
+	// the portal is closed before all rows are read.
+	Close() error
+}
+
+// nextRow returns the next row of the result of p. It returns io.EOF when there are no more rows.
+func (p *Portal) nextRow(ctx context.Context) ([][]byte, error) {
+	if p.next < len(p.result.Rows) {
+		row := p.result.Rows[p.next]
+		p.next++
+		return row, nil
+	}
+
+	if p.result.Iter == nil || p.iterDone {
+		return nil, io.EOF
+	}
+
+	row, err := p.result.Iter.Next(ctx)
+	if err != nil {
+		closeErr := p.closeIter()
+		if err == io.EOF && closeErr != nil {
+			return nil, closeErr
+		}
+		return nil, err
+	}
+	return row, nil
+}
+
+func (p *Portal) closeIter() error {
+	p.iterDone = true
+	return p.result.Iter.Close()
+}
+
+// close closes the iterator of p if it is open.
+func (p *Portal) close() {
+	if p.result != nil && p.result.Iter != nil && !p.iterDone {
+		p.closeIter()
+	}
+}
@@ -0,0 +1,155 @@
+package pgserver_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/pgserver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// counterIterator returns the rows 1 to n as they are requested and fails at failAt if it is not 0.
+type counterIterator struct {
+	mu     sync.Mutex
+	i      int
+	n      int
+	failAt int
+	closed bool
+}
+
+func (it *counterIterator) Next(ctx context.Context) ([][]byte, error) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+
+	if it.i == it.n {
+		return nil, io.EOF
+	}
+	it.i++
+	if it.i == it.failAt {
+		return nil, pgserver.Errorf("22012", "division by zero")
+	}
+	return [][]byte{[]byte(strconv.Itoa(it.i))}, nil
+}
+
+func (it *counterIterator) Close() error {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.closed = true
+	return nil
+}
+
+func (it *counterIterator) state() (int, bool) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.i, it.closed
+}
+
+// iterExecutor returns iter as the result of every statement.
+type iterExecutor struct {
+	iter *counterIterator
+}
+
+func (e *iterExecutor) Describe(ctx context.Context, sql string, paramOIDs []uint32) (*pgserver.StatementDescription, error) {
+	return &pgserver.StatementDescription{Fields: []pgproto3.FieldDescription{intField}}, nil
+}
+
+func (e *iterExecutor) Execute(ctx context.Context, portal *pgserver.Portal) (*pgserver.Result, error) {
+	return &pgserver.Result{Iter: e.iter}, nil
+}
+
+func TestPortalPager(t *testing.T) {
+	t.Parallel()
+
+	iter := &counterIterator{n: 5}
+	client := startSession(t, &iterExecutor{iter: iter})
+	ctx := context.Background()
+
+	pager, err := client.frontend.OpenPortalPager(ctx, "select n", nil, 2)
+	require.NoError(t, err)
+	require.Len(t, pager.Fields(), 1)
+	assert.Equal(t, "n", string(pager.Fields()[0].Name))
+
+	var pages [][]string
+	for {
+		rows, err := pager.NextPage()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		var page []string
+		for _, row := range rows {
+			page = append(page, string(row[0]))
+		}
+		pages = append(pages, page)
+
+		// Rows are produced as they are fetched.
+		i, _ := iter.state()
+		assert.Equal(t, pager.Rows(), int64(i))
+	}
+	assert.Equal(t, [][]string{{"1", "2"}, {"3", "4"}, {"5"}}, pages)
+	assert.EqualValues(t, 5, pager.Rows())
+
+	_, closed := iter.state()
+	assert.True(t, closed)
+
+	// The Frontend is ready for the next query.
+	client.send(&pgproto3.Query{String: ""})
+	msgs, _ := client.receiveUntilReady()
+	assert.Equal(t, []string{"EmptyQueryResponse", "ReadyForQuery"}, msgs)
+}
+
+func TestPortalPagerClose(t *testing.T) {
+	t.Parallel()
+
+	iter := &counterIterator{n: 100}
+	client := startSession(t, &iterExecutor{iter: iter})
+
+	pager, err := client.frontend.OpenPortalPager(context.Background(), "select n", nil, 10)
+	require.NoError(t, err)
+
+	rows, err := pager.NextPage()
+	require.NoError(t, err)
+	assert.Len(t, rows, 10)
+
+	require.NoError(t, pager.Close())
+	i, closed := iter.state()
+	assert.Equal(t, 10, i)
+	assert.True(t, closed)
+
+	_, err = pager.NextPage()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestPortalPagerError(t *testing.T) {
+	t.Parallel()
+
+	iter := &counterIterator{n: 10, failAt: 4}
+	client := startSession(t, &iterExecutor{iter: iter})
+
+	pager, err := client.frontend.OpenPortalPager(context.Background(), "select n", nil, 3)
+	require.NoError(t, err)
+
+	rows, err := pager.NextPage()
+	require.NoError(t, err)
+	assert.Len(t, rows, 3)
+
+	_, err = pager.NextPage()
+	var errResp *pgproto3.ErrorResponse
+	require.True(t, errors.As(err, &errResp))
+	assert.Equal(t, "22012", errResp.Code)
+
+	_, closed := iter.state()
+	assert.True(t, closed)
+	require.NoError(t, pager.Close())
+
+	client.send(&pgproto3.Query{String: ""})
+	msgs, _ := client.receiveUntilReady()
+	assert.Equal(t, []string{"EmptyQueryResponse", "ReadyForQuery"}, msgs)
+}
@@ -0,0 +1,702 @@
+// Package pgserver implements the bookkeeping of a PostgreSQL server session on top of pgproto3.Backend.
+//
+// A Session handles the simple and extended query protocols for a connection whose startup and authentication are
+// complete. It splits a simple Query into its statements and runs them in an implicit transaction, keeps the prepared
+// statements created by Parse and the portals created by Bind, answers Describe, resumes portals across Execute
+// messages with MaxRows and PortalSuspended, ignores messages after an error until Sync and tracks the transaction
+// status reported by ReadyForQuery. The statements themselves are run by an Executor supplied by the application, which
+// makes it straightforward to build mock servers that behave correctly for drivers such as pgx and JDBC.
+package pgserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/internal/sqlscan"
+)
+
+// Executor runs the statements of a Session.
+type Executor interface {
+	// Describe is called when a statement is prepared by Parse or run by a simple Query. paramOIDs are the parameter
+	// types specified by the client; zero means unspecified. An error is reported to the client.
+	Describe(ctx context.Context, sql string, paramOIDs []uint32) (*StatementDescription, error)
+
+	// Execute runs the statement of portal with its bound parameters. It is called on the first Execute of the portal
+	// and the rows it returns are sent by that and any later Execute of the same portal, so a Result.Iter can produce
+	// them as they are fetched. The values of the rows must be encoded in the formats of portal.ResultFormats. An
+	// error is reported to the client.
+	Execute(ctx context.Context, portal *Portal) (*Result, error)
+}
+
+// ImplicitTransactor is implemented by an Executor that supports implicit transactions. When a simple Query with
+// several statements is received outside of a transaction block, BeginImplicit is called before the first statement
+// and EndImplicit after the last, with commit false if a statement failed, so the statements succeed or fail together
+// as they do in PostgreSQL. If one of the statements begins a transaction block the implicit transaction becomes part of
+// it and EndImplicit is not called; the Executor is responsible for that. An error returned by BeginImplicit or
+// EndImplicit is reported to the client.
+type ImplicitTransactor interface {
+	BeginImplicit(ctx context.Context) error
+	EndImplicit(ctx context.Context, commit bool) error
+}
+
+// StatementDescription describes a statement.
+type StatementDescription struct {
+	// ParamOIDs are the types of the parameters. If nil the types specified by the client are used.
+	ParamOIDs []uint32
+
+	// Fields describe the columns of the rows returned by the statement. They must be nil if the statement does not
+	// return rows. Their Format is ignored.
+	Fields []pgproto3.FieldDescription
+}
+
+// Statement is a prepared statement.
+type Statement struct {
+	Name      string
+	SQL       string
+	ParamOIDs []uint32
+	Fields    []pgproto3.FieldDescription
+}
+
+// Portal is a statement bound to its parameters. A simple Query is run as an unnamed portal with no parameters and
+// text results.
+type Portal struct {
+	Name      string
+	Statement *Statement
+
+	// Params are the parameter values. A nil value is NULL.
+	Params [][]byte
+
+	// ParamFormats has the format code of each parameter.
+	ParamFormats []int16
+
+	// ResultFormats has the format code of each column of the result.
+	ResultFormats []int16
+
+	// TxStatus is the transaction status when the portal is run: 'I', 'T' or 'E'. Only statements that end the
+	// transaction block are run in a failed transaction block.
+	TxStatus byte
+
+	result   *Result
+	next     int  // the index of the next row of result.Rows to send
+	iterDone bool // result.Iter has been closed
+	done     bool // CommandComplete has been sent
+}
+
+// Result is the result of a statement.
+type Result struct {
+	// Rows are the rows returned by the statement.
+	Rows [][][]byte
+
+	// Iter, if not nil, returns the rows of the statement after Rows. It is read as the client fetches the rows and is
+	// closed when the last row is read or the portal is closed.
+	Iter RowIterator
+
+	// CommandTag is the tag sent with CommandComplete. If it is empty, "SELECT n" is sent where n is the number of rows
+	// sent by the Execute that completed the portal.
+	CommandTag string
+}
+
+// Errorf returns an error that is reported to the client as an ErrorResponse with severity ERROR and the SQLSTATE
+// code.
+func Errorf(code string, format string, args ...interface{}) error {
+	return &pgproto3.ErrorResponse{
+		Severity:            "ERROR",
+		SeverityUnlocalized: "ERROR",
+		Code:                code,
+		Message:             fmt.Sprintf(format, args...),
+	}
+}
+
+// Session serves the queries of a single client connection.
+type Session struct {
+	backend  *pgproto3.Backend
+	executor Executor
+
+	statements map[string]*Statement
+	portals    map[string]*Portal
+
+	txStatus       byte
+	failed         bool // an error was reported for the current message
+	ignoreTillSync bool // an error occurred in the extended query protocol and messages are ignored until Sync
+}
+
+// NewSession returns a Session that serves the client of backend by running its statements with executor. The startup
+// and authentication of the client must be complete.
+func NewSession(backend *pgproto3.Backend, executor Executor) *Session {
+	return &Session{
+		backend:    backend,
+		executor:   executor,
+		statements: make(map[string]*Statement),
+		portals:    make(map[string]*Portal),
+		txStatus:   'I',
+	}
+}
+
+// TxStatus returns the transaction status that is sent with the next ReadyForQuery: 'I' when idle, 'T' in a
+// transaction block or 'E' in a failed transaction block.
+func (s *Session) TxStatus() byte {
+	return s.txStatus
+}
+
+// Serve receives and handles messages until the client sends Terminate, in which case it returns nil, or an error
+// occurs. It uses Backend.ReceiveContext so backend must write to the connection it reads from. The Session is closed
+// when Serve returns.
+func (s *Session) Serve(ctx context.Context) error {
+	defer s.Close()
+
+	for {
+		msg, err := s.backend.ReceiveContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := msg.(*pgproto3.Terminate); ok {
+			return nil
+		}
+
+		err = s.Handle(ctx, msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the open portals.
+func (s *Session) Close() {
+	s.closePortals()
+}
+
+// Handle handles a message received from the client. Errors of the statements are reported to the client; Handle only
+// returns an error if sending a response fails or msg can not be handled at all.
+func (s *Session) Handle(ctx context.Context, msg pgproto3.FrontendMessage) error {
+	if s.ignoreTillSync {
+		switch msg.(type) {
+		case *pgproto3.Sync, *pgproto3.Terminate:
+		default:
+			return nil
+		}
+	}
+
+	s.failed = false
+
+	var err error
+	switch msg := msg.(type) {
+	case *pgproto3.Query:
+		return s.query(ctx, msg)
+	case *pgproto3.Parse:
+		err = s.parse(ctx, msg)
+	case *pgproto3.Bind:
+		err = s.bind(msg)
+	case *pgproto3.Describe:
+		err = s.describe(msg)
+	case *pgproto3.Execute:
+		err = s.execute(ctx, msg)
+	case *pgproto3.Close:
+		err = s.close(msg)
+	case *pgproto3.Sync:
+		return s.sync()
+	case *pgproto3.FunctionCall:
+		return s.functionCall(ctx, msg)
+	case *pgproto3.Flush, *pgproto3.Terminate:
+		// Responses are sent as they are created.
+	case *pgproto3.CopyData, *pgproto3.CopyDone, *pgproto3.CopyFail:
+		// PostgreSQL ignores copy messages outside of a copy. They are left over from a copy that failed.
+	default:
+		return fmt.Errorf("pgserver: unexpected message %T", msg)
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.failed {
+		s.ignoreTillSync = true
+	}
+	return nil
+}
+
+func (s *Session) query(ctx context.Context, msg *pgproto3.Query) error {
+	// A simple query destroys the unnamed statement and portal.
+	delete(s.statements, "")
+	s.dropPortal("")
+
+	statements := sqlscan.Split(msg.String)
+	if len(statements) == 0 {
+		err := s.backend.Send(&pgproto3.EmptyQueryResponse{})
+		if err != nil {
+			return err
+		}
+		return s.readyForQuery()
+	}
+
+	// Like PostgreSQL, several statements outside of a transaction block run in an implicit transaction.
+	transactor, implicit := s.executor.(ImplicitTransactor)
+	implicit = implicit && len(statements) > 1 && s.txStatus == 'I'
+	if implicit {
+		err := transactor.BeginImplicit(ctx)
+		if err != nil {
+			err = s.fail(err)
+			if err != nil {
+				return err
+			}
+			return s.readyForQuery()
+		}
+	}
+
+	// The statements run until one fails. Each sends its own results.
+	for _, sql := range statements {
+		err := s.simpleQuery(ctx, sql)
+		if err != nil {
+			return err
+		}
+		if s.txStatus != 'I' {
+			// The statement began a transaction block which took over the implicit transaction.
+			implicit = false
+		}
+		if s.failed {
+			break
+		}
+	}
+
+	if implicit {
+		err := transactor.EndImplicit(ctx, !s.failed)
+		if err != nil && !s.failed {
+			err = s.fail(err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.readyForQuery()
+}
+
+// simpleQuery runs sql, a single statement of a simple Query.
+func (s *Session) simpleQuery(ctx context.Context, sql string) error {
+	err := s.checkAborted(sql)
+	if err != nil {
+		return s.fail(err)
+	}
+
+	desc, err := s.executor.Describe(ctx, sql, nil)
+	if err != nil {
+		return s.fail(err)
+	}
+
+	portal := &Portal{
+		Statement:     &Statement{SQL: sql, ParamOIDs: desc.ParamOIDs, Fields: desc.Fields},
+		ResultFormats: make([]int16, len(desc.Fields)),
+	}
+	defer portal.close()
+
+	if portal.Statement.Fields != nil {
+		err = s.backend.Send(&pgproto3.RowDescription{Fields: resultFields(portal.Statement.Fields, portal.ResultFormats)})
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.run(ctx, portal, 0)
+}
+
+func (s *Session) functionCall(ctx context.Context, msg *pgproto3.FunctionCall) error {
+	result, err := s.callFunction(ctx, msg)
+	if err != nil {
+		err = s.fail(err)
+	} else {
+		err = s.backend.Send(&pgproto3.FunctionCallResponse{Result: result})
+	}
+	if err != nil {
+		return err
+	}
+	return s.readyForQuery()
+}
+
+func (s *Session) callFunction(ctx context.Context, msg *pgproto3.FunctionCall) ([]byte, error) {
+	caller, ok := s.executor.(FunctionCaller)
+	if !ok {
+		return nil, Errorf("0A000", "function calls are not supported")
+	}
+	if err := s.checkAborted(""); err != nil {
+		return nil, err
+	}
+
+	codes := make([]int16, len(msg.ArgFormatCodes))
+	for i, code := range msg.ArgFormatCodes {
+		codes[i] = int16(code)
+	}
+	formats, ok := expandFormats(codes, len(msg.Arguments))
+	if !ok {
+		return nil, Errorf("08P01", "function call message has %d argument formats but %d arguments", len(codes), len(msg.Arguments))
+	}
+
+	call := &FunctionCall{
+		OID:          msg.Function,
+		Args:         make([][]byte, len(msg.Arguments)),
+		ArgFormats:   formats,
+		ResultFormat: int16(msg.ResultFormatCode),
+		TxStatus:     s.txStatus,
+	}
+	// The arguments are only valid until the next message is received.
+	for i, arg := range msg.Arguments {
+		if arg != nil {
+			call.Args[i] = append([]byte{}, arg...)
+		}
+	}
+	return caller.CallFunction(ctx, call)
+}
+
+func (s *Session) parse(ctx context.Context, msg *pgproto3.Parse) error {
+	if _, ok := s.statements[msg.Name]; ok && msg.Name != "" {
+		return s.fail(Errorf("42P05", "prepared statement \"%s\" already exists", msg.Name))
+	}
+
+	err := s.checkAborted(msg.Query)
+	if err != nil {
+		return s.fail(err)
+	}
+
+	stmt := &Statement{
+		Name:      msg.Name,
+		SQL:       msg.Query,
+		ParamOIDs: append([]uint32{}, msg.ParameterOIDs...),
+	}
+	if !isEmptyQuery(msg.Query) {
+		desc, err := s.executor.Describe(ctx, msg.Query, stmt.ParamOIDs)
+		if err != nil {
+			return s.fail(err)
+		}
+		if desc.ParamOIDs != nil {
+			stmt.ParamOIDs = desc.ParamOIDs
+		}
+		stmt.Fields = desc.Fields
+	}
+
+	s.statements[msg.Name] = stmt
+	return s.backend.Send(&pgproto3.ParseComplete{})
+}
+
+func (s *Session) bind(msg *pgproto3.Bind) error {
+	stmt, ok := s.statements[msg.PreparedStatement]
+	if !ok {
+		return s.fail(Errorf("26000", "prepared statement \"%s\" does not exist", msg.PreparedStatement))
+	}
+	if _, ok := s.portals[msg.DestinationPortal]; ok && msg.DestinationPortal != "" {
+		return s.fail(Errorf("42P03", "portal \"%s\" already exists", msg.DestinationPortal))
+	}
+
+	err := s.checkAborted(stmt.SQL)
+	if err != nil {
+		return s.fail(err)
+	}
+
+	if len(msg.Parameters) != len(stmt.ParamOIDs) {
+		return s.fail(Errorf("08P01", "bind message supplies %d parameters, but prepared statement \"%s\" requires %d",
+			len(msg.Parameters), stmt.Name, len(stmt.ParamOIDs)))
+	}
+	paramFormats, ok := expandFormats(msg.ParameterFormatCodes, len(msg.Parameters))
+	if !ok {
+		return s.fail(Errorf("08P01", "bind message has %d parameter formats but %d parameters",
+			len(msg.ParameterFormatCodes), len(msg.Parameters)))
+	}
+	resultFormats, ok := expandFormats(msg.ResultFormatCodes, len(stmt.Fields))
+	if !ok {
+		return s.fail(Errorf("08P01", "bind message has %d result formats but query has %d columns",
+			len(msg.ResultFormatCodes), len(stmt.Fields)))
+	}
+
+	// The message is only valid until the next message is received.
+	params := make([][]byte, len(msg.Parameters))
+	for i, p := range msg.Parameters {
+		if p != nil {
+			params[i] = append([]byte{}, p...)
+		}
+	}
+
+	s.dropPortal(msg.DestinationPortal)
+	s.portals[msg.DestinationPortal] = &Portal{
+		Name:          msg.DestinationPortal,
+		Statement:     stmt,
+		Params:        params,
+		ParamFormats:  paramFormats,
+		ResultFormats: resultFormats,
+	}
+	return s.backend.Send(&pgproto3.BindComplete{})
+}
+
+func (s *Session) describe(msg *pgproto3.Describe) error {
+	switch msg.ObjectType {
+	case 'S':
+		stmt, ok := s.statements[msg.Name]
+		if !ok {
+			return s.fail(Errorf("26000", "prepared statement \"%s\" does not exist", msg.Name))
+		}
+		err := s.backend.Send(&pgproto3.ParameterDescription{ParameterOIDs: stmt.ParamOIDs})
+		if err != nil {
+			return err
+		}
+		return s.sendRowDescription(stmt.Fields, nil)
+
+	case 'P':
+		portal, ok := s.portals[msg.Name]
+		if !ok {
+			return s.fail(Errorf("34000", "portal \"%s\" does not exist", msg.Name))
+		}
+		return s.sendRowDescription(portal.Statement.Fields, portal.ResultFormats)
+
+	default:
+		return s.fail(Errorf("08P01", "invalid DESCRIBE message subtype %d", msg.ObjectType))
+	}
+}
+
+// sendRowDescription sends the RowDescription of fields with formats, or NoData if fields is nil.
+func (s *Session) sendRowDescription(fields []pgproto3.FieldDescription, formats []int16) error {
+	if fields == nil {
+		return s.backend.Send(&pgproto3.NoData{})
+	}
+	return s.backend.Send(&pgproto3.RowDescription{Fields: resultFields(fields, formats)})
+}
+
+func (s *Session) execute(ctx context.Context, msg *pgproto3.Execute) error {
+	portal, ok := s.portals[msg.Portal]
+	if !ok {
+		return s.fail(Errorf("34000", "portal \"%s\" does not exist", msg.Portal))
+	}
+
+	if isEmptyQuery(portal.Statement.SQL) {
+		return s.backend.Send(&pgproto3.EmptyQueryResponse{})
+	}
+
+	if portal.result == nil {
+		err := s.checkAborted(portal.Statement.SQL)
+		if err != nil {
+			return s.fail(err)
+		}
+	}
+
+	return s.run(ctx, portal, msg.MaxRows)
+}
+
+// run runs portal if it has not been run yet and sends up to maxRows of its remaining rows, or all of them if maxRows
+// is 0. It then sends PortalSuspended if maxRows rows were sent and CommandComplete otherwise.
+func (s *Session) run(ctx context.Context, portal *Portal, maxRows uint32) error {
+	if portal.done {
+		// Like PostgreSQL a completed portal that returns rows completes again with no rows and one that does not
+		// cannot be run again.
+		if portal.Statement.Fields == nil {
+			return s.fail(Errorf("55000", "portal \"%s\" cannot be run", portal.Name))
+		}
+		return s.backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(emptyCommandTag(portal.result.CommandTag))})
+	}
+
+	if portal.result == nil {
+		portal.TxStatus = s.txStatus
+		result, err := s.executor.Execute(ctx, portal)
+		if err != nil {
+			return s.fail(err)
+		}
+		portal.result = result
+		s.updateTxStatus(portal.Statement.SQL)
+	}
+
+	// Like PostgreSQL the portal is suspended when maxRows rows are sent even if no rows remain.
+	var n uint32
+	for maxRows == 0 || n < maxRows {
+		row, err := portal.nextRow(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.dropPortal(portal.Name)
+			return s.fail(err)
+		}
+
+		err = s.backend.Send(&pgproto3.DataRow{Values: row})
+		if err != nil {
+			return err
+		}
+		n++
+	}
+
+	if maxRows > 0 && n == maxRows {
+		return s.backend.Send(&pgproto3.PortalSuspended{})
+	}
+
+	portal.done = true
+	tag := portal.result.CommandTag
+	if tag == "" {
+		tag = fmt.Sprintf("SELECT %d", n)
+	}
+	return s.backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+}
+
+// emptyCommandTag returns tag with its row count, if any, replaced by 0, or SELECT 0 if tag is empty.
+func emptyCommandTag(tag string) string {
+	if tag == "" {
+		return "SELECT 0"
+	}
+	i := strings.LastIndexByte(tag, ' ')
+	if _, err := strconv.ParseUint(tag[i+1:], 10, 64); i < 0 || err != nil {
+		return tag
+	}
+	return tag[:i+1] + "0"
+}
+
+func (s *Session) close(msg *pgproto3.Close) error {
+	switch msg.ObjectType {
+	case 'S':
+		// Portals created from the statement remain usable.
+		delete(s.statements, msg.Name)
+	case 'P':
+		s.dropPortal(msg.Name)
+	default:
+		return s.fail(Errorf("08P01", "invalid CLOSE message subtype %d", msg.ObjectType))
+	}
+	return s.backend.Send(&pgproto3.CloseComplete{})
+}
+
+func (s *Session) sync() error {
+	s.ignoreTillSync = false
+	return s.readyForQuery()
+}
+
+// readyForQuery ends the implicit transaction, if any, and sends ReadyForQuery.
+func (s *Session) readyForQuery() error {
+	if s.txStatus == 'I' {
+		// Portals only live until the end of the transaction.
+		s.closePortals()
+	}
+	return s.backend.Send(&pgproto3.ReadyForQuery{TxStatus: s.txStatus})
+}
+
+// dropPortal closes and removes the portal name if it exists.
+func (s *Session) dropPortal(name string) {
+	if portal, ok := s.portals[name]; ok {
+		portal.close()
+		delete(s.portals, name)
+	}
+}
+
+func (s *Session) closePortals() {
+	for _, portal := range s.portals {
+		portal.close()
+	}
+	s.portals = make(map[string]*Portal)
+}
+
+// fail reports err to the client and fails the transaction block, if any.
+func (s *Session) fail(err error) error {
+	s.failed = true
+	if s.txStatus == 'T' {
+		s.txStatus = 'E'
+	}
+	return s.backend.Send(errorResponse(err))
+}
+
+func errorResponse(err error) *pgproto3.ErrorResponse {
+	var errResp *pgproto3.ErrorResponse
+	if errors.As(err, &errResp) {
+		return errResp
+	}
+	return &pgproto3.ErrorResponse{Severity: "ERROR", SeverityUnlocalized: "ERROR", Code: "XX000", Message: err.Error()}
+}
+
+// checkAborted returns an error if the transaction block has failed and sql does not end it.
+func (s *Session) checkAborted(sql string) error {
+	if s.txStatus != 'E' {
+		return nil
+	}
+	switch transactionEffect(sql) {
+	case txEnd, txRollbackToSavepoint:
+		return nil
+	}
+	return Errorf("25P02", "current transaction is aborted, commands ignored until end of transaction block")
+}
+
+// updateTxStatus updates the transaction status after sql has been run successfully.
+func (s *Session) updateTxStatus(sql string) {
+	switch transactionEffect(sql) {
+	case txBegin:
+		if s.txStatus == 'I' {
+			s.txStatus = 'T'
+		}
+	case txEnd:
+		s.txStatus = 'I'
+	case txRollbackToSavepoint:
+		if s.txStatus == 'E' {
+			s.txStatus = 'T'
+		}
+	}
+}
+
+const (
+	txNone = iota
+	txBegin
+	txEnd
+	txRollbackToSavepoint
+)
+
+// transactionEffect returns how the statement sql affects the transaction block.
+func transactionEffect(sql string) int {
+	keywords := sqlscan.Keywords(sql, 3)
+	if len(keywords) == 0 {
+		return txNone
+	}
+
+	switch keywords[0] {
+	case "BEGIN":
+		return txBegin
+	case "START":
+		if len(keywords) > 1 && keywords[1] == "TRANSACTION" {
+			return txBegin
+		}
+	case "COMMIT", "END", "ABORT":
+		return txEnd
+	case "ROLLBACK":
+		for _, k := range keywords[1:] {
+			if k == "TO" {
+				return txRollbackToSavepoint
+			}
+		}
+		return txEnd
+	}
+	return txNone
+}
+
+func isEmptyQuery(sql string) bool {
+	return len(sqlscan.Split(sql)) == 0
+}
+
+// expandFormats returns the format code of each of n values from the format codes of a Bind message.
+func expandFormats(codes []int16, n int) ([]int16, bool) {
+	formats := make([]int16, n)
+	switch len(codes) {
+	case 0:
+	case 1:
+		for i := range formats {
+			formats[i] = codes[0]
+		}
+	case n:
+		copy(formats, codes)
+	default:
+		return nil, false
+	}
+	return formats, true
+}
+
+// resultFields returns a copy of fields with the formats. If formats is nil the fields are in text format.
+func resultFields(fields []pgproto3.FieldDescription, formats []int16) []pgproto3.FieldDescription {
+	result := make([]pgproto3.FieldDescription, len(fields))
+	copy(result, fields)
+	for i := range result {
+		result[i].Format = 0
+		if formats != nil {
+			result[i].Format = formats[i]
+		}
+	}
+	return result
+}
@@ -0,0 +1,413 @@
+package pgserver_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgproto3/v2/pgserver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testExecutor understands "generate n" which returns the rows 1 to n, "echo $1" which returns its parameter and
+// "fail" which is a syntax error. Any other statement succeeds without rows and its first word is its command tag.
+type testExecutor struct {
+	executed []string
+}
+
+var intField = pgproto3.FieldDescription{Name: []byte("n"), DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1}
+
+func (e *testExecutor) Describe(ctx context.Context, sql string, paramOIDs []uint32) (*pgserver.StatementDescription, error) {
+	switch {
+	case sql == "fail":
+		return nil, pgserver.Errorf("42601", "syntax error at or near \"fail\"")
+	case strings.HasPrefix(sql, "generate "):
+		return &pgserver.StatementDescription{Fields: []pgproto3.FieldDescription{intField}}, nil
+	case sql == "echo $1":
+		return &pgserver.StatementDescription{ParamOIDs: []uint32{25}, Fields: []pgproto3.FieldDescription{intField}}, nil
+	default:
+		return &pgserver.StatementDescription{}, nil
+	}
+}
+
+func (e *testExecutor) Execute(ctx context.Context, portal *pgserver.Portal) (*pgserver.Result, error) {
+	sql := portal.Statement.SQL
+	e.executed = append(e.executed, sql)
+
+	switch {
+	case strings.HasPrefix(sql, "generate "):
+		n, err := strconv.Atoi(strings.TrimPrefix(sql, "generate "))
+		if err != nil {
+			return nil, pgserver.Errorf("22P02", "invalid input syntax for type integer")
+		}
+		result := &pgserver.Result{}
+		for i := 1; i <= n; i++ {
+			result.Rows = append(result.Rows, [][]byte{[]byte(strconv.Itoa(i))})
+		}
+		return result, nil
+	case sql == "echo $1":
+		return &pgserver.Result{Rows: [][][]byte{{portal.Params[0]}}}, nil
+	default:
+		return &pgserver.Result{CommandTag: strings.ToUpper(strings.Fields(sql)[0])}, nil
+	}
+}
+
+type testClient struct {
+	t        *testing.T
+	conn     net.Conn
+	frontend *pgproto3.Frontend
+}
+
+// startSession serves a Session with executor and returns a client connected to it.
+func startSession(t *testing.T, executor pgserver.Executor) *testClient {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(serverConn), serverConn)
+	session := pgserver.NewSession(backend, executor)
+	go session.Serve(context.Background())
+
+	return &testClient{t: t, conn: clientConn, frontend: pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)}
+}
+
+// send writes msgs in a single write in the background.
+func (c *testClient) send(msgs ...pgproto3.FrontendMessage) {
+	var buf []byte
+	for _, msg := range msgs {
+		var err error
+		buf, err = msg.Encode(buf)
+		require.NoError(c.t, err)
+	}
+	go c.conn.Write(buf)
+}
+
+// receiveUntilReady returns the names of the messages received up to and including ReadyForQuery and the last
+// ReadyForQuery.
+func (c *testClient) receiveUntilReady() ([]string, byte) {
+	var names []string
+	for {
+		msg, err := c.frontend.Receive()
+		require.NoError(c.t, err)
+
+		name := typeName(msg)
+		switch msg := msg.(type) {
+		case *pgproto3.DataRow:
+			name += " " + string(msg.Values[0])
+		case *pgproto3.CommandComplete:
+			name += " " + string(msg.CommandTag)
+		case *pgproto3.ErrorResponse:
+			name += " " + msg.Code
+		case *pgproto3.ReadyForQuery:
+			names = append(names, name)
+			return names, msg.TxStatus
+		}
+		names = append(names, name)
+	}
+}
+
+func typeName(msg pgproto3.BackendMessage) string {
+	switch msg.(type) {
+	case *pgproto3.ParseComplete:
+		return "ParseComplete"
+	case *pgproto3.BindComplete:
+		return "BindComplete"
+	case *pgproto3.CloseComplete:
+		return "CloseComplete"
+	case *pgproto3.ParameterDescription:
+		return "ParameterDescription"
+	case *pgproto3.RowDescription:
+		return "RowDescription"
+	case *pgproto3.NoData:
+		return "NoData"
+	case *pgproto3.DataRow:
+		return "DataRow"
+	case *pgproto3.CommandComplete:
+		return "CommandComplete"
+	case *pgproto3.EmptyQueryResponse:
+		return "EmptyQueryResponse"
+	case *pgproto3.PortalSuspended:
+		return "PortalSuspended"
+	case *pgproto3.ErrorResponse:
+		return "ErrorResponse"
+	case *pgproto3.ReadyForQuery:
+		return "ReadyForQuery"
+	default:
+		return "unexpected"
+	}
+}
+
+func TestSessionExtendedQuery(t *testing.T) {
+	t.Parallel()
+
+	executor := &testExecutor{}
+	client := startSession(t, executor)
+
+	client.send(
+		&pgproto3.Parse{Name: "gen", Query: "generate 3"},
+		&pgproto3.Describe{ObjectType: 'S', Name: "gen"},
+		&pgproto3.Bind{DestinationPortal: "p", PreparedStatement: "gen", ResultFormatCodes: []int16{1}},
+		&pgproto3.Describe{ObjectType: 'P', Name: "p"},
+		&pgproto3.Execute{Portal: "p", MaxRows: 2},
+		&pgproto3.Execute{Portal: "p", MaxRows: 2},
+		&pgproto3.Sync{},
+	)
+	msgs, txStatus := client.receiveUntilReady()
+	assert.Equal(t, []string{
+		"ParseComplete",
+		"ParameterDescription",
+		"RowDescription",
+		"BindComplete",
+		"RowDescription",
+		"DataRow 1",
+		"DataRow 2",
+		"PortalSuspended",
+		"DataRow 3",
+		"CommandComplete SELECT 1",
+		"ReadyForQuery",
+	}, msgs)
+	assert.Equal(t, byte('I'), txStatus)
+	assert.Equal(t, []string{"generate 3"}, executor.executed)
+
+	// The named statement survives the Sync but the portal does not.
+	client.send(
+		&pgproto3.Bind{PreparedStatement: "gen"},
+		&pgproto3.Execute{},
+		&pgproto3.Execute{Portal: "p"},
+		&pgproto3.Sync{},
+	)
+	msgs, _ = client.receiveUntilReady()
+	assert.Equal(t, []string{
+		"BindComplete",
+		"DataRow 1",
+		"DataRow 2",
+		"DataRow 3",
+		"CommandComplete SELECT 3",
+		"ErrorResponse 34000",
+		"ReadyForQuery",
+	}, msgs)
+}
+
+func TestSessionExecuteCompletedPortal(t *testing.T) {
+	t.Parallel()
+
+	executor := &testExecutor{}
+	client := startSession(t, executor)
+
+	// A completed portal that returns rows completes again without rows and one that does not cannot be run again.
+	client.send(
+		&pgproto3.Parse{Name: "gen", Query: "generate 2"},
+		&pgproto3.Bind{DestinationPortal: "gen", PreparedStatement: "gen"},
+		&pgproto3.Execute{Portal: "gen"},
+		&pgproto3.Execute{Portal: "gen"},
+		&pgproto3.Parse{Name: "upd", Query: "update users"},
+		&pgproto3.Bind{DestinationPortal: "upd", PreparedStatement: "upd"},
+		&pgproto3.Execute{Portal: "upd"},
+		&pgproto3.Execute{Portal: "upd"},
+		&pgproto3.Sync{},
+	)
+	msgs, _ := client.receiveUntilReady()
+	assert.Equal(t, []string{
+		"ParseComplete",
+		"BindComplete",
+		"DataRow 1",
+		"DataRow 2",
+		"CommandComplete SELECT 2",
+		"CommandComplete SELECT 0",
+		"ParseComplete",
+		"BindComplete",
+		"CommandComplete UPDATE",
+		"ErrorResponse 55000",
+		"ReadyForQuery",
+	}, msgs)
+	assert.Equal(t, []string{"generate 2", "update users"}, executor.executed)
+}
+
+func TestSessionDescribeFormats(t *testing.T) {
+	t.Parallel()
+
+	client := startSession(t, &testExecutor{})
+
+	client.send(
+		&pgproto3.Parse{Query: "echo $1"},
+		&pgproto3.Bind{Parameters: [][]byte{[]byte("hello")}, ResultFormatCodes: []int16{1}},
+		&pgproto3.Describe{ObjectType: 'P'},
+		&pgproto3.Sync{},
+	)
+	for _, want := range []pgproto3.BackendMessage{
+		&pgproto3.ParseComplete{},
+		&pgproto3.BindComplete{},
+		&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("n"), DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1, Format: 1}}},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	} {
+		msg, err := client.frontend.Receive()
+		require.NoError(t, err)
+		assert.Equal(t, want, msg)
+	}
+}
+
+func TestSessionErrorUntilSync(t *testing.T) {
+	t.Parallel()
+
+	executor := &testExecutor{}
+	client := startSession(t, executor)
+
+	client.send(
+		&pgproto3.Parse{Query: "fail"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+		&pgproto3.Parse{Name: "echo", Query: "echo $1"},
+		&pgproto3.Bind{PreparedStatement: "echo"},
+		&pgproto3.Parse{Name: "echo", Query: "echo $1"},
+		&pgproto3.Sync{},
+	)
+	msgs, _ := client.receiveUntilReady()
+	assert.Equal(t, []string{"ErrorResponse 42601", "ReadyForQuery"}, msgs)
+
+	msgs, _ = client.receiveUntilReady()
+	assert.Equal(t, []string{"ParseComplete", "ErrorResponse 08P01", "ReadyForQuery"}, msgs)
+	assert.Empty(t, executor.executed)
+}
+
+func TestSessionSimpleQueryDropsUnnamedStatement(t *testing.T) {
+	t.Parallel()
+
+	client := startSession(t, &testExecutor{})
+
+	client.send(
+		&pgproto3.Parse{Query: "generate 1"},
+		&pgproto3.Sync{},
+		&pgproto3.Query{String: "generate 2"},
+		&pgproto3.Query{String: " -- nothing"},
+		&pgproto3.Bind{},
+		&pgproto3.Sync{},
+	)
+	msgs, _ := client.receiveUntilReady()
+	assert.Equal(t, []string{"ParseComplete", "ReadyForQuery"}, msgs)
+
+	msgs, _ = client.receiveUntilReady()
+	assert.Equal(t, []string{"RowDescription", "DataRow 1", "DataRow 2", "CommandComplete SELECT 2", "ReadyForQuery"}, msgs)
+
+	msgs, _ = client.receiveUntilReady()
+	assert.Equal(t, []string{"EmptyQueryResponse", "ReadyForQuery"}, msgs)
+
+	msgs, _ = client.receiveUntilReady()
+	assert.Equal(t, []string{"ErrorResponse 26000", "ReadyForQuery"}, msgs)
+}
+
+func TestSessionTransaction(t *testing.T) {
+	t.Parallel()
+
+	client := startSession(t, &testExecutor{})
+
+	client.send(&pgproto3.Query{String: "begin"})
+	msgs, txStatus := client.receiveUntilReady()
+	assert.Equal(t, []string{"CommandComplete BEGIN", "ReadyForQuery"}, msgs)
+	assert.Equal(t, byte('T'), txStatus)
+
+	// Portals survive Sync in a transaction block.
+	client.send(
+		&pgproto3.Parse{Query: "generate 2"},
+		&pgproto3.Bind{DestinationPortal: "cursor"},
+		&pgproto3.Execute{Portal: "cursor", MaxRows: 1},
+		&pgproto3.Sync{},
+		&pgproto3.Execute{Portal: "cursor", MaxRows: 1},
+		&pgproto3.Sync{},
+	)
+	msgs, txStatus = client.receiveUntilReady()
+	assert.Equal(t, []string{"ParseComplete", "BindComplete", "DataRow 1", "PortalSuspended", "ReadyForQuery"}, msgs)
+	assert.Equal(t, byte('T'), txStatus)
+	msgs, _ = client.receiveUntilReady()
+	assert.Equal(t, []string{"DataRow 2", "PortalSuspended", "ReadyForQuery"}, msgs)
+
+	client.send(&pgproto3.Query{String: "fail"})
+	msgs, txStatus = client.receiveUntilReady()
+	assert.Equal(t, []string{"ErrorResponse 42601", "ReadyForQuery"}, msgs)
+	assert.Equal(t, byte('E'), txStatus)
+
+	client.send(&pgproto3.Query{String: "generate 1"})
+	msgs, txStatus = client.receiveUntilReady()
+	assert.Equal(t, []string{"ErrorResponse 25P02", "ReadyForQuery"}, msgs)
+	assert.Equal(t, byte('E'), txStatus)
+
+	client.send(&pgproto3.Query{String: "rollback"})
+	msgs, txStatus = client.receiveUntilReady()
+	assert.Equal(t, []string{"CommandComplete ROLLBACK", "ReadyForQuery"}, msgs)
+	assert.Equal(t, byte('I'), txStatus)
+
+	client.send(&pgproto3.Execute{Portal: "cursor"}, &pgproto3.Sync{})
+	msgs, _ = client.receiveUntilReady()
+	assert.Equal(t, []string{"ErrorResponse 34000", "ReadyForQuery"}, msgs)
+}
+
+// transactorExecutor is a testExecutor that records implicit transactions.
+type transactorExecutor struct {
+	testExecutor
+}
+
+func (e *transactorExecutor) BeginImplicit(ctx context.Context) error {
+	e.executed = append(e.executed, "begin implicit")
+	return nil
+}
+
+func (e *transactorExecutor) EndImplicit(ctx context.Context, commit bool) error {
+	if commit {
+		e.executed = append(e.executed, "commit implicit")
+	} else {
+		e.executed = append(e.executed, "rollback implicit")
+	}
+	return nil
+}
+
+func TestSessionMultiStatementQuery(t *testing.T) {
+	t.Parallel()
+
+	executor := &transactorExecutor{}
+	client := startSession(t, executor)
+
+	client.send(&pgproto3.Query{String: "generate 1; select 'a;b' -- c;\n; ;generate 2"})
+	msgs, _ := client.receiveUntilReady()
+	assert.Equal(t, []string{
+		"RowDescription",
+		"DataRow 1",
+		"CommandComplete SELECT 1",
+		"CommandComplete SELECT",
+		"RowDescription",
+		"DataRow 1",
+		"DataRow 2",
+		"CommandComplete SELECT 2",
+		"ReadyForQuery",
+	}, msgs)
+	assert.Equal(t, []string{"begin implicit", "generate 1", "select 'a;b' -- c;", "generate 2", "commit implicit"}, executor.executed)
+
+	// The statements after an error are not run.
+	executor.executed = nil
+	client.send(&pgproto3.Query{String: "generate 1; fail; generate 2"})
+	msgs, txStatus := client.receiveUntilReady()
+	assert.Equal(t, []string{"RowDescription", "DataRow 1", "CommandComplete SELECT 1", "ErrorResponse 42601", "ReadyForQuery"}, msgs)
+	assert.Equal(t, byte('I'), txStatus)
+	assert.Equal(t, []string{"begin implicit", "generate 1", "rollback implicit"}, executor.executed)
+
+	// BEGIN takes over the implicit transaction.
+	executor.executed = nil
+	client.send(&pgproto3.Query{String: "update; begin; update"})
+	msgs, txStatus = client.receiveUntilReady()
+	assert.Equal(t, []string{"CommandComplete UPDATE", "CommandComplete BEGIN", "CommandComplete UPDATE", "ReadyForQuery"}, msgs)
+	assert.Equal(t, byte('T'), txStatus)
+	assert.Equal(t, []string{"begin implicit", "update", "begin", "update"}, executor.executed)
+
+	// Statements in a transaction block do not run in an implicit transaction.
+	executor.executed = nil
+	client.send(&pgproto3.Query{String: "update; fail; update"})
+	msgs, txStatus = client.receiveUntilReady()
+	assert.Equal(t, []string{"CommandComplete UPDATE", "ErrorResponse 42601", "ReadyForQuery"}, msgs)
+	assert.Equal(t, byte('E'), txStatus)
+	assert.Equal(t, []string{"update"}, executor.executed)
+}
@@ -0,0 +1,176 @@
+package pgproto3
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// PortalPager fetches the rows of a query in pages with Execute.MaxRows, as a cursor does. It is created by
+// Frontend.OpenPortalPager.
+//
+// The query runs in the unnamed portal. Pages are requested with Flush rather than Sync so the portal and its implicit
+// transaction stay open until the last page has been received or the pager is closed.
+//
+// The Frontend must not be used for anything else until NextPage has returned io.EOF or an error or Close has returned.
+type PortalPager struct {
+	f        *Frontend
+	ctx      context.Context
+	pageSize uint32
+
+	fields []FieldDescription
+	rows   int64
+
+	done bool  // the portal is complete and ReadyForQuery has been received
+	err  error // the error that ended the portal
+}
+
+// OpenPortalPager prepares sql as the unnamed statement and binds params, which are in text format, to the unnamed
+// portal. NextPage then fetches up to pageSize rows at a time, or all rows at once if pageSize is 0. The rows are in
+// text format. ctx applies to all the pages.
+//
+// If the server reports an error it is returned as an *ErrorResponse and the Frontend is ready for the next query.
+func (f *Frontend) OpenPortalPager(ctx context.Context, sql string, params [][]byte, pageSize uint32) (*PortalPager, error) {
+	err := f.sendBatch(&Parse{Query: sql}, &Bind{Parameters: params}, &Describe{ObjectType: 'P'}, &Flush{})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PortalPager{f: f, ctx: ctx, pageSize: pageSize}
+	for {
+		msg, err := f.ReceiveContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg := msg.(type) {
+		case *ParseComplete, *BindComplete:
+		case *RowDescription:
+			p.fields = make([]FieldDescription, len(msg.Fields))
+			for i, fd := range msg.Fields {
+				p.fields[i] = fd
+				p.fields[i].Name = append([]byte(nil), fd.Name...)
+			}
+			return p, nil
+		case *NoData:
+			return p, nil
+		case *ErrorResponse:
+			errResp := *msg
+			if err := p.sync(); err != nil {
+				return nil, err
+			}
+			return nil, &errResp
+		case *NoticeResponse, *ParameterStatus, *NotificationResponse:
+		default:
+			return nil, fmt.Errorf("unexpected message while opening portal: %T", msg)
+		}
+	}
+}
+
+// Fields returns the description of the columns of the rows. It is nil if the query does not return rows.
+func (p *PortalPager) Fields() []FieldDescription {
+	return p.fields
+}
+
+// NextPage fetches the next page of rows. It returns io.EOF when all rows have been fetched and the server is ready
+// for the next query. The last page may be shorter than the page size. NULL values are nil. If the server reports an
+// error it is returned as an *ErrorResponse.
+func (p *PortalPager) NextPage() ([][][]byte, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.done {
+		return nil, io.EOF
+	}
+
+	err := p.f.sendBatch(&Execute{MaxRows: p.pageSize}, &Flush{})
+	if err != nil {
+		p.err = err
+		return nil, err
+	}
+
+	var rows [][][]byte
+	for {
+		msg, err := p.f.ReceiveContext(p.ctx)
+		if err != nil {
+			p.err = err
+			return nil, err
+		}
+
+		switch msg := msg.(type) {
+		case *DataRow:
+			rows = append(rows, copyRow(msg.Values))
+			p.rows++
+		case *PortalSuspended:
+			return rows, nil
+		case *CommandComplete, *EmptyQueryResponse:
+			if err := p.sync(); err != nil {
+				p.err = err
+				return nil, err
+			}
+			p.done = true
+			if len(rows) == 0 {
+				return nil, io.EOF
+			}
+			return rows, nil
+		case *ErrorResponse:
+			errResp := *msg
+			if err := p.sync(); err != nil {
+				p.err = err
+				return nil, err
+			}
+			p.err = &errResp
+			return nil, p.err
+		case *NoticeResponse, *ParameterStatus, *NotificationResponse:
+		default:
+			p.err = fmt.Errorf("unexpected message while fetching portal: %T", msg)
+			return nil, p.err
+		}
+	}
+}
+
+// Rows returns the number of rows fetched so far.
+func (p *PortalPager) Rows() int64 {
+	return p.rows
+}
+
+// Close closes the portal if rows remain and waits for the server to be ready for the next query.
+func (p *PortalPager) Close() error {
+	if p.done || p.err != nil {
+		return nil
+	}
+
+	p.done = true
+	err := p.sync(&Close{ObjectType: 'P'})
+	if err != nil {
+		p.err = err
+	}
+	return err
+}
+
+// sync sends msgs followed by Sync to end the extended query and waits for ReadyForQuery.
+func (p *PortalPager) sync(msgs ...FrontendMessage) error {
+	err := p.f.sendBatch(append(msgs, &Sync{})...)
+	if err != nil {
+		return err
+	}
+	return p.f.receiveReadyForQuery(p.ctx)
+}
+
+// copyRow returns a copy of values in a single allocation.
+func copyRow(values [][]byte) [][]byte {
+	n := 0
+	for _, v := range values {
+		n += len(v)
+	}
+
+	buf := make([]byte, 0, n)
+	row := make([][]byte, len(values))
+	for i, v := range values {
+		if v != nil {
+			buf = append(buf, v...)
+			row[i] = buf[len(buf)-len(v) : len(buf) : len(buf)]
+		}
+	}
+	return row
+}
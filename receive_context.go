@@ -0,0 +1,194 @@
+package pgproto3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ReadDeadliner is implemented by connections that support read deadlines such as net.Conn.
+type ReadDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+var errNoReadDeadline = errors.New("ReceiveContext requires a connection with SetReadDeadline")
+
+// readWatcherIdleTimeout is how long the goroutine of a readWatcher waits for another read before it exits.
+const readWatcherIdleTimeout = time.Second
+
+// readWatcher makes reads from a connection fail when a context is done. A single goroutine watches successive reads
+// so receiving a message at a time in a loop does not start a goroutine per message. The goroutine exits once no read
+// has been watched for readWatcherIdleTimeout.
+type readWatcher struct {
+	conn ReadDeadliner // set by SetReadDeadliner
+
+	mu      sync.Mutex
+	running bool
+	pending int // reads sent to the goroutine that it has not received yet
+	watch   chan watchedRead
+	unwatch chan struct{}
+}
+
+// watchedRead is a read from conn that must fail when ctx is done.
+type watchedRead struct {
+	ctx  context.Context
+	conn ReadDeadliner
+}
+
+// ReceiveContext is like Receive but it returns ctx.Err() if ctx is done before a message is received. The read is
+// interrupted with a read deadline on the connection set by SetReadDeadliner or, by default, on the writer passed to
+// NewFrontend if it has a SetReadDeadline method as net.Conn does. Without one ReceiveContext returns an error without
+// receiving unless ctx can never be done. A message that was partially received when ctx was done is completed by the
+// next call to Receive or ReceiveContext so the Frontend remains usable. The connection's read deadline is cleared
+// when ReceiveContext returns.
+func (f *Frontend) ReceiveContext(ctx context.Context) (BackendMessage, error) {
+	stop, err := f.readWatcher.start(ctx, f.w)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := f.Receive()
+	if err != nil {
+		return nil, stop(err)
+	}
+	stop(nil)
+	return msg, nil
+}
+
+// SetReadDeadliner sets the connection whose read deadline ReceiveContext uses to interrupt reads. It must be the
+// connection the ChunkReader reads from. It is only needed if the writer passed to NewFrontend is not that connection,
+// for example if it is buffered.
+func (f *Frontend) SetReadDeadliner(conn ReadDeadliner) {
+	f.readWatcher.conn = conn
+}
+
+// ReceiveContext is like Receive but it returns ctx.Err() if ctx is done before a message is received. The read is
+// interrupted with a read deadline on the connection set by SetReadDeadliner or, by default, on the writer passed to
+// NewBackend if it has a SetReadDeadline method as net.Conn does. Without one ReceiveContext returns an error without
+// receiving unless ctx can never be done. A message that was partially received when ctx was done is completed by the
+// next call to Receive or ReceiveContext so the Backend remains usable. The connection's read deadline is cleared when
+// ReceiveContext returns.
+func (b *Backend) ReceiveContext(ctx context.Context) (FrontendMessage, error) {
+	stop, err := b.readWatcher.start(ctx, b.w)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := b.Receive()
+	if err != nil {
+		return nil, stop(err)
+	}
+	stop(nil)
+	return msg, nil
+}
+
+// SetReadDeadliner sets the connection whose read deadline ReceiveContext uses to interrupt reads. It must be the
+// connection the ChunkReader reads from. It is only needed if the writer passed to NewBackend is not that connection,
+// for example if it is buffered.
+func (b *Backend) SetReadDeadliner(conn ReadDeadliner) {
+	b.readWatcher.conn = conn
+}
+
+// start makes the next read fail when ctx is done. w is used as the connection if none was set. The returned stop
+// function must be called when the read is complete with the error returned by the read. It clears the read deadline
+// and returns the error to report.
+func (rw *readWatcher) start(ctx context.Context, w io.Writer) (stop func(readErr error) error, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if ctx.Done() == nil {
+		return func(readErr error) error { return readErr }, nil
+	}
+
+	conn := rw.conn
+	if conn == nil {
+		var ok bool
+		conn, ok = w.(ReadDeadliner)
+		if !ok {
+			return nil, errNoReadDeadline
+		}
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	rw.mu.Lock()
+	rw.pending++
+	if !rw.running {
+		rw.running = true
+		rw.watch = make(chan watchedRead)
+		rw.unwatch = make(chan struct{})
+		go rw.run(rw.watch, rw.unwatch)
+	}
+	watch, unwatch := rw.watch, rw.unwatch
+	rw.mu.Unlock()
+	watch <- watchedRead{ctx: ctx, conn: conn}
+
+	stop = func(readErr error) error {
+		// Once the goroutine receives from unwatch it no longer sets the deadline.
+		unwatch <- struct{}{}
+		conn.SetReadDeadline(time.Time{})
+
+		if readErr == nil {
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// The connection's deadline can pass just before the context's timer fires.
+		if netErr, ok := readErr.(net.Error); ok && netErr.Timeout() && hasDeadline && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		return readErr
+	}
+
+	return stop, nil
+}
+
+// run watches the reads sent by start until it has been idle for readWatcherIdleTimeout.
+func (rw *readWatcher) run(watch <-chan watchedRead, unwatch <-chan struct{}) {
+	idle := time.NewTimer(readWatcherIdleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case read := <-watch:
+			rw.mu.Lock()
+			rw.pending--
+			rw.mu.Unlock()
+
+			select {
+			case <-read.ctx.Done():
+				// A deadline in the past interrupts a read in progress.
+				read.conn.SetReadDeadline(time.Unix(1, 0))
+				<-unwatch
+			case <-unwatch:
+			}
+
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(readWatcherIdleTimeout)
+
+		case <-idle.C:
+			rw.mu.Lock()
+			if rw.pending > 0 {
+				// A read is about to be sent.
+				rw.mu.Unlock()
+				idle.Reset(readWatcherIdleTimeout)
+				continue
+			}
+			rw.running = false
+			rw.mu.Unlock()
+			return
+		}
+	}
+}
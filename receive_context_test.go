@@ -0,0 +1,176 @@
+package pgproto3_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrontendReceiveContextCancel(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	reading := make(chan struct{})
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(&notifyingReader{r: clientConn, reading: reading}), clientConn)
+
+	// Cancel once the Frontend reads so the read is interrupted rather than never started.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-reading
+		cancel()
+	}()
+	_, err := frontend.ReceiveContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = frontend.ReceiveContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	// The Frontend is still usable.
+	go serverConn.Write(mustEncode(t, &pgproto3.ReadyForQuery{TxStatus: 'I'}))
+	msg, err := frontend.ReceiveContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'I'}, msg)
+}
+
+// notifyingReader closes reading when the first Read starts.
+type notifyingReader struct {
+	r       io.Reader
+	reading chan struct{}
+	once    sync.Once
+}
+
+func (r *notifyingReader) Read(p []byte) (int, error) {
+	r.once.Do(func() { close(r.reading) })
+	return r.r.Read(p)
+}
+
+func TestFrontendReceiveContextDeadlinePartialMessage(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)
+	buf := mustEncode(t, &pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+
+	for _, split := range []int{3, 7} {
+		go serverConn.Write(buf[:split])
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := frontend.ReceiveContext(ctx)
+		cancel()
+		assert.Equal(t, context.DeadlineExceeded, err)
+
+		go serverConn.Write(buf[split:])
+		msg, err := frontend.ReceiveContext(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, &pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")}, msg)
+	}
+}
+
+func TestBackendReceiveContext(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(serverConn), serverConn)
+	buf := mustEncode(t, &pgproto3.Query{String: "select 1"})
+
+	go clientConn.Write(buf[:6])
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err := backend.ReceiveContext(ctx)
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	go clientConn.Write(buf[6:])
+	msg, err := backend.ReceiveContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.Query{String: "select 1"}, msg)
+}
+
+func TestReceiveContextRequiresReadDeadline(t *testing.T) {
+	t.Parallel()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(&bytes.Buffer{}), &bytes.Buffer{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := frontend.ReceiveContext(ctx)
+	assert.Error(t, err)
+}
+
+func TestReceiveContextSetReadDeadliner(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	w := bufio.NewWriter(clientConn)
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), w)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := frontend.ReceiveContext(ctx)
+	assert.Error(t, err)
+	assert.NotEqual(t, context.DeadlineExceeded, err)
+
+	frontend.SetReadDeadliner(clientConn)
+	_, err = frontend.ReceiveContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestReceiveContextReusesWatcher(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(clientConn), clientConn)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var buf []byte
+	for i := 0; i < 10; i++ {
+		buf = append(buf, mustEncode(t, &pgproto3.DataRow{Values: [][]byte{[]byte("1")}})...)
+	}
+	go serverConn.Write(buf)
+
+	var watcher interface{}
+	for i := 0; i < 10; i++ {
+		_, err := frontend.ReceiveContext(ctx)
+		require.NoError(t, err)
+		if i == 0 {
+			watcher = pgproto3.ReadWatcher(frontend)
+			require.NotNil(t, watcher)
+		}
+		assert.Equal(t, watcher, pgproto3.ReadWatcher(frontend))
+	}
+
+	// The watcher still interrupts a read in progress.
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err := frontend.ReceiveContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func mustEncode(t *testing.T, msg pgproto3.Message) []byte {
+	buf, err := msg.Encode(nil)
+	require.NoError(t, err)
+	return buf
+}
@@ -0,0 +1,138 @@
+package pgproto3
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSCRAMClientRFC7677 checks the SCRAM exchange against the SCRAM-SHA-256 test vector in RFC 7677 section 3.
+func TestSCRAMClientRFC7677(t *testing.T) {
+	sc, err := newSCRAMClient([]string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"}, "pencil")
+	require.NoError(t, err)
+	sc.clientNonce = []byte("rOprNGfwEbeRWgbNEkqO")
+	sc.clientFirstMessage()
+	sc.clientFirstMessageBare = []byte("n=user,r=rOprNGfwEbeRWgbNEkqO")
+
+	err = sc.recvServerFirstMessage([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	require.NoError(t, err)
+
+	require.Equal(t,
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		string(sc.clientFinalMessage()),
+	)
+
+	err = sc.recvServerFinalMessage([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+	require.NoError(t, err)
+
+	err = sc.recvServerFinalMessage([]byte("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+	require.Error(t, err)
+}
+
+func TestSCRAMClientRequiresSCRAMSHA256(t *testing.T) {
+	_, err := newSCRAMClient([]string{"SCRAM-SHA-256-PLUS"}, "secret")
+	require.Error(t, err)
+}
+
+func TestMD5Password(t *testing.T) {
+	require.Equal(t, "md56478b3003505cc2b7c3cf5b2e47288ef", md5Password("jack", "secret", [4]byte{1, 2, 3, 4}))
+}
+
+func TestSCRAMClientInvalidServerFirstMessage(t *testing.T) {
+	tests := []string{
+		"",
+		"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0",
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=!!!,i=4096",
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0",
+		"r=other%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"r=rOprNGfwEbeRWgbNEkqO,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+	}
+
+	for i, tt := range tests {
+		sc, err := newSCRAMClient([]string{"SCRAM-SHA-256"}, "pencil")
+		require.NoError(t, err)
+		sc.clientNonce = []byte("rOprNGfwEbeRWgbNEkqO")
+		sc.clientFirstMessage()
+
+		err = sc.recvServerFirstMessage([]byte(tt))
+		assert.Errorf(t, err, "%d. %q", i, tt)
+	}
+}
+
+// TestFrontendStartupSCRAM checks a complete SCRAM-SHA-256 exchange against a server that verifies the client proof.
+func TestFrontendStartupSCRAM(t *testing.T) {
+	t.Parallel()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	serverErrChan := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		serverErrChan <- serveSCRAM(serverConn, "pencil")
+	}()
+
+	frontend := NewFrontend(NewChunkReader(clientConn), clientConn)
+	result, err := frontend.Startup(&StartupConfig{
+		Parameters: map[string]string{"user": "jack"},
+		Password:   "pencil",
+	})
+	require.NoError(t, err)
+	require.NoError(t, <-serverErrChan)
+	assert.Equal(t, byte('I'), result.TxStatus)
+}
+
+// serveSCRAM performs the server side of SCRAM-SHA-256 authentication for password.
+func serveSCRAM(conn net.Conn, password string) error {
+	backend := NewBackend(NewChunkReader(conn), conn)
+
+	if _, err := backend.ReceiveStartupMessage(); err != nil {
+		return err
+	}
+
+	backend.Send(&AuthenticationSASL{AuthMechanisms: []string{"SCRAM-SHA-256"}})
+	backend.SetAuthType(AuthTypeSASL)
+	msg, err := backend.Receive()
+	if err != nil {
+		return err
+	}
+	initial, ok := msg.(*SASLInitialResponse)
+	if !ok || initial.AuthMechanism != "SCRAM-SHA-256" || !bytes.HasPrefix(initial.Data, []byte("n,,n=,r=")) {
+		return fmt.Errorf("unexpected SASLInitialResponse: %#v", msg)
+	}
+	clientFirstMessageBare := initial.Data[len("n,,"):]
+	clientNonce := clientFirstMessageBare[len("n=,r="):]
+
+	salt := []byte("salt")
+	serverFirstMessage := []byte(fmt.Sprintf("r=%sserver,s=%s,i=4096", clientNonce, base64.StdEncoding.EncodeToString(salt)))
+	backend.Send(&AuthenticationSASLContinue{Data: serverFirstMessage})
+	backend.SetAuthType(AuthTypeSASLContinue)
+	msg, err = backend.Receive()
+	if err != nil {
+		return err
+	}
+	response, ok := msg.(*SASLResponse)
+	if !ok {
+		return fmt.Errorf("unexpected SASLResponse: %#v", msg)
+	}
+	idx := bytes.LastIndex(response.Data, []byte(",p="))
+	if idx == -1 {
+		return fmt.Errorf("client-final-message did not include proof: %s", response.Data)
+	}
+
+	saltedPassword := pbkdf2SHA256([]byte(password), salt, 4096)
+	authMessage := bytes.Join([][]byte{clientFirstMessageBare, serverFirstMessage, response.Data[:idx]}, []byte(","))
+	if !bytes.Equal(response.Data[idx+len(",p="):], computeSCRAMClientProof(saltedPassword, authMessage)) {
+		return fmt.Errorf("invalid client proof")
+	}
+
+	backend.Send(&AuthenticationSASLFinal{Data: append([]byte("v="), computeSCRAMServerSignature(saltedPassword, authMessage)...)})
+	backend.Send(&AuthenticationOk{})
+	return backend.Send(&ReadyForQuery{TxStatus: 'I'})
+}